@@ -0,0 +1,191 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/core"
+)
+
+// exportHeader carries the key export secret from data-dir, which exporting
+// the signing keys' private halves takes on top of the api token
+const exportHeader = "X-SLURP-EXPORT-SECRET"
+
+// exportState returns a portable snapshot of slurp's state, leaving out the
+// signing keys' private halves unless they are asked for with the key export
+// secret
+func exportState(rw http.ResponseWriter, req *http.Request) {
+	// GET /admin/state
+	keys := req.URL.Query().Get("keys") == "true"
+	if keys && !slurp.CheckExportSecret(req.Header.Get(exportHeader)) {
+		writeBody(rw, req, apiError{"Exporting signing keys takes the export secret"}, http.StatusForbidden)
+		return
+	}
+	writeBody(rw, req, slurp.ExportState(keys), http.StatusOK)
+}
+
+// importState restores a snapshot produced by exportState
+func importState(rw http.ResponseWriter, req *http.Request) {
+	// PUT /admin/state
+	var state slurp.State
+	err := parseBody(req, &state)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	err = slurp.ImportState(state)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
+}
+
+// collectGarbage removes staging dirs that don't belong to a known stage
+func collectGarbage(rw http.ResponseWriter, req *http.Request) {
+	// POST /admin/gc
+	report, err := slurp.CollectGarbage()
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, report, http.StatusOK)
+}
+
+// retentionReport judges the committed builds against the retention rules
+// without pruning any
+func retentionReport(rw http.ResponseWriter, req *http.Request) {
+	// GET /admin/retention
+	report, err := slurp.Retain(true)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, report, http.StatusOK)
+}
+
+// enforceRetention prunes the committed builds past the retention rules now
+func enforceRetention(rw http.ResponseWriter, req *http.Request) {
+	// POST /admin/retention
+	report, err := slurp.Retain(false)
+	if errors.Is(err, backend.ErrNoDelete) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, report, http.StatusOK)
+}
+
+// lastVerify returns the report of the last replicated blob verification
+func lastVerify(rw http.ResponseWriter, req *http.Request) {
+	// GET /admin/verify
+	writeBody(rw, req, slurp.LastVerify(), http.StatusOK)
+}
+
+// verifyBlobs verifies a sample of committed blobs across the stores now,
+// "?sample=N" overriding the configured sample size
+func verifyBlobs(rw http.ResponseWriter, req *http.Request) {
+	// POST /admin/verify
+	sample := config.VerifyN
+	if n := req.URL.Query().Get("sample"); n != "" {
+		var err error
+		sample, err = strconv.Atoi(n)
+		if err != nil || sample < 0 {
+			writeBody(rw, req, apiError{"Bad sample size"}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	writeBody(rw, req, slurp.Verify(sample), http.StatusOK)
+}
+
+// listTasks lists the scheduled tasks and how their last runs went
+func listTasks(rw http.ResponseWriter, req *http.Request) {
+	// GET /admin/schedule
+	writeBody(rw, req, slurp.ListTasks(), http.StatusOK)
+}
+
+// runTask runs a background task now, scheduled or not, replying once it
+// finishes
+func runTask(rw http.ResponseWriter, req *http.Request) {
+	// POST /admin/schedule/{task}
+	status, err := slurp.RunTask(req.URL.Query().Get(":task"))
+	switch {
+	case err == slurp.ErrNoTask:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+	case err == slurp.ErrTaskRunning:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+	case err != nil:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+	default:
+		writeBody(rw, req, status, http.StatusOK)
+	}
+}
+
+// listKeys lists the signing keys (without their private halves)
+func listKeys(rw http.ResponseWriter, req *http.Request) {
+	// GET /admin/keys
+	keys, err := slurp.ListKeys()
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, keys, http.StatusOK)
+}
+
+// generateKey creates a signing key, "?activate=true" making it the one new
+// builds are signed with
+func generateKey(rw http.ResponseWriter, req *http.Request) {
+	// POST /admin/keys
+	activate, _ := strconv.ParseBool(req.URL.Query().Get("activate"))
+
+	key, err := slurp.GenerateKey(activate)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, key, http.StatusOK)
+}
+
+// activateKey makes a signing key the one new builds are signed with, older
+// keys still verify what they signed
+func activateKey(rw http.ResponseWriter, req *http.Request) {
+	// POST /admin/keys/{fingerprint}/activate
+	key, err := slurp.ActivateKey(req.URL.Query().Get(":fingerprint"))
+	writeKey(rw, req, key, err)
+}
+
+// revokeKey stops a signing key from signing, and the builds it signed from
+// verifying
+func revokeKey(rw http.ResponseWriter, req *http.Request) {
+	// DELETE /admin/keys/{fingerprint}
+	key, err := slurp.RevokeKey(req.URL.Query().Get(":fingerprint"))
+	writeKey(rw, req, key, err)
+}
+
+// writeKey replies with a changed signing key, or why it couldn't be changed
+func writeKey(rw http.ResponseWriter, req *http.Request, key slurp.SigningKey, err error) {
+	switch {
+	case err == slurp.ErrNoKey:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+	case err == slurp.ErrRevoked:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+	case err != nil:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+	default:
+		writeBody(rw, req, key, http.StatusOK)
+	}
+}
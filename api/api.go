@@ -2,17 +2,22 @@
 package api
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"sync"
 
 	"github.com/gorilla/pat"
 	"github.com/mu-box/golang-microauth"
 
+	"github.com/mu-box/slurp/bind"
 	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/names"
 )
 
 var (
@@ -29,43 +34,208 @@ type (
 	}
 )
 
+// header api requests carry the token in
+const authHeader = "X-AUTH-TOKEN"
+
+// token api requests must carry
+var (
+	token     string
+	tokenLock sync.RWMutex
+)
+
+// closed once the api is serving on every address
+var (
+	serving     = make(chan struct{})
+	servingOnce sync.Once
+)
+
+// Serving returns a channel closed once the api is serving on every address
+func Serving() <-chan struct{} {
+	return serving
+}
+
 // start the web server
 func StartApi() error {
-	uri, err := url.Parse(config.ApiAddress)
-	if err != nil {
-		return fmt.Errorf("Failed to parse 'api-address' - %v", err)
+	addrs := bind.Split(config.ApiAddress)
+	if len(addrs) == 0 {
+		return errors.New("Missing 'api-address'")
+	}
+	uris := make([]*url.URL, len(addrs))
+	for i, addr := range addrs {
+		uri, err := url.Parse(addr)
+		if err != nil {
+			return fmt.Errorf("Failed to parse 'api-address' - %v", err)
+		}
+		if uri.Scheme != "http" {
+			uri.Scheme = "https"
+		}
+		uris[i] = uri
+	}
+	if config.Get(&config.ApiToken) == "" {
+		return errors.New("Missing 'api-token'")
 	}
+	SetToken(config.Get(&config.ApiToken))
 
-	var auth microauth.Auth
-	auth.Header = "X-AUTH-TOKEN"
+	// bound the tls handshake and header reads (slowloris) so slow or
+	// half-open clients can't hold connections open
+	server := &http.Server{
+		Handler:           authorize(routes(), "/ping", "/health"),
+		ReadHeaderTimeout: config.ApiHeader,
+		IdleTimeout:       config.ApiIdle,
+	}
+
+	// bind every address before serving any, so a bad one fails startup
+	var tlsConfig *tls.Config
+	listeners := make([]net.Listener, 0, len(uris))
+	for _, uri := range uris {
+		listener, err := bind.Listen(uri.Host, len(uris) > 1)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
+		}
 
-	if uri.Scheme == "http" {
-		config.Log.Info("Api listening at http://%s...", uri.Host)
-		return auth.ListenAndServe(uri.Host, config.ApiToken, routes(), "/ping")
+		if uri.Scheme == "https" {
+			if tlsConfig == nil {
+				cert, err := microauth.Generate("slurp.microbox.cloud")
+				if err != nil {
+					listener.Close()
+					return err
+				}
+				tlsConfig = &tls.Config{Certificates: []tls.Certificate{*cert}}
+			}
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+		listeners = append(listeners, listener)
 	}
 
-	cert, err := microauth.Generate("slurp.microbox.cloud")
-	if err != nil {
-		return err
+	errs := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		config.Log.Info("Api listening at %s://%s...", uris[i].Scheme, uris[i].Host)
+		go func(listener net.Listener) {
+			errs <- server.Serve(listener)
+		}(listener)
 	}
-	auth.Certificate = cert
+	servingOnce.Do(func() { close(serving) })
+	return <-errs
+}
+
+// SetToken changes the token api requests must carry, without a restart
+func SetToken(newToken string) {
+	tokenLock.Lock()
+	token = newToken
+	tokenLock.Unlock()
+}
 
-	config.Log.Info("Api listening at https://%s...", uri.Host)
-	return auth.ListenAndServeTLS(uri.Host, config.ApiToken, routes(), "/ping")
+// getToken returns the token api requests must carry
+func getToken() string {
+	tokenLock.RLock()
+	defer tokenLock.RUnlock()
+	return token
 }
 
 // api routes
-func routes() *pat.Router {
+func routes() http.Handler {
 	router := pat.New()
 
+	// read-only replicas only serve committed builds
+	if config.ReadOnly {
+		router.Get("/builds/{buildId}/files/{path:.+}", getFile)
+		router.Get("/builds/{buildId}/index", getIndex)
+		router.Get("/builds/{buildId}/manifest", getManifest)
+		router.Get("/builds/{buildId}/licenses", getLicenses)
+		router.Get("/builds/{buildId}/preview", getPreview)
+		router.Get("/builds/{buildId}", getBuild)
+		router.Get("/blobs/{blobId:.+}", getBlob)
+		router.Head("/blobs/{blobId:.+}", headBlob)
+		router.Get("/blobs", listBlobs)
+		router.Get("/channels/{app}/{channel}/history", getChannelHistory)
+		router.Get("/channels/{app}/{channel}", getChannel)
+		router.Get("/channels/{app}", listChannels)
+		router.Get("/cache/blobs/{blobId:.+}", getCached)
+		router.Get("/cache", getAdvert)
+
+		router.Get("/ping", pong)
+		router.Get("/health", health)
+		router.Get("/capabilities", capabilities)
+
+		return accessLog(router)
+	}
+
 	// keep "/stages" so a build named "ping" won't break anything
-	router.Post("/stages", addStage)
-	router.Put("/stages/{buildId}", commitStage)
-	router.Delete("/stages/{buildId}", deleteStage)
+	// (batch routes first, pat matches by prefix). Requests for a build
+	// staged on another node of a cluster are forwarded to it.
+	router.Post("/stages/{buildId}/abort", clustered(audited("stage.abort", abortStage)))
+	router.Post("/stages/{buildId}/handoff", clustered(audited("stage.handoff", handoffStage)))
+	router.Post("/stages/commit", audited("stages.commit", commitStages))
+	router.Post("/stages/delete", audited("stages.delete", deleteStages))
+	router.Post("/stages/bulk-delete", audited("stages.bulk-delete", bulkDeleteStages))
+	router.Post("/stages", clusteredAdd(audited("stage.add", addStage)))
+	router.Put("/stages/{buildId}", clustered(audited("stage.commit", commitStage)))
+	router.Delete("/stages/{buildId}", clustered(audited("stage.delete", deleteStage)))
+	router.Patch("/stages/{buildId}", clustered(audited("stage.update", updateStage)))
+	router.Get("/stages/{buildId}/sessions", clustered(getSessions))
+	router.Get("/stages/{buildId}/commit", clustered(getCommit))
+	router.Get("/stages/{buildId}/stats", clustered(getStats))
+	router.Get("/stages/{buildId}/usage", clustered(getUsage))
+	router.Get("/stages/{buildId}", clustered(getStage))
+	router.Get("/stages", listStages)
+	router.Post("/receipts/verify", verifyReceipt)
+
+	router.Get("/quarantine/{buildId}/diagnostics", getDiagnostics)
+	router.Post("/quarantine/{buildId}/retry", audited("quarantine.retry", retryQuarantined))
+	router.Delete("/quarantine/{buildId}", audited("quarantine.purge", purgeQuarantined))
+	router.Get("/quarantine/{buildId}", getQuarantined)
+	router.Get("/quarantine", listQuarantined)
+
+	router.Get("/builds/{buildId}/files/{path:.+}", getFile)
+	router.Get("/builds/{buildId}/index", getIndex)
+	router.Get("/builds/{buildId}/manifest", getManifest)
+	router.Get("/builds/{buildId}/licenses", getLicenses)
+	router.Get("/builds/{buildId}/preview", getPreview)
+	router.Get("/builds/{buildId}/signature", getSignature)
+	router.Get("/builds/{buildId}", getBuild)
+	router.Post("/builds/{buildId}/promote", audited("build.promote", promoteBuild))
+	router.Post("/blobs/bulk-verify", audited("blobs.bulk-verify", bulkVerifyBlobs))
+	router.Get("/blobs/{blobId:.+}", getBlob)
+	router.Head("/blobs/{blobId:.+}", headBlob)
+	router.Get("/blobs", listBlobs)
+	router.Get("/bulk/{jobId}", getBulk)
+	router.Get("/channels/{app}/{channel}/history", getChannelHistory)
+	router.Put("/channels/{app}/{channel}", audited("channel.set", setChannel))
+	router.Delete("/channels/{app}/{channel}", audited("channel.delete", deleteChannel))
+	router.Get("/channels/{app}/{channel}", getChannel)
+	router.Get("/channels/{app}", listChannels)
+
+	router.Get("/admin/audit/verify", verifyAudit)
+	router.Get("/admin/audit/exports", listAuditExports)
+	router.Get("/admin/audit", listAudit)
+	router.Get("/admin/cluster", listNodes)
+	router.Get("/admin/state", exportState)
+	router.Put("/admin/state", audited("admin.state-import", importState))
+	router.Post("/admin/gc", audited("admin.gc", collectGarbage))
+	router.Get("/admin/retention", retentionReport)
+	router.Post("/admin/retention", audited("admin.retention", enforceRetention))
+	router.Get("/admin/verify", lastVerify)
+	router.Post("/admin/verify", audited("admin.verify", verifyBlobs))
+	router.Post("/admin/schedule/{task}", audited("admin.run-task", runTask))
+	router.Get("/admin/schedule", listTasks)
+	router.Post("/admin/keys/{fingerprint}/activate", audited("admin.key-activate", activateKey))
+	router.Delete("/admin/keys/{fingerprint}", audited("admin.key-revoke", revokeKey))
+	router.Get("/admin/keys", listKeys)
+	router.Post("/admin/keys", audited("admin.key-generate", generateKey))
 
 	router.Get("/ping", pong)
+	router.Get("/health", health)
+	router.Get("/status", status)
+	router.Get("/capabilities", capabilities)
+	router.Get("/events", watchEvents)
 
-	return router
+	if config.Mode == "ssh" {
+		return accessLog(trustPeers(peersOnly(router)))
+	}
+	return accessLog(trustPeers(router))
 }
 
 // write the json body and log the request
@@ -113,6 +283,11 @@ func parseBody(req *http.Request, v interface{}) error {
 	return nil
 }
 
+// routeId returns the normalized build id from the route
+func routeId(req *http.Request) (string, error) {
+	return names.BuildId(req.URL.Query().Get(":buildId"))
+}
+
 // reply pong (life check)
 func pong(rw http.ResponseWriter, req *http.Request) {
 	rw.Write([]byte("pong\n"))
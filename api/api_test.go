@@ -3,16 +3,19 @@ package api_test
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jcelliott/lumber"
 
 	"github.com/mu-box/slurp/api"
+	"github.com/mu-box/slurp/audit"
 	"github.com/mu-box/slurp/backend"
 	"github.com/mu-box/slurp/config"
 )
@@ -93,6 +96,79 @@ func TestDeleteStage(t *testing.T) {
 	}
 }
 
+func TestBatchDelete(t *testing.T) {
+	rest("POST", "/stages", "{\"new-id\": \"batch-a\"}")
+	rest("POST", "/stages", "{\"new-id\": \"batch-b\"}")
+
+	// an id listed twice is deleted once
+	body, err := rest("POST", "/stages/delete", "{\"ids\": [\"batch-a\", \"batch-b\", \"batch-a\"]}")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"results\":[{\"id\":\"batch-a\",\"msg\":\"Success\"},{\"id\":\"batch-b\",\"msg\":\"Success\"}]}\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// batches are capped
+	ids := make([]string, 101)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("\"batch-%d\"", i)
+	}
+	body, err = rest("POST", "/stages/delete", "{\"ids\": ["+strings.Join(ids, ",")+"]}")
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.Contains(string(body), "Too many ids") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	body, err := rest("GET", "/admin/audit?build=newbuild", "")
+	if err != nil {
+		t.Error(err)
+	}
+	var records []audit.Record
+	err = json.Unmarshal(body, &records)
+	if err != nil {
+		t.Fatalf("Failed to parse %q - %v", body, err)
+	}
+	ops := []string{}
+	for _, record := range records {
+		ops = append(ops, fmt.Sprintf("%s %d", record.Op, record.Status))
+	}
+	if fmt.Sprint(ops) != "[stage.add 200 stage.commit 200 stage.delete 200]" {
+		t.Errorf("%v doesn't match expected operations", ops)
+	}
+
+	body, err = rest("GET", "/admin/audit/verify", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.HasPrefix(string(body), "{\"records\":") || !strings.Contains(string(body), "\"ok\":true") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+}
+
+func TestExportState(t *testing.T) {
+	body, err := rest("GET", "/admin/state", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if !strings.HasPrefix(string(body), "{\"version\":1") || strings.Contains(string(body), "\"private\"") {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+
+	// the api token alone doesn't export the signing keys
+	body, err = rest("GET", "/admin/state?keys=true", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if string(body) != "{\"error\":\"Exporting signing keys takes the export secret\"}\n" {
+		t.Errorf("%q doesn't match expected out", body)
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // PRIVS
 ////////////////////////////////////////////////////////////////////////////////
@@ -100,14 +176,20 @@ func TestDeleteStage(t *testing.T) {
 // manually configure and start internals
 func initialize() {
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	config.ApiToken = ""
+	config.ApiToken = "secret"
 	config.BuildDir = "/tmp/slurpApi/"
 	config.LogLevel = "fatal"
 	config.SshHostKey = "/tmp/slurp_rsa"
 	config.Log = lumber.NewConsoleLogger(lumber.LvlInt(config.LogLevel))
 
+	err := audit.Open("/tmp/slurpApi/audit.log")
+	if err != nil {
+		fmt.Printf("Audit log init failed - %v\n", err)
+		os.Exit(1)
+	}
+
 	// initialize backend
-	err := backend.Initialize()
+	err = backend.Initialize()
 	if err != nil {
 		fmt.Printf("Backend init failed, skipping tests - %v\n", err)
 		os.Exit(0)
@@ -119,7 +201,7 @@ func rest(method, route, data string) ([]byte, error) {
 	body := bytes.NewBuffer([]byte(data))
 
 	req, _ := http.NewRequest(method, fmt.Sprintf("%s%s", config.ApiAddress, route), body)
-	req.Header.Add("X-AUTH-TOKEN", "")
+	req.Header.Add("X-AUTH-TOKEN", config.ApiToken)
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/mu-box/slurp/audit"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+)
+
+// most of an error reply kept for the audit record
+const auditBody = 1024
+
+// auditWriter records the status and (the start of) the body of an error
+// reply
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	body   []byte
+}
+
+func (self *auditWriter) WriteHeader(status int) {
+	self.status = status
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *auditWriter) Write(b []byte) (int, error) {
+	if self.status >= 400 && len(self.body) < auditBody {
+		n := auditBody - len(self.body)
+		if n > len(b) {
+			n = len(b)
+		}
+		self.body = append(self.body, b[:n]...)
+	}
+	return self.ResponseWriter.Write(b)
+}
+
+// audited records the operation a mutating route performs to the audit log
+// once it has been handled: who asked (by token and owner fingerprint), from
+// where, which builds it touched, and how it went
+func audited(op string, next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		id := requestId(rw)
+		reqid.Watch(id)
+		aw := &auditWriter{ResponseWriter: rw, status: http.StatusOK}
+		next(aw, req)
+
+		// builds the handler touched, and the one the route names
+		builds := reqid.Unwatch(id)
+		if buildId, err := routeId(req); err == nil && buildId != "" && !contains(builds, buildId) {
+			builds = append([]string{buildId}, builds...)
+		}
+
+		token := req.Header.Get(authHeader)
+		if token == "" {
+			token = req.FormValue(authHeader)
+		}
+		remote, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			remote = req.RemoteAddr
+		}
+		record := audit.Record{
+			Time:      time.Now().UTC(),
+			Op:        op,
+			Method:    req.Method,
+			Path:      req.URL.Path,
+			Token:     audit.Fingerprint(token),
+			Owner:     audit.Fingerprint(req.Header.Get(ownerHeader)),
+			Remote:    remote,
+			Builds:    builds,
+			Status:    aw.status,
+			RequestId: id,
+		}
+		if aw.status >= 400 {
+			var reply apiError
+			json.Unmarshal(aw.body, &reply)
+			record.Error = reply.ErrorString
+			if record.Error == "" {
+				record.Error = http.StatusText(aw.status)
+			}
+		}
+
+		err = audit.Add(record)
+		if err != nil && !errors.Is(err, audit.ErrClosed) {
+			config.Log.Error("[%s] Failed to record %s to the audit log - %v", id, op, err)
+		}
+	}
+}
+
+// contains reports whether list holds s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// listAudit lists the recorded operations matching "?build=", "?op=",
+// "?since=", and "?until=" (RFC3339), the most recent "?limit=" (default 100)
+// of them, oldest first
+func listAudit(rw http.ResponseWriter, req *http.Request) {
+	// GET /admin/audit
+	query := req.URL.Query()
+	filter := audit.Filter{Build: query.Get("build"), Op: query.Get("op"), Limit: 100}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if v := query.Get(name); v != "" {
+			var err error
+			*t, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				writeBody(rw, req, apiError{"Bad '" + name + "' time, expected RFC3339"}, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if n := query.Get("limit"); n != "" {
+		var err error
+		filter.Limit, err = strconv.Atoi(n)
+		if err != nil || filter.Limit < 0 {
+			writeBody(rw, req, apiError{"Bad limit"}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	records, err := audit.Query(filter)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, records, http.StatusOK)
+}
+
+// listAuditExports lists the audit log segments exported to storage
+func listAuditExports(rw http.ResponseWriter, req *http.Request) {
+	// GET /admin/audit/exports
+	exports, err := audit.ExportIndex()
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, exports, http.StatusOK)
+}
+
+// verifyAudit checks no recorded operation was edited or removed since
+func verifyAudit(rw http.ResponseWriter, req *http.Request) {
+	// GET /admin/audit/verify
+	report, err := audit.Verify()
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, report, http.StatusOK)
+}
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/core"
+	"github.com/mu-box/slurp/names"
+	"github.com/mu-box/slurp/reqid"
+)
+
+const (
+	// maxBatch is the most ids a batch request can list (bulk jobs take more)
+	maxBatch = 100
+
+	// batchWorkers is how many ids of a batch are worked on at once (commits
+	// also queue for commit-limit)
+	batchWorkers = 8
+)
+
+type (
+	batch struct {
+		Ids []string `json:"ids"` // builds to operate on
+	}
+	batchResult struct {
+		Id          string `json:"id"`
+		MsgString   string `json:"msg,omitempty"`
+		ErrorString string `json:"error,omitempty"`
+	}
+	batchResults struct {
+		Results []batchResult `json:"results"`
+	}
+	bulkFilter struct {
+		slurp.BulkFilter
+		OlderThan string `json:"older-than"` // eg "24h" (stages)
+	}
+)
+
+// commitStages commits (and cleans up) a list of staged builds concurrently
+func commitStages(rw http.ResponseWriter, req *http.Request) {
+	// POST /stages/commit
+	owner := req.Header.Get(ownerHeader)
+	doBatch(rw, req, func(buildId string) error {
+		err := slurp.CheckOwner(buildId, owner)
+		if err != nil {
+			return err
+		}
+		err = slurp.CommitStage(buildId)
+		if err != nil {
+			return err
+		}
+		// unless the identical commit it reused already cleaned it up
+		err = slurp.DeleteStage(buildId)
+		if err == slurp.ErrNoStage {
+			return nil
+		}
+		return err
+	})
+}
+
+// deleteStages removes a list of staged builds concurrently
+func deleteStages(rw http.ResponseWriter, req *http.Request) {
+	// POST /stages/delete
+	owner := req.Header.Get(ownerHeader)
+	doBatch(rw, req, func(buildId string) error {
+		err := slurp.CheckOwner(buildId, owner)
+		if err != nil {
+			return err
+		}
+		return slurp.DeleteStage(buildId)
+	})
+}
+
+// doBatch runs fn for every id in the request body concurrently, once for an
+// id listed twice, and replies with the per-id results. The status is 207 if
+// any of them failed.
+func doBatch(rw http.ResponseWriter, req *http.Request, fn func(string) error) {
+	var ids batch
+	err := parseBody(req, &ids)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	if len(ids.Ids) == 0 {
+		writeBody(rw, req, apiError{"Missing Payload Data"}, http.StatusBadRequest)
+		return
+	}
+	if len(ids.Ids) > maxBatch {
+		writeBody(rw, req, apiError{fmt.Sprintf("Too many ids (most %d, use a bulk job)", maxBatch)}, http.StatusBadRequest)
+		return
+	}
+
+	// ids are normalized before duplicates are dropped, so two spellings of
+	// one id don't race each other
+	seen := map[string]bool{}
+	unique := ids.Ids[:0]
+	for _, id := range ids.Ids {
+		id, err = names.BuildId(id)
+		if err != nil {
+			writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	ids.Ids = unique
+
+	results := make([]batchResult, len(ids.Ids))
+	next := make(chan int)
+	go func() {
+		for i := range ids.Ids {
+			next <- i
+		}
+		close(next)
+	}()
+
+	// stages on peers are refused rather than acted on here (the build dir
+	// is shared), they're committed or deleted on their node
+	wg := sync.WaitGroup{}
+	for w := 0; w < batchWorkers && w < len(ids.Ids); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i].Id = ids.Ids[i]
+				reqid.Set(ids.Ids[i], requestId(rw))
+				if node, ok := slurp.Owner(ids.Ids[i]); ok {
+					results[i].ErrorString = fmt.Sprintf("Stage is on node '%s'", node.Name)
+					continue
+				}
+				if err := fn(ids.Ids[i]); err != nil {
+					results[i].ErrorString = err.Error()
+					continue
+				}
+				results[i].MsgString = "Success"
+			}
+		}()
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	for i := range results {
+		if results[i].ErrorString != "" {
+			status = http.StatusMultiStatus
+			break
+		}
+	}
+
+	writeBody(rw, req, batchResults{results}, status)
+}
+
+// bulkDeleteStages deletes the stages matching a filter (or list of ids) as a
+// tracked background job
+func bulkDeleteStages(rw http.ResponseWriter, req *http.Request) {
+	// POST /stages/bulk-delete
+	owner := req.Header.Get(ownerHeader)
+	startBulk(rw, req, names.BuildId, func(filter slurp.BulkFilter) (slurp.BulkJob, error) {
+		filter.Owner = owner
+		return slurp.BulkDeleteStages(filter)
+	})
+}
+
+// bulkVerifyBlobs verifies the recorded blobs matching a prefix (or list of
+// ids) across the stores as a tracked background job
+func bulkVerifyBlobs(rw http.ResponseWriter, req *http.Request) {
+	// POST /blobs/bulk-verify
+	startBulk(rw, req, names.Path, slurp.BulkVerifyBlobs)
+}
+
+// startBulk parses the filter of a bulk operation (normalizing its ids) and
+// starts it, replying with the job to poll
+func startBulk(rw http.ResponseWriter, req *http.Request, normalize func(string) (string, error), fn func(slurp.BulkFilter) (slurp.BulkJob, error)) {
+	var filter bulkFilter
+	err := parseBody(req, &filter)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	for i := range filter.Ids {
+		filter.Ids[i], err = normalize(filter.Ids[i])
+		if err != nil {
+			writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	if filter.OlderThan != "" {
+		filter.BulkFilter.OlderThan, err = time.ParseDuration(filter.OlderThan)
+		if err != nil || filter.BulkFilter.OlderThan <= 0 {
+			writeBody(rw, req, apiError{"Bad older-than"}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	job, err := fn(filter.BulkFilter)
+	if err == slurp.ErrNoFilter {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, job, http.StatusAccepted)
+}
+
+// getBulk returns the progress and results of a bulk job
+func getBulk(rw http.ResponseWriter, req *http.Request) {
+	// GET /bulk/{jobId}
+	job, err := slurp.GetBulk(req.URL.Query().Get(":jobId"))
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+
+	writeBody(rw, req, job, http.StatusOK)
+}
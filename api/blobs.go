@@ -0,0 +1,110 @@
+package api
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/cache"
+	"github.com/mu-box/slurp/core"
+	"github.com/mu-box/slurp/names"
+)
+
+// getBlob streams a committed blob (an archive, index, or tree file) from the
+// backend, serving it from the local cache when possible
+func getBlob(rw http.ResponseWriter, req *http.Request) {
+	// GET /blobs/{blobId}
+	blobId, err := names.Path(req.URL.Query().Get(":blobId"))
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	serveBlob(rw, req, blobId)
+}
+
+// serveBlob streams a committed blob
+func serveBlob(rw http.ResponseWriter, req *http.Request, blobId string) {
+	blob, err := cache.Read(blobId, backend.ReadBlob)
+	if err == backend.ErrNotFound {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	// single file builds are served as assets
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	if entry, ok := slurp.BlobInfo(blobId); ok && entry.ContentType != "" {
+		rw.Header().Set("Content-Type", entry.ContentType)
+		rw.Header().Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+		rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": entry.Filename}))
+	}
+	rw.WriteHeader(http.StatusOK)
+	io.Copy(rw, blob)
+}
+
+// headBlob describes a committed blob from the backend without reading it
+func headBlob(rw http.ResponseWriter, req *http.Request) {
+	// HEAD /blobs/{blobId}
+	blobId, err := names.Path(req.URL.Query().Get(":blobId"))
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	stat, err := backend.StatBlob(blobId)
+	switch {
+	case err == backend.ErrNotFound:
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	case err == backend.ErrNoStat:
+		rw.WriteHeader(http.StatusNotImplemented)
+		return
+	case err != nil:
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	if entry, ok := slurp.BlobInfo(blobId); ok && entry.ContentType != "" {
+		rw.Header().Set("Content-Type", entry.ContentType)
+		rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": entry.Filename}))
+	}
+	if stat.Size >= 0 {
+		rw.Header().Set("Content-Length", strconv.FormatInt(stat.Size, 10))
+	}
+	if !stat.Modified.IsZero() {
+		rw.Header().Set("Last-Modified", stat.Modified.Format(http.TimeFormat))
+	}
+	if stat.Checksum != "" {
+		rw.Header().Set("ETag", strconv.Quote(stat.Checksum))
+	}
+	for k, v := range stat.Meta {
+		rw.Header().Set("X-Blob-Meta-"+url.QueryEscape(k), url.QueryEscape(v))
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// listBlobs lists the blobs of the primary (or a named) store, optionally
+// those starting with a prefix
+func listBlobs(rw http.ResponseWriter, req *http.Request) {
+	// GET /blobs?prefix=&store=
+	list, err := backend.ListBlobsAt(req.URL.Query().Get("store"), req.URL.Query().Get("prefix"))
+	switch {
+	case errors.Is(err, backend.ErrUnknownStore):
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+	case err == backend.ErrNoList:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotImplemented)
+	case err != nil:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+	default:
+		writeBody(rw, req, list, http.StatusOK)
+	}
+}
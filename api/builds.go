@@ -0,0 +1,297 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mu-box/slurp/backend"
+
+	"github.com/mu-box/slurp/core"
+	"github.com/mu-box/slurp/names"
+	"github.com/mu-box/slurp/reqid"
+)
+
+// getIndex lists the blobs (and their checksums) written when a build was committed
+func getIndex(rw http.ResponseWriter, req *http.Request) {
+	// GET /builds/{buildId}/index
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	index, err := slurp.GetIndex(buildId)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, index, http.StatusOK)
+}
+
+// getManifest lists the files (paths, modes, sizes, and checksums) of a
+// committed build
+func getManifest(rw http.ResponseWriter, req *http.Request) {
+	// GET /builds/{buildId}/manifest
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	manifest, err := slurp.GetManifest(buildId)
+	if errors.Is(err, backend.ErrNotFound) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, manifest, http.StatusOK)
+}
+
+// getLicenses reports the licenses found in a committed build, and where
+func getLicenses(rw http.ResponseWriter, req *http.Request) {
+	// GET /builds/{buildId}/licenses
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	report, err := slurp.GetLicenses(buildId)
+	if errors.Is(err, backend.ErrNotFound) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, report, http.StatusOK)
+}
+
+// getPreview shows the README, version file and such of a committed build,
+// without reading its blobs
+func getPreview(rw http.ResponseWriter, req *http.Request) {
+	// GET /builds/{buildId}/preview
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	preview, err := slurp.GetPreview(buildId)
+	if errors.Is(err, backend.ErrNotFound) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, preview, http.StatusOK)
+}
+
+// getFile streams a single file of a committed build, or the byte range of it
+// asked for, without downloading the build. Seekable tar.zst builds only
+// fetch and decompress the frames holding the bytes.
+func getFile(rw http.ResponseWriter, req *http.Request) {
+	// GET /builds/{buildId}/files/{path}
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	name, err := names.Path(req.URL.Query().Get(":path"))
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	file, err := slurp.OpenFile(buildId, name)
+	switch {
+	case err == slurp.ErrUnreadable:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	case err == slurp.ErrNoFile, errors.Is(err, backend.ErrNotFound):
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	case err != nil:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	off, n, partial := int64(0), file.Size, false
+	if header := req.Header.Get("Range"); header != "" {
+		off, n, err = parseRange(header, file.Size)
+		if err != nil {
+			rw.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", file.Size))
+			writeBody(rw, req, apiError{err.Error()}, http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		partial = true
+	}
+
+	body, err := file.ReadRange(off, n)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	rw.Header().Set("Accept-Ranges", "bytes")
+	if !partial {
+		rw.WriteHeader(http.StatusOK)
+		io.Copy(rw, body)
+		return
+	}
+	rw.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, off+n-1, file.Size))
+	rw.WriteHeader(http.StatusPartialContent)
+	io.Copy(rw, body)
+}
+
+// parseRange returns the offset and length of a single range "bytes=" header
+// ("start-end", "start-", or "-suffix") within size bytes
+func parseRange(header string, size int64) (int64, int64, error) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	first, last, ok := strings.Cut(spec, "-")
+	if spec == header || !ok || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("Bad range '%s'", header)
+	}
+
+	if first == "" {
+		suffix, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || suffix <= 0 {
+			return 0, 0, fmt.Errorf("Bad range '%s'", header)
+		}
+		if suffix > size {
+			suffix = size
+		}
+		return size - suffix, suffix, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, fmt.Errorf("Bad range '%s'", header)
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("Bad range '%s'", header)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, nil
+}
+
+// getSignature verifies a committed build's signature, reporting which key
+// signed it and whether it is still valid
+func getSignature(rw http.ResponseWriter, req *http.Request) {
+	// GET /builds/{buildId}/signature
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	result, err := slurp.VerifyBuild(buildId)
+	if err == slurp.ErrUnsigned || errors.Is(err, backend.ErrNotFound) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, result, http.StatusOK)
+}
+
+// promotion selects the stores a build is promoted between
+type promotion struct {
+	From string `json:"from"` // named store to copy from (empty is the primary)
+	To   string `json:"to"`   // named store to copy to (empty is the primary)
+}
+
+// promoteBuild copies a committed build between stores, verifying each blob
+func promoteBuild(rw http.ResponseWriter, req *http.Request) {
+	// POST /builds/{buildId}/promote
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	reqid.Set(buildId, requestId(rw))
+
+	var stores promotion
+	err = parseBody(req, &stores)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	report, err := slurp.Promote(buildId, stores.From, stores.To)
+	switch {
+	case err == slurp.ErrSameStore, errors.Is(err, backend.ErrUnknownStore):
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+	case errors.Is(err, backend.ErrNotFound):
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+	case err != nil:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+	default:
+		writeBody(rw, req, report, http.StatusOK)
+	}
+}
+
+// content types of the archive formats
+var contentTypes = map[string]string{
+	slurp.FormatTarGz:    "application/gzip",
+	slurp.FormatTarZst:   "application/zstd",
+	slurp.FormatSquashfs: "application/octet-stream",
+}
+
+// getBuild streams the full tree of a committed build as a compressed tar,
+// reassembling delta builds from their layers
+func getBuild(rw http.ResponseWriter, req *http.Request) {
+	// GET /builds/{buildId}
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	build, format, err := slurp.ReadBuild(buildId)
+	if errors.Is(err, backend.ErrNotFound) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	defer build.Close()
+
+	rw.Header().Set("Content-Type", contentTypes[format])
+	rw.WriteHeader(http.StatusOK)
+	io.Copy(rw, build)
+}
@@ -0,0 +1,49 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/cache"
+	"github.com/mu-box/slurp/names"
+)
+
+// getAdvert lists the blobs this replica has cached, for its cache peers
+func getAdvert(rw http.ResponseWriter, req *http.Request) {
+	// GET /cache
+	writeBody(rw, req, cache.Advertise(), http.StatusOK)
+}
+
+// getCached streams a cached blob to a cache peer. With fill, a miss is
+// fetched from the backend (once, however many peers ask) and cached;
+// otherwise it is not found.
+func getCached(rw http.ResponseWriter, req *http.Request) {
+	// GET /cache/blobs/{blobId}?fill=
+	blobId, err := names.Path(req.URL.Query().Get(":blobId"))
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	var blob io.ReadCloser
+	if fill, _ := strconv.ParseBool(req.URL.Query().Get("fill")); fill {
+		blob, err = cache.Fill(blobId, backend.ReadBlob)
+	} else {
+		blob, err = cache.Open(blobId)
+	}
+	switch {
+	case err == backend.ErrNotFound || err == cache.ErrNotCached:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	case err != nil:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+	defer blob.Close()
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.WriteHeader(http.StatusOK)
+	io.Copy(rw, blob)
+}
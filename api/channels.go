@@ -0,0 +1,159 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/mu-box/slurp/backend"
+	slurp "github.com/mu-box/slurp/core"
+	"github.com/mu-box/slurp/names"
+)
+
+// channelHeader carries the token of a channel role
+const channelHeader = "X-CHANNEL-TOKEN"
+
+// channelMove is the body of a channel update
+type channelMove struct {
+	Blob string `json:"blob"` // blob to point the channel at
+}
+
+// routeChannel returns the app and channel a request is for
+func routeChannel(req *http.Request) (string, string, error) {
+	app, err := names.BuildId(req.URL.Query().Get(":app"))
+	if err != nil {
+		return "", "", err
+	}
+	channel, err := names.BuildId(req.URL.Query().Get(":channel"))
+	if err != nil {
+		return "", "", err
+	}
+	return app, channel, nil
+}
+
+// channelError replies with the status of a channel error
+func channelError(rw http.ResponseWriter, req *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, slurp.ErrNoChannel), errors.Is(err, backend.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, slurp.ErrChannelRole):
+		status = http.StatusForbidden
+	}
+	writeBody(rw, req, apiError{err.Error()}, status)
+}
+
+// listChannels lists an app's channels
+func listChannels(rw http.ResponseWriter, req *http.Request) {
+	// GET /channels/{app}
+	app, err := names.BuildId(req.URL.Query().Get(":app"))
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	channels, err := slurp.ListChannels(app)
+	if err != nil {
+		channelError(rw, req, err)
+		return
+	}
+	for i := range channels {
+		channels[i].History = nil
+	}
+	writeBody(rw, req, channels, http.StatusOK)
+}
+
+// getChannelHistory shows a channel with its history
+func getChannelHistory(rw http.ResponseWriter, req *http.Request) {
+	// GET /channels/{app}/{channel}/history
+	app, name, err := routeChannel(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	channel, err := slurp.GetChannel(app, name)
+	if err != nil {
+		channelError(rw, req, err)
+		return
+	}
+	writeBody(rw, req, channel, http.StatusOK)
+}
+
+// getChannel streams the blob a channel points to, so deploy targets can
+// always fetch eg. the current stable release
+func getChannel(rw http.ResponseWriter, req *http.Request) {
+	// GET /channels/{app}/{channel}
+	app, name, err := routeChannel(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	channel, err := slurp.GetChannel(app, name)
+	if err != nil {
+		channelError(rw, req, err)
+		return
+	}
+	rw.Header().Set("X-SLURP-BLOB", channel.Blob)
+	serveBlob(rw, req, channel.Blob)
+}
+
+// setChannel points a channel at a committed blob, if the request carries the
+// token of a channel role allowed to move it
+func setChannel(rw http.ResponseWriter, req *http.Request) {
+	// PUT /channels/{app}/{channel}
+	app, name, err := routeChannel(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	var move channelMove
+	err = parseBody(req, &move)
+	if err != nil || move.Blob == "" {
+		writeBody(rw, req, apiError{"Missing Payload Data"}, http.StatusBadRequest)
+		return
+	}
+	blob, err := names.Path(move.Blob)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	role, err := slurp.ChannelRole(app, name, req.Header.Get(channelHeader))
+	if err != nil {
+		channelError(rw, req, err)
+		return
+	}
+
+	channel, err := slurp.SetChannel(app, name, blob, role, requestId(rw))
+	if err != nil {
+		channelError(rw, req, err)
+		return
+	}
+	writeBody(rw, req, channel, http.StatusOK)
+}
+
+// deleteChannel removes a channel, if the request carries the token of a
+// channel role allowed to move it
+func deleteChannel(rw http.ResponseWriter, req *http.Request) {
+	// DELETE /channels/{app}/{channel}
+	app, name, err := routeChannel(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	_, err = slurp.ChannelRole(app, name, req.Header.Get(channelHeader))
+	if err != nil {
+		channelError(rw, req, err)
+		return
+	}
+
+	err = slurp.DeleteChannel(app, name)
+	if err != nil {
+		channelError(rw, req, err)
+		return
+	}
+	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
+}
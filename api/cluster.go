@@ -0,0 +1,176 @@
+package api
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/mu-box/slurp/config"
+	slurp "github.com/mu-box/slurp/core"
+	"github.com/mu-box/slurp/names"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/trace"
+)
+
+// header marking a request a peer forwarded, which is served where it lands
+const forwardHeader = "X-SLURP-FORWARDED"
+
+// header carrying the cluster token, proving a forwarded request came from a
+// peer
+const peerHeader = "X-SLURP-PEER-TOKEN"
+
+// peers' api certificates are generated at startup, like this node's
+var peerTransport = &http.Transport{
+	Proxy:           http.ProxyFromEnvironment,
+	TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+}
+
+// clustered forwards requests for a build staged on another node of the
+// cluster to it
+func clustered(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		buildId, err := routeId(req)
+		if err == nil && forward(rw, req, buildId) {
+			return
+		}
+		next(rw, req)
+	}
+}
+
+// clusteredAdd forwards staging a build that is staged on another node of
+// the cluster to it (where it is restaged as it would be here). Api nodes
+// forward new builds to the ssh node staging the fewest.
+func clusteredAdd(next http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		if !slurp.Clustered() {
+			next(rw, req)
+			return
+		}
+		raw, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			writeBody(rw, req, apiError{bodyReadFail.Error()}, http.StatusBadRequest)
+			return
+		}
+
+		var stage build
+		json.Unmarshal(raw, &stage)
+		req.Body = ioutil.NopCloser(bytes.NewReader(raw))
+		if buildId, err := names.BuildId(stage.NewId); err == nil && forward(rw, req, buildId) {
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(raw))
+		if config.Mode == "api" && req.Header.Get(forwardHeader) == "" {
+			node, ok := slurp.DataNode()
+			if !ok {
+				writeBody(rw, req, apiError{"No ssh node to stage on"}, http.StatusServiceUnavailable)
+				return
+			}
+			if !forwardTo(rw, req, node) {
+				writeBody(rw, req, apiError{fmt.Sprintf("Bad api uri of node '%s'", node.Name)}, http.StatusBadGateway)
+			}
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(raw))
+		next(rw, req)
+	}
+}
+
+// trustPeers drops the forward mark of requests that don't carry the cluster
+// token, so clients can't pass for a peer
+func trustPeers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		token := req.Header.Get(peerHeader)
+		req.Header.Del(peerHeader)
+		if config.NodeToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.NodeToken)) != 1 {
+			req.Header.Del(forwardHeader)
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// peersOnly refuses requests no peer forwarded, but for pings and health
+// checks, so ssh nodes serve their api to the cluster's api nodes alone
+func peersOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(forwardHeader) == "" && req.URL.Path != "/ping" && req.URL.Path != "/health" {
+			writeBody(rw, req, apiError{"Ssh node, use an api node"}, http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// listNodes lists the nodes of the cluster, this one first
+func listNodes(rw http.ResponseWriter, req *http.Request) {
+	// GET /admin/cluster
+	if !slurp.Clustered() {
+		writeBody(rw, req, apiError{"Not clustered"}, http.StatusNotFound)
+		return
+	}
+	writeBody(rw, req, slurp.Nodes(), http.StatusOK)
+}
+
+// forward proxies a request to the peer owning a build, reporting whether it
+// did. Requests a peer forwarded aren't forwarded again.
+func forward(rw http.ResponseWriter, req *http.Request, buildId string) bool {
+	if req.Header.Get(forwardHeader) != "" {
+		return false
+	}
+	node, ok := slurp.Owner(buildId)
+	if !ok {
+		return false
+	}
+	return forwardTo(rw, req, node)
+}
+
+// forwardTo proxies a request to a peer, reporting whether it did
+func forwardTo(rw http.ResponseWriter, req *http.Request, node slurp.Node) bool {
+	target, err := url.Parse(node.Api)
+	if err != nil {
+		return false
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = peerTransport
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Header.Set(forwardHeader, config.Node)
+		req.Header.Set(peerHeader, config.NodeToken)
+		// the peer continues this request's id and trace
+		id := requestId(rw)
+		req.Header.Set(reqid.Header, id)
+		if ctx := trace.Request(id); ctx.Valid() {
+			req.Header.Set(trace.Header, ctx.String())
+		}
+		// drop the route params pat added to the query
+		query := req.URL.Query()
+		for key := range query {
+			if strings.HasPrefix(key, ":") {
+				query.Del(key)
+			}
+		}
+		req.URL.RawQuery = query.Encode()
+	}
+	proxy.ModifyResponse = func(res *http.Response) error {
+		// the request's own are already set
+		res.Header.Del(reqid.Header)
+		res.Header.Del(trace.Header)
+		return nil
+	}
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		writeBody(rw, req, apiError{fmt.Sprintf("Failed to reach node '%s' - %v", node.Name, err)}, http.StatusBadGateway)
+	}
+
+	config.Log.Debug("Forwarding %s %s to node '%v'", req.Method, req.URL.Path, node.Name)
+	proxy.ServeHTTP(rw, req)
+	return true
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mu-box/slurp/webhook"
+)
+
+// keepalive is how often an idle event stream is sent a comment, so proxies
+// between slurp and the client don't close it
+const keepalive = 15 * time.Second
+
+// watchEvents streams the events sent to webhooks as server-sent events until
+// the client goes away. "event" query values filter them, as a webhook's
+// events do (eg "stage.*").
+func watchEvents(rw http.ResponseWriter, req *http.Request) {
+	// GET /events
+	patterns := req.URL.Query()["event"]
+	events, stop := webhook.Watch()
+	defer stop()
+
+	stream := http.NewResponseController(rw)
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.WriteHeader(http.StatusOK)
+	if err := stream.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(keepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-ticker.C:
+			fmt.Fprint(rw, ": keepalive\n\n")
+		case event := <-events:
+			if !webhook.Matches(patterns, event.Event) {
+				continue
+			}
+			b, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", event.Event, b)
+		}
+		if err := stream.Flush(); err != nil {
+			return
+		}
+	}
+}
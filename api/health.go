@@ -0,0 +1,89 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/core"
+	"github.com/mu-box/slurp/disk"
+	"github.com/mu-box/slurp/ssh"
+)
+
+type (
+	healthCheck struct {
+		Name     string `json:"name"`
+		Ok       bool   `json:"ok"`
+		Error    string `json:"error,omitempty"`
+		Duration string `json:"duration"`
+	}
+	healthReport struct {
+		Status string        `json:"status"` // "ok" if every check passed, otherwise "fail"
+		Checks []healthCheck `json:"checks"`
+	}
+)
+
+// health actively checks slurp's dependencies, replying 503 if any fail so it
+// can be used as a load balancer health check
+func health(rw http.ResponseWriter, req *http.Request) {
+	// GET /health
+	type probe struct {
+		name string
+		fn   func() error
+	}
+	checks := []probe{
+		{"backend", backend.Check},
+		{"ssh", ssh.Check},
+		{"staging", slurp.CheckStaging},
+		{"disk", checkDisk},
+	}
+	// replicas don't stage builds, so only storage and the cache's disk matter
+	if config.ReadOnly {
+		checks = []probe{{"backend", backend.Check}, {"disk", checkDisk}}
+	}
+	// api nodes stage builds on the cluster's ssh nodes
+	if config.Mode == "api" {
+		checks = []probe{{"backend", backend.Check}, {"data-plane", slurp.CheckDataPlane}}
+	}
+
+	report := healthReport{Status: "ok"}
+	status := http.StatusOK
+	for _, check := range checks {
+		start := time.Now()
+		err := check.fn()
+
+		result := healthCheck{Name: check.name, Ok: err == nil, Duration: time.Since(start).String()}
+		if err != nil {
+			result.Error = err.Error()
+			report.Status = "fail"
+			status = http.StatusServiceUnavailable
+		}
+		report.Checks = append(report.Checks, result)
+	}
+
+	writeBody(rw, req, report, status)
+}
+
+// checkDisk fails if the build dir's (or a replica's cache dir's) filesystem
+// is low on free space
+func checkDisk() error {
+	dir := config.BuildDir
+	if config.ReadOnly {
+		dir = config.CacheDir
+		os.MkdirAll(dir, 0755)
+	}
+
+	stats, err := disk.Usage(dir)
+	if err != nil {
+		return err
+	}
+
+	free := 100 - stats.Percent
+	if free < config.HealthFree {
+		return fmt.Errorf("Only %.1f%% free (%d bytes)", free, stats.Free)
+	}
+	return nil
+}
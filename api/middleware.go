@@ -0,0 +1,100 @@
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/trace"
+)
+
+// statusWriter records the status code written to a response
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (self *statusWriter) WriteHeader(status int) {
+	self.status = status
+	self.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap returns the wrapped writer, so streams can flush it
+func (self *statusWriter) Unwrap() http.ResponseWriter {
+	return self.ResponseWriter
+}
+
+// authorize refuses requests without the api token, in the X-AUTH-TOKEN header
+// or form value, except to the open paths and CORS preflights (browsers can't
+// add headers to them)
+func authorize(next http.Handler, open ...string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		skip := req.Method == "OPTIONS"
+		for _, path := range open {
+			if path == req.URL.Path {
+				skip = true
+				break
+			}
+		}
+
+		if !skip {
+			auth := req.Header.Get(authHeader)
+			if auth == "" {
+				auth = req.FormValue(authHeader)
+			}
+			if subtle.ConstantTimeCompare([]byte(auth), []byte(getToken())) == 0 {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+		}
+
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// accessLog assigns every request an id (the client's X-Request-Id, if it sent
+// a usable one), returns it and the request's trace context in headers, and
+// logs one line (and records a span) per request once it has been handled.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		id := reqid.Accept(req.Header.Get(reqid.Header))
+		rw.Header().Set(reqid.Header, id)
+
+		// continue the client's trace, if it sent one
+		span := trace.Start("api "+req.Method, trace.KindServer, trace.Parse(req.Header.Get(trace.Header)))
+		trace.SetRequest(id, span.Context())
+		rw.Header().Set(trace.Header, span.Context().String())
+
+		sw := &statusWriter{ResponseWriter: rw, status: http.StatusOK}
+		next.ServeHTTP(sw, req)
+
+		span.Set("http.method", req.Method)
+		span.Set("http.target", req.URL.Path)
+		span.Set("http.status_code", sw.status)
+		span.Set("slurp.request_id", id)
+		var err error
+		if sw.status >= 500 {
+			err = fmt.Errorf("%d %s", sw.status, http.StatusText(sw.status))
+		}
+		span.Finish(err)
+
+		// which listener (of several) the request came in on
+		listener := ""
+		if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+			listener = addr.String()
+		}
+
+		config.Log.Info("request_id=%s trace_id=%x listener=%s remote=%s method=%s path=%s status=%d latency=%s",
+			id, span.Context().TraceId, listener, req.RemoteAddr, req.Method, req.URL.Path, sw.status, time.Since(start))
+	})
+}
+
+// requestId returns the id assigned to the request being handled
+func requestId(rw http.ResponseWriter) string {
+	return rw.Header().Get(reqid.Header)
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/mu-box/slurp/core"
+)
+
+// listQuarantined lists the builds whose commits failed into quarantine
+func listQuarantined(rw http.ResponseWriter, req *http.Request) {
+	// GET /quarantine
+	writeBody(rw, req, slurp.ListQuarantined(), http.StatusOK)
+}
+
+// getQuarantined shows a quarantined build and why its commit failed
+func getQuarantined(rw http.ResponseWriter, req *http.Request) {
+	// GET /quarantine/{buildId}
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	record, err := slurp.GetQuarantined(buildId)
+	if err == slurp.ErrNotQuarantined {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+
+	writeBody(rw, req, record, http.StatusOK)
+}
+
+// getDiagnostics downloads the diagnostic bundle of a quarantined build
+func getDiagnostics(rw http.ResponseWriter, req *http.Request) {
+	// GET /quarantine/{buildId}/diagnostics
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	bundle, err := slurp.Diagnostics(buildId)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	defer bundle.Close()
+
+	rw.Header().Set("Content-Type", "application/gzip")
+	rw.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": buildId + "-diagnostics.tar.gz"}))
+	rw.WriteHeader(http.StatusOK)
+	io.Copy(rw, bundle)
+}
+
+// retryQuarantined moves a quarantined build back to a stage and commits it
+// again, replying once the commit finishes
+func retryQuarantined(rw http.ResponseWriter, req *http.Request) {
+	// POST /quarantine/{buildId}/retry
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	err = slurp.RetryQuarantined(buildId)
+	switch {
+	case err == slurp.ErrNotQuarantined:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+	case err == slurp.ErrRetrying || err == slurp.ErrRestaged:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+	case err != nil:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+	default:
+		writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
+	}
+}
+
+// purgeQuarantined removes a quarantined build and its diagnostics
+func purgeQuarantined(rw http.ResponseWriter, req *http.Request) {
+	// DELETE /quarantine/{buildId}
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	err = slurp.PurgeQuarantined(buildId)
+	switch {
+	case err == slurp.ErrNotQuarantined:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+	case err == slurp.ErrRetrying:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+	case err != nil:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+	default:
+		writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
+	}
+}
@@ -1,23 +1,55 @@
 package api
 
 import (
+	"errors"
 	"net/http"
+	"time"
 
+	"github.com/mu-box/slurp/backend"
 	"github.com/mu-box/slurp/core"
+	"github.com/mu-box/slurp/names"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/ssh"
 )
 
 // for whatever reason, these need to be exported so json.[un]marshal can utilize it
 type build struct {
-	OldId string `json:"old-id"` // build to fetch from storage
-	NewId string `json:"new-id"` // build to stage and store
+	OldId    string `json:"old-id"`   // build to fetch from storage
+	From     string `json:"from"`     // any committed build to seed the stage from (same as old-id)
+	NewId    string `json:"new-id"`   // build to stage and store
+	Template string `json:"template"` // stage template to use (optional)
+	Format   string `json:"format"`   // archive format to commit with, eg "tar.zst" (optional)
+	TTL      string `json:"ttl"`      // time the stage may live uncommitted, eg "2h" (optional)
+	Owner    string `json:"owner"`    // credential required to act on the stage (optional)
+
+	Metadata map[string]string `json:"metadata"` // labels for the stage (optional)
+	Notes    string            `json:"notes"`    // release notes to commit the build with (optional)
+}
+
+type labels struct {
+	Metadata map[string]string `json:"metadata"`
+	Notes    *string           `json:"notes"` // replaces the release notes if set
+}
+
+// commitOptions is the (optional) body of a commit
+type commitOptions struct {
+	Notes *string `json:"notes"` // replaces the release notes if set
 }
 
 type auth struct {
 	AuthSecret string `json:"secret"`
 }
 
-// addStage prepares a directory for receiving the new build. If an old build is specified,
-// that build is fetched from hoarder, otherwise a new directory is created.
+type handoff struct {
+	To string `json:"to"` // credential of the new owner
+}
+
+// ownerHeader carries the owner credential of an owned stage
+const ownerHeader = "X-STAGE-OWNER"
+
+// addStage prepares a directory for receiving the new build. If an old build is specified
+// (any committed build, with "from" or "old-id"), that build is fetched from hoarder,
+// otherwise a new directory is created.
 func addStage(rw http.ResponseWriter, req *http.Request) {
 	var stage build
 	err := parseBody(req, &stage)
@@ -31,8 +63,55 @@ func addStage(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	stage.NewId, err = names.BuildId(stage.NewId)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	if stage.From != "" {
+		if stage.OldId != "" && stage.OldId != stage.From {
+			writeBody(rw, req, apiError{"Only one of 'from' and 'old-id' can be set"}, http.StatusBadRequest)
+			return
+		}
+		stage.OldId = stage.From
+	}
+	if stage.OldId != "" {
+		stage.OldId, err = names.BuildId(stage.OldId)
+		if err != nil {
+			writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts := slurp.StageOptions{Template: stage.Template, Format: stage.Format, Metadata: stage.Metadata, Notes: stage.Notes, Owner: stage.Owner, Current: req.Header.Get(ownerHeader)}
+	if stage.TTL != "" {
+		opts.TTL, err = time.ParseDuration(stage.TTL)
+		if err != nil || opts.TTL < 0 {
+			writeBody(rw, req, apiError{"Bad TTL"}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	reqid.Set(stage.NewId, requestId(rw))
+
 	// stage the build
-	err = slurp.AddStage(stage.OldId, stage.NewId)
+	err = slurp.AddStage(stage.OldId, stage.NewId, opts)
+	if err == slurp.ErrNotOwner {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusForbidden)
+		return
+	}
+	if errors.Is(err, slurp.ErrRecentlyDeleted) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+		return
+	}
+	if errors.Is(err, slurp.ErrDiskFull) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, backend.ErrNotFound) {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
 		return
@@ -46,18 +125,57 @@ func addStage(rw http.ResponseWriter, req *http.Request) {
 // user for security.
 func commitStage(rw http.ResponseWriter, req *http.Request) {
 	// PUT /stages/{buildId}
-	buildId := req.URL.Query().Get(":buildId")
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	reqid.Set(buildId, requestId(rw))
+
+	if !checkOwner(rw, req, buildId) {
+		return
+	}
+
+	// release notes can be given with the commit
+	if req.ContentLength > 0 {
+		var opts commitOptions
+		err = parseBody(req, &opts)
+		if err != nil {
+			writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+			return
+		}
+		if opts.Notes != nil {
+			_, err = slurp.UpdateNotes(buildId, *opts.Notes)
+			if err == slurp.ErrNoStage {
+				writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+				return
+			}
+		}
+	}
 
 	// commit the staged build
-	err := slurp.CommitStage(buildId)
+	err = slurp.CommitStage(buildId)
+	if err == slurp.ErrNoStage {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err == slurp.ErrSyncing || err == slurp.ErrAborted {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+		return
+	}
 	if err != nil {
 		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
 		return
 	}
 
-	// delete the staged build
+	// delete the staged build (unless the identical commit it reused
+	// already did)
 	err = slurp.DeleteStage(buildId)
-	if err != nil {
+	if err != nil && err != slurp.ErrNoStage {
 		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
 		return
 	}
@@ -65,13 +183,99 @@ func commitStage(rw http.ResponseWriter, req *http.Request) {
 	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
 }
 
+// abortStage stops all work on a staged build (syncs and its commit), keeping
+// its data and session logs for a post-mortem
+func abortStage(rw http.ResponseWriter, req *http.Request) {
+	// POST /stages/{buildId}/abort
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	reqid.Set(buildId, requestId(rw))
+
+	if !checkOwner(rw, req, buildId) {
+		return
+	}
+
+	stage, err := slurp.AbortStage(buildId)
+	if err == slurp.ErrNoStage {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+		return
+	}
+
+	writeBody(rw, req, stage, http.StatusOK)
+}
+
+// handoffStage transfers a stage to a new owner credential, eg from the job
+// that synced it to the one that commits it
+func handoffStage(rw http.ResponseWriter, req *http.Request) {
+	// POST /stages/{buildId}/handoff
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	reqid.Set(buildId, requestId(rw))
+
+	var to handoff
+	err = parseBody(req, &to)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	stage, err := slurp.HandoffStage(buildId, req.Header.Get(ownerHeader), to.To)
+	switch err {
+	case nil:
+		writeBody(rw, req, stage, http.StatusOK)
+	case slurp.ErrNoStage:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+	case slurp.ErrNotOwner:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusForbidden)
+	case slurp.ErrCommitted:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusConflict)
+	default:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+	}
+}
+
+// checkOwner replies forbidden, returning false, if the request doesn't carry
+// the owner credential of an owned stage (or not found, if a node of a
+// cluster doesn't hold the stage)
+func checkOwner(rw http.ResponseWriter, req *http.Request, buildId string) bool {
+	err := slurp.CheckOwner(buildId, req.Header.Get(ownerHeader))
+	if err == slurp.ErrNoStage {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return false
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
 // deleteStage removes the staged build directory
 func deleteStage(rw http.ResponseWriter, req *http.Request) {
 	// DELETE /stages/{buildId}
-	buildId := req.URL.Query().Get(":buildId")
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+	reqid.Set(buildId, requestId(rw))
+
+	if !checkOwner(rw, req, buildId) {
+		return
+	}
 
 	// delete the staged build
-	err := slurp.DeleteStage(buildId)
+	err = slurp.DeleteStage(buildId)
 	if err != nil {
 		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
 		return
@@ -79,3 +283,162 @@ func deleteStage(rw http.ResponseWriter, req *http.Request) {
 
 	writeBody(rw, req, apiMsg{"Success"}, http.StatusOK)
 }
+
+// getSessions lists the recent rsync sessions (including rsync's stderr) for a
+// staged build
+func getSessions(rw http.ResponseWriter, req *http.Request) {
+	// GET /stages/{buildId}/sessions
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	writeBody(rw, req, ssh.Sessions(buildId), http.StatusOK)
+}
+
+// verifyReceipt checks a receipt of an rsync session was signed by slurp and
+// hasn't been altered
+func verifyReceipt(rw http.ResponseWriter, req *http.Request) {
+	// POST /receipts/verify
+	var receipt slurp.Receipt
+	err := parseBody(req, &receipt)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	writeBody(rw, req, slurp.VerifyReceipt(receipt), http.StatusOK)
+}
+
+// getCommit returns the record of a build's last commit, kept after the stage
+// is cleaned up
+func getCommit(rw http.ResponseWriter, req *http.Request) {
+	// GET /stages/{buildId}/commit
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	job, err := slurp.GetJob(buildId)
+	if err == slurp.ErrNoJob {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, job, http.StatusOK)
+}
+
+// getStats reports what was published to a build: synced to its stage and
+// written by its commits, kept after the stage is cleaned up
+func getStats(rw http.ResponseWriter, req *http.Request) {
+	// GET /stages/{buildId}/stats
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	stats, err := slurp.GetStats(buildId)
+	if err == slurp.ErrNoStage {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, stats, http.StatusOK)
+}
+
+// getUsage reports how close a stage is to its quota, ttl, and bandwidth
+// limits
+func getUsage(rw http.ResponseWriter, req *http.Request) {
+	// GET /stages/{buildId}/usage
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	usage, err := slurp.GetUsage(buildId)
+	switch {
+	case err == slurp.ErrNoStage:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+	case err != nil:
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+	default:
+		writeBody(rw, req, usage, http.StatusOK)
+	}
+}
+
+// listStages lists the uncommitted stages
+func listStages(rw http.ResponseWriter, req *http.Request) {
+	// GET /stages
+	if slurp.Clustered() {
+		writeBody(rw, req, slurp.ClusterStages(), http.StatusOK)
+		return
+	}
+	writeBody(rw, req, slurp.ListStages(), http.StatusOK)
+}
+
+// getStage returns the status of a staged build
+func getStage(rw http.ResponseWriter, req *http.Request) {
+	// GET /stages/{buildId}
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	stage, err := slurp.GetStage(buildId)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+
+	writeBody(rw, req, stage, http.StatusOK)
+}
+
+// updateStage merges metadata into a staged build's labels, and replaces its
+// release notes if given. Empty values remove the label.
+func updateStage(rw http.ResponseWriter, req *http.Request) {
+	// PATCH /stages/{buildId}
+	buildId, err := routeId(req)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	if !checkOwner(rw, req, buildId) {
+		return
+	}
+
+	var update labels
+	err = parseBody(req, &update)
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	stage, err := slurp.UpdateMetadata(buildId, update.Metadata)
+	if err == nil && update.Notes != nil {
+		stage, err = slurp.UpdateNotes(buildId, *update.Notes)
+	}
+	if err == slurp.ErrNoStage {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusBadRequest)
+		return
+	}
+
+	writeBody(rw, req, stage, http.StatusOK)
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/mu-box/slurp/core"
+)
+
+type statusReport struct {
+	Disk    slurp.DiskStatus     `json:"disk"`      // build dir filesystem usage
+	Janitor slurp.JanitorStatus  `json:"janitor"`   // how aggressively expired stages are swept
+	Stages  int                  `json:"stages"`    // number of uncommitted stages
+	Queue   slurp.QueueStatus    `json:"queue"`     // commit upload queue
+	Buffers slurp.BufferStatus   `json:"buffers"`   // memory used buffering commit uploads
+	Deletes slurp.DeletionStatus `json:"deletions"` // staging dirs being removed
+	Publish slurp.StatsTotals    `json:"published"` // what was published to the builds whose stats are kept
+}
+
+// capabilities describes what this slurp supports, for clients to negotiate
+// with
+func capabilities(rw http.ResponseWriter, req *http.Request) {
+	// GET /capabilities
+	writeBody(rw, req, slurp.GetCapabilities(), http.StatusOK)
+}
+
+// status reports the build dir's disk usage, whether new stages are accepted,
+// how aggressively the janitor sweeps, the commit upload queue and buffers,
+// the progress of stage deletions, and the totals published
+func status(rw http.ResponseWriter, req *http.Request) {
+	// GET /status
+	usage, err := slurp.DiskUsage()
+	if err != nil {
+		writeBody(rw, req, apiError{err.Error()}, http.StatusInternalServerError)
+		return
+	}
+
+	writeBody(rw, req, statusReport{Disk: usage, Janitor: slurp.Janitor(), Stages: len(slurp.ListStages()), Queue: slurp.Queue(), Buffers: slurp.Buffers(), Deletes: slurp.Deletions(), Publish: slurp.Totals()}, http.StatusOK)
+}
@@ -0,0 +1,270 @@
+// Package "audit" keeps an append-only trail of mutating api operations: who
+// (by token fingerprint) did what to which builds, from where, and how it
+// went. Each record carries the hash of the one before it, so a record edited
+// or removed after the fact breaks the chain (see Verify).
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned recording to a trail that isn't open
+var ErrClosed = errors.New("Audit log isn't open")
+
+// Record is one audited operation
+type Record struct {
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`               // operation, eg stage.commit
+	Method    string    `json:"method"`           // http method of the request
+	Path      string    `json:"path"`             // request path
+	Token     string    `json:"token"`            // sha256 fingerprint of the api token used
+	Owner     string    `json:"owner,omitempty"`  // sha256 fingerprint of the stage owner credential used, if any
+	Remote    string    `json:"remote"`           // client address
+	Builds    []string  `json:"builds,omitempty"` // builds the operation touched
+	Status    int       `json:"status"`           // http status replied
+	Error     string    `json:"error,omitempty"`  // why the operation failed
+	RequestId string    `json:"request-id"`       // id of the api request
+	Prev      string    `json:"prev"`             // sha256 of the previous record's line (empty for the first)
+}
+
+// Filter selects records. Zero fields match everything.
+type Filter struct {
+	Build string    // records touching this build
+	Op    string    // records of this operation
+	Since time.Time // records at or after this time
+	Until time.Time // records before this time
+	Limit int       // most recent records returned
+}
+
+// Report is the outcome of verifying the chain
+type Report struct {
+	Records int    `json:"records"`         // records checked
+	Ok      bool   `json:"ok"`              // whether every record chains to the one before it
+	Error   string `json:"error,omitempty"` // where the chain breaks
+}
+
+// the open trail, guarded by lock
+var trail = struct {
+	sync.Mutex
+	path string
+	file *os.File
+	prev string // hash of the last record's line
+}{}
+
+// Open opens (or creates) the trail at path to append records to
+func Open(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create audit log dir - %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to open audit log - %v", err)
+	}
+	prev, err := lastHash(file)
+	if err == errPartial {
+		// a record cut short (eg. by a crash) is left to fail verification,
+		// with the next one on a line of its own
+		_, err = file.Write([]byte("\n"))
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to read audit log - %v", err)
+	}
+
+	trail.Lock()
+	defer trail.Unlock()
+	if trail.file != nil {
+		trail.file.Close()
+	}
+	trail.path, trail.file, trail.prev = path, file, prev
+	return nil
+}
+
+// Close closes the trail
+func Close() error {
+	trail.Lock()
+	defer trail.Unlock()
+	if trail.file == nil {
+		return nil
+	}
+	err := trail.file.Close()
+	trail.file = nil
+	return err
+}
+
+// Add appends a record to the trail, chained to the last one, and syncs it to
+// disk before returning
+func Add(record Record) error {
+	trail.Lock()
+	defer trail.Unlock()
+	if trail.file == nil {
+		return ErrClosed
+	}
+
+	record.Prev = trail.prev
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = trail.file.Write(append(line, '\n'))
+	if err != nil {
+		return fmt.Errorf("Failed to write audit record - %v", err)
+	}
+	err = trail.file.Sync()
+	if err != nil {
+		return fmt.Errorf("Failed to sync audit log - %v", err)
+	}
+	trail.prev = hash(line)
+	return nil
+}
+
+// Query returns the records matching filter, oldest first
+func Query(filter Filter) ([]Record, error) {
+	records := []Record{}
+	err := scan(func(line []byte, record Record) error {
+		if match(record, filter) {
+			records = append(records, record)
+			if filter.Limit > 0 && len(records) > filter.Limit {
+				records = records[1:]
+			}
+		}
+		return nil
+	})
+	return records, err
+}
+
+// Verify checks every record chains to the one before it
+func Verify() (Report, error) {
+	report := Report{Ok: true}
+	prev := ""
+	err := scan(func(line []byte, record Record) error {
+		if record.Prev != prev {
+			return fmt.Errorf("record %d (%v %s) doesn't follow the one before it", report.Records+1, record.Time.Format(time.RFC3339), record.Op)
+		}
+		prev = hash(line)
+		report.Records++
+		return nil
+	})
+	if errors.Is(err, ErrClosed) {
+		return report, err
+	}
+	if err != nil {
+		report.Ok, report.Error = false, err.Error()
+	}
+	return report, nil
+}
+
+// scan calls fn with each line of the trail, and its record
+func scan(fn func(line []byte, record Record) error) error {
+	trail.Lock()
+	path := trail.path
+	trail.Unlock()
+	if path == "" {
+		return ErrClosed
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	lines := bufio.NewScanner(file)
+	lines.Buffer(make([]byte, 64*1024), 1024*1024)
+	n := 0
+	for lines.Scan() {
+		n++
+		var record Record
+		err = json.Unmarshal(lines.Bytes(), &record)
+		if err != nil {
+			return fmt.Errorf("record %d doesn't parse - %v", n, err)
+		}
+		err = fn(lines.Bytes(), record)
+		if err != nil {
+			return err
+		}
+	}
+	return lines.Err()
+}
+
+// match reports whether a record matches a filter
+func match(record Record, filter Filter) bool {
+	if filter.Op != "" && record.Op != filter.Op {
+		return false
+	}
+	if !filter.Since.IsZero() && record.Time.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !record.Time.Before(filter.Until) {
+		return false
+	}
+	if filter.Build == "" {
+		return true
+	}
+	for _, build := range record.Builds {
+		if build == filter.Build {
+			return true
+		}
+	}
+	return false
+}
+
+// errPartial is returned by lastHash if the last line wasn't finished
+var errPartial = errors.New("Last record is incomplete")
+
+// lastHash returns the hash of the last line of file, reading only its tail
+func lastHash(file *os.File) (string, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+	size := info.Size()
+	if size == 0 {
+		return "", nil
+	}
+
+	tail := int64(1024 * 1024)
+	if tail > size {
+		tail = size
+	}
+	buf := make([]byte, tail)
+	_, err = file.ReadAt(buf, size-tail)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if buf[len(buf)-1] != '\n' {
+		return "", errPartial
+	}
+	buf = buf[:len(buf)-1]
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	return hash(buf), nil
+}
+
+// Fingerprint is what a token or credential is recorded as, so the secret
+// itself isn't (the same sha256 hex stages record their owner as)
+func Fingerprint(secret string) string {
+	if secret == "" {
+		return ""
+	}
+	return hash([]byte(secret))
+}
+
+// hash returns the hex sha256 of a record's line
+func hash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,64 @@
+package audit_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mu-box/slurp/audit"
+)
+
+func TestAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	err := audit.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	start := time.Now().UTC()
+	for _, record := range []audit.Record{
+		{Time: start, Op: "stage.add", Builds: []string{"a"}, Status: 200},
+		{Time: start.Add(time.Minute), Op: "stage.commit", Builds: []string{"a"}, Status: 200},
+		{Time: start.Add(2 * time.Minute), Op: "stage.add", Builds: []string{"b"}, Status: 400, Error: "Stage exists"},
+	} {
+		err = audit.Add(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records, err := audit.Query(audit.Filter{Build: "a"})
+	if err != nil || len(records) != 2 || records[1].Op != "stage.commit" {
+		t.Errorf("Expected build a's two records - %v %+v", err, records)
+	}
+	records, _ = audit.Query(audit.Filter{Op: "stage.add", Limit: 1})
+	if len(records) != 1 || records[0].Error != "Stage exists" {
+		t.Errorf("Expected the latest stage.add record - %+v", records)
+	}
+	records, _ = audit.Query(audit.Filter{Since: start.Add(time.Minute), Until: start.Add(2 * time.Minute)})
+	if len(records) != 1 || records[0].Op != "stage.commit" {
+		t.Errorf("Expected the record between since and until - %+v", records)
+	}
+
+	// reopening continues the chain
+	err = audit.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	audit.Add(audit.Record{Time: start.Add(3 * time.Minute), Op: "stage.delete", Builds: []string{"a"}, Status: 200})
+	report, err := audit.Verify()
+	if err != nil || !report.Ok || report.Records != 4 {
+		t.Errorf("Expected an intact chain of 4 records - %v %+v", err, report)
+	}
+
+	// an edited record breaks it
+	b, _ := os.ReadFile(path)
+	os.WriteFile(path, bytes.Replace(b, []byte("Stage exists"), []byte("Stage absent"), 1), 0600)
+	report, err = audit.Verify()
+	if err != nil || report.Ok || report.Records != 3 {
+		t.Errorf("Expected the chain to break after 3 records - %v %+v", err, report)
+	}
+}
@@ -0,0 +1,212 @@
+package audit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+)
+
+// exportIndex is the blob the exported segments are listed in
+const exportIndex = "audit/index.json"
+
+// Segment is a run of records exported to storage. Its blob is written once
+// and never rewritten; later records go to the next segment.
+type Segment struct {
+	Seq      int       `json:"seq"`      // position in the export, from 1
+	Blob     string    `json:"blob"`     // blob id it is stored as
+	Offset   int64     `json:"offset"`   // where in the trail its records start
+	Size     int64     `json:"size"`     // bytes of records
+	Records  int       `json:"records"`  // records it holds
+	First    time.Time `json:"first"`    // time of its first record
+	Last     time.Time `json:"last"`     // time of its last record
+	Prev     string    `json:"prev"`     // hash of the record before its first, chaining it to the previous segment
+	Head     string    `json:"head"`     // hash of its last record
+	Sha256   string    `json:"sha256"`   // checksum of the blob
+	Exported time.Time `json:"exported"` // when it was written
+}
+
+// Exports lists the segments exported so far, in order
+type Exports struct {
+	Segments []Segment `json:"segments"`
+}
+
+// what has been exported, loaded from storage on first use
+var exported = struct {
+	sync.Mutex
+	index *Exports
+	dirty bool // whether the stored index is missing segments
+}{}
+
+// StartExporter ships new records to audit-store every interval
+func StartExporter(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			segment, err := Export()
+			if err != nil {
+				config.Log.Error("Failed to export audit log - %v", err)
+				continue
+			}
+			if segment != nil {
+				config.Log.Debug("Exported %d audit record(s) as '%v'", segment.Records, segment.Blob)
+			}
+		}
+	}()
+}
+
+// Export writes the records added since the last export to audit-store as a
+// new segment, and updates the index of segments. Records must chain to those
+// already exported, so an edited trail isn't shipped as if it were intact. It
+// returns nil if there was nothing new to export.
+func Export() (*Segment, error) {
+	exported.Lock()
+	defer exported.Unlock()
+	err := loadExports()
+	if err != nil {
+		return nil, err
+	}
+
+	trail.Lock()
+	path := trail.path
+	trail.Unlock()
+	if path == "" {
+		return nil, ErrClosed
+	}
+
+	segment := Segment{Seq: len(exported.index.Segments) + 1}
+	if n := len(exported.index.Segments); n > 0 {
+		last := exported.index.Segments[n-1]
+		segment.Offset, segment.Prev = last.Offset+last.Size, last.Head
+	}
+	data, err := readFrom(path, segment.Offset)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, writeExports()
+	}
+
+	// check the records chain on from the exported ones
+	segment.Head = segment.Prev
+	for _, line := range bytes.Split(bytes.TrimSuffix(data, []byte("\n")), []byte("\n")) {
+		var record Record
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			return nil, fmt.Errorf("Record %d doesn't parse - %v", segment.Records+1, err)
+		}
+		if record.Prev != segment.Head {
+			return nil, fmt.Errorf("Record %d (%v %s) doesn't follow the exported ones", segment.Records+1, record.Time.Format(time.RFC3339), record.Op)
+		}
+		if segment.Records == 0 {
+			segment.First = record.Time
+		}
+		segment.Last, segment.Head = record.Time, hash(line)
+		segment.Records++
+	}
+
+	sum := sha256.Sum256(data)
+	segment.Blob = fmt.Sprintf("audit/%08d.log", segment.Seq)
+	segment.Size, segment.Sha256 = int64(len(data)), hex.EncodeToString(sum[:])
+	err = backend.WriteBlobAt(config.AuditStore, segment.Blob, bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write audit segment - %v", err)
+	}
+	segment.Exported = time.Now().UTC()
+
+	// the segment is kept even if the index fails to write, so it isn't
+	// rewritten; the index is retried on the next export
+	exported.index.Segments = append(exported.index.Segments, segment)
+	exported.dirty = true
+	return &segment, writeExports()
+}
+
+// ExportIndex returns the index of exported segments
+func ExportIndex() (Exports, error) {
+	exported.Lock()
+	defer exported.Unlock()
+	err := loadExports()
+	if err != nil {
+		return Exports{}, err
+	}
+	return Exports{Segments: append([]Segment{}, exported.index.Segments...)}, nil
+}
+
+// loadExports reads the index of exported segments from audit-store, if it
+// hasn't been yet
+func loadExports() error {
+	if exported.index != nil {
+		return nil
+	}
+	index := &Exports{Segments: []Segment{}}
+	body, err := backend.ReadBlobAt(config.AuditStore, exportIndex)
+	if errors.Is(err, backend.ErrNotFound) {
+		exported.index = index
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read audit export index - %v", err)
+	}
+	defer body.Close()
+	err = json.NewDecoder(body).Decode(index)
+	if err != nil {
+		return fmt.Errorf("Failed to parse audit export index - %v", err)
+	}
+	exported.index = index
+	return nil
+}
+
+// writeExports writes the index of exported segments to audit-store, if it is
+// missing any
+func writeExports() error {
+	if !exported.dirty {
+		return nil
+	}
+	raw, err := json.Marshal(exported.index)
+	if err != nil {
+		return err
+	}
+	err = backend.WriteBlobAt(config.AuditStore, exportIndex, bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("Failed to write audit export index - %v", err)
+	}
+	exported.dirty = false
+	return nil
+}
+
+// readFrom returns the complete records of the trail at path from offset on
+func readFrom(path string, offset int64) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < offset {
+		return nil, fmt.Errorf("Audit log is shorter than what was exported (%d < %d bytes)", info.Size(), offset)
+	}
+
+	data, err := ioutil.ReadAll(io.NewSectionReader(file, offset, info.Size()-offset))
+	if err != nil {
+		return nil, err
+	}
+	// a record being written is left for the next export
+	return data[:bytes.LastIndexByte(data, '\n')+1], nil
+}
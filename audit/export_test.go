@@ -0,0 +1,66 @@
+package audit_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/mu-box/slurp/audit"
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+)
+
+func TestExport(t *testing.T) {
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("FATAL"))
+	config.Stores = map[string]config.Store{"audit": {Addr: config.StoreAddr, Prefix: fmt.Sprintf("audit-test-%d/", time.Now().UnixNano())}}
+	config.AuditStore = "audit"
+	err := backend.Initialize()
+	if err != nil {
+		t.Skipf("Backend init failed, skipping - %v", err)
+	}
+
+	err = audit.Open(filepath.Join(t.TempDir(), "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	audit.Add(audit.Record{Time: time.Now().UTC(), Op: "stage.add", Builds: []string{"a"}, Status: 200})
+	audit.Add(audit.Record{Time: time.Now().UTC(), Op: "stage.commit", Builds: []string{"a"}, Status: 200})
+	first, err := audit.Export()
+	if err != nil || first == nil || first.Seq != 1 || first.Records != 2 || first.Prev != "" {
+		t.Fatalf("Expected both records in the first segment - %v %+v", err, first)
+	}
+
+	none, err := audit.Export()
+	if err != nil || none != nil {
+		t.Errorf("Expected nothing new to export - %v %+v", err, none)
+	}
+
+	audit.Add(audit.Record{Time: time.Now().UTC(), Op: "stage.delete", Builds: []string{"a"}, Status: 200})
+	second, err := audit.Export()
+	if err != nil || second == nil || second.Records != 1 || second.Offset != first.Size || second.Prev != first.Head {
+		t.Fatalf("Expected the new record chained to the first segment - %v %+v", err, second)
+	}
+
+	index, err := audit.ExportIndex()
+	if err != nil || len(index.Segments) != 2 || index.Segments[1].Blob != second.Blob {
+		t.Fatalf("Expected both segments indexed - %v %+v", err, index)
+	}
+	body, err := backend.ReadBlobAt("audit", second.Blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	data, _ := ioutil.ReadAll(body)
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != second.Sha256 {
+		t.Errorf("Stored segment doesn't match its checksum")
+	}
+}
@@ -2,50 +2,292 @@
 package backend
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
+	"sync"
+	"time"
 
 	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/trace"
 )
 
 type blobReadWriter interface {
 	initialize() error
+	ping() error
 	readBlob(id string) (io.ReadCloser, error)
 	writeBlob(id string, blob io.Reader) error
 }
 
+// blobMetaWriter is implemented by backends able to store metadata with a blob
+type blobMetaWriter interface {
+	writeBlobMeta(id string, blob io.Reader, meta map[string]string) error
+}
+
+// blobRangeReader is implemented by backends able to read part of a blob
+type blobRangeReader interface {
+	readBlobRange(id string, off, n int64) (io.ReadCloser, error)
+}
+
+// blobDeleter is implemented by backends able to delete a blob
+type blobDeleter interface {
+	deleteBlob(id string) error
+}
+
+// blobStater is implemented by backends able to describe a blob without
+// reading it
+type blobStater interface {
+	statBlob(id string) (BlobStat, error)
+}
+
+// blobLister is implemented by backends able to list their blobs
+type blobLister interface {
+	listBlobs(prefix string) ([]BlobStat, error)
+}
+
+// BlobStat describes a stored blob, as far as its backend knows it
+type BlobStat struct {
+	Id       string            `json:"id"`
+	Size     int64             `json:"size"`
+	Modified time.Time         `json:"modified,omitempty"` // when it was written
+	Checksum string            `json:"checksum,omitempty"` // the backend's checksum of it
+	Meta     map[string]string `json:"meta,omitempty"`     // metadata written with it
+}
+
 var (
-	backend   blobReadWriter // the pluggable (future) backend
-	storeAddr string         // storage address
+	// ErrNotFound is returned when reading a blob the backend doesn't have
+	ErrNotFound = errors.New("Blob not found")
+	// ErrNoDelete is returned deleting a blob from a backend that can't
+	ErrNoDelete = errors.New("Backend can't delete blobs")
+	// ErrNoStat is returned describing a blob with a backend that can't
+	ErrNoStat = errors.New("Backend can't describe blobs")
+	// ErrNoList is returned listing the blobs of a backend that can't
+	ErrNoList = errors.New("Backend can't list blobs")
+)
+
+// retryInterval is how long Start waits between connection attempts
+const retryInterval = 5 * time.Second
+
+var (
+	backend blobReadWriter // the pluggable (future) backend
+
+	ready     = make(chan struct{}) // closed once the backend has initialized
+	readyOnce = sync.Once{}
 )
 
 // Initialize prepares the backend and ensures it is available
 func Initialize() error {
+	err := setup()
+	if err != nil {
+		return err
+	}
+
+	err = backend.initialize()
+	if err != nil {
+		return err
+	}
+
+	readyOnce.Do(func() { close(ready) })
+	return nil
+}
+
+// Start prepares the backend and connects to it in the background, retrying
+// until it is available, so slurp can come up while storage is unreachable.
+// Only a bad storage address is returned as an error.
+func Start() error {
+	err := setup()
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			err := backend.initialize()
+			if err == nil {
+				config.Log.Info("Backend ready")
+				readyOnce.Do(func() { close(ready) })
+				return
+			}
+			config.Log.Error("Backend not ready, retrying in %v - %v", retryInterval, err)
+			time.Sleep(retryInterval)
+		}
+	}()
+
+	return nil
+}
+
+// WaitHealthy blocks until the backend has initialized and passes a health
+// check, retrying for up to timeout. Work needing the backend (commits) waits
+// here rather than failing while storage is rebooting.
+func WaitHealthy(timeout time.Duration) error {
+	deadline := time.After(timeout)
+
+	select {
+	case <-ready:
+	case <-deadline:
+		return fmt.Errorf("Backend unavailable after %v", timeout)
+	}
+
+	for {
+		err := Check()
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-time.After(retryInterval):
+		case <-deadline:
+			return fmt.Errorf("Backend unhealthy after %v - %v", timeout, err)
+		}
+	}
+}
+
+// setup picks the backend implementation from the storage address, and
+// prepares the client storage is reached with and any replicas and named
+// stores
+func setup() error {
 	var err error
-	var u *url.URL
-	u, err = url.Parse(config.StoreAddr)
+	client, err = newClient()
 	if err != nil {
-		return fmt.Errorf("Failed to parse backend connection - %v", err)
+		return err
+	}
+	backend, err = newBackend(config.StoreAddr)
+	if err != nil {
+		return err
+	}
+	err = setupReplicas()
+	if err != nil {
+		return err
+	}
+	return setupStores()
+}
+
+// newBackend picks the backend implementation for a storage address
+func newBackend(addr string) (blobReadWriter, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse backend connection - %v", err)
 	}
 	switch u.Scheme {
 	case "hoarder": // insecure hoarder
-		backend = &hoarder{proto: "http"}
+		return &hoarder{proto: "http", addr: u.Host}, nil
 	case "hoarders": // secure hoarder
-		backend = &hoarder{proto: "https"}
+		return &hoarder{proto: "https", addr: u.Host}, nil
 	default:
-		backend = &hoarder{proto: "https"}
+		return &hoarder{proto: "https", addr: u.Host}, nil
 	}
-	storeAddr = u.Host
-	return backend.initialize()
 }
 
 // ReadBlob reads a blob from a storage backend
 func ReadBlob(id string) (io.ReadCloser, error) {
+	config.Log.Debug("%sReading blob '%v'", reqid.Tag(id), id)
 	return backend.readBlob(id)
 }
 
+// ReadBlobRange reads n bytes of a blob starting at off. Backends that can't
+// read part of a blob read it from the start, skipping to off.
+func ReadBlobRange(id string, off, n int64) (io.ReadCloser, error) {
+	config.Log.Debug("%sReading blob '%v' bytes %d-%d", reqid.Tag(id), id, off, off+n-1)
+	if rr, ok := backend.(blobRangeReader); ok {
+		return rr.readBlobRange(id, off, n)
+	}
+
+	body, err := backend.readBlob(id)
+	if err != nil {
+		return nil, err
+	}
+	return skipRange(body, off, n)
+}
+
+// skipRange discards the first off bytes of a blob, limiting it to n bytes
+func skipRange(body io.ReadCloser, off, n int64) (io.ReadCloser, error) {
+	_, err := io.CopyN(io.Discard, body, off)
+	if err != nil {
+		body.Close()
+		return nil, fmt.Errorf("Failed to skip to offset %d - %v", off, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, n), body}, nil
+}
+
 // WriteBlob writes a blob to a storage backend
 func WriteBlob(id string, blob io.Reader) error {
-	return backend.writeBlob(id, blob)
+	config.Log.Debug("%sWriting blob '%v'", reqid.Tag(id), id)
+	span := startWrite(id)
+	n, err := retried(id, blob, func(body io.Reader) error {
+		return backend.writeBlob(id, body)
+	})
+	finishWrite(span, n, err)
+	return err
+}
+
+// DeleteBlob deletes a blob from the storage backend. Deleting a blob it
+// doesn't have succeeds.
+func DeleteBlob(id string) error {
+	bd, ok := backend.(blobDeleter)
+	if !ok {
+		return ErrNoDelete
+	}
+	config.Log.Debug("%sDeleting blob '%v'", reqid.Tag(id), id)
+	err := bd.deleteBlob(id)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// StatBlob describes a blob in the storage backend without reading it
+func StatBlob(id string) (BlobStat, error) {
+	return StatBlobAt("", id)
+}
+
+// ListBlobs lists the blobs in the storage backend whose id starts with
+// prefix, sorted by id
+func ListBlobs(prefix string) ([]BlobStat, error) {
+	return ListBlobsAt("", prefix)
+}
+
+// WriteBlobMeta writes a blob to a storage backend along with metadata. The
+// metadata is dropped if the backend can't store it.
+func WriteBlobMeta(id string, blob io.Reader, meta map[string]string) error {
+	if mw, ok := backend.(blobMetaWriter); ok && len(meta) > 0 {
+		config.Log.Debug("%sWriting blob '%v' with metadata", reqid.Tag(id), id)
+		span := startWrite(id)
+		n, err := retried(id, blob, func(body io.Reader) error {
+			return mw.writeBlobMeta(id, body, meta)
+		})
+		finishWrite(span, n, err)
+		return err
+	}
+	return WriteBlob(id, blob)
+}
+
+// startWrite starts the span of a blob upload, under its build's trace
+func startWrite(id string) *trace.Span {
+	span := trace.Start("backend.write", trace.KindClient, trace.Build(id))
+	span.Set("slurp.blob", id)
+	span.Set("slurp.store", config.StoreAddr)
+	return span
+}
+
+// finishWrite ends the span of a blob upload of n bytes
+func finishWrite(span *trace.Span, n int64, err error) {
+	span.Set("slurp.bytes", n)
+	span.Finish(err)
+}
+
+// countReader counts the bytes read through it
+type countReader struct {
+	io.Reader
+	n int64
+}
+
+func (self *countReader) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	self.n += int64(n)
+	return n, err
 }
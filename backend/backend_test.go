@@ -3,7 +3,13 @@ package backend_test
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/jcelliott/lumber"
@@ -45,6 +51,236 @@ func TestReadBlob(t *testing.T) {
 	}
 }
 
+func TestWriteRetry(t *testing.T) {
+	// a store failing the first write of each blob partway through
+	var mutex sync.Mutex
+	tries := map[string]int{}
+	written := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/ping" {
+			return
+		}
+		mutex.Lock()
+		tries[req.URL.Path]++
+		try := tries[req.URL.Path]
+		mutex.Unlock()
+		if try == 1 {
+			io.CopyN(io.Discard, req.Body, 4)
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		mutex.Lock()
+		written[req.URL.Path] = body
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	config.Stores = map[string]config.Store{"flaky": {Addr: "hoarder://" + server.Listener.Addr().String()}}
+	config.BuildDir = t.TempDir()
+	defer func() { config.Stores = map[string]config.Store{} }()
+	err := backend.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a stream is replayed from the spool
+	stream := io.MultiReader(strings.NewReader("big-"), strings.NewReader("build"))
+	err = backend.WriteBlobAt("flaky", "streamed", stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written["/blobs/streamed"]) != "big-build" || tries["/blobs/streamed"] != 2 {
+		t.Errorf("%q (after %d tries) doesn't match expected blob", written["/blobs/streamed"], tries["/blobs/streamed"])
+	}
+
+	// unless it outgrows the spool
+	config.StoreSpool = 0
+	defer func() { config.StoreSpool = 256 }()
+	err = backend.WriteBlobAt("flaky", "large", io.MultiReader(strings.NewReader("big-build")))
+	if err == nil {
+		t.Error("Expected a stream larger than the spool not to be retried")
+	}
+
+	// a seekable blob is rewound
+	err = backend.WriteBlobAt("flaky", "seekable", strings.NewReader("big-build"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(written["/blobs/seekable"]) != "big-build" {
+		t.Errorf("%q doesn't match expected blob", written["/blobs/seekable"])
+	}
+}
+
+func TestStatList(t *testing.T) {
+	// a hoarder keeping metadata, and listing its blobs
+	var mutex sync.Mutex
+	headers := map[string]http.Header{}
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch {
+		case req.URL.Path == "/ping":
+		case req.URL.Path == "/blobs":
+			fmt.Fprint(rw, `[{"Name":"other","Size":1},{"Name":"meta/build.index","CheckSum":"abc","Size":9,"ModTime":"2016-07-26T12:00:00Z"}]`)
+		case req.Method == "POST":
+			n, _ := io.Copy(io.Discard, req.Body)
+			headers[req.URL.Path] = http.Header{"Content-Length": {fmt.Sprint(n)}}
+			for k, v := range req.Header {
+				if strings.HasPrefix(k, "X-Blob-Meta-") {
+					headers[req.URL.Path][k] = v
+				}
+			}
+		case req.Method == "HEAD" && headers[req.URL.Path] != nil:
+			for k, v := range headers[req.URL.Path] {
+				rw.Header()[k] = v
+			}
+			rw.Header().Set("Last-Modified", "Tue, 26 Jul 2016 12:00:00 GMT")
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	addr := config.StoreAddr
+	config.StoreAddr = "hoarder://" + server.Listener.Addr().String()
+	config.Stores = map[string]config.Store{"prefixed": {Addr: config.StoreAddr, Prefix: "meta/"}}
+	defer func() {
+		config.StoreAddr, config.Stores = addr, map[string]config.Store{}
+		backend.Initialize()
+	}()
+	err := backend.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backend.WriteBlobMeta("described", strings.NewReader("big-build"), map[string]string{"app": "my app", "archive-format": "tar.gz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, err := backend.StatBlob("described")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size != 9 || stat.Modified.Year() != 2016 || stat.Meta["app"] != "my app" || stat.Meta["archive-format"] != "tar.gz" {
+		t.Errorf("Unexpected blob stat - %+v", stat)
+	}
+	if _, err = backend.StatBlob("missing"); err != backend.ErrNotFound {
+		t.Errorf("Expected not found, got %v", err)
+	}
+
+	list, err := backend.ListBlobsAt("prefixed", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Id != "build.index" || list[0].Checksum != "abc" || list[0].Size != 9 {
+		t.Errorf("Unexpected blob list - %+v", list)
+	}
+}
+
+func TestStoreProxy(t *testing.T) {
+	// an https store only reachable through the proxy
+	store := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(io.Discard, req.Body)
+	}))
+	defer store.Close()
+
+	var mutex sync.Mutex
+	seen := []string{}
+	proxy := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		seen = append(seen, req.Method+" "+req.Host)
+		mutex.Unlock()
+		if req.Method != "CONNECT" {
+			// plain http is proxied by absolute url, answered here
+			io.Copy(io.Discard, req.Body)
+			return
+		}
+		upstream, err := net.Dial("tcp", store.Listener.Addr().String())
+		if err != nil {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		conn, _, _ := rw.(http.Hijacker).Hijack()
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	defer proxy.Close()
+
+	addr := config.StoreAddr
+	config.StoreProxy = proxy.URL
+	config.StoreAddr = "hoarders://store.invalid:7410"
+	config.Stores = map[string]config.Store{"plain": {Addr: "hoarder://plain.invalid:7410"}}
+	defer func() {
+		config.StoreAddr, config.StoreProxy, config.Stores = addr, "", map[string]config.Store{}
+		backend.Initialize()
+	}()
+	err := backend.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backend.WriteBlob("proxied", strings.NewReader("big-build"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.WriteBlobAt("plain", "proxied", strings.NewReader("big-build"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(seen) < 2 || seen[0] != "CONNECT store.invalid:7410" || seen[len(seen)-1] != "POST plain.invalid:7410" {
+		t.Errorf("Expected storage requests to go through the proxy, got %v", seen)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	// a store whose ping route, like hoarder's, doesn't check the token
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/ping" && req.Header.Get("X-AUTH-TOKEN") != "rotated" {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if req.URL.Path != "/ping" {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	addr, token := config.StoreAddr, config.StoreToken
+	defer func() {
+		config.StoreAddr, config.StoreToken, config.StoreTFile = addr, token, ""
+		backend.Initialize()
+	}()
+	config.StoreAddr, config.StoreToken = "hoarder://"+server.Listener.Addr().String(), "rotated"
+	err := backend.Initialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an expired token is noticed, and the new one read
+	config.StoreToken = "expired"
+	config.StoreTFile = t.TempDir() + "/store-token"
+	os.WriteFile(config.StoreTFile, []byte("rotated\n"), 0600)
+	err = backend.Check()
+	if err != nil || config.StoreToken != "rotated" {
+		t.Errorf("Expected the heartbeat to refresh the token, got %q - %v", config.StoreToken, err)
+	}
+
+	// and a token that can't be refreshed fails the check
+	config.StoreToken = "expired"
+	os.WriteFile(config.StoreTFile, []byte("expired\n"), 0600)
+	if err = backend.Check(); err == nil {
+		t.Error("Expected the heartbeat to fail with an expired token")
+	}
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // PRIVS
 ////////////////////////////////////////////////////////////////////////////////
@@ -0,0 +1,70 @@
+package backend
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+)
+
+// last heartbeat result
+var health = struct {
+	sync.Mutex
+	checked time.Time
+	err     error
+}{}
+
+// StartHeartbeat pings the backend every interval so expired tokens and dead
+// connections are noticed (and fixed) before a commit needs them.
+func StartHeartbeat(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			err := Check()
+			if err != nil {
+				config.Log.Error("Backend heartbeat failed - %v", err)
+			}
+		}
+	}()
+}
+
+// Check pings the backend with the store token, re-authenticating once if the
+// token was rejected. The result is recorded for Health.
+func Check() error {
+	err := backend.ping()
+	if err == errUnauthorized {
+		config.Log.Info("Backend rejected store token, re-authenticating...")
+		err = reauth()
+	}
+
+	health.Lock()
+	health.checked = time.Now()
+	health.err = err
+	health.Unlock()
+
+	return err
+}
+
+// Health returns when the backend was last checked and the result of that check
+func Health() (time.Time, error) {
+	health.Lock()
+	defer health.Unlock()
+	return health.checked, health.err
+}
+
+// reauth refreshes the store token, drops pooled connections made with the
+// old one, and pings again.
+func reauth() error {
+	err := config.RefreshStoreToken()
+	if err != nil {
+		return fmt.Errorf("Failed to refresh store token - %v", err)
+	}
+
+	client.CloseIdleConnections()
+
+	return backend.ping()
+}
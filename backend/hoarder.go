@@ -2,62 +2,283 @@ package backend
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/trace"
 )
 
+var errUnauthorized = errors.New("401 Unauthorized. Please specify backend api token (-T 'backend-token')")
+
+// client is the http client storage is reached with, set up by newClient
+var client = http.DefaultClient
+
+// newClient builds the http client storage is reached with: through
+// store-proxy, else the proxy the environment names (CONNECT tunnels https
+// storage through either)
+func newClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if config.StoreProxy != "" {
+		proxy, err := url.Parse(config.StoreProxy)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse store proxy - %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	// if insecure is false, verify cert
+	if config.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// metaHeader prefixes the headers blob metadata is sent to (and read back from)
+// hoarder in, keys and values query escaped
+const metaHeader = "X-Blob-Meta-"
+
 type hoarder struct {
 	proto string
+	addr  string // host:port
+	token string // api token, empty uses store-token
 }
 
 // ensure hoarder is up
 func (self hoarder) initialize() error {
-	_, err := self.rest("GET", "ping", nil)
-	return err
+	return self.ping()
+}
+
+// probeBlob is the blob the heartbeat asks hoarder about. It needn't exist:
+// hoarder checks the token before looking.
+const probeBlob = ".heartbeat"
+
+// check hoarder is reachable and accepts our token. Hoarder's ping route
+// skips auth, so an authenticated route is probed instead.
+func (self hoarder) ping() error {
+	res, err := self.rest("HEAD", "blobs/"+probeBlob, nil, "")
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusForbidden {
+		return errUnauthorized
+	}
+	return nil
 }
 
 // get blob from hoarder and return Reader for piping to next command
 func (self hoarder) readBlob(id string) (io.ReadCloser, error) {
-	res, err := self.rest("GET", "blobs/"+id, nil)
+	res, err := self.rest("GET", "blobs/"+url.PathEscape(id), nil, id)
 	if err != nil { // prevent panic if no res
 		return nil, err
 	}
+	if res.StatusCode == 404 {
+		res.Body.Close()
+		return nil, ErrNotFound
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		res.Body.Close()
+		return nil, fmt.Errorf("Unexpected status '%v' from hoarder", res.Status)
+	}
 	return res.Body, err
 }
 
-// pipe blob to hoarder
+// delete a blob from hoarder
+func (self hoarder) deleteBlob(id string) error {
+	res, err := self.rest("DELETE", "blobs/"+url.PathEscape(id), nil, id)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode == 404 {
+		return ErrNotFound
+	}
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status '%v' from hoarder", res.Status)
+	}
+	return nil
+}
+
+// get part of a blob from hoarder, skipping to the range if hoarder sends
+// the whole blob
+func (self hoarder) readBlobRange(id string, off, n int64) (io.ReadCloser, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+n-1)}}
+	res, err := self.restHeader("GET", "blobs/"+url.PathEscape(id), nil, id, header)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case res.StatusCode == 404:
+		res.Body.Close()
+		return nil, ErrNotFound
+	case res.StatusCode == http.StatusPartialContent:
+		return res.Body, nil
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		res.Body.Close()
+		return nil, fmt.Errorf("Unexpected status '%v' from hoarder", res.Status)
+	}
+	return skipRange(res.Body, off, n)
+}
+
+// pipe blob to hoarder (ids are escaped so tree blobs like "build/dir/file" stay one path segment)
 func (self hoarder) writeBlob(id string, blob io.Reader) error {
-	_, err := self.rest("POST", "blobs/"+id, blob)
-	return err
+	res, err := self.rest("POST", "blobs/"+url.PathEscape(id), blob, id)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status '%v' from hoarder", res.Status)
+	}
+	return nil
 }
 
-// rest is a helper method http client to interact with hoarder
-func (self hoarder) rest(method, path string, body io.Reader) (*http.Response, error) {
-	config.Log.Trace("[client] - %v hoarder/%v", method, path)
-	var client *http.Client
-	client = http.DefaultClient
-	uri := fmt.Sprintf("%s://%s/%s", self.proto, storeAddr, path)
+// pipe blob to hoarder with its metadata, which hoarders that keep metadata
+// return describing it (others ignore it)
+func (self hoarder) writeBlobMeta(id string, blob io.Reader, meta map[string]string) error {
+	header := http.Header{}
+	for k, v := range meta {
+		header.Set(metaHeader+url.QueryEscape(k), url.QueryEscape(v))
+	}
+	res, err := self.restHeader("POST", "blobs/"+url.PathEscape(id), blob, id, header)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("Unexpected status '%v' from hoarder", res.Status)
+	}
+	return nil
+}
 
-	// if insecure is false, verify cert
-	if config.Insecure {
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+// describe a blob from the headers of a HEAD request
+func (self hoarder) statBlob(id string) (BlobStat, error) {
+	res, err := self.rest("HEAD", "blobs/"+url.PathEscape(id), nil, id)
+	if err != nil {
+		return BlobStat{}, err
+	}
+	res.Body.Close()
+	switch {
+	case res.StatusCode == 404:
+		return BlobStat{}, ErrNotFound
+	case res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented:
+		return BlobStat{}, ErrNoStat
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return BlobStat{}, fmt.Errorf("Unexpected status '%v' from hoarder", res.Status)
 	}
 
+	stat := BlobStat{Id: id, Size: res.ContentLength, Checksum: strings.Trim(res.Header.Get("ETag"), `"`)}
+	if modified, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		stat.Modified = modified.UTC()
+	}
+	for k, v := range res.Header {
+		if !strings.HasPrefix(k, metaHeader) || len(v) == 0 {
+			continue
+		}
+		key, kerr := url.QueryUnescape(strings.ToLower(strings.TrimPrefix(k, metaHeader)))
+		value, verr := url.QueryUnescape(v[0])
+		if kerr != nil || verr != nil {
+			continue
+		}
+		if stat.Meta == nil {
+			stat.Meta = map[string]string{}
+		}
+		stat.Meta[key] = value
+	}
+	return stat, nil
+}
+
+// hoarderBlob is a blob as hoarder lists it
+type hoarderBlob struct {
+	Name     string    `json:"Name"`
+	CheckSum string    `json:"CheckSum"`
+	Size     int64     `json:"Size"`
+	ModTime  time.Time `json:"ModTime"`
+}
+
+// list the blobs hoarder has, keeping those starting with prefix (hoarders
+// that can filter are asked to)
+func (self hoarder) listBlobs(prefix string) ([]BlobStat, error) {
+	path := "blobs"
+	if prefix != "" {
+		path += "?prefix=" + url.QueryEscape(prefix)
+	}
+	res, err := self.rest("GET", path, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == 404 || res.StatusCode == http.StatusMethodNotAllowed || res.StatusCode == http.StatusNotImplemented:
+		return nil, ErrNoList
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		return nil, fmt.Errorf("Unexpected status '%v' from hoarder", res.Status)
+	}
+
+	var blobs []hoarderBlob
+	err = json.NewDecoder(res.Body).Decode(&blobs)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse blob list - %v", err)
+	}
+	list := []BlobStat{}
+	for _, blob := range blobs {
+		if strings.HasPrefix(blob.Name, prefix) {
+			list = append(list, BlobStat{Id: blob.Name, Size: blob.Size, Modified: blob.ModTime.UTC(), Checksum: blob.CheckSum})
+		}
+	}
+	return list, nil
+}
+
+// rest is a helper method http client to interact with hoarder. The id of the
+// api request and the trace context a blob's build was last touched under are
+// forwarded to hoarder (a request id is generated for requests not tied to a
+// blob, or a request).
+func (self hoarder) rest(method, path string, body io.Reader, blob string) (*http.Response, error) {
+	return self.restHeader(method, path, body, blob, nil)
+}
+
+// restHeader is rest with extra request headers
+func (self hoarder) restHeader(method, path string, body io.Reader, blob string, header http.Header) (*http.Response, error) {
+	reqId := reqid.Get(blob)
+	if reqId == "" {
+		reqId = reqid.New()
+	}
+	config.Log.Trace("[client] - %v hoarder/%v %v", method, path, reqId)
+	uri := fmt.Sprintf("%s://%s/%s", self.proto, self.addr, path)
+
 	req, err := http.NewRequest(method, uri, body)
 	if err != nil {
 		panic(err)
 	}
-	req.Header.Add("X-AUTH-TOKEN", config.StoreToken)
+	token := self.token
+	if token == "" {
+		token = config.Get(&config.StoreToken)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Add("X-AUTH-TOKEN", token)
+	req.Header.Set(reqid.Header, reqId)
+	if ctx := trace.Build(blob); blob != "" && ctx.Valid() {
+		req.Header.Set(trace.Header, ctx.String())
+	}
 	res, err := client.Do(req)
 	if err != nil {
 		// return original error to client
 		return nil, err
 	}
 	if res.StatusCode == 401 {
-		return nil, fmt.Errorf("401 Unauthorized. Please specify backend api token (-T 'backend-token')")
+		res.Body.Close()
+		return nil, errUnauthorized
 	}
 	return res, nil
 }
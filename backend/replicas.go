@@ -0,0 +1,66 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+)
+
+// replicas of the primary store (replicated by storage), used to verify and
+// repair blobs
+var replicas []blobReadWriter
+
+// setupReplicas prepares a backend for each replica address
+func setupReplicas() error {
+	replicas = nil
+	for _, addr := range config.StoreRepl {
+		replica, err := newBackend(addr)
+		if err != nil {
+			return fmt.Errorf("Bad replica '%s' - %v", addr, err)
+		}
+		replicas = append(replicas, replica)
+	}
+	return nil
+}
+
+// Stores returns the address of the primary store followed by its replicas,
+// the order stores are numbered in for ReadBlobFrom and WriteBlobTo
+func Stores() []string {
+	return append([]string{config.StoreAddr}, config.StoreRepl...)
+}
+
+// ReadBlobFrom reads a blob from a single store
+func ReadBlobFrom(store int, id string) (io.ReadCloser, error) {
+	backend, err := storeFor(store)
+	if err != nil {
+		return nil, err
+	}
+	config.Log.Debug("%sReading blob '%v' from store %d", reqid.Tag(id), id, store)
+	return backend.readBlob(id)
+}
+
+// WriteBlobTo writes a blob to a single store
+func WriteBlobTo(store int, id string, blob io.Reader) error {
+	backend, err := storeFor(store)
+	if err != nil {
+		return err
+	}
+	config.Log.Debug("%sWriting blob '%v' to store %d", reqid.Tag(id), id, store)
+	_, err = retried(id, blob, func(body io.Reader) error {
+		return backend.writeBlob(id, body)
+	})
+	return err
+}
+
+// storeFor returns the backend numbered store (0 is the primary)
+func storeFor(store int) (blobReadWriter, error) {
+	if store == 0 {
+		return backend, nil
+	}
+	if store < 0 || store > len(replicas) {
+		return nil, fmt.Errorf("No store %d", store)
+	}
+	return replicas[store-1], nil
+}
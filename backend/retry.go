@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+)
+
+// retried writes a blob with write, retrying a write that fails up to
+// store-retries times. A seekable blob is rewound for each attempt; a stream
+// is spooled as it is read (up to store-retry-spool MB), so an attempt that
+// fails partway replays what was read before carrying on with the rest of the
+// stream, rather than the commit packaging the build again. It returns the
+// bytes the last attempt read.
+func retried(id string, blob io.Reader, write func(io.Reader) error) (int64, error) {
+	if config.StoreRetry <= 0 {
+		counted := &countReader{Reader: blob}
+		err := write(counted)
+		return counted.n, err
+	}
+
+	source := newReplay(blob, int64(config.StoreSpool)<<20)
+	defer source.Release()
+
+	for try := 1; ; try++ {
+		body := &attempt{source: source}
+		err := write(body)
+		n := body.end()
+		if err == nil || try > config.StoreRetry {
+			return n, err
+		}
+		if rerr := source.Rewind(); rerr != nil {
+			config.Log.Debug("%sCan't retry write of blob '%v' - %v", reqid.Tag(id), id, rerr)
+			return n, err
+		}
+		config.Log.Error("%sFailed to write blob '%v' (attempt %d of %d), retrying - %v", reqid.Tag(id), id, try, config.StoreRetry+1, err)
+		time.Sleep(time.Duration(try) * time.Second)
+	}
+}
+
+// attempt is the body of one try at a write, cut off once the try is over:
+// the http transport may read on after a failed request returns
+type attempt struct {
+	sync.Mutex
+	source io.Reader
+	n      int64 // bytes read
+	over   bool
+}
+
+func (self *attempt) Read(p []byte) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+	if self.over {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := self.source.Read(p)
+	self.n += int64(n)
+	return n, err
+}
+
+// end cuts the attempt off, returning the bytes it read
+func (self *attempt) end() int64 {
+	self.Lock()
+	defer self.Unlock()
+	self.over = true
+	return self.n
+}
+
+// replay reads a blob for a write that may have to be retried: a seekable
+// blob from where it started, a stream from a spool file of what was read of
+// it so far, then from the stream (spooling that too)
+type replay struct {
+	blob   io.Reader
+	start  int64    // offset a seekable blob started at, -1 for a stream
+	spool  *os.File // what was read of a stream, nil until first read
+	size   int64    // bytes in the spool
+	pos    int64    // bytes of the spool replayed this attempt
+	max    int64    // bytes the spool may grow to
+	failed error    // why the blob can't be replayed, if it can't
+}
+
+func newReplay(blob io.Reader, max int64) *replay {
+	self := &replay{blob: blob, start: -1, max: max}
+	if seeker, ok := blob.(io.Seeker); ok {
+		if start, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			self.start = start
+		}
+	}
+	return self
+}
+
+func (self *replay) Read(p []byte) (int, error) {
+	if self.start >= 0 {
+		return self.blob.Read(p)
+	}
+
+	// replay the spool before reading on
+	if self.pos < self.size {
+		if rest := self.size - self.pos; int64(len(p)) > rest {
+			p = p[:rest]
+		}
+		n, err := self.spool.ReadAt(p, self.pos)
+		self.pos += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+
+	n, err := self.blob.Read(p)
+	if err != nil && err != io.EOF {
+		// the stream itself failed, there is nothing to retry
+		self.failed = err
+	}
+	if n > 0 && self.failed == nil {
+		self.keep(p[:n])
+	}
+	return n, err
+}
+
+// keep appends bytes read from the stream to the spool
+func (self *replay) keep(p []byte) {
+	if self.size+int64(len(p)) > self.max {
+		self.failed = fmt.Errorf("Blob is larger than the %dMB retry spool", self.max>>20)
+		self.Release()
+		return
+	}
+	if self.spool == nil {
+		file, err := ioutil.TempFile(config.BuildDir, ".slurp-retry-")
+		if err != nil {
+			self.failed = fmt.Errorf("Failed to create retry spool - %v", err)
+			return
+		}
+		// unlinked at once, so it is gone with the write (or a crash)
+		os.Remove(file.Name())
+		self.spool = file
+	}
+	_, err := self.spool.WriteAt(p, self.size)
+	if err != nil {
+		self.failed = fmt.Errorf("Failed to spool blob - %v", err)
+		self.Release()
+		return
+	}
+	self.size += int64(len(p))
+	self.pos = self.size
+}
+
+// Rewind readies the blob to be read again from its start, failing if it
+// can't be
+func (self *replay) Rewind() error {
+	if self.start >= 0 {
+		_, err := self.blob.(io.Seeker).Seek(self.start, io.SeekStart)
+		return err
+	}
+	if self.failed != nil {
+		return self.failed
+	}
+	self.pos = 0
+	return nil
+}
+
+// Release removes the spool
+func (self *replay) Release() {
+	if self.spool != nil {
+		self.spool.Close()
+		self.spool = nil
+	}
+}
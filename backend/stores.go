@@ -0,0 +1,152 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+)
+
+// ErrUnknownStore is returned when a named store isn't configured
+var ErrUnknownStore = errors.New("Unknown store")
+
+// named stores builds can be promoted between
+var stores = map[string]blobReadWriter{}
+
+// prefixed stores blobs under a prefix within another backend
+type prefixed struct {
+	blobReadWriter
+	prefix string
+}
+
+func (self prefixed) readBlob(id string) (io.ReadCloser, error) {
+	return self.blobReadWriter.readBlob(self.prefix + id)
+}
+
+func (self prefixed) writeBlob(id string, blob io.Reader) error {
+	return self.blobReadWriter.writeBlob(self.prefix+id, blob)
+}
+
+func (self prefixed) deleteBlob(id string) error {
+	bd, ok := self.blobReadWriter.(blobDeleter)
+	if !ok {
+		return ErrNoDelete
+	}
+	return bd.deleteBlob(self.prefix + id)
+}
+
+func (self prefixed) statBlob(id string) (BlobStat, error) {
+	bs, ok := self.blobReadWriter.(blobStater)
+	if !ok {
+		return BlobStat{}, ErrNoStat
+	}
+	stat, err := bs.statBlob(self.prefix + id)
+	stat.Id = id
+	return stat, err
+}
+
+func (self prefixed) listBlobs(prefix string) ([]BlobStat, error) {
+	bl, ok := self.blobReadWriter.(blobLister)
+	if !ok {
+		return nil, ErrNoList
+	}
+	list, err := bl.listBlobs(self.prefix + prefix)
+	for i := range list {
+		list[i].Id = strings.TrimPrefix(list[i].Id, self.prefix)
+	}
+	return list, err
+}
+
+// setupStores prepares a backend for each named store
+func setupStores() error {
+	stores = map[string]blobReadWriter{}
+	for name, store := range config.Stores {
+		backend, err := newBackend(store.Addr)
+		if err != nil {
+			return fmt.Errorf("Bad store '%s' - %v", name, err)
+		}
+		if h, ok := backend.(*hoarder); ok {
+			h.token = store.Token
+		}
+		if store.Prefix != "" {
+			backend = prefixed{blobReadWriter: backend, prefix: store.Prefix}
+		}
+		stores[name] = backend
+	}
+	return nil
+}
+
+// ReadBlobAt reads a blob from a named store ("" is the primary store)
+func ReadBlobAt(store, id string) (io.ReadCloser, error) {
+	backend, err := namedStore(store)
+	if err != nil {
+		return nil, err
+	}
+	config.Log.Debug("%sReading blob '%v' from store '%v'", reqid.Tag(id), id, store)
+	return backend.readBlob(id)
+}
+
+// WriteBlobAt writes a blob to a named store ("" is the primary store)
+func WriteBlobAt(store, id string, blob io.Reader) error {
+	backend, err := namedStore(store)
+	if err != nil {
+		return err
+	}
+	config.Log.Debug("%sWriting blob '%v' to store '%v'", reqid.Tag(id), id, store)
+	_, err = retried(id, blob, func(body io.Reader) error {
+		return backend.writeBlob(id, body)
+	})
+	return err
+}
+
+// StatBlobAt describes a blob in a named store ("" is the primary store)
+// without reading it
+func StatBlobAt(store, id string) (BlobStat, error) {
+	backend, err := namedStore(store)
+	if err != nil {
+		return BlobStat{}, err
+	}
+	bs, ok := backend.(blobStater)
+	if !ok {
+		return BlobStat{}, ErrNoStat
+	}
+	config.Log.Debug("%sDescribing blob '%v' in store '%v'", reqid.Tag(id), id, store)
+	return bs.statBlob(id)
+}
+
+// ListBlobsAt lists the blobs of a named store ("" is the primary store)
+// whose id starts with prefix, sorted by id
+func ListBlobsAt(store, prefix string) ([]BlobStat, error) {
+	backend, err := namedStore(store)
+	if err != nil {
+		return nil, err
+	}
+	bl, ok := backend.(blobLister)
+	if !ok {
+		return nil, ErrNoList
+	}
+	config.Log.Debug("Listing blobs '%v*' in store '%v'", prefix, store)
+	list, err := bl.listBlobs(prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list, nil
+}
+
+// namedStore returns the backend of a named store
+func namedStore(store string) (blobReadWriter, error) {
+	if store == "" {
+		return backend, nil
+	}
+	if backend, ok := stores[store]; ok {
+		return backend, nil
+	}
+	return nil, fmt.Errorf("%w '%s'", ErrUnknownStore, store)
+}
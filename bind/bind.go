@@ -0,0 +1,41 @@
+// Package "bind" binds the api and ssh servers to their listen addresses,
+// which may be several (comma separated) and IPv4 or IPv6.
+package bind
+
+import (
+	"net"
+	"strings"
+
+	"github.com/mu-box/slurp/systemd"
+)
+
+// Split splits a comma separated list of listen addresses, dropping blanks
+func Split(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Listen binds a tcp listener to a host:port address, adopting the socket if
+// systemd bound it for slurp (socket activation). When it is one of
+// several (many), an IPv6 literal is bound v6-only so "[::]:1567" and
+// "0.0.0.0:1567" can both be listened on, rather than the dual-stack v6
+// socket taking the v4 port too.
+func Listen(addr string, many bool) (net.Listener, error) {
+	if listener := systemd.Listener(addr); listener != nil {
+		return listener, nil
+	}
+
+	network := "tcp"
+	if host, _, err := net.SplitHostPort(addr); err == nil && many {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			network = "tcp6"
+		}
+	}
+	return net.Listen(network, addr)
+}
@@ -0,0 +1,40 @@
+package bind_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mu-box/slurp/bind"
+)
+
+func TestSplit(t *testing.T) {
+	addrs := bind.Split(" [::]:1567, 10.0.0.5:1567,,")
+	if !reflect.DeepEqual(addrs, []string{"[::]:1567", "10.0.0.5:1567"}) {
+		t.Errorf("%q doesn't match expected out", addrs)
+	}
+	if addrs := bind.Split(""); len(addrs) != 0 {
+		t.Errorf("%q doesn't match expected out", addrs)
+	}
+}
+
+func TestListen(t *testing.T) {
+	v4, err := bind.Listen("127.0.0.1:0", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v4.Close()
+
+	// hosts without IPv6 can't test the rest
+	v6, err := bind.Listen("[::1]:0", true)
+	if err != nil {
+		t.Skipf("No IPv6 - %v", err)
+	}
+	defer v6.Close()
+
+	conn, err := net.Dial("tcp", v6.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
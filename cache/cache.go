@@ -0,0 +1,286 @@
+// Package "cache" keeps local copies of blobs read from the backend so
+// repeated downloads (eg. from a read-only replica) don't hit storage.
+// Replicas listed in cache-peers share their caches, fetching blobs from each
+// other before going to storage.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+)
+
+// fillWait is the longest a read waits on another's fill of a blob before
+// fetching the blob itself, uncached
+const fillWait = 10 * time.Second
+
+// ErrNotCached is returned opening a blob without a fresh cached copy
+var ErrNotCached = errors.New("Blob not cached")
+
+// mutex keeps evictions from racing each other
+var mutex = sync.Mutex{}
+
+// blobs being fetched into the cache
+var fills = struct {
+	sync.Mutex
+	ids map[string]*fill
+}{ids: map[string]*fill{}}
+
+// fill is a blob being fetched into the cache
+type fill struct {
+	done chan struct{} // closed once the fill ends
+	peer atomic.Bool   // set while the blob is requested of a peer
+}
+
+// Fetch reads a blob from its source (normally backend.ReadBlob)
+type Fetch func(id string) (io.ReadCloser, error)
+
+// Read returns the blob "id" from the cache, fetching it (and caching it as it
+// is read) on a miss or once the cached copy is older than the cache ttl. A
+// miss is fetched from a peer that has the blob before its source, and reads
+// of a blob being fetched wait for that fetch rather than repeat it (up to
+// fillWait, then fetch it uncached). Caching is disabled when the cache size
+// is 0.
+func Read(id string, fetch Fetch) (io.ReadCloser, error) {
+	return read(id, fetch, true)
+}
+
+// Fill is Read for a peer: a miss is fetched from its source, never from
+// another peer (which may be the one asking), nor does it wait on a fill
+// requesting the blob of a peer (which may be waiting on this replica)
+func Fill(id string, fetch Fetch) (io.ReadCloser, error) {
+	return read(id, fetch, false)
+}
+
+// Open returns the fresh cached copy of a blob, without fetching it
+func Open(id string) (*os.File, error) {
+	info, err := os.Stat(path(id))
+	if err != nil || !fresh(info) {
+		return nil, ErrNotCached
+	}
+	return os.Open(path(id))
+}
+
+func read(id string, fetch Fetch, shared bool) (io.ReadCloser, error) {
+	if config.CacheSize <= 0 {
+		return fetch(id)
+	}
+
+	var claim *fill
+	for {
+		if f, err := Open(id); err == nil {
+			config.Log.Trace("Cache hit for '%v'", id)
+			return f, nil
+		}
+		current, claimed := claimFill(id)
+		if claimed {
+			claim = current
+			break
+		}
+		if !waitFill(current, shared) {
+			config.Log.Debug("Fetching '%v' uncached rather than wait on its fill", id)
+			blob, err := fetch(id)
+			if err == nil {
+				countFetch(false)
+			}
+			return blob, err
+		}
+		// a fill cut short leaves nothing cached, so this read claims the next
+	}
+
+	var blob io.ReadCloser
+	if shared {
+		claim.peer.Store(true)
+		blob = fetchPeer(id)
+		claim.peer.Store(false)
+	}
+	if blob == nil {
+		var err error
+		blob, err = fetch(id)
+		if err != nil {
+			endFill(id, claim)
+			return nil, err
+		}
+		countFetch(false)
+	}
+
+	err := os.MkdirAll(config.CacheDir, 0755)
+	if err != nil {
+		config.Log.Error("Failed to create cache dir - %v", err)
+		endFill(id, claim)
+		return blob, nil
+	}
+
+	tmp, err := os.CreateTemp(config.CacheDir, ".fill-")
+	if err != nil {
+		config.Log.Error("Failed to create cache file - %v", err)
+		endFill(id, claim)
+		return blob, nil
+	}
+
+	return &filler{id: id, fill: claim, blob: blob, tmp: tmp, file: path(id)}, nil
+}
+
+// claimFill marks a blob being fetched into the cache, returning its fill,
+// and whether this read claimed it (rather than found one under way)
+func claimFill(id string) (*fill, bool) {
+	fills.Lock()
+	defer fills.Unlock()
+	if current, ok := fills.ids[id]; ok {
+		return current, false
+	}
+	claim := &fill{done: make(chan struct{})}
+	fills.ids[id] = claim
+	return claim, true
+}
+
+// waitFill waits for another read's fill of a blob, reporting whether it
+// ended within fillWait. A peer's read doesn't wait on a fill requesting the
+// blob of a peer, which may be waiting on this replica's fill in turn.
+func waitFill(current *fill, shared bool) bool {
+	if !shared && current.peer.Load() {
+		return false
+	}
+	timer := time.NewTimer(fillWait)
+	defer timer.Stop()
+	select {
+	case <-current.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// endFill releases the reads waiting on a blob's fill (once, should the fill
+// end twice)
+func endFill(id string, claim *fill) {
+	fills.Lock()
+	defer fills.Unlock()
+	if fills.ids[id] == claim {
+		close(claim.done)
+		delete(fills.ids, id)
+	}
+}
+
+// fresh reports whether a cached copy may still be served
+func fresh(info os.FileInfo) bool {
+	return config.CacheTTL <= 0 || time.Since(info.ModTime()) < config.CacheTTL
+}
+
+// Forget drops the cached copy of a blob (eg. once it is deleted from storage)
+func Forget(id string) {
+	err := os.Remove(path(id))
+	if err != nil && !os.IsNotExist(err) {
+		config.Log.Error("Failed to remove cache file - %v", err)
+	}
+}
+
+// path returns the cache file for a blob
+func path(id string) string {
+	return filepath.Join(config.CacheDir, key(id))
+}
+
+// key names a blob's cache file and its entry in peer adverts (ids are hashed
+// as tree blob ids contain slashes)
+func key(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// filler copies a blob into the cache as it is read. The copy is only kept
+// if the blob is read to the end.
+type filler struct {
+	id   string
+	fill *fill
+	blob io.ReadCloser
+	tmp  *os.File
+	file string
+	done bool
+	fail bool
+}
+
+func (self *filler) Read(p []byte) (int, error) {
+	n, err := self.blob.Read(p)
+	if n > 0 && !self.fail {
+		if _, werr := self.tmp.Write(p[:n]); werr != nil {
+			config.Log.Error("Failed to write cache file - %v", werr)
+			self.fail = true
+		}
+	}
+	if err == io.EOF {
+		self.done = true
+	}
+	return n, err
+}
+
+func (self *filler) Close() error {
+	err := self.blob.Close()
+	self.tmp.Close()
+	defer endFill(self.id, self.fill)
+
+	if !self.done || self.fail {
+		os.Remove(self.tmp.Name())
+		return err
+	}
+
+	if rerr := os.Rename(self.tmp.Name(), self.file); rerr != nil {
+		config.Log.Error("Failed to store cache file - %v", rerr)
+		os.Remove(self.tmp.Name())
+		return err
+	}
+
+	if eerr := evict(); eerr != nil {
+		config.Log.Error("Failed to evict cache files - %v", eerr)
+	}
+	return err
+}
+
+// evict removes the oldest cached blobs until the cache fits in its size
+func evict() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	entries, err := os.ReadDir(config.CacheDir)
+	if err != nil {
+		return fmt.Errorf("Failed to read cache dir - %v", err)
+	}
+
+	var files []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || entry.Name()[0] == '.' {
+			continue
+		}
+		files = append(files, info)
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().Before(files[j].ModTime())
+	})
+
+	limit := int64(config.CacheSize) << 20
+	for _, info := range files {
+		if total <= limit {
+			break
+		}
+		err = os.Remove(filepath.Join(config.CacheDir, info.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		total -= info.Size()
+	}
+
+	return nil
+}
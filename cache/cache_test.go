@@ -0,0 +1,304 @@
+package cache_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/mu-box/slurp/cache"
+	"github.com/mu-box/slurp/config"
+)
+
+func TestMain(m *testing.M) {
+	// clean test dir
+	os.RemoveAll("/tmp/slurpCache")
+
+	initialize()
+
+	rtn := m.Run()
+
+	os.RemoveAll("/tmp/slurpCache")
+
+	os.Exit(rtn)
+}
+
+func TestReadCaches(t *testing.T) {
+	fetch, count := counter("big-build")
+
+	for i := 0; i < 2; i++ {
+		out := read(t, "build1", fetch)
+		if out != "big-build" {
+			t.Errorf("%q doesn't match expected out", out)
+		}
+	}
+
+	if *count != 1 {
+		t.Errorf("Fetched %d times, expected 1", *count)
+	}
+}
+
+func TestPartialReadNotCached(t *testing.T) {
+	fetch, count := counter("big-build")
+
+	blob, err := cache.Read("build2", fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob.Read(make([]byte, 3))
+	blob.Close()
+
+	read(t, "build2", fetch)
+	if *count != 2 {
+		t.Errorf("Fetched %d times, expected 2", *count)
+	}
+}
+
+func TestReadExpires(t *testing.T) {
+	config.CacheTTL = time.Millisecond
+	defer func() { config.CacheTTL = time.Hour }()
+
+	fetch, count := counter("big-build")
+	read(t, "build3", fetch)
+	time.Sleep(5 * time.Millisecond)
+	read(t, "build3", fetch)
+
+	if *count != 2 {
+		t.Errorf("Fetched %d times, expected 2", *count)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	os.RemoveAll(config.CacheDir)
+	config.CacheSize = 1
+	defer func() { config.CacheSize = 1024 }()
+
+	// each blob is over half the cache, so only the newest stays
+	big := strings.Repeat("a", 600<<10)
+	fetch, count := counter(big)
+	read(t, "old", fetch)
+	time.Sleep(10 * time.Millisecond)
+	read(t, "new", fetch)
+	read(t, "new", fetch)
+	read(t, "old", fetch)
+
+	if *count != 3 {
+		t.Errorf("Fetched %d times, expected 3", *count)
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	var count int32
+	fetch := func(id string) (io.ReadCloser, error) {
+		atomic.AddInt32(&count, 1)
+		time.Sleep(50 * time.Millisecond)
+		return ioutil.NopCloser(strings.NewReader("big-build")), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if out := read(t, "build4", fetch); out != "big-build" {
+				t.Errorf("%q doesn't match expected out", out)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if count != 1 {
+		t.Errorf("Fetched %d times, expected 1", count)
+	}
+}
+
+func TestPeers(t *testing.T) {
+	// peer "a" has "shared" cached, peer "b" has nothing but fills misses
+	var filled []string
+	peer := func(node string, blobs ...string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("X-AUTH-TOKEN") != config.ApiToken {
+				rw.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			id := strings.TrimPrefix(req.URL.Path, cache.BlobPath)
+			switch {
+			case req.URL.Path == cache.AdvertPath:
+				keys := []string{}
+				for _, blob := range blobs {
+					keys = append(keys, hash(blob))
+				}
+				json.NewEncoder(rw).Encode(cache.Advert{Node: node, Blobs: keys})
+			case req.URL.Query().Get("fill") == "true":
+				filled = append(filled, id)
+				rw.Write([]byte("filled-by-" + node))
+			case len(blobs) > 0 && id == blobs[0]:
+				rw.Write([]byte("cached-by-" + node))
+			default:
+				rw.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	}
+	a, b := peer("a", "shared"), peer("b")
+	defer a.Close()
+	defer b.Close()
+	// peer "c" has "contended" cached but holds it back, as if it were
+	// waiting on this replica's fill in turn
+	asked, release := make(chan struct{}), make(chan struct{})
+	c := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == cache.AdvertPath {
+			json.NewEncoder(rw).Encode(cache.Advert{Node: "c", Blobs: []string{hash("contended")}})
+			return
+		}
+		close(asked)
+		<-release
+		rw.Write([]byte("cached-by-c"))
+	}))
+	defer c.Close()
+
+	config.CachePeers, config.PeerEvery = []string{a.URL, b.URL, c.URL}, time.Hour
+	defer func() { config.CachePeers = []string{} }()
+	cache.StartPeers()
+	polled := func() bool {
+		for _, peer := range cache.Peers().Peers {
+			if peer.Node == "" {
+				return false
+			}
+		}
+		return len(cache.Peers().Peers) == 3
+	}
+	for i := 0; !polled(); i++ {
+		if i > 100 {
+			t.Fatalf("Peers weren't polled - %+v", cache.Peers())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fetch, count := counter("from-storage")
+	if out := read(t, "shared", fetch); out != "cached-by-a" {
+		t.Errorf("Expected blob from peer a, got %q", out)
+	}
+
+	// find blobs whose home is b, and this replica
+	self := cache.Peers().Node
+	var homeB, homeSelf string
+	for i := 0; homeB == "" || homeSelf == ""; i++ {
+		id := fmt.Sprintf("blob-%d", i)
+		switch home(id, self, "a", "b", "c") {
+		case "b":
+			homeB = id
+		case self:
+			homeSelf = id
+		}
+	}
+	if out := read(t, homeB, fetch); out != "filled-by-b" || len(filled) != 1 || filled[0] != homeB {
+		t.Errorf("Expected blob filled by its home peer, got %q (filled %v)", out, filled)
+	}
+	if out := read(t, homeSelf, fetch); out != "from-storage" || *count != 1 {
+		t.Errorf("Expected blob from storage, got %q (fetched %d times)", out, *count)
+	}
+	if status := cache.Peers(); status.Peer != 2 {
+		t.Errorf("Expected 2 blobs from peers, got %+v", status)
+	}
+
+	// blobs fetched from peers are cached and advertised like any other
+	advert := cache.Advertise()
+	for _, id := range []string{"shared", homeB, homeSelf} {
+		found := false
+		for _, key := range advert.Blobs {
+			found = found || key == hash(id)
+		}
+		if !found {
+			t.Errorf("Expected '%s' advertised", id)
+		}
+	}
+
+	// a peer's fill doesn't wait on a read requesting the blob of a peer
+	shared := make(chan string)
+	go func() {
+		shared <- read(t, "contended", fetch)
+	}()
+	select {
+	case <-asked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Peer c wasn't asked for the blob")
+	}
+	start := time.Now()
+	blob, err := cache.Fill("contended", fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ := ioutil.ReadAll(blob)
+	blob.Close()
+	if string(out) != "from-storage" || *count != 2 || time.Since(start) > time.Second {
+		t.Errorf("Expected fill from storage without waiting, got %q (fetched %d times in %v)", out, *count, time.Since(start))
+	}
+	close(release)
+	if out := <-shared; out != "cached-by-c" {
+		t.Errorf("Expected blob from peer c, got %q", out)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// PRIVS
+////////////////////////////////////////////////////////////////////////////////
+
+// manually configure internals
+func initialize() {
+	config.LogLevel = "fatal"
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt(config.LogLevel))
+	config.CacheDir = "/tmp/slurpCache"
+}
+
+// hash is a blob's key in adverts
+func hash(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// home returns the node a blob's id ranks highest with
+func home(id string, nodes ...string) string {
+	var best, bestScore string
+	for _, node := range nodes {
+		if score := hash(node + "/" + id); score > bestScore {
+			best, bestScore = node, score
+		}
+	}
+	return best
+}
+
+// counter returns a fetch serving body that counts its calls
+func counter(body string) (cache.Fetch, *int) {
+	count := 0
+	return func(id string) (io.ReadCloser, error) {
+		count++
+		return ioutil.NopCloser(strings.NewReader(body)), nil
+	}, &count
+}
+
+// read reads a whole blob through the cache
+func read(t *testing.T, id string, fetch cache.Fetch) string {
+	blob, err := cache.Read(id, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+
+	b, err := ioutil.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
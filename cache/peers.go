@@ -0,0 +1,301 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+)
+
+const (
+	peerPoll = 10 * time.Second // longest a peer may take to send its advert
+	peerWait = 30 * time.Second // longest a peer may take to start sending a blob (it may wait out fillWait, then storage)
+)
+
+// AdvertPath is where replicas serve their adverts, and BlobPath where they
+// serve their cached blobs, to peers
+const (
+	AdvertPath = "/cache"
+	BlobPath   = "/cache/blobs/"
+)
+
+// Advert is what a replica tells its peers it has cached
+type Advert struct {
+	Node  string   `json:"node"`  // id the replica picked at startup
+	Blobs []string `json:"blobs"` // keys of its fresh cached blobs (sha256 of their ids)
+}
+
+// Peer is a replica listed in cache-peers, as it was last polled
+type Peer struct {
+	Uri    string    `json:"uri"`
+	Node   string    `json:"node,omitempty"`
+	Blobs  int       `json:"blobs"`           // blobs it advertised
+	Polled time.Time `json:"polled"`          // when it was last polled
+	Error  string    `json:"error,omitempty"` // why the last poll failed (it isn't asked for blobs until one succeeds)
+	keys   map[string]bool
+}
+
+// PeerStatus is how the replica's cache misses were filled
+type PeerStatus struct {
+	Node   string `json:"node"`
+	Peers  []Peer `json:"peers"`
+	Peer   int64  `json:"peer"`   // blobs fetched from peers
+	Source int64  `json:"source"` // blobs fetched from storage
+}
+
+// node identifies this replica to its peers (and itself, if it is listed in
+// its own cache-peers)
+var node = newNode()
+
+// the peers as last polled, guarded by their lock
+var peers = struct {
+	sync.Mutex
+	known  map[string]*Peer // by uri
+	peer   int64
+	source int64
+}{known: map[string]*Peer{}}
+
+// peerClient reaches peers' apis, whose certificates are generated at startup
+var peerClient = &http.Client{Transport: &http.Transport{
+	DialContext:           (&net.Dialer{Timeout: 5 * time.Second}).DialContext,
+	TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+	TLSHandshakeTimeout:   5 * time.Second,
+	ResponseHeaderTimeout: peerWait,
+}}
+
+// StartPeers polls the replicas in cache-peers for the blobs they have cached
+// every cache-gossip
+func StartPeers() {
+	if len(config.CachePeers) == 0 {
+		return
+	}
+	config.Log.Info("Sharing the blob cache with %d peers as '%v'", len(config.CachePeers), node)
+	go func() {
+		for {
+			pollPeers()
+			time.Sleep(config.PeerEvery)
+		}
+	}()
+}
+
+// Advertise lists the fresh blobs in the cache, for peers
+func Advertise() Advert {
+	advert := Advert{Node: node, Blobs: []string{}}
+	entries, err := os.ReadDir(config.CacheDir)
+	if err != nil {
+		return advert
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() || entry.Name()[0] == '.' || !fresh(info) {
+			continue
+		}
+		advert.Blobs = append(advert.Blobs, entry.Name())
+	}
+	return advert
+}
+
+// Peers returns the peers as last polled, and how many misses each source
+// filled
+func Peers() PeerStatus {
+	peers.Lock()
+	defer peers.Unlock()
+	status := PeerStatus{Node: node, Peers: []Peer{}, Peer: peers.peer, Source: peers.source}
+	for _, peer := range peers.known {
+		status.Peers = append(status.Peers, *peer)
+	}
+	sort.Slice(status.Peers, func(i, j int) bool {
+		return status.Peers[i].Uri < status.Peers[j].Uri
+	})
+	return status
+}
+
+// pollPeers fetches every peer's advert at once
+func pollPeers() {
+	var wg sync.WaitGroup
+	for _, uri := range config.CachePeers {
+		wg.Add(1)
+		go func(uri string) {
+			defer wg.Done()
+			pollPeer(strings.TrimSuffix(uri, "/"))
+		}(uri)
+	}
+	wg.Wait()
+}
+
+// pollPeer fetches a peer's advert, dropping this replica from its own peers
+func pollPeer(uri string) {
+	advert, err := getAdvert(uri)
+
+	peers.Lock()
+	defer peers.Unlock()
+	if err == nil && advert.Node == node {
+		delete(peers.known, uri)
+		return
+	}
+	peer, ok := peers.known[uri]
+	if !ok {
+		peer = &Peer{Uri: uri}
+		peers.known[uri] = peer
+	}
+	peer.Polled = time.Now().UTC()
+	if err != nil {
+		if peer.Error == "" {
+			config.Log.Warn("Failed to poll cache peer '%v' - %v", uri, err)
+		}
+		peer.Error, peer.Blobs, peer.keys = err.Error(), 0, nil
+		return
+	}
+	if peer.Error != "" {
+		config.Log.Info("Cache peer '%v' is back", uri)
+	}
+	peer.Node, peer.Error, peer.Blobs = advert.Node, "", len(advert.Blobs)
+	peer.keys = make(map[string]bool, len(advert.Blobs))
+	for _, key := range advert.Blobs {
+		peer.keys[key] = true
+	}
+}
+
+// getAdvert requests a peer's advert
+func getAdvert(uri string) (Advert, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), peerPoll)
+	defer cancel()
+
+	var advert Advert
+	res, err := peerGet(ctx, uri+AdvertPath)
+	if err != nil {
+		return advert, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return advert, fmt.Errorf("Unexpected status '%d'", res.StatusCode)
+	}
+	err = json.NewDecoder(res.Body).Decode(&advert)
+	if err != nil {
+		return advert, fmt.Errorf("Bad advert - %v", err)
+	}
+	return advert, nil
+}
+
+// fetchPeer reads a blob from a peer: one that advertised having it cached,
+// else the blob's home peer, which fetches it from storage once for the
+// whole fleet. It returns nil if no peer served it.
+func fetchPeer(id string) io.ReadCloser {
+	holders, home := peersFor(id)
+	for _, uri := range holders {
+		if blob := getBlob(uri, id, false); blob != nil {
+			return blob
+		}
+		if uri == home {
+			home = ""
+		}
+	}
+	if home != "" {
+		return getBlob(home, id, true)
+	}
+	return nil
+}
+
+// peersFor returns the live peers that advertised a blob (in random order, to
+// spread the load), and its home peer: the live peer (or this replica, then
+// empty) the blob's id hashes highest with, which every replica seeing the
+// same peers agrees on
+func peersFor(id string) ([]string, string) {
+	peers.Lock()
+	defer peers.Unlock()
+
+	var holders []string
+	home, best := "", score(node, id)
+	for uri, peer := range peers.known {
+		if peer.Error != "" || peer.Node == "" {
+			continue
+		}
+		if peer.keys[key(id)] {
+			holders = append(holders, uri)
+		}
+		if s := score(peer.Node, id); s > best {
+			home, best = uri, s
+		}
+	}
+	mrand.Shuffle(len(holders), func(i, j int) {
+		holders[i], holders[j] = holders[j], holders[i]
+	})
+	return holders, home
+}
+
+// score ranks a replica for a blob's home
+func score(node, id string) string {
+	sum := sha256.Sum256([]byte(node + "/" + id))
+	return hex.EncodeToString(sum[:])
+}
+
+// getBlob requests a blob from a peer: its cached copy, or with fill, the
+// copy it fetches from storage on a miss. It returns nil if the peer didn't
+// send it.
+func getBlob(uri, id string, fill bool) io.ReadCloser {
+	segments := strings.Split(id, "/")
+	for i := range segments {
+		segments[i] = url.PathEscape(segments[i])
+	}
+	target := uri + BlobPath + strings.Join(segments, "/")
+	if fill {
+		target += "?fill=true"
+	}
+
+	res, err := peerGet(context.Background(), target)
+	if err != nil {
+		config.Log.Debug("Failed to fetch '%v' from cache peer '%v' - %v", id, uri, err)
+		return nil
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		config.Log.Debug("Cache peer '%v' didn't send '%v' - status '%d'", uri, id, res.StatusCode)
+		return nil
+	}
+	config.Log.Trace("Fetching '%v' from cache peer '%v'", id, uri)
+	countFetch(true)
+	return res.Body
+}
+
+// peerGet makes a request of a peer's api (replicas share their api token)
+func peerGet(ctx context.Context, target string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-AUTH-TOKEN", config.Get(&config.ApiToken))
+	return peerClient.Do(req)
+}
+
+// countFetch counts a miss filled from a peer or from storage
+func countFetch(peer bool) {
+	peers.Lock()
+	defer peers.Unlock()
+	if peer {
+		peers.peer++
+	} else {
+		peers.source++
+	}
+}
+
+// newNode picks a random id for this replica
+func newNode() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,350 @@
+// Package "client" is a go client of the slurp api, for orchestrators that
+// stage, commit, and watch builds without hand rolling its http requests.
+//
+//	c := client.New("https://slurp:1566", token)
+//	secret, err := c.AddStage(ctx, "def456", client.StageOptions{From: "abc123"})
+//	// rsync the build to secret@slurp:def456
+//	err = c.Commit(ctx, "def456", client.CommitOptions{})
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// headers the api reads and writes
+const (
+	authHeader    = "X-AUTH-TOKEN"
+	ownerHeader   = "X-STAGE-OWNER"
+	requestHeader = "X-Request-Id"
+)
+
+// Errors an api Error matches (with errors.Is), by its status
+var (
+	ErrUnauthorized = errors.New("Unauthorized")        // 401, a bad api token
+	ErrForbidden    = errors.New("Forbidden")           // 403, eg a stage owned by another credential
+	ErrNotFound     = errors.New("Not found")           // 404, eg a build that isn't staged
+	ErrConflict     = errors.New("Conflict")            // 409, eg a commit while rsync is running
+	ErrUnavailable  = errors.New("Service unavailable") // 503, eg a full build dir
+)
+
+// Error is an error response from the api
+type Error struct {
+	Status    int    // http status code
+	Message   string // error slurp reported
+	RequestId string // id of the request, tagging slurp's log lines about it
+}
+
+func (self *Error) Error() string {
+	msg := self.Message
+	if msg == "" {
+		msg = http.StatusText(self.Status)
+	}
+	return fmt.Sprintf("slurp: %s (status %d, request %s)", msg, self.Status, self.RequestId)
+}
+
+// Is matches the error for its status, eg ErrNotFound for a 404
+func (self *Error) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return self.Status == http.StatusUnauthorized
+	case ErrForbidden:
+		return self.Status == http.StatusForbidden
+	case ErrNotFound:
+		return self.Status == http.StatusNotFound
+	case ErrConflict:
+		return self.Status == http.StatusConflict
+	case ErrUnavailable:
+		return self.Status == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// Client makes requests to a slurp's api
+type Client struct {
+	Addr  string       // api address, eg "https://slurp:1566"
+	Token string       // api token
+	HTTP  *http.Client // client requests are made with (http.DefaultClient if nil), eg to trust slurp's certificate
+}
+
+// New creates a client of the slurp api at addr
+func New(addr, token string) *Client {
+	return &Client{Addr: strings.TrimSuffix(addr, "/"), Token: token}
+}
+
+// Stage is a staged build
+type Stage struct {
+	Id       string    `json:"id"`                 // build id (also the ssh user)
+	Template string    `json:"template,omitempty"` // stage template in use
+	Created  time.Time `json:"created"`            // when the stage was added
+	Expires  time.Time `json:"expires,omitempty"`  // when it expires uncommitted (zero never)
+
+	Base   string `json:"base,omitempty"`   // build the stage was seeded from
+	Format string `json:"format,omitempty"` // archive format to commit with
+	State  string `json:"state"`            // staged, queued, committing, or committed
+	Queue  int    `json:"queue,omitempty"`  // place in the upload queue while queued (1 is next)
+
+	Metadata map[string]string `json:"metadata,omitempty"` // labels
+	Notes    string            `json:"notes,omitempty"`    // release notes
+
+	Owner    string    `json:"owner,omitempty"`    // fingerprint of the credential owning the stage
+	Handoffs []Handoff `json:"handoffs,omitempty"` // owner changes, oldest first
+
+	Node string `json:"node,omitempty"` // cluster node the stage is on (set listing a cluster's stages)
+}
+
+// Handoff is a change of a stage's owner
+type Handoff struct {
+	From      string    `json:"from"` // fingerprints of the credentials
+	To        string    `json:"to"`
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"request-id,omitempty"`
+}
+
+// Stats is what was published to a build, kept after its stage is cleaned up
+type Stats struct {
+	Build     string    `json:"build"`
+	Sessions  int       `json:"sessions"`  // rsync sessions synced to it (resumed ones count once)
+	Files     int       `json:"files"`     // files written by them
+	Synced    int64     `json:"synced"`    // bytes written by them
+	Staged    int64     `json:"staged"`    // size of the staged files, as of its last commit once committed
+	Commits   int       `json:"commits"`   // successful commits
+	Committed int64     `json:"committed"` // bytes of the blobs its commits wrote
+	Updated   time.Time `json:"updated"`   // when they last changed
+}
+
+// Usage is how close a stage is to its limits, to prune what is uploaded
+// before a sync or commit fails on one
+type Usage struct {
+	Build     string    `json:"build"`
+	State     string    `json:"state"`
+	Files     int       `json:"files"`             // files in the staging dir
+	Bytes     int64     `json:"bytes"`             // their size
+	Quota     int64     `json:"quota"`             // bytes the stage may hold to be committed (0 unlimited)
+	Remaining int64     `json:"remaining"`         // bytes left under the quota (-1 unlimited)
+	Expires   time.Time `json:"expires,omitempty"` // when it expires uncommitted (zero never)
+	TTL       string    `json:"ttl,omitempty"`     // time left until then
+	Pressure  *struct {
+		Used   float64 `json:"used"`
+		Factor float64 `json:"factor"`
+	} `json:"pressure,omitempty"` // disk pressure tier shortening its ttl
+	Sessions  int  `json:"sessions"`  // rsync sessions running
+	BwLimit   int  `json:"bwlimit"`   // KB/s each session is limited to (0 unlimited)
+	Throttled bool `json:"throttled"` // whether sessions are bandwidth limited
+	Disk      *struct {
+		Total     uint64  `json:"total"`
+		Free      uint64  `json:"free"`
+		Used      uint64  `json:"used"`
+		Percent   float64 `json:"percent"`
+		Watermark float64 `json:"watermark"`
+		Accepting bool    `json:"accepting"`
+	} `json:"disk,omitempty"` // usage of the build dir's filesystem
+}
+
+// Capabilities is what a slurp supports, to negotiate the best path both the
+// client and it know
+type Capabilities struct {
+	Release    string   `json:"release"`    // slurp's version (empty for dev builds)
+	Api        int      `json:"api"`        // api version
+	Mode       string   `json:"mode"`       // all, api, ssh, or read-only
+	Transfers  []string `json:"transfers"`  // rsync, and resume if resumption tokens are issued
+	Formats    []string `json:"formats"`    // archive formats commits can write
+	Outputs    []string `json:"outputs"`    // commit outputs
+	Splits     []string `json:"splits"`     // split rules of archive commits
+	Digests    []string `json:"digests"`    // checksums of blobs, files, and manifests
+	Signatures []string `json:"signatures"` // algorithms builds and receipts are signed with
+	Features   []string `json:"features"`   // optional features enabled
+	Limits     struct {
+		StageTTL      string `json:"stage-ttl"`
+		ResumeWindow  string `json:"resume-window"`
+		RsyncBwLimit  int    `json:"rsync-bwlimit"`
+		RsyncTimeout  int    `json:"rsync-timeout"`
+		RsyncDeadline string `json:"rsync-deadline"`
+		SplitSize     int    `json:"split-size"`
+		PreviewSize   int    `json:"preview-size"`
+		CommitLimit   int    `json:"commit-limit"`
+	} `json:"limits"` // limits of stages without a template
+}
+
+// Supports reports whether a capability (eg a format like "tar.zst", or a
+// feature like "signing") is listed
+func (self Capabilities) Supports(name string) bool {
+	for _, list := range [][]string{self.Transfers, self.Formats, self.Outputs, self.Splits, self.Digests, self.Signatures, self.Features} {
+		for _, entry := range list {
+			if entry == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// StageOptions are the optional settings of a new stage
+type StageOptions struct {
+	From     string            // committed build to seed the stage with
+	Template string            // stage template to use
+	Format   string            // archive format to commit with
+	TTL      time.Duration     // time the stage may live uncommitted (0 uses the template's, then slurp's)
+	Metadata map[string]string // labels for the stage
+	Notes    string            // release notes to commit the build with
+	Owner    string            // credential the stage's commit, delete... must carry
+}
+
+// CommitOptions are the optional settings of a commit
+type CommitOptions struct {
+	Notes *string // replaces the stage's release notes if set
+	Owner string  // credential owning the stage, if it is owned
+}
+
+// AddStage stages a new build, returning the secret to rsync it with (as the
+// ssh user)
+func (self *Client) AddStage(ctx context.Context, id string, opts StageOptions) (string, error) {
+	body := map[string]interface{}{"new-id": id}
+	for key, value := range map[string]string{"from": opts.From, "template": opts.Template, "format": opts.Format, "notes": opts.Notes, "owner": opts.Owner} {
+		if value != "" {
+			body[key] = value
+		}
+	}
+	if opts.TTL > 0 {
+		body["ttl"] = opts.TTL.String()
+	}
+	if len(opts.Metadata) > 0 {
+		body["metadata"] = opts.Metadata
+	}
+
+	var auth struct {
+		Secret string `json:"secret"`
+	}
+	// restaging an owned stage takes its owner's credential
+	err := self.do(ctx, "POST", "/stages", body, opts.Owner, &auth)
+	return auth.Secret, err
+}
+
+// Commit commits a staged build to storage, returning once it is committed
+func (self *Client) Commit(ctx context.Context, id string, opts CommitOptions) error {
+	var body interface{}
+	if opts.Notes != nil {
+		body = map[string]string{"notes": *opts.Notes}
+	}
+	return self.do(ctx, "PUT", stagePath(id), body, opts.Owner, nil)
+}
+
+// Delete deletes a staged build without committing it. owner is the
+// credential owning the stage, if it is owned.
+func (self *Client) Delete(ctx context.Context, id, owner string) error {
+	return self.do(ctx, "DELETE", stagePath(id), nil, owner, nil)
+}
+
+// GetStage returns a staged build
+func (self *Client) GetStage(ctx context.Context, id string) (Stage, error) {
+	var stage Stage
+	err := self.do(ctx, "GET", stagePath(id), nil, "", &stage)
+	return stage, err
+}
+
+// GetStats returns what was published to a build
+func (self *Client) GetStats(ctx context.Context, id string) (Stats, error) {
+	var stats Stats
+	err := self.do(ctx, "GET", stagePath(id)+"/stats", nil, "", &stats)
+	return stats, err
+}
+
+// GetUsage returns how close a stage is to its quota, ttl, and bandwidth
+// limits
+func (self *Client) GetUsage(ctx context.Context, id string) (Usage, error) {
+	var usage Usage
+	err := self.do(ctx, "GET", stagePath(id)+"/usage", nil, "", &usage)
+	return usage, err
+}
+
+// GetCapabilities returns what slurp supports
+func (self *Client) GetCapabilities(ctx context.Context) (Capabilities, error) {
+	var caps Capabilities
+	err := self.do(ctx, "GET", "/capabilities", nil, "", &caps)
+	return caps, err
+}
+
+// ListStages returns the uncommitted stages (of the whole cluster, when slurp
+// runs as one)
+func (self *Client) ListStages(ctx context.Context) ([]Stage, error) {
+	var stages []Stage
+	err := self.do(ctx, "GET", "/stages", nil, "", &stages)
+	return stages, err
+}
+
+// stagePath returns the api path of a stage
+func stagePath(id string) string {
+	return "/stages/" + url.PathEscape(id)
+}
+
+// do makes an api request with a json body (if body isn't nil), decoding the
+// json response into out (if it isn't nil)
+func (self *Client) do(ctx context.Context, method, path string, body interface{}, owner string, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	res, err := self.request(ctx, method, path, reader, owner)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	err = json.NewDecoder(res.Body).Decode(out)
+	if err != nil {
+		return fmt.Errorf("Failed to parse response - %v", err)
+	}
+	return nil
+}
+
+// request makes an api request, turning an error status into an Error
+func (self *Client) request(ctx context.Context, method, path string, body io.Reader, owner string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, self.Addr+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(authHeader, self.Token)
+	if owner != "" {
+		req.Header.Set(ownerHeader, owner)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := self.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		apiErr := &Error{Status: res.StatusCode, RequestId: res.Header.Get(requestHeader)}
+		var msg struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(io.LimitReader(res.Body, 1<<16)).Decode(&msg) == nil {
+			apiErr.Message = msg.Error
+		}
+		return nil, apiErr
+	}
+	return res, nil
+}
@@ -0,0 +1,118 @@
+package client_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/mu-box/slurp/client"
+)
+
+// fakeSlurp answers the stage api as slurp would, for one owned stage
+func fakeSlurp(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stages", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			var body map[string]interface{}
+			json.NewDecoder(req.Body).Decode(&body)
+			if body["new-id"] != "def456" || body["from"] != "abc123" || body["ttl"] != "1h0m0s" {
+				t.Errorf("%v doesn't match expected body", body)
+			}
+			fmt.Fprintln(rw, `{"secret":"def456"}`)
+			return
+		}
+		fmt.Fprintln(rw, `[{"id":"def456","state":"staged","created":"2016-07-26T12:00:00Z"}]`)
+	})
+	mux.HandleFunc("/stages/def456", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-STAGE-OWNER") != "ci" {
+			rw.Header().Set("X-Request-Id", "f00")
+			rw.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(rw, `{"error":"Stage is owned by another credential"}`)
+			return
+		}
+		fmt.Fprintln(rw, `{"msg":"Success"}`)
+	})
+	mux.HandleFunc("/capabilities", func(rw http.ResponseWriter, req *http.Request) {
+		fmt.Fprintln(rw, `{"api":1,"formats":["tar.gz","tar.zst"],"features":["signing"],"limits":{"stage-ttl":"24h0m0s"}}`)
+	})
+	mux.HandleFunc("/events", func(rw http.ResponseWriter, req *http.Request) {
+		if events := req.URL.Query()["event"]; len(events) != 1 || events[0] != "stage.*" {
+			t.Errorf("%q doesn't match expected events", events)
+		}
+		rw.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(rw, ": keepalive\n\n")
+		fmt.Fprint(rw, "event: stage.added\ndata: {\"event\":\"stage.added\",\"build\":\"def456\"}\n\n")
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestStages(t *testing.T) {
+	server := fakeSlurp(t)
+	defer server.Close()
+	c := client.New(server.URL, "secret")
+	ctx := context.Background()
+
+	secret, err := c.AddStage(ctx, "def456", client.StageOptions{From: "abc123", TTL: time.Hour})
+	if err != nil || secret != "def456" {
+		t.Fatalf("Failed to add stage - %q, %v", secret, err)
+	}
+
+	stages, err := c.ListStages(ctx)
+	if err != nil || len(stages) != 1 || stages[0].Id != "def456" || stages[0].State != "staged" {
+		t.Errorf("Unexpected stages - %+v, %v", stages, err)
+	}
+
+	err = c.Commit(ctx, "def456", client.CommitOptions{})
+	var apiErr *client.Error
+	if !errors.Is(err, client.ErrForbidden) || !errors.As(err, &apiErr) || apiErr.RequestId != "f00" || apiErr.Message != "Stage is owned by another credential" {
+		t.Errorf("Expected a forbidden error, got %v", err)
+	}
+	if errors.Is(err, client.ErrNotFound) {
+		t.Error("Expected a forbidden error not to be not found")
+	}
+
+	err = c.Commit(ctx, "def456", client.CommitOptions{Owner: "ci"})
+	if err != nil {
+		t.Errorf("Failed to commit - %v", err)
+	}
+	err = c.Delete(ctx, "def456", "ci")
+	if err != nil {
+		t.Errorf("Failed to delete - %v", err)
+	}
+}
+
+func TestWatchEvents(t *testing.T) {
+	server := fakeSlurp(t)
+	defer server.Close()
+	c := client.New(server.URL, "secret")
+
+	var events []client.Event
+	err := c.WatchEvents(context.Background(), func(event client.Event) {
+		events = append(events, event)
+	}, "stage.*")
+	if err == nil {
+		t.Error("Expected an error once the stream ends")
+	}
+	if len(events) != 1 || events[0].Event != "stage.added" || events[0].Build != "def456" {
+		t.Errorf("%+v doesn't match expected events", events)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	server := fakeSlurp(t)
+	defer server.Close()
+	c := client.New(server.URL, "secret")
+
+	caps, err := c.GetCapabilities(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if caps.Api != 1 || caps.Limits.StageTTL != "24h0m0s" || !caps.Supports("tar.zst") || !caps.Supports("signing") || caps.Supports("squashfs") {
+		t.Errorf("Unexpected capabilities - %+v", caps)
+	}
+}
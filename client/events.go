@@ -0,0 +1,74 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Event is a stage lifecycle event (or alert), as webhooks are sent them
+type Event struct {
+	Event     string          `json:"event"`                // event name, eg "stage.committed"
+	Build     string          `json:"build"`                // build id the event is for
+	RequestId string          `json:"request-id,omitempty"` // api request that triggered the event
+	TraceId   string          `json:"trace-id,omitempty"`   // trace the event is part of
+	Time      time.Time       `json:"time"`                 // when the event happened
+	Data      json.RawMessage `json:"data,omitempty"`       // event specific details
+}
+
+// WatchEvents streams slurp's events to handle as they happen, until ctx is
+// done (returning its error) or the stream fails. events filters them by
+// name, as a webhook's events do (eg "stage.*"); none watches every event.
+// Events happening while the client isn't connected are missed.
+func (self *Client) WatchEvents(ctx context.Context, handle func(Event), events ...string) error {
+	path := "/events"
+	if len(events) > 0 {
+		path += "?" + url.Values{"event": events}.Encode()
+	}
+	res, err := self.request(ctx, "GET", path, nil, "")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	err = readEvents(res.Body, handle)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("Event stream ended - %v", err)
+}
+
+// readEvents reads server-sent events, passing each one's data to handle
+func readEvents(stream io.Reader, handle func(Event)) error {
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 64<<10), 16<<20)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// a blank line ends an event
+			if data.Len() > 0 {
+				var event Event
+				if err := json.Unmarshal([]byte(data.String()), &event); err == nil {
+					handle(event)
+				}
+				data.Reset()
+			}
+		case strings.HasPrefix(line, "data:"):
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,79 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ConfigFormats are the config file formats slurp reads, with the same keys
+var ConfigFormats = []string{"json", "toml", "yaml"}
+
+var (
+	tomlLine = regexp.MustCompile(`^(\[.+\]|[\w."-]+\s*=)`) // a table header or key = value
+	yamlLine = regexp.MustCompile(`^(- |[\w"-]+\s*:)`)      // a list item or key: value
+)
+
+// configFormat returns the format of the config file: config-format if set,
+// else from the file's extension, else detected from its contents
+func configFormat() (string, error) {
+	if ConfigFmt != "" {
+		format := strings.ToLower(ConfigFmt)
+		if format == "yml" {
+			format = "yaml"
+		}
+		for _, known := range ConfigFormats {
+			if format == known {
+				return format, nil
+			}
+		}
+		return "", fmt.Errorf("Unknown config format '%s' [%s]", ConfigFmt, strings.Join(ConfigFormats, "|"))
+	}
+
+	if format := FormatOf(ConfigFile); format != "" {
+		return format, nil
+	}
+
+	b, err := ioutil.ReadFile(ConfigFile)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read config file - %v", err)
+	}
+	return sniffFormat(string(b)), nil
+}
+
+// FormatOf returns the config format a file's extension names, or "" if it
+// names none
+func FormatOf(file string) string {
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".json":
+		return "json"
+	case ".toml":
+		return "toml"
+	case ".yaml", ".yml":
+		return "yaml"
+	}
+	return ""
+}
+
+// sniffFormat guesses the format of a config from its first setting,
+// defaulting to yaml
+func sniffFormat(content string) string {
+	if strings.HasPrefix(strings.TrimSpace(content), "{") {
+		return "json"
+	}
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if tomlLine.MatchString(line) {
+			return "toml"
+		}
+		if yamlLine.MatchString(line) {
+			return "yaml"
+		}
+	}
+	return "yaml"
+}
@@ -0,0 +1,158 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// client used to talk to Vault
+var vaultClient = &http.Client{Timeout: 10 * time.Second}
+
+// LoadSecrets replaces the api and storage tokens with the ones in their
+// token files or Vault, where set, so they needn't be in the config file
+func LoadSecrets() error {
+	apiToken, storeToken, err := readSecrets()
+	if err != nil {
+		return err
+	}
+	reloadLock.Lock()
+	if apiToken != "" {
+		ApiToken = apiToken
+	}
+	if storeToken != "" {
+		StoreToken = storeToken
+	}
+	reloadLock.Unlock()
+	return nil
+}
+
+// RefreshSecrets renews the Vault token, so it doesn't expire while slurp
+// runs, and re-reads the tokens from Vault (and the token files)
+func RefreshSecrets() error {
+	err := renewVault()
+	if err != nil {
+		Log.Error("Failed to renew Vault token - %v", err)
+	}
+	return LoadSecrets()
+}
+
+// readSecrets reads the api and storage tokens from their token files, then
+// Vault (which wins). Tokens with no source set are returned empty.
+func readSecrets() (apiToken, storeToken string, err error) {
+	if ApiTokFile != "" {
+		apiToken, err = readSecretFile(ApiTokFile)
+		if err != nil {
+			return "", "", fmt.Errorf("Failed to read api token file - %v", err)
+		}
+	}
+	if StoreTFile != "" {
+		storeToken, err = readSecretFile(StoreTFile)
+		if err != nil {
+			return "", "", fmt.Errorf("Failed to read store token file - %v", err)
+		}
+	}
+
+	if VaultAddr == "" {
+		return apiToken, storeToken, nil
+	}
+	secret, err := readVault()
+	if err != nil {
+		return "", "", fmt.Errorf("Failed to read secrets from Vault - %v", err)
+	}
+	if token, ok := secret["api-token"].(string); ok && token != "" {
+		apiToken = token
+	}
+	if token, ok := secret["store-token"].(string); ok && token != "" {
+		storeToken = token
+	}
+	return apiToken, storeToken, nil
+}
+
+// readSecretFile reads a secret from a file, dropping surrounding whitespace
+// (eg. the trailing newline of a mounted secret)
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	secret := strings.TrimSpace(string(b))
+	if secret == "" {
+		return "", fmt.Errorf("'%s' is empty", path)
+	}
+	return secret, nil
+}
+
+// vaultToken returns the token slurp authenticates to Vault with
+func vaultToken() (string, error) {
+	if VaultTFile != "" {
+		return readSecretFile(VaultTFile)
+	}
+	if token := os.Getenv("VAULT_TOKEN"); token != "" {
+		return token, nil
+	}
+	return "", fmt.Errorf("No Vault token, set vault-token-file or $VAULT_TOKEN")
+}
+
+// readVault reads the data of the secret at vault-path, unwrapping kv v2
+// secrets
+func readVault() (map[string]interface{}, error) {
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	err := vaultRequest("GET", "/v1/"+strings.TrimPrefix(VaultPath, "/"), &body)
+	if err != nil {
+		return nil, err
+	}
+
+	// kv v2 nests the secret with its metadata
+	if data, ok := body.Data["data"].(map[string]interface{}); ok && body.Data["metadata"] != nil {
+		return data, nil
+	}
+	return body.Data, nil
+}
+
+// renewVault extends the lease of slurp's Vault token
+func renewVault() error {
+	return vaultRequest("POST", "/v1/auth/token/renew-self", nil)
+}
+
+// vaultRequest calls the Vault api, decoding the response into v (if set)
+func vaultRequest(method, path string, v interface{}) error {
+	token, err := vaultToken()
+	if err != nil {
+		return err
+	}
+
+	body := ""
+	if method == "POST" {
+		body = "{}"
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(VaultAddr, "/")+path, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	res, err := vaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		var errs struct {
+			Errors []string `json:"errors"`
+		}
+		json.NewDecoder(res.Body).Decode(&errs)
+		return fmt.Errorf("%s %s failed (%d) - %s", method, path, res.StatusCode, strings.Join(errs.Errors, ", "))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
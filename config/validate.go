@@ -0,0 +1,418 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mu-box/slurp/bind"
+	"github.com/mu-box/slurp/syslog"
+)
+
+// Validate checks the loaded settings without starting anything: that
+// addresses parse, values are in range, and the directories and files slurp
+// uses are usable. Every problem found is returned, so they can be fixed at
+// once rather than one fatal at a time.
+func Validate() []error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if ApiToken == "" {
+		fail("api-token: must be set")
+	}
+	if len(bind.Split(ApiAddress)) == 0 {
+		fail("api-address: must be set")
+	}
+	for _, addr := range bind.Split(ApiAddress) {
+		if u, err := url.Parse(addr); err != nil || checkHostPort(u.Host) != nil {
+			fail("api-address: '%s' isn't a listen uri, eg https://127.0.0.1:1566", addr)
+		}
+	}
+	if len(bind.Split(SshAddr)) == 0 {
+		fail("ssh-addr: must be set")
+	}
+	for _, addr := range bind.Split(SshAddr) {
+		if err := checkHostPort(addr); err != nil {
+			fail("ssh-addr: %v", err)
+		}
+	}
+	if err := checkStoreAddr(StoreAddr); err != nil {
+		fail("store-addr: %v", err)
+	}
+	for _, peer := range CachePeers {
+		if u, err := url.Parse(peer); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("cache-peers: '%s' isn't an http(s) url", peer)
+		}
+	}
+	if len(CachePeers) > 0 {
+		switch {
+		case !ReadOnly:
+			fail("cache-peers: only read-only replicas share their caches")
+		case CacheSize <= 0:
+			fail("cache-peers: needs a cache (cache-size)")
+		case PeerEvery <= 0:
+			fail("cache-gossip: must be positive")
+		}
+	}
+	if StoreProxy != "" {
+		if u, err := url.Parse(StoreProxy); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("store-proxy: '%s' isn't an http(s) url, eg http://proxy:3128", StoreProxy)
+		}
+	}
+	for _, addr := range StoreRepl {
+		if err := checkStoreAddr(addr); err != nil {
+			fail("store-replica: %v", err)
+		}
+	}
+	for name, store := range Stores {
+		if err := checkStoreAddr(store.Addr); store.Addr != "" && err != nil {
+			fail("stores.%s: %v", name, err)
+		}
+	}
+
+	switch Mode {
+	case "all":
+	case "api", "ssh":
+		if Node == "" {
+			fail("mode: %s nodes must be part of a cluster (set cluster-node and cluster-peers)", Mode)
+		}
+		if ReadOnly {
+			fail("mode: read-only replicas only serve downloads")
+		}
+	default:
+		fail("mode: '%s' isn't all, api, or ssh", Mode)
+	}
+	if Node != "" {
+		if ReadOnly {
+			fail("cluster-node: read-only replicas can't join a cluster")
+		}
+		if NodeToken == "" {
+			fail("cluster-token: must be set with cluster-node")
+		}
+		for _, name := range append([]string{Node}, Peers...) {
+			if name == "" || strings.ContainsAny(name, "/ ") {
+				fail("cluster-peers: '%s' isn't a node name", name)
+			}
+		}
+		for _, peer := range Peers {
+			if peer == Node {
+				fail("cluster-peers: '%s' is this node", peer)
+			}
+		}
+	}
+
+	if _, ok := Stores[AuditStore]; AuditStore != "" && !ok {
+		fail("audit-store: no store named '%s'", AuditStore)
+	}
+
+	for _, raw := range WebhookUrls {
+		if u, err := url.Parse(raw); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			fail("webhook-url: '%s' isn't an http(s) url", raw)
+		}
+	}
+	for i, hook := range Webhooks {
+		if u, err := url.Parse(hook.Url); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			fail("webhooks[%d]: '%s' isn't an http(s) url", i, hook.Url)
+		}
+	}
+
+	for i, role := range ChannelRoles {
+		if role.Name == "" || role.Token == "" {
+			fail("channel-roles[%d]: needs a name and a token", i)
+		}
+		for _, pattern := range role.Channels {
+			if _, err := path.Match(pattern, ""); err != nil || strings.Count(pattern, "/") != 1 {
+				fail("channel-roles[%d]: '%s' isn't an app/channel pattern", i, pattern)
+			}
+		}
+	}
+
+	for i, rule := range Retention {
+		if rule.Keep < 0 || rule.MaxAge < 0 {
+			fail("retention[%d]: keep and max-age can't be negative", i)
+		}
+	}
+
+	for _, pattern := range Previews {
+		if _, err := path.Match(pattern, ""); err != nil {
+			fail("preview-files: '%s' isn't a path pattern", pattern)
+		}
+	}
+
+	for _, pattern := range Exclude {
+		if _, err := path.Match(strings.Trim(pattern, "/"), ""); err != nil || strings.Trim(pattern, "/") == "" {
+			fail("commit-exclude: '%s' isn't a path pattern", pattern)
+		}
+	}
+	switch {
+	case Scanner == "":
+	case strings.HasPrefix(Scanner, "clamd://"):
+		addr := strings.TrimPrefix(Scanner, "clamd://")
+		if !strings.HasPrefix(addr, "/") && checkHostPort(addr) != nil {
+			fail("commit-scanner: '%s' isn't a socket path or host:port, eg clamd:///run/clamav/clamd.ctl", Scanner)
+		}
+	case strings.HasPrefix(Scanner, "exec:"):
+		if strings.TrimSpace(strings.TrimPrefix(Scanner, "exec:")) == "" {
+			fail("commit-scanner: exec needs a command, eg exec:clamscan --no-summary")
+		}
+	default:
+		fail("commit-scanner: '%s' isn't clamd://<socket or host:port> or exec:<command>", Scanner)
+	}
+
+	for _, entry := range DialAllow {
+		switch {
+		case strings.Contains(entry, "/"):
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				fail("dial-allow: '%s' isn't a cidr", entry)
+			}
+		case net.ParseIP(entry) != nil:
+		case entry == "" || strings.ContainsAny(entry, " :"):
+			fail("dial-allow: '%s' isn't a host, ip, or cidr", entry)
+		}
+	}
+	if DialDNS != "" && net.ParseIP(DialDNS) == nil && checkHostPort(DialDNS) != nil {
+		fail("dial-dns: '%s' isn't an ip or ip:port", DialDNS)
+	}
+	if DialProxy != "" {
+		if u, err := url.Parse(DialProxy); err != nil || u.Scheme != "socks5" || checkHostPort(u.Host) != nil {
+			fail("dial-proxy: '%s' isn't a socks5 url, eg socks5://127.0.0.1:1080", DialProxy)
+		}
+	}
+
+	switch strings.ToLower(LogLevel) {
+	case "trace", "debug", "info", "warn", "error", "fatal":
+	default:
+		fail("log-level: unknown level '%s'", LogLevel)
+	}
+	switch LogFormat {
+	case "console", "json":
+	default:
+		fail("log-format: unknown format '%s'", LogFormat)
+	}
+
+	if DebugAddr != "" {
+		if err := checkHostPort(DebugAddr); err != nil {
+			fail("debug-addr: %v", err)
+		} else if host, _, _ := net.SplitHostPort(DebugAddr); host != "localhost" && !net.ParseIP(host).IsLoopback() {
+			fail("debug-addr: '%s' isn't a loopback address", DebugAddr)
+		}
+	}
+	if OtlpAddr != "" {
+		if u, err := url.Parse(OtlpAddr); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			fail("otlp-endpoint: '%s' isn't an http(s) url", OtlpAddr)
+		}
+	}
+	if TraceRatio < 0 || TraceRatio > 1 {
+		fail("trace-sample: %v isn't between 0 and 1", TraceRatio)
+	}
+
+	switch LogSink {
+	case "stdout", "syslog", "journald":
+	default:
+		fail("log-sink: unknown sink '%s'", LogSink)
+	}
+	if LogSink == "syslog" {
+		if _, err := syslog.Facility(SyslogFac); err != nil {
+			fail("syslog-facility: unknown facility '%s'", SyslogFac)
+		}
+		if u, err := url.Parse(SyslogAddr); SyslogAddr != "" && (err != nil || (u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "unix") || (u.Host == "" && u.Path == "")) {
+			fail("syslog-addr: '%s' isn't a udp://, tcp://, or unix:// address", SyslogAddr)
+		}
+	}
+
+	for name, value := range map[string]float64{"disk-watermark": DiskHigh, "health-min-free": HealthFree} {
+		if value < 0 || value > 100 {
+			fail("%s: %v isn't a percentage", name, value)
+		}
+	}
+	for name, value := range map[string]int{"cache-size": CacheSize, "commit-limit": CommitMax, "commit-max-file": FileMax, "delete-rate": DelRate, "log-keep": LogKeep, "log-max-size": LogSize, "preview-size": PreviewMax, "rsync-bwlimit": BwLimit, "rsync-timeout": RsyncIdle, "stage-cache": StageCache, "stage-quota": StageQuota, "store-retries": StoreRetry, "store-retry-spool": StoreSpool, "verify-sample": VerifyN, "zstd-frame-size": ZstdFrame} {
+		if value < 0 {
+			fail("%s: can't be negative", name)
+		}
+	}
+	if CommitMem <= 0 {
+		fail("commit-memory: must be positive")
+	}
+	if DelWorkers <= 0 {
+		fail("delete-workers: must be positive")
+	}
+	for name, value := range map[string]time.Duration{"abort-window": AbortKeep, "audit-export": AuditEvery, "cluster-timeout": NodeTTL, "commit-hook-timeout": HookMax, "api-header-timeout": ApiHeader, "api-idle-timeout": ApiIdle, "cache-ttl": CacheTTL, "log-max-age": LogAge, "log-retention": LogRetain, "quarantine-ttl": QuarKeep, "resume-window": ResumeTTL, "retention-interval": RetainFreq, "reuse-cooldown": ReuseWait, "rsync-deadline": RsyncMax, "ssh-handshake-timeout": SshTimeout, "ssh-self-check": SshCheck, "stage-ttl": StageTTL, "store-heartbeat": StoreBeat, "store-wait": StoreWait, "verify-interval": VerifyFreq} {
+		if value < 0 {
+			fail("%s: can't be negative", name)
+		}
+	}
+	for _, hook := range CommitHook {
+		if strings.TrimSpace(hook) == "" {
+			fail("commit-hook: can't be empty")
+		}
+	}
+	for name, tmpl := range Templates {
+		for _, hook := range tmpl.Hooks {
+			if strings.TrimSpace(hook) == "" {
+				fail("templates.%s.hooks: can't be empty", name)
+			}
+		}
+		if tmpl.Quota < 0 {
+			fail("templates.%s.quota: can't be negative", name)
+		}
+		if tmpl.Rsync.Timeout < 0 || tmpl.Rsync.BwLimit < 0 || tmpl.Rsync.Deadline < 0 {
+			fail("templates.%s.rsync: timeout, bwlimit, and deadline can't be negative", name)
+		}
+	}
+	if SplitMB <= 0 {
+		fail("split-size: must be positive")
+	}
+	if SweepEvery <= 0 {
+		fail("sweep-interval: must be positive")
+	}
+
+	// read-only replicas only use the blob cache
+	if !ReadOnly {
+		for name, dir := range map[string]string{"build-dir": BuildDir, "data-dir": DataDir} {
+			if err := checkDir(dir); err != nil {
+				fail("%s: %v", name, err)
+			}
+		}
+		if err := checkKeyFile(SshHostKey); err != nil {
+			fail("ssh-host: %v", err)
+		}
+		if Dedup {
+			if err := checkDir(PoolDir); err != nil {
+				fail("pool-dir: %v", err)
+			} else if !sameDevice(PoolDir, BuildDir) {
+				fail("pool-dir: must be on the same filesystem as build-dir to share files")
+			}
+		}
+		if Quarantine {
+			if err := checkDir(QuarDir); err != nil {
+				fail("quarantine-dir: %v", err)
+			} else if !sameDevice(QuarDir, BuildDir) {
+				fail("quarantine-dir: must be on the same filesystem as build-dir to move stages into it")
+			}
+		}
+	}
+	if LeaderLock != "" {
+		if ReadOnly {
+			fail("leader-lock: read-only replicas have no state to fail over")
+		} else if err := checkDir(filepath.Dir(LeaderLock)); err != nil {
+			fail("leader-lock: %v", err)
+		}
+	}
+	if AuditFile != "" && !ReadOnly {
+		if err := checkDir(filepath.Dir(AuditFile)); err != nil {
+			fail("audit-log: %v", err)
+		}
+	}
+	if LogFile != "" {
+		if err := checkDir(filepath.Dir(LogFile)); err != nil {
+			fail("log-file: %v", err)
+		}
+	}
+	if CacheSize > 0 {
+		if err := checkDir(CacheDir); err != nil {
+			fail("cache-dir: %v", err)
+		}
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errs
+}
+
+// checkHostPort checks an ip:port listen address
+func checkHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("'%s' isn't a host:port address - %v", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("'%s' has a bad port", addr)
+	}
+	return nil
+}
+
+// checkStoreAddr checks a storage host address, eg hoarders://127.0.0.1:7410
+func checkStoreAddr(addr string) error {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return fmt.Errorf("'%s' doesn't parse - %v", addr, err)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("'%s' has no host, eg hoarders://127.0.0.1:7410", addr)
+	}
+	return nil
+}
+
+// checkDir checks slurp can write to a directory, or create it
+func checkDir(dir string) error {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return checkCreatable(dir)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' isn't a directory", dir)
+	}
+	return checkWritable(dir)
+}
+
+// checkKeyFile checks slurp can read an existing key file, or write a new one
+func checkKeyFile(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return checkCreatable(path)
+	}
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// checkCreatable checks the closest existing parent of path is writable
+func checkCreatable(path string) error {
+	parent := filepath.Dir(filepath.Clean(path))
+	for {
+		info, err := os.Stat(parent)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Errorf("'%s' isn't a directory", parent)
+			}
+			return checkWritable(parent)
+		}
+		if !os.IsNotExist(err) || parent == filepath.Dir(parent) {
+			return err
+		}
+		parent = filepath.Dir(parent)
+	}
+}
+
+// checkWritable checks a file can be created in dir
+func checkWritable(dir string) error {
+	file, err := os.CreateTemp(dir, ".slurp-check-")
+	if err != nil {
+		return fmt.Errorf("'%s' isn't writable - %v", dir, err)
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// sameDevice reports whether two existing paths are on the same filesystem.
+// Paths that don't exist yet are assumed to be.
+func sameDevice(a, b string) bool {
+	var sa, sb syscall.Stat_t
+	if syscall.Stat(a, &sa) != nil || syscall.Stat(b, &sb) != nil {
+		return true
+	}
+	return sa.Dev == sb.Dev
+}
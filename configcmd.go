@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/jcelliott/lumber"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	core "github.com/mu-box/slurp/core"
+)
+
+var (
+	// configCmd groups the config file helpers
+	configCmd = &cobra.Command{
+		Use:   "config",
+		Short: "Validate or scaffold a config file",
+		// the subcommands load (or write) the config file themselves
+		PersistentPreRunE: func(ccmd *cobra.Command, args []string) error { return nil },
+	}
+
+	// validateConfig checks a config file without starting slurp
+	validateConfig = &cobra.Command{
+		Use:   "validate",
+		Short: "Check the config (-c file and flags): addresses, paths, permissions, tools, and backend connectivity",
+		Args:  cobra.NoArgs,
+		RunE:  runValidateConfig,
+	}
+
+	// initConfig writes a sample config file
+	initConfig = &cobra.Command{
+		Use:   "init [file]",
+		Short: "Write a sample config (commented yaml or toml, or json) with every setting at its default",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runInitConfig,
+	}
+
+	// skip the backend check of validate
+	offline bool
+
+	// format of the config init writes
+	sampleFmt string
+)
+
+func init() {
+	validateConfig.Flags().BoolVar(&offline, "offline", false, "Skip checking the storage backend is reachable")
+	initConfig.Flags().StringVar(&sampleFmt, "format", "", "Format to write [json|toml|yaml] (defaults to the file's extension, else yaml)")
+	configCmd.AddCommand(validateConfig, initConfig)
+	slurp.AddCommand(configCmd)
+}
+
+func runValidateConfig(ccmd *cobra.Command, args []string) error {
+	config.Log = lumber.NewConsoleLogger(lumber.FATAL)
+
+	err := config.LoadConfigFile()
+	if err != nil {
+		return err
+	}
+
+	var problems []error
+	err = config.LoadSecrets()
+	if err != nil {
+		problems = append(problems, err)
+	}
+	problems = append(problems, config.Validate()...)
+	problems = append(problems, core.ValidateConfig()...)
+	if !offline {
+		err = backend.Initialize()
+		if err == nil {
+			err = backend.Check()
+		}
+		if err != nil {
+			problems = append(problems, fmt.Errorf("store-addr: backend isn't usable - %v", err))
+		}
+	}
+
+	source := "flags and defaults"
+	if config.ConfigFile != "" {
+		source = config.ConfigFile
+	}
+	if len(problems) == 0 {
+		fmt.Printf("%s: ok\n", source)
+		return nil
+	}
+
+	for _, problem := range problems {
+		fmt.Printf("  %v\n", problem)
+	}
+	return fmt.Errorf("%s: %d problem(s) found", source, len(problems))
+}
+
+func runInitConfig(ccmd *cobra.Command, args []string) error {
+	format := strings.ToLower(sampleFmt)
+	if format == "" && len(args) > 0 {
+		format = config.FormatOf(args[0])
+	}
+	switch format {
+	case "", "yml":
+		format = "yaml"
+	case "json", "toml", "yaml":
+	default:
+		return fmt.Errorf("Unknown config format '%s' [%s]", sampleFmt, strings.Join(config.ConfigFormats, "|"))
+	}
+	sample := sampleConfig(format)
+
+	// default to stdout
+	if len(args) == 0 {
+		_, err := os.Stdout.Write(sample)
+		return err
+	}
+
+	// never clobber a real config
+	file, err := os.OpenFile(args[0], os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to create config file - %v", err)
+	}
+	_, err = file.Write(sample)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// sampleConfig renders every setting slurp's flags know at its current
+// (default) value, plus the config file only settings. Yaml and toml carry the
+// help text as comments and commented examples of the config file only
+// settings; json has no comments, so those are left empty.
+func sampleConfig(format string) []byte {
+	out := &bytes.Buffer{}
+	if format != "json" {
+		fmt.Fprintf(out, "# slurp config, load with 'slurp -c <file>'. Flags given with -c are\n# overridden by this file.\n\n")
+	}
+
+	var settings []string
+	slurp.PersistentFlags().VisitAll(func(flag *pflag.Flag) {
+		if flag.Name == "config-file" || flag.Name == "config-format" {
+			return
+		}
+		switch format {
+		case "json":
+			settings = append(settings, fmt.Sprintf("  %q: %s", flag.Name, sampleValue(flag)))
+		case "toml":
+			fmt.Fprintf(out, "# %s\n%s = %s\n\n", flag.Usage, flag.Name, sampleValue(flag))
+		default:
+			fmt.Fprintf(out, "# %s\n%s: %s\n\n", flag.Usage, flag.Name, sampleValue(flag))
+		}
+	})
+
+	switch format {
+	case "json":
+		settings = append(settings, `  "templates": {}`, `  "stores": {}`, `  "schedule": {}`, `  "webhooks": []`, `  "channel-roles": []`, `  "retention": []`)
+		fmt.Fprintf(out, "{\n%s\n}\n", strings.Join(settings, ",\n"))
+	case "toml":
+		io.WriteString(out, sampleSectionsToml)
+	default:
+		io.WriteString(out, sampleSections)
+	}
+	return out.Bytes()
+}
+
+// sampleValue renders a flag's value as yaml, toml, or json (which agree on
+// the scalars and lists slurp's settings use)
+func sampleValue(flag *pflag.Flag) string {
+	switch flag.Value.Type() {
+	case "bool", "int", "float64":
+		return flag.Value.String()
+	case "stringSlice":
+		values := flag.Value.(pflag.SliceValue).GetSlice()
+		for i := range values {
+			values[i] = strconv.Quote(values[i])
+		}
+		return "[" + strings.Join(values, ", ") + "]"
+	default:
+		return strconv.Quote(flag.Value.String())
+	}
+}
+
+// sampleSections are the settings only a config file can hold, as yaml
+const sampleSections = `# Named stage templates, selected with "template" when staging a build
+# templates:
+#   files:
+#     output: tree         # archive, tree, or delta
+#     format: tar.zst      # tar.gz, tar.zst, or squashfs
+#     key: "{tenant}/{buildId}.{format}"
+#     split: dirs          # dirs or size (archive output)
+#     split-size: 4096     # MB per part of size splits
+#     ttl: 2h
+#     hooks: ["make test"] # run in the staging dir before committing
+#     verify: full-hash    # none, size-only, sampled-hash, or full-hash
+#     quota: 2048          # MB the stage may hold
+#     rsync:
+#       filters: ["P .cache/"]
+#       chmod: D755,F644
+#       numeric-ids: false
+#       timeout: 600
+#       bwlimit: 0
+#       deadline: 1h
+
+# Named stores builds can be promoted between
+# stores:
+#   production:
+#     addr: hoarders://prod-storage:7410
+#     token: ""            # defaults to store-token
+#     prefix: ""
+
+# Cron expressions background tasks run on (sweep, gc, verify, benchmark)
+# schedule:
+#   sweep: "*/5 * * * *"
+#   verify: "0 3 * * *"
+#   benchmark: "@every 1h"
+
+# Webhooks scoped by event type and labels
+# webhooks:
+#   - url: https://ci.example.com/hooks/slurp
+#     secret: ""           # defaults to webhook-secret
+#     events: ["stage.committed", "stage.commit-failed"]
+#     labels: {tenant: acme}
+
+# Roles that may move release channels (empty lets any api client)
+# channel-roles:
+#   - name: release
+#     token: ""
+#     channels: ["*/stable", "*/beta"]
+
+# Rules pruning old committed builds from storage (empty keeps every build)
+# retention:
+#   - name: nightlies
+#     labels: {channel: nightly}
+#     group-by: app
+#     keep: 10             # newest builds of each group kept
+#     max-age: 720h        # pruned past this age, newest or not
+`
+
+// sampleSectionsToml are sampleSections as toml. Tables end the settings
+// before them, so they come last.
+const sampleSectionsToml = `# Named stage templates, selected with "template" when staging a build
+# [templates.files]
+# output = "tree"         # archive, tree, or delta
+# format = "tar.zst"      # tar.gz, tar.zst, or squashfs
+# key = "{tenant}/{buildId}.{format}"
+# split = "dirs"          # dirs or size (archive output)
+# split-size = 4096       # MB per part of size splits
+# ttl = "2h"
+# hooks = ["make test"]   # run in the staging dir before committing
+# verify = "full-hash"    # none, size-only, sampled-hash, or full-hash
+# quota = 2048           # MB the stage may hold
+# [templates.files.rsync]
+# filters = ["P .cache/"]
+# chmod = "D755,F644"
+# numeric-ids = false
+# timeout = 600
+# bwlimit = 0
+# deadline = "1h"
+
+# Named stores builds can be promoted between
+# [stores.production]
+# addr = "hoarders://prod-storage:7410"
+# token = ""              # defaults to store-token
+# prefix = ""
+
+# Cron expressions background tasks run on (sweep, gc, verify, benchmark)
+# [schedule]
+# sweep = "*/5 * * * *"
+# verify = "0 3 * * *"
+# benchmark = "@every 1h"
+
+# Webhooks scoped by event type and labels
+# [[webhooks]]
+# url = "https://ci.example.com/hooks/slurp"
+# secret = ""             # defaults to webhook-secret
+# events = ["stage.committed", "stage.commit-failed"]
+# labels = {tenant = "acme"}
+
+# Roles that may move release channels (empty lets any api client)
+# [[channel-roles]]
+# name = "release"
+# token = ""
+# channels = ["*/stable", "*/beta"]
+
+# Rules pruning old committed builds from storage (empty keeps every build)
+# [[retention]]
+# name = "nightlies"
+# labels = {channel = "nightly"}
+# group-by = "app"
+# keep = 10               # newest builds of each group kept
+# max-age = "720h"        # pruned past this age, newest or not
+`
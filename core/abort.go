@@ -0,0 +1,95 @@
+package slurp
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/ssh"
+	"github.com/mu-box/slurp/webhook"
+)
+
+// ErrAborted is returned when committing a stage that was aborted
+var ErrAborted = errors.New("Stage was aborted")
+
+// ErrCommitted is returned when aborting a stage that was already committed
+var ErrCommitted = errors.New("Stage was already committed")
+
+// aborted builds and what to run to cancel their commit
+var aborts = struct {
+	sync.Mutex
+	stopped map[string]bool
+	hooks   map[string][]func()
+}{stopped: map[string]bool{}, hooks: map[string][]func(){}}
+
+// AbortStage stops all work on a stage without destroying it: its rsync
+// sessions are terminated, a queued or running commit is cancelled, and the
+// staging data and session logs are kept for abort-window before the stage
+// is removed, for a post-mortem.
+func AbortStage(buildId string) (Stage, error) {
+	mutex.Lock()
+	stage, ok := stages[buildId]
+	if !ok {
+		mutex.Unlock()
+		return Stage{}, ErrNoStage
+	}
+	if stage.State == StateCommitted {
+		mutex.Unlock()
+		return Stage{}, ErrCommitted
+	}
+	stage.State = StateAborted
+	stage.Expires = time.Now().UTC().Add(config.AbortKeep)
+	record := stage.copy()
+	mutex.Unlock()
+
+	persist(record)
+
+	killed := ssh.AbortUser(buildId)
+
+	aborts.Lock()
+	aborts.stopped[buildId] = true
+	hooks := aborts.hooks[buildId]
+	delete(aborts.hooks, buildId)
+	aborts.Unlock()
+
+	for _, hook := range hooks {
+		hook()
+	}
+
+	config.Log.Info("%sAborted '%v', terminated %d session(s) and %d commit step(s)", reqid.Tag(buildId), buildId, killed, len(hooks))
+	webhook.SendLabeled(webhook.StageAborted, buildId, record.Metadata, map[string]interface{}{"stage": record, "sessions": killed})
+
+	return record, nil
+}
+
+// onAbort runs fn if the build is aborted, right away if it already was
+func onAbort(buildId string, fn func()) {
+	aborts.Lock()
+	if aborts.stopped[buildId] {
+		aborts.Unlock()
+		fn()
+		return
+	}
+	aborts.hooks[buildId] = append(aborts.hooks[buildId], fn)
+	aborts.Unlock()
+}
+
+// isAborted reports whether a build was aborted
+func isAborted(buildId string) bool {
+	aborts.Lock()
+	defer aborts.Unlock()
+	return aborts.stopped[buildId]
+}
+
+// clearAbort forgets a build's commit hooks once its commit is done, and
+// whether it was aborted once it is deleted
+func clearAbort(buildId string, deleted bool) {
+	aborts.Lock()
+	delete(aborts.hooks, buildId)
+	if deleted {
+		delete(aborts.stopped, buildId)
+	}
+	aborts.Unlock()
+}
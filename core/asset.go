@@ -0,0 +1,87 @@
+package slurp
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/mu-box/slurp/store"
+)
+
+// sniffLen is how much of a file is read to detect its content type
+const sniffLen = 512
+
+// contentType detects the type of a file from its extension, falling back to
+// sniffing its contents. The file is left at its start.
+func contentType(file *os.File) (string, error) {
+	if typ := mime.TypeByExtension(path.Ext(file.Name())); typ != "" {
+		return typ, nil
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// blobMeta is the metadata a build's blobs are written with: its labels, and
+// the level they are verified at after upload
+func blobMeta(index *Index) map[string]string {
+	meta := make(map[string]string, len(index.Metadata)+1)
+	for k, v := range index.Metadata {
+		meta[k] = v
+	}
+	if index.Verify != "" {
+		meta["verify-level"] = index.Verify
+	}
+	return meta
+}
+
+// assetMeta adds a single file build's content type, size, and filename to
+// the labels stored with its blob
+func assetMeta(labels map[string]string, entry Entry) map[string]string {
+	meta := make(map[string]string, len(labels)+3)
+	for k, v := range labels {
+		meta[k] = v
+	}
+	meta["content-type"] = entry.ContentType
+	meta["filename"] = entry.Filename
+	meta["size"] = strconv.FormatInt(entry.Size, 10)
+	return meta
+}
+
+// BlobInfo describes a committed blob, from the commit's record if this slurp
+// made it, or else its build's index (replicas). It reports whether the blob
+// was found.
+func BlobInfo(blobId string) (Entry, bool) {
+	var entry Entry
+	if found, err := store.Get(blobsBucket, blobId, &entry); err == nil && found {
+		return entry, true
+	}
+
+	// only tree blobs (prefixed with their build id) describe a single file
+	parts := strings.SplitN(blobId, "/", 2)
+	if len(parts) < 2 {
+		return Entry{}, false
+	}
+	index, err := GetIndex(parts[0])
+	if err != nil {
+		return Entry{}, false
+	}
+	for _, entry := range index.Entries {
+		if entry.Blob == blobId {
+			return entry, true
+		}
+	}
+	return Entry{}, false
+}
@@ -0,0 +1,280 @@
+package slurp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/store"
+)
+
+// bulkWorkers is how many items of a bulk job are worked on at once
+const bulkWorkers = 8
+
+// Bulk job states
+const (
+	BulkRunning = "running" // items still being worked on
+	BulkDone    = "done"    // every item has a result
+)
+
+var (
+	// ErrNoBulk is returned when a bulk job isn't known
+	ErrNoBulk = errors.New("Bulk job not found")
+	// ErrNoFilter is returned for a bulk operation without ids or a filter
+	ErrNoFilter = errors.New("Bulk operations need ids or a filter")
+)
+
+// BulkFilter selects what a bulk operation works on. Set fields must all
+// match; ids that don't exist are reported as failed.
+type BulkFilter struct {
+	Ids       []string          `json:"ids"`      // build ids (stages) or blob ids (blobs)
+	State     string            `json:"state"`    // stage state (stages)
+	Template  string            `json:"template"` // stage template (stages)
+	Labels    map[string]string `json:"labels"`   // stage labels (stages)
+	OlderThan time.Duration     `json:"-"`        // created longer ago than (stages)
+	Prefix    string            `json:"prefix"`   // blob id prefix (blobs)
+	Owner     string            `json:"-"`        // credential acting on owned stages (stages)
+}
+
+// BulkResult is the outcome of a bulk operation on one item
+type BulkResult struct {
+	Id       string       `json:"id"`
+	Error    string       `json:"error,omitempty"`
+	Diverged []Divergence `json:"diverged,omitempty"` // bad copies found verifying a blob
+}
+
+// BulkJob tracks a bulk operation running in the background
+type BulkJob struct {
+	Id      string       `json:"id"`
+	Op      string       `json:"op"`    // delete-stages or verify-blobs
+	State   string       `json:"state"` // running or done
+	Started time.Time    `json:"started"`
+	Ended   time.Time    `json:"ended,omitempty"`
+	Total   int          `json:"total"`  // items selected
+	Done    int          `json:"done"`   // items finished
+	Failed  int          `json:"failed"` // items that failed
+	Results []BulkResult `json:"results"`
+}
+
+// bulk jobs by id, kept for a while after they finish
+var bulks = struct {
+	sync.Mutex
+	jobs map[string]*BulkJob
+}{jobs: map[string]*BulkJob{}}
+
+// BulkDeleteStages deletes every stage matching filter in the background.
+// Owned stages the filter's owner credential doesn't own are left, failed.
+func BulkDeleteStages(filter BulkFilter) (BulkJob, error) {
+	if len(filter.Ids) == 0 && filter.State == "" && filter.Template == "" && len(filter.Labels) == 0 && filter.OlderThan <= 0 {
+		return BulkJob{}, ErrNoFilter
+	}
+
+	return runBulk("delete-stages", matchStages(filter), func(buildId string) BulkResult {
+		if _, err := GetStage(buildId); err != nil {
+			return BulkResult{Id: buildId, Error: err.Error()}
+		}
+		if err := CheckOwner(buildId, filter.Owner); err != nil {
+			return BulkResult{Id: buildId, Error: err.Error()}
+		}
+		if err := DeleteStage(buildId); err != nil {
+			return BulkResult{Id: buildId, Error: err.Error()}
+		}
+		return BulkResult{Id: buildId}
+	}), nil
+}
+
+// BulkVerifyBlobs verifies every recorded blob matching filter across the
+// stores in the background, like a verification run
+func BulkVerifyBlobs(filter BulkFilter) (BulkJob, error) {
+	if len(filter.Ids) == 0 && filter.Prefix == "" {
+		return BulkJob{}, ErrNoFilter
+	}
+
+	entries, err := matchBlobs(filter)
+	if err != nil {
+		return BulkJob{}, err
+	}
+
+	ids := []string{}
+	for id := range entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	stores := backend.Stores()
+	return runBulk("verify-blobs", ids, func(blobId string) BulkResult {
+		entry := entries[blobId]
+		if entry.Blob == "" {
+			return BulkResult{Id: blobId, Error: "Blob not recorded"}
+		}
+
+		result := BulkResult{Id: blobId, Diverged: verifyBlob(entry, stores)}
+		for _, divergence := range result.Diverged {
+			alertDivergence(divergence)
+			if !divergence.Repaired {
+				result.Error = fmt.Sprintf("%d of %d copies diverged", len(result.Diverged), len(stores))
+			}
+		}
+		return result
+	}), nil
+}
+
+// GetBulk returns the progress (and results so far) of a bulk job
+func GetBulk(id string) (BulkJob, error) {
+	bulks.Lock()
+	defer bulks.Unlock()
+	job, ok := bulks.jobs[id]
+	if !ok {
+		return BulkJob{}, ErrNoBulk
+	}
+	return job.copy(), nil
+}
+
+// runBulk starts fn on every id in the background
+func runBulk(op string, ids []string, fn func(string) BulkResult) BulkJob {
+	job := &BulkJob{Id: reqid.New(), Op: op, State: BulkRunning, Started: time.Now().UTC(), Total: len(ids), Results: []BulkResult{}}
+
+	bulks.Lock()
+	bulks.jobs[job.Id] = job
+	record := job.copy()
+	bulks.Unlock()
+
+	config.Log.Info("Started bulk job '%v' (%s of %d items)", job.Id, op, len(ids))
+
+	work := make(chan string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < bulkWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				result := fn(id)
+
+				bulks.Lock()
+				job.Done++
+				if result.Error != "" {
+					job.Failed++
+				}
+				job.Results = append(job.Results, result)
+				bulks.Unlock()
+			}
+		}()
+	}
+	go func() {
+		for _, id := range ids {
+			work <- id
+		}
+		close(work)
+		wg.Wait()
+
+		bulks.Lock()
+		job.State = BulkDone
+		job.Ended = time.Now().UTC()
+		bulks.Unlock()
+
+		config.Log.Info("Finished bulk job '%v' (%d of %d failed)", job.Id, job.Failed, job.Total)
+	}()
+
+	return record
+}
+
+// matchStages returns the ids of the stages matching filter, plus any ids
+// asked for that aren't staged (to be reported as failed)
+func matchStages(filter BulkFilter) []string {
+	wanted := map[string]bool{}
+	for _, id := range filter.Ids {
+		wanted[id] = true
+	}
+
+	var ids []string
+	cutoff := time.Now().Add(-filter.OlderThan)
+	for _, stage := range ListStages() {
+		switch {
+		case len(wanted) > 0 && !wanted[stage.Id]:
+			continue
+		case filter.State != "" && stage.State != filter.State:
+			continue
+		case filter.Template != "" && stage.Template != filter.Template:
+			continue
+		case filter.OlderThan > 0 && !stage.Created.Before(cutoff):
+			continue
+		case !hasLabels(stage.Metadata, filter.Labels):
+			continue
+		}
+		ids = append(ids, stage.Id)
+	}
+
+	for _, id := range filter.Ids {
+		if _, err := GetStage(id); err != nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// matchBlobs returns the recorded blobs matching filter by id. Ids asked for
+// that aren't recorded map to an empty entry (to be reported as failed).
+func matchBlobs(filter BulkFilter) (map[string]Entry, error) {
+	wanted := map[string]bool{}
+	for _, id := range filter.Ids {
+		wanted[id] = true
+	}
+
+	entries := map[string]Entry{}
+	err := store.Each(blobsBucket, func(key string, raw []byte) error {
+		if len(wanted) > 0 && !wanted[key] || !strings.HasPrefix(key, filter.Prefix) {
+			return nil
+		}
+		var entry Entry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return fmt.Errorf("Bad blob record '%s' - %v", key, err)
+		}
+		entries[key] = entry
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list blobs - %v", err)
+	}
+
+	for id := range wanted {
+		if _, ok := entries[id]; !ok {
+			entries[id] = Entry{}
+		}
+	}
+	return entries, nil
+}
+
+// hasLabels reports whether labels has every one of want
+func hasLabels(labels, want map[string]string) bool {
+	for k, v := range want {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// pruneBulk forgets bulk jobs that finished before the retention window
+func pruneBulk(now time.Time) {
+	bulks.Lock()
+	defer bulks.Unlock()
+	for id, job := range bulks.jobs {
+		if job.State == BulkDone && job.Ended.Add(jobRetention).Before(now) {
+			delete(bulks.jobs, id)
+		}
+	}
+}
+
+// copy returns a copy of the job that is safe to use without the lock
+func (self *BulkJob) copy() BulkJob {
+	job := *self
+	job.Results = append([]BulkResult{}, self.Results...)
+	return job
+}
@@ -0,0 +1,123 @@
+package slurp
+
+import (
+	"os/exec"
+	"sort"
+
+	"github.com/mu-box/slurp/config"
+)
+
+// ApiVersion is the version of the api, raised on changes existing clients
+// can't handle
+const ApiVersion = 1
+
+// Release is slurp's version, set at startup (empty for dev builds)
+var Release string
+
+// Capabilities describes what this slurp supports, so clients can pick the
+// best path both sides know rather than assume one
+type Capabilities struct {
+	Release    string           `json:"release"`    // slurp's version
+	Api        int              `json:"api"`        // api version
+	Mode       string           `json:"mode"`       // all, api, ssh, or read-only
+	Transfers  []string         `json:"transfers"`  // ways builds are uploaded: rsync (over ssh), resume (resumption tokens)
+	Formats    []string         `json:"formats"`    // archive formats commits can write (their tools are installed)
+	Outputs    []string         `json:"outputs"`    // commit outputs
+	Splits     []string         `json:"splits"`     // split rules of archive commits
+	Digests    []string         `json:"digests"`    // checksums of blobs, files, and manifests
+	Signatures []string         `json:"signatures"` // algorithms builds and receipts are signed with (empty without an active key)
+	Features   []string         `json:"features"`   // optional features enabled
+	Limits     CapabilityLimits `json:"limits"`     // limits of stages without a template
+}
+
+// CapabilityLimits are the limits stages are held to, unless their template
+// sets others
+type CapabilityLimits struct {
+	StageTTL      string `json:"stage-ttl"`      // time a stage may live uncommitted (0s never expires)
+	ResumeWindow  string `json:"resume-window"`  // time a resumption token stays valid
+	RsyncBwLimit  int    `json:"rsync-bwlimit"`  // KB/s per rsync session (0 unlimited)
+	RsyncTimeout  int    `json:"rsync-timeout"`  // seconds of io an rsync session may stall for (0 none)
+	RsyncDeadline string `json:"rsync-deadline"` // longest an rsync session may run (0s unlimited)
+	SplitSize     int    `json:"split-size"`     // MB of file contents per part of size split archives
+	PreviewSize   int    `json:"preview-size"`   // KB of each preview file kept (0 keeps no previews)
+	CommitLimit   int    `json:"commit-limit"`   // commits uploading at once (0 unlimited)
+}
+
+// GetCapabilities describes what this slurp supports as configured
+func GetCapabilities() Capabilities {
+	caps := Capabilities{
+		Release:    Release,
+		Api:        ApiVersion,
+		Mode:       config.Mode,
+		Transfers:  []string{"rsync"},
+		Formats:    []string{},
+		Outputs:    []string{OutputArchive, OutputTree, OutputDelta},
+		Splits:     []string{SplitDirs, SplitSize},
+		Digests:    []string{"sha256"},
+		Signatures: []string{},
+		Features:   []string{},
+		Limits: CapabilityLimits{
+			StageTTL:      config.StageTTL.String(),
+			ResumeWindow:  config.ResumeTTL.String(),
+			RsyncBwLimit:  config.Get(&config.BwLimit),
+			RsyncTimeout:  config.Get(&config.RsyncIdle),
+			RsyncDeadline: config.Get(&config.RsyncMax).String(),
+			SplitSize:     config.SplitMB,
+			PreviewSize:   config.Get(&config.PreviewMax),
+			CommitLimit:   config.CommitMax,
+		},
+	}
+	if config.ReadOnly {
+		caps.Mode = "read-only"
+	}
+	if config.ResumeTTL > 0 {
+		caps.Transfers = append(caps.Transfers, "resume")
+	}
+
+	for _, format := range []struct {
+		name  string
+		tools []string
+	}{
+		{FormatTarGz, []string{"tar"}},
+		{FormatTarZst, []string{"tar", "zstd"}},
+		{FormatSquashfs, []string{"mksquashfs", "unsquashfs"}},
+	} {
+		if installed(format.tools...) {
+			caps.Formats = append(caps.Formats, format.name)
+		}
+	}
+
+	if _, err := activeKey(); err == nil {
+		caps.Signatures = append(caps.Signatures, "ed25519")
+		caps.Features = append(caps.Features, "signing", "receipts")
+	}
+	for _, feature := range []struct {
+		name    string
+		enabled bool
+	}{
+		{"cluster", Clustered()},
+		{"dedup", config.Dedup},
+		{"licenses", scanEnabled()},
+		{"preview", previewEnabled()},
+		{"quarantine", config.Quarantine},
+		{"retention", len(config.Get(&config.Retention)) > 0},
+		{"scanner", config.Get(&config.Scanner) != ""},
+		{"stage-store", config.StageStore},
+	} {
+		if feature.enabled {
+			caps.Features = append(caps.Features, feature.name)
+		}
+	}
+	sort.Strings(caps.Features)
+	return caps
+}
+
+// installed reports whether every tool is on the path
+func installed(tools ...string) bool {
+	for _, tool := range tools {
+		if _, err := exec.LookPath(tool); err != nil {
+			return false
+		}
+	}
+	return true
+}
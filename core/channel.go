@@ -0,0 +1,243 @@
+package slurp
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/names"
+	"github.com/mu-box/slurp/webhook"
+)
+
+// channelHistory is how many moves of a channel are kept
+const channelHistory = 50
+
+var (
+	// ErrNoChannel is returned when an app has no channel by a name
+	ErrNoChannel = errors.New("Channel not found")
+	// ErrChannelRole is returned moving a channel without the token of a role
+	// allowed to
+	ErrChannelRole = errors.New("Not allowed to move this channel")
+)
+
+// channelLock serializes changes to channels
+var channelLock = sync.Mutex{}
+
+// Channel is a named release pointer of an app (eg stable, beta, nightly) to
+// a committed blob. An app's channels are kept in storage together, as
+// ".channels/<app>.json", so every node (and read-only replica) resolves them
+// the same.
+type Channel struct {
+	App     string        `json:"app"`
+	Name    string        `json:"name"`
+	Blob    string        `json:"blob"` // blob the channel points to
+	Updated time.Time     `json:"updated"`
+	History []ChannelMove `json:"history,omitempty"` // moves of the channel, newest (the current one) first
+}
+
+// ChannelMove is a change of the blob a channel points to
+type ChannelMove struct {
+	Blob      string    `json:"blob"`
+	Time      time.Time `json:"time"`
+	Role      string    `json:"role,omitempty"` // channel role that moved it (empty without roles)
+	RequestId string    `json:"request-id,omitempty"`
+}
+
+// ChannelRole returns the name of the channel role a token is for, failing if
+// the role may not move an app's channel. Without channel-roles any api client
+// may move any channel, as no role.
+func ChannelRole(app, name, token string) (string, error) {
+	if len(config.Get(&config.ChannelRoles)) == 0 {
+		return "", nil
+	}
+	if token == "" {
+		return "", ErrChannelRole
+	}
+	for _, role := range config.Get(&config.ChannelRoles) {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(role.Token)) == 0 {
+			continue
+		}
+		for _, pattern := range role.Channels {
+			if ok, _ := path.Match(pattern, app+"/"+name); ok {
+				return role.Name, nil
+			}
+		}
+	}
+	return "", ErrChannelRole
+}
+
+// channelBlob returns the blob an app's channels are kept in
+func channelBlob(app string) string {
+	return ".channels/" + app + ".json"
+}
+
+// ListChannels returns an app's channels, by name
+func ListChannels(app string) ([]Channel, error) {
+	app, err := names.BuildId(app)
+	if err != nil {
+		return nil, fmt.Errorf("Bad app - %v", err)
+	}
+	channels, err := readChannels(app)
+	if err != nil {
+		return nil, err
+	}
+	list := []Channel{}
+	for _, channel := range channels {
+		list = append(list, *channel)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// GetChannel returns an app's channel
+func GetChannel(app, name string) (Channel, error) {
+	app, name, err := channelNames(app, name)
+	if err != nil {
+		return Channel{}, err
+	}
+	channels, err := readChannels(app)
+	if err != nil {
+		return Channel{}, err
+	}
+	channel, ok := channels[name]
+	if !ok {
+		return Channel{}, ErrNoChannel
+	}
+	return *channel, nil
+}
+
+// SetChannel points an app's channel (creating it if need be) at a committed
+// blob, recording the move in its history
+func SetChannel(app, name, blob, role, requestId string) (Channel, error) {
+	app, name, err := channelNames(app, name)
+	if err != nil {
+		return Channel{}, err
+	}
+	blob, err = names.Path(blob)
+	if err != nil {
+		return Channel{}, err
+	}
+
+	// a channel can't point at nothing
+	reader, err := backend.ReadBlob(blob)
+	if err != nil {
+		return Channel{}, fmt.Errorf("Failed to find blob '%s' - %w", blob, err)
+	}
+	reader.Close()
+
+	channelLock.Lock()
+	defer channelLock.Unlock()
+
+	channels, err := readChannels(app)
+	if err != nil {
+		return Channel{}, err
+	}
+	channel, ok := channels[name]
+	if !ok {
+		channel = &Channel{App: app, Name: name}
+		channels[name] = channel
+	}
+	previous := channel.Blob
+	move := ChannelMove{Blob: blob, Time: time.Now().UTC(), Role: role, RequestId: requestId}
+	channel.Blob, channel.Updated = blob, move.Time
+	channel.History = append([]ChannelMove{move}, channel.History...)
+	if len(channel.History) > channelHistory {
+		channel.History = channel.History[:channelHistory]
+	}
+
+	err = writeChannels(app, channels)
+	if err != nil {
+		return Channel{}, err
+	}
+	recordApp(app)
+	config.Log.Info("Moved channel '%v/%v' from '%v' to '%v'", app, name, previous, blob)
+	webhook.Send(webhook.ChannelMoved, "", map[string]string{"app": app, "channel": name, "from": previous, "to": blob, "role": role})
+	return *channel, nil
+}
+
+// DeleteChannel removes an app's channel, with its history
+func DeleteChannel(app, name string) error {
+	app, name, err := channelNames(app, name)
+	if err != nil {
+		return err
+	}
+
+	channelLock.Lock()
+	defer channelLock.Unlock()
+
+	channels, err := readChannels(app)
+	if err != nil {
+		return err
+	}
+	if _, ok := channels[name]; !ok {
+		return ErrNoChannel
+	}
+	delete(channels, name)
+
+	err = writeChannels(app, channels)
+	if err != nil {
+		return err
+	}
+	config.Log.Info("Deleted channel '%v/%v'", app, name)
+	return nil
+}
+
+// channelNames normalizes the names of an app and channel, which must each be
+// a single path segment as build ids are
+func channelNames(app, name string) (string, string, error) {
+	app, err := names.BuildId(app)
+	if err != nil {
+		return "", "", fmt.Errorf("Bad app - %v", err)
+	}
+	name, err = names.BuildId(name)
+	if err != nil {
+		return "", "", fmt.Errorf("Bad channel - %v", err)
+	}
+	return app, name, nil
+}
+
+// readChannels reads an app's channels from storage, by name (none if the app
+// has none)
+func readChannels(app string) (map[string]*Channel, error) {
+	channels := map[string]*Channel{}
+	blob, err := backend.ReadBlob(channelBlob(app))
+	if errors.Is(err, backend.ErrNotFound) {
+		return channels, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read channels - %v", err)
+	}
+	defer blob.Close()
+
+	raw, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read channels - %v", err)
+	}
+	err = json.Unmarshal(raw, &channels)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse channels - %v", err)
+	}
+	return channels, nil
+}
+
+// writeChannels writes an app's channels to storage
+func writeChannels(app string, channels map[string]*Channel) error {
+	raw, err := json.Marshal(channels)
+	if err != nil {
+		return err
+	}
+	err = backend.WriteBlob(channelBlob(app), bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("Failed to write channels - %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package slurp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/names"
+)
+
+// Kinds of checks run while committing
+const (
+	CheckHook       = "hook"       // output of a hook run against the build
+	CheckValidation = "validation" // result of validating the build's contents
+	CheckPolicy     = "policy"     // decision made from slurp's settings
+)
+
+// maxCheckOutput is the most output kept for a single check
+const maxCheckOutput = 4 << 10
+
+// Check is the result of a hook, validation, or policy decision made while
+// committing a build
+type Check struct {
+	Name      string `json:"name"`                // what was checked
+	Kind      string `json:"kind"`                // hook, validation, or policy
+	Ok        bool   `json:"ok"`                  // whether the commit may proceed
+	Output    string `json:"output,omitempty"`    // details or error (first 4KiB)
+	Truncated bool   `json:"truncated,omitempty"` // whether output was cut short
+}
+
+// CommitReport is the payload of commit events, so receivers can gate on a
+// commit without asking slurp for details
+type CommitReport struct {
+	Index
+	Checks []Check `json:"checks"`          // checks run while committing, in order
+	Error  string  `json:"error,omitempty"` // why the commit failed
+}
+
+// checks collects the checks run for a commit
+type checks []Check
+
+// add records a check, failing it if err is set (the error becomes its output)
+func (self *checks) add(name, kind string, err error, output string) {
+	check := Check{Name: name, Kind: kind, Ok: err == nil, Output: output}
+	if err != nil {
+		check.Output = err.Error()
+	}
+	if len(check.Output) > maxCheckOutput {
+		check.Output = check.Output[:maxCheckOutput]
+		check.Truncated = true
+	}
+	*self = append(*self, check)
+}
+
+// outputPolicy describes why a build is committed with its output format
+func outputPolicy(buildId, output string) string {
+	if stage, err := GetStage(buildId); err == nil && stage.Template != "" && config.Get(&config.Templates)[stage.Template].Output != "" {
+		return fmt.Sprintf("%s (template '%s')", output, stage.Template)
+	}
+	return fmt.Sprintf("%s (default)", output)
+}
+
+// validatePaths ensures every file in the build dir can be named as a blob
+// before anything is uploaded, returning the number of files
+func validatePaths(buildId string) (int, error) {
+	root := filepath.Join(config.BuildDir, buildId)
+	count := 0
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		_, err = names.Path(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+
+		count++
+		return nil
+	})
+
+	return count, err
+}
@@ -0,0 +1,444 @@
+package slurp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/bind"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/ssh"
+	"github.com/mu-box/slurp/store"
+)
+
+const (
+	clusterBeat  = 5 * time.Second // interval between announcements
+	clusterGrace = time.Minute     // age under which unknown staging dirs may be a peer's stage being added
+)
+
+// Node is a slurp of the cluster, as it last announced itself. Each node
+// announces the stages (and recent commits) it owns to storage, as
+// ".cluster/<name>.json", for its peers to forward requests by.
+type Node struct {
+	Name   string    `json:"name"`
+	Api    string    `json:"api"`              // api uri peers forward requests to
+	Ssh    string    `json:"ssh"`              // ssh address peers relay syncs to
+	Mode   string    `json:"mode,omitempty"`   // "api" or "ssh" if it runs only that part
+	Beat   time.Time `json:"beat"`             // when it last announced itself
+	Stages []Stage   `json:"stages,omitempty"` // stages it owns
+	Jobs   []Job     `json:"jobs,omitempty"`   // its commits kept for jobRetention
+	Live   bool      `json:"live"`             // whether it announced itself within cluster-timeout
+}
+
+// the peers as last read, guarded by their lock
+var cluster = struct {
+	sync.Mutex
+	peers   map[string]Node
+	changed chan struct{} // signals a change worth announcing at once
+}{peers: map[string]Node{}, changed: make(chan struct{}, 1)}
+
+// clusterBlob returns the blob a node announces itself as
+func clusterBlob(name string) string {
+	return ".cluster/" + name + ".json"
+}
+
+// Clustered reports whether slurp runs as a node of a cluster
+func Clustered() bool {
+	return config.Node != ""
+}
+
+// StartCluster joins the cluster: it waits for storage, gives up restored
+// stages a live peer took over while this node was gone, then announces the
+// node's stages every few seconds (and as they change), watching its peers
+// to take over the stages of one that stops.
+func StartCluster() error {
+	if !Clustered() {
+		return nil
+	}
+	err := backend.WaitHealthy(config.StoreWait)
+	if err != nil {
+		return fmt.Errorf("Backend not ready - %v", err)
+	}
+
+	refreshPeers()
+	for _, stage := range ListStages() {
+		if node, ok := peerOwner(stage.Id); ok {
+			config.Log.Info("Stage '%v' was taken over by '%v', giving it up", stage.Id, node.Name)
+			release(stage.Id)
+		}
+	}
+	takeOver()
+	err = announce()
+	if err != nil {
+		return err
+	}
+	ssh.OnRelay(relayAddr)
+
+	go func() {
+		tick := time.NewTicker(clusterBeat)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				refreshPeers()
+				takeOver()
+			case <-cluster.changed:
+			}
+			err := announce()
+			if err != nil {
+				config.Log.Error("%v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+// clusterChanged announces the node's stages soon, so peers learn of a new
+// stage before a client reaches them
+func clusterChanged() {
+	if !Clustered() {
+		return
+	}
+	select {
+	case cluster.changed <- struct{}{}:
+	default:
+	}
+}
+
+// announce writes the node's announcement
+func announce() error {
+	node := thisNode()
+	node.Stages, node.Jobs = ListStages(), recentJobs()
+	raw, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	err = backend.WriteBlob(clusterBlob(node.Name), bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("Failed to announce node - %v", err)
+	}
+	return nil
+}
+
+// thisNode returns this node as it announces itself, without its stages and
+// commits. Api nodes run no ssh server to relay syncs to.
+func thisNode() Node {
+	node := Node{Name: config.Node, Api: advertised(config.ApiAddress, true), Beat: time.Now().UTC(), Live: true}
+	if config.Mode != "all" {
+		node.Mode = config.Mode
+	}
+	if config.Mode != "api" {
+		node.Ssh = advertised(config.SshAddr, false)
+	}
+	return node
+}
+
+// advertised returns the first of a list of listen addresses (api uris if
+// uri) with its host replaced by cluster-host
+func advertised(list string, uri bool) string {
+	addrs := bind.Split(list)
+	if len(addrs) == 0 {
+		return ""
+	}
+	addr := addrs[0]
+	if uri {
+		u, err := url.Parse(addr)
+		if err != nil {
+			return ""
+		}
+		if u.Scheme != "http" {
+			u.Scheme = "https"
+		}
+		u.Host = net.JoinHostPort(clusterHost(), u.Port())
+		return u.String()
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	return net.JoinHostPort(clusterHost(), port)
+}
+
+// clusterHost returns the host peers reach this node at
+func clusterHost() string {
+	if config.NodeHost != "" {
+		return config.NodeHost
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// refreshPeers reads the peers' announcements
+func refreshPeers() {
+	peers := map[string]Node{}
+	for _, name := range config.Peers {
+		body, err := backend.ReadBlob(clusterBlob(name))
+		if errors.Is(err, backend.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			config.Log.Error("Failed to read peer '%v' - %v", name, err)
+			// keep what was last known of it
+			cluster.Lock()
+			if node, ok := cluster.peers[name]; ok {
+				peers[name] = node
+			}
+			cluster.Unlock()
+			continue
+		}
+		var node Node
+		err = json.NewDecoder(body).Decode(&node)
+		body.Close()
+		if err != nil {
+			config.Log.Error("Bad announcement from peer '%v' - %v", name, err)
+			continue
+		}
+		node.Live = config.NodeTTL <= 0 || time.Since(node.Beat) < config.NodeTTL
+		peers[name] = node
+	}
+
+	cluster.Lock()
+	cluster.peers = peers
+	cluster.Unlock()
+}
+
+// Peers returns the cluster's other nodes, by name
+func Peers() []Node {
+	cluster.Lock()
+	defer cluster.Unlock()
+	nodes := make([]Node, 0, len(cluster.peers))
+	for _, node := range cluster.peers {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Name < nodes[j].Name
+	})
+	return nodes
+}
+
+// Nodes returns the nodes of the cluster, this one first, as they last
+// announced themselves (without their stages and commits)
+func Nodes() []Node {
+	nodes := []Node{thisNode()}
+	for _, node := range Peers() {
+		node.Stages, node.Jobs = nil, nil
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// ClusterStages returns the stages of this node and its live peers, sorted by
+// id, each with the node it is on
+func ClusterStages() []Stage {
+	list := ListStages()
+	for i := range list {
+		list[i].Node = config.Node
+	}
+	for _, node := range Peers() {
+		if !node.Live {
+			continue
+		}
+		for _, stage := range node.Stages {
+			stage.Node = node.Name
+			list = append(list, stage)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+// Owner returns the live peer a build's stage (or its recent commit) is on,
+// if it isn't this node's. A build the peers aren't known to have is looked
+// for again in their latest announcements.
+func Owner(buildId string) (Node, bool) {
+	if !Clustered() || getUser(buildId) == nil {
+		return Node{}, false
+	}
+	if _, err := GetJob(buildId); err == nil {
+		return Node{}, false
+	}
+	if node, ok := peerOwner(buildId); ok {
+		return node, true
+	}
+	refreshPeers()
+	return peerOwner(buildId)
+}
+
+// peerOwner returns the live peer owning a build, as last read
+func peerOwner(buildId string) (Node, bool) {
+	for _, node := range Peers() {
+		if !node.Live {
+			continue
+		}
+		for _, stage := range node.Stages {
+			if stage.Id == buildId {
+				return node, true
+			}
+		}
+		for _, job := range node.Jobs {
+			if job.Build == buildId {
+				return node, true
+			}
+		}
+	}
+	return Node{}, false
+}
+
+// DataNode returns the live peer an api node stages a new build on: the one
+// staging the fewest builds (by name if tied), among those running ssh
+func DataNode() (Node, bool) {
+	var best Node
+	found := false
+	for _, node := range Peers() {
+		if !node.Live || node.Mode == "api" {
+			continue
+		}
+		if !found || len(node.Stages) < len(best.Stages) {
+			best, found = node, true
+		}
+	}
+	return best, found
+}
+
+// CheckDataPlane fails if an api node has no live peer to stage builds on
+func CheckDataPlane() error {
+	if _, ok := DataNode(); !ok {
+		return errors.New("No live ssh node to stage builds on")
+	}
+	return nil
+}
+
+// relayAddr returns the ssh address of the live peer syncs to a build are
+// relayed to, or "" if none owns it
+func relayAddr(build string) string {
+	if node, ok := Owner(build); ok {
+		return node.Ssh
+	}
+	return ""
+}
+
+// takeOver adopts the stages of peers that stopped announcing themselves.
+// The live node running ssh whose name sorts first adopts them, so only one
+// does (api nodes have no ssh server to sync them to).
+func takeOver() {
+	if config.NodeTTL <= 0 || config.Mode == "api" {
+		return
+	}
+	var dead []Node
+	first := config.Node
+	for _, node := range Peers() {
+		if !node.Live {
+			dead = append(dead, node)
+		} else if node.Mode != "api" && node.Name < first {
+			first = node.Name
+		}
+	}
+	if first != config.Node {
+		return
+	}
+
+	for _, node := range dead {
+		for _, stage := range node.Stages {
+			if getUser(stage.Id) == nil {
+				continue
+			}
+			if _, ok := peerOwner(stage.Id); ok {
+				// already taken over by another node
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(config.BuildDir, stage.Id)); err != nil {
+				config.Log.Error("Can't take over stage '%v' from '%v', build dir is gone - %v", stage.Id, node.Name, err)
+				continue
+			}
+			err := adopt(stage)
+			if err != nil {
+				config.Log.Error("%sFailed to take over stage '%v' from '%v' - %v", reqid.Tag(stage.Id), stage.Id, node.Name, err)
+				continue
+			}
+			config.Log.Info("Took over stage '%v' from '%v'", stage.Id, node.Name)
+		}
+	}
+}
+
+// adopt makes a stage of a stopped peer this node's, restarting a commit
+// the peer was running (as ResumeCommits does after a restart)
+func adopt(stage Stage) error {
+	interrupted := stage.State == StateQueued || stage.State == StateCommitting
+	if interrupted {
+		stage.State = StateStaged
+	}
+	stage.Node, stage.Queue = "", 0
+
+	if stage.State != StateCommitted && stage.State != StateAborted {
+		err := ssh.AddUser(stage.Id, config.Get(&config.Templates)[stage.Template].Rsync)
+		if err != nil {
+			return fmt.Errorf("Failed to add user - %v", err)
+		}
+	}
+	mutex.Lock()
+	stages[stage.Id] = &stage
+	mutex.Unlock()
+	persist(stage)
+
+	switch {
+	case stage.State == StateCommitted:
+		// uploaded, only the clean up was missed
+		go DeleteStage(stage.Id)
+	case interrupted && config.Resume:
+		config.Log.Info("%sResuming commit of '%v' taken over", reqid.Tag(stage.Id), stage.Id)
+		go resume(stage.Id)
+	}
+	return nil
+}
+
+// release gives up a stage a peer owns now, leaving its (shared) build dir
+func release(buildId string) {
+	ssh.DelUser(buildId)
+	mutex.Lock()
+	delete(stages, buildId)
+	mutex.Unlock()
+	forget(buildId)
+	store.Delete(jobsBucket, buildId)
+}
+
+// peerDir reports whether a dir in the shared build dir may belong to a
+// peer: one of its stages, or one it may be adding (changed recently)
+func peerDir(name string) bool {
+	if !Clustered() {
+		return false
+	}
+	for _, node := range Peers() {
+		for _, stage := range node.Stages {
+			if stage.Id == name {
+				return true
+			}
+		}
+	}
+	info, err := os.Stat(filepath.Join(config.BuildDir, name))
+	return err == nil && time.Since(info.ModTime()) < clusterGrace
+}
+
+// recentJobs returns the node's commit records
+func recentJobs() []Job {
+	jobs := []Job{}
+	err := store.Each(jobsBucket, func(key string, raw []byte) error {
+		var job Job
+		if json.Unmarshal(raw, &job) == nil {
+			jobs = append(jobs, job)
+		}
+		return nil
+	})
+	if err != nil {
+		config.Log.Error("Failed to load commits - %v", err)
+	}
+	return jobs
+}
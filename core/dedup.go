@@ -0,0 +1,87 @@
+package slurp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+)
+
+// upload is a commit in flight
+type upload struct {
+	digest string        // content hash of the staged build, taken before the commit touched it
+	hashed chan struct{} // closed once digest is set
+	done   chan struct{} // closed once the upload finished
+	err    error         // result of the upload, set before done is closed
+}
+
+var (
+	// commits in flight keyed by build id
+	uploads = map[string]*upload{}
+
+	// uploadMutex ensures updates to uploads are atomic
+	uploadMutex = sync.Mutex{}
+)
+
+// claimUpload takes the upload lock for a build, hashing the staged build
+// before the commit touches it (its hooks and excludes edit the dir). A
+// commit finding another of the build in flight doesn't hash the dir that one
+// is working on: the stage has been locked since it was hashed, so it takes
+// that hash as its own and waits. If the upload of that content succeeded a
+// nil upload is returned (nothing left to do), otherwise the lock is claimed
+// once it is released. A claimed upload must be passed to finishUpload.
+func claimUpload(buildId string) (*upload, error) {
+	var digest string
+	for {
+		uploadMutex.Lock()
+		current, ok := uploads[buildId]
+		if !ok {
+			owned := &upload{hashed: make(chan struct{}), done: make(chan struct{})}
+			uploads[buildId] = owned
+			uploadMutex.Unlock()
+
+			var err error
+			owned.digest, err = stageDigest(buildId)
+			close(owned.hashed)
+			if err != nil {
+				finishUpload(buildId, owned, err)
+				return nil, fmt.Errorf("Failed to hash build - %v", err)
+			}
+			return owned, nil
+		}
+		uploadMutex.Unlock()
+
+		<-current.hashed
+		if digest == "" {
+			digest = current.digest
+		}
+		<-current.done
+		if current.err == nil && current.digest == digest {
+			return nil, nil
+		}
+	}
+}
+
+// finishUpload records the result of a claimed upload and releases the lock
+func finishUpload(buildId string, owned *upload, err error) {
+	uploadMutex.Lock()
+	owned.err = err
+	delete(uploads, buildId)
+	uploadMutex.Unlock()
+
+	close(owned.done)
+}
+
+// stageDigest hashes the paths, modes, and contents of a staged build
+func stageDigest(buildId string) (string, error) {
+	files, err := manifest(buildId)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.New()
+	for _, file := range files {
+		fmt.Fprintf(sum, "%s\x00%v\x00%s\x00", file.Path, file.Mode, file.Sha256)
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
@@ -0,0 +1,371 @@
+package slurp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+)
+
+// maxDeltaDepth is the longest chain of delta layers before a full layer is
+// committed, bounding the work to reassemble a build
+const maxDeltaDepth = 10
+
+// File describes a file (or dir, or symlink) of a build committed as a delta
+type File struct {
+	Path   string      `json:"path"`             // path within the build
+	Mode   os.FileMode `json:"mode"`             // type and permission bits
+	Size   int64       `json:"size,omitempty"`   // bytes (regular files)
+	Sha256 string      `json:"sha256,omitempty"` // checksum of the contents (or symlink target)
+	Offset int64       `json:"offset,omitempty"` // where the contents start in a seekable archive, uncompressed
+	Part   int         `json:"part,omitempty"`   // split archive part holding the file
+}
+
+// commitDelta uploads only the files that changed since the stage's base
+// build as a compressed layer, recording the full manifest and a pointer to
+// the base in the index. Builds without a usable base get a full layer.
+// Bash equivalent:
+//  `tar -C buildDir/buildId --no-recursion -czf - changed... | curl localhost:7410/blobs/newId -T -`
+func commitDelta(buildId string, index *Index, results *checks) error {
+	files, err := manifest(buildId)
+	if err != nil {
+		return fmt.Errorf("Failed to list build - %v", err)
+	}
+	index.Files = files
+
+	base := map[string]File{}
+	if stage, err := GetStage(buildId); err == nil && stage.Base != "" {
+		baseIndex, err := GetIndex(stage.Base)
+		switch {
+		case err != nil:
+			config.Log.Debug("%sNo index for base '%v', committing a full layer - %v", reqid.Tag(buildId), stage.Base, err)
+		case baseIndex.Output != OutputDelta:
+			config.Log.Debug("%sBase '%v' isn't a delta build, committing a full layer", reqid.Tag(buildId), stage.Base)
+		case baseIndex.Depth >= maxDeltaDepth:
+			config.Log.Debug("%sBase '%v' is %d layers deep, committing a full layer", reqid.Tag(buildId), stage.Base, baseIndex.Depth)
+		default:
+			index.Base = stage.Base
+			index.Depth = baseIndex.Depth + 1
+			for _, file := range baseIndex.Files {
+				base[file.Path] = file
+			}
+		}
+	}
+
+	var changed []string
+	for _, file := range files {
+		if old, ok := base[file.Path]; !ok || old.Mode != file.Mode || old.Sha256 != file.Sha256 {
+			changed = append(changed, file.Path)
+		}
+	}
+
+	if index.Base != "" {
+		results.add("delta", CheckPolicy, nil, fmt.Sprintf("%d of %d files changed since '%s' (depth %d)", len(changed), len(files), index.Base, index.Depth))
+	} else {
+		results.add("delta", CheckPolicy, nil, fmt.Sprintf("full layer of %d files", len(files)))
+	}
+
+	key, err := blobKey(buildId, index)
+	if err != nil {
+		return err
+	}
+
+	buffer := newSpool()
+	defer buffer.Release()
+	onAbort(buildId, buffer.Release)
+
+	cmd := exec.Command("tar", "-C", filepath.Join(config.BuildDir, buildId), "--no-recursion", "--null", "-T", "-", "-czf", "-")
+	cmd.Env = append(os.Environ(), "GZIP=-n")
+	cmd.Stdin = strings.NewReader(strings.Join(changed, "\x00"))
+	cmd.Stdout = buffer
+
+	config.Log.Trace("%sRunning compress command '%v'", reqid.Tag(buildId), cmd.Args)
+
+	echan := make(chan error, 1)
+	sum := newDigest()
+	go func() {
+		err := backend.WriteBlobMeta(key, io.TeeReader(buffer, sum), blobMeta(index))
+		buffer.Release()
+		echan <- err
+	}()
+
+	// a failed compression fails the upload rather than ending it, so a
+	// truncated layer isn't stored
+	err = cmd.Run()
+	if err != nil {
+		buffer.Release()
+		<-echan
+		return fmt.Errorf("Failed to compress build - %v", err)
+	}
+	buffer.Close()
+
+	err = <-echan
+	if err != nil {
+		return fmt.Errorf("Failed to write build - %v", err)
+	}
+
+	index.Entries = append(index.Entries, sum.entry("", key))
+	return nil
+}
+
+// manifest lists the files, dirs, and symlinks of a staged build
+func manifest(buildId string) ([]File, error) {
+	root := filepath.Join(config.BuildDir, buildId)
+	var files []File
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		file := File{Path: filepath.ToSlash(rel), Mode: info.Mode()}
+
+		switch {
+		case info.Mode().IsRegular():
+			file.Size = info.Size()
+			file.Sha256, err = fileSum(path)
+		case info.Mode()&os.ModeSymlink != 0:
+			var target string
+			target, err = os.Readlink(path)
+			sum := sha256.Sum256([]byte(target))
+			file.Sha256 = hex.EncodeToString(sum[:])
+		}
+		if err != nil {
+			return err
+		}
+
+		files = append(files, file)
+		return nil
+	})
+
+	return files, err
+}
+
+// fileSum returns the hex encoded sha256 of a file's contents
+func fileSum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// extractBuild writes the full tree of a committed build to dir, applying
+// delta layers on top of their base and the parts of split archives in order.
+// Files listed in the exclude file (if set) are skipped.
+func extractBuild(buildId, dir, exclude string) error {
+	index, err := GetIndex(buildId)
+	if errors.Is(err, backend.ErrNotFound) {
+		// builds committed before indexes existed are archives
+		return extractArchive(buildId, FormatTarGz, dir, exclude)
+	}
+	if err == nil && index.Split != "" {
+		for _, part := range index.parts() {
+			err = extractArchive(part, index.Format, dir, exclude)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err == nil && index.Output != OutputDelta {
+		return extractArchive(index.blob(), index.Format, dir, exclude)
+	}
+	if err != nil {
+		return err
+	}
+
+	if index.Base != "" {
+		err = extractBuild(index.Base, dir, exclude)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = extractArchive(index.blob(), FormatTarGz, dir, exclude)
+	if err != nil {
+		return err
+	}
+
+	return pruneTree(dir, index.Files)
+}
+
+// extractArchive extracts a blob of an archive format into dir, skipping the
+// paths listed in the exclude file (if set) for tar formats
+// Bash equivalent:
+//  `curl localhost:7410/blobs/blobId | tar -C dir -zxf -`
+func extractArchive(blobId, format, dir, exclude string) error {
+	res, err := backend.ReadBlob(blobId)
+	if err != nil {
+		return fmt.Errorf("Failed to get old build - %w", err)
+	}
+	defer res.Close()
+
+	config.Log.Trace("Fetched build")
+
+	if format == FormatSquashfs {
+		return extractSquashfs(res, blobId, dir)
+	}
+
+	flags, err := tarArgs(format, false)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"--atime-preserve", "-C", dir}
+	if exclude != "" {
+		// listed paths are matched whole, as written
+		args = append(args, "--anchored", "--no-wildcards", "-X", exclude)
+	}
+	cmd := exec.Command("tar", append(append(args, flags...), "-")...)
+	cmd.Stdin = res
+
+	config.Log.Trace("%sRunning extract command '%v'", reqid.Tag(blobId), cmd.Args)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to extract build to dir '%s' - %v", out, err)
+	}
+
+	config.Log.Trace("Extracted build")
+	return nil
+}
+
+// pruneTree removes everything under dir that isn't in the manifest (files
+// deleted since the base layer)
+func pruneTree(dir string, files []File) error {
+	keep := map[string]bool{}
+	for _, file := range files {
+		keep[file.Path] = true
+	}
+
+	var remove []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		if !keep[filepath.ToSlash(rel)] {
+			remove = append(remove, path)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to prune build - %v", err)
+	}
+
+	for _, path := range remove {
+		err = os.RemoveAll(path)
+		if err != nil {
+			return fmt.Errorf("Failed to prune build - %v", err)
+		}
+	}
+	return nil
+}
+
+// ReadBuild returns the full tree of a committed build as a single archive,
+// along with its format, reassembling delta builds from their layers and
+// split builds from their parts.
+func ReadBuild(buildId string) (io.ReadCloser, string, error) {
+	index, err := GetIndex(buildId)
+	if errors.Is(err, backend.ErrNotFound) {
+		blob, err := backend.ReadBlob(buildId)
+		return blob, FormatTarGz, err
+	}
+	if err == nil && index.Output == OutputArchive && index.Split == "" {
+		blob, err := backend.ReadBlob(index.blob())
+		return blob, index.Format, err
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if index.Output == OutputTree {
+		return nil, "", fmt.Errorf("Builds with '%s' output can't be read as one archive", index.Output)
+	}
+
+	dir, err := ioutil.TempDir("", "slurp-assemble-")
+	if err != nil {
+		return nil, "", fmt.Errorf("Failed to create assembly dir - %v", err)
+	}
+
+	err = extractBuild(buildId, dir, "")
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", err
+	}
+
+	// split archives list their files in the manifest
+	files := index.Files
+	if index.Split != "" {
+		manifest, err := GetManifest(buildId)
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, "", err
+		}
+		files = manifest.Files
+	}
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		paths = append(paths, file.Path)
+	}
+
+	cmd := exec.Command("tar", "-C", dir, "--no-recursion", "--null", "-T", "-", "-czf", "-")
+	cmd.Env = append(os.Environ(), "GZIP=-n")
+	cmd.Stdin = strings.NewReader(strings.Join(paths, "\x00"))
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", fmt.Errorf("Failed to compress build - %v", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, "", fmt.Errorf("Failed to compress build - %v", err)
+	}
+
+	return &assembled{ReadCloser: out, cmd: cmd, dir: dir}, FormatTarGz, nil
+}
+
+// assembled is a reassembled build being streamed, cleaned up on close
+type assembled struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+	dir string
+}
+
+func (self *assembled) Close() error {
+	self.ReadCloser.Close()
+	err := self.cmd.Wait()
+	os.RemoveAll(self.dir)
+	return err
+}
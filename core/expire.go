@@ -0,0 +1,91 @@
+package slurp
+
+import (
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/webhook"
+)
+
+// StartSweeper deletes stages that expired uncommitted, checking every
+// interval while disk space is plentiful, and more often (with shorter ttls)
+// past each of sweep-tiers
+func StartSweeper(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		next := interval
+		for {
+			time.Sleep(next)
+			next = janitorSweep(interval)
+		}
+	}()
+}
+
+// sweep deletes every stage that expired before now. Under disk pressure
+// (tier isn't nil) stage ttls are scaled by the tier's factor, and aborted
+// stages and orphaned staging dirs are removed at once.
+func sweep(now time.Time, tier *SweepTier) {
+	pruneDeleted(now)
+	pruneJobs(now)
+	pruneStats(now)
+	pruneQuarantine(now)
+	pruneBulk(now)
+
+	if bytes := prunePool(); bytes > 0 {
+		config.Log.Debug("Pruned %d unused bytes from the pool", bytes)
+	}
+
+	if tier != nil {
+		report, err := CollectGarbage()
+		if err != nil {
+			config.Log.Error("Failed to collect garbage under disk pressure - %v", err)
+		} else if report.Bytes > 0 {
+			config.Log.Info("Reclaimed %d bytes of orphaned staging dirs under disk pressure", report.Bytes)
+		}
+	}
+
+	var expired []string
+	early := map[string]bool{}
+
+	mutex.Lock()
+	for id, stage := range stages {
+		if expires := expiry(stage, tier); !expires.IsZero() && expires.Before(now) {
+			expired = append(expired, id)
+			early[id] = !stage.Expires.Before(now)
+		}
+	}
+	mutex.Unlock()
+
+	for _, id := range expired {
+		if early[id] {
+			config.Log.Info("Stage '%v' expired early under disk pressure, removing", id)
+		} else {
+			config.Log.Info("Stage '%v' expired uncommitted, removing", id)
+		}
+		var labels map[string]string
+		if stage, err := GetStage(id); err == nil {
+			labels = stage.Metadata
+		}
+		webhook.SendLabeled(webhook.StageExpired, id, labels, nil)
+
+		err := DeleteStage(id)
+		if err != nil {
+			config.Log.Error("Failed to remove expired stage '%v' - %v", id, err)
+		}
+	}
+}
+
+// ttlFor returns how long a new stage may live uncommitted, preferring the
+// requested ttl, then the template's, then the global default.
+func ttlFor(opts StageOptions) time.Duration {
+	if opts.TTL > 0 {
+		return opts.TTL
+	}
+	if ttl := config.Get(&config.Templates)[opts.Template].TTL; opts.Template != "" && ttl > 0 {
+		return ttl
+	}
+	return config.StageTTL
+}
@@ -0,0 +1,269 @@
+package slurp
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+)
+
+// scanTimeout is the longest the scanner may take over a single file
+const scanTimeout = 5 * time.Minute
+
+// clamdChunk is the size of the chunks files are streamed to clamd in
+const clamdChunk = 64 << 10
+
+// filterBuild removes the paths commit-exclude leaves out of a build from its
+// staging dir, then refuses the build if it has files over commit-max-file or
+// files commit-scanner flags, naming them
+func filterBuild(buildId string, results *checks) error {
+	root := filepath.Join(config.BuildDir, buildId)
+
+	if len(config.Get(&config.Exclude)) > 0 {
+		excluded, err := excludePaths(buildId, root)
+		if err != nil {
+			results.add("exclude", CheckPolicy, err, "")
+			return fmt.Errorf("Failed to exclude files - %v", err)
+		}
+		summary := fmt.Sprintf("removed %d paths", len(excluded))
+		if len(excluded) > 0 {
+			summary += ": " + strings.Join(excluded, ", ")
+		}
+		results.add("exclude", CheckPolicy, nil, summary)
+	}
+
+	fileMax, scanner := config.Get(&config.FileMax), config.Get(&config.Scanner)
+	if fileMax <= 0 && scanner == "" {
+		return nil
+	}
+	var files, oversized []string
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		files = append(files, rel)
+		if fileMax > 0 && info.Size() > int64(fileMax)<<20 {
+			oversized = append(oversized, fmt.Sprintf("%s (%dMB)", rel, info.Size()>>20))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to list build - %v", err)
+	}
+
+	if fileMax > 0 {
+		if len(oversized) > 0 {
+			err = fmt.Errorf("Build contains files over %dMB: %s", fileMax, strings.Join(oversized, ", "))
+		}
+		results.add("max-file-size", CheckPolicy, err, fmt.Sprintf("%d files within %dMB", len(files), fileMax))
+		if err != nil {
+			return err
+		}
+	}
+
+	if scanner != "" {
+		flagged, err := scanFiles(buildId, root, files, scanner)
+		if err != nil {
+			results.add("scanner", CheckValidation, err, "")
+			return fmt.Errorf("Failed to scan files - %v", err)
+		}
+		if len(flagged) > 0 {
+			err = fmt.Errorf("Scanner flagged files: %s", strings.Join(flagged, ", "))
+		}
+		results.add("scanner", CheckValidation, err, fmt.Sprintf("%d files clean", len(files)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// excludePaths removes the files and dirs of a build matching commit-exclude,
+// returning their paths
+func excludePaths(buildId, root string) ([]string, error) {
+	var excluded []string
+	err := filepath.Walk(root, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if file == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !isExcluded(rel) {
+			return nil
+		}
+
+		excluded = append(excluded, rel)
+		if info.IsDir() {
+			err = removeDir(file)
+			if err == nil {
+				err = filepath.SkipDir
+			}
+			return err
+		}
+		return os.Remove(file)
+	})
+	if len(excluded) > 0 {
+		config.Log.Debug("%sExcluded %d paths from '%v'", reqid.Tag(buildId), len(excluded), buildId)
+	}
+	return excluded, err
+}
+
+// isExcluded reports whether commit-exclude leaves a path out of commits. A
+// pattern without a / matches any file or dir of that name, others match the
+// path from the build's root.
+func isExcluded(rel string) bool {
+	for _, pattern := range config.Get(&config.Exclude) {
+		pattern = strings.Trim(pattern, "/")
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// scanFiles checks a build's files with a scanner (commit-scanner), returning those it
+// flags with what was found
+func scanFiles(buildId, root string, files []string, scanner string) ([]string, error) {
+	var scan func(file string) (string, error)
+	switch {
+	case strings.HasPrefix(scanner, "clamd://"):
+		scan = clamdScanner(strings.TrimPrefix(scanner, "clamd://"))
+	case strings.HasPrefix(scanner, "exec:"):
+		scan = execScanner(strings.TrimPrefix(scanner, "exec:"))
+	default:
+		return nil, fmt.Errorf("Unknown scanner '%s'", scanner)
+	}
+
+	var flagged []string
+	for _, rel := range files {
+		if isAborted(buildId) {
+			return nil, ErrAborted
+		}
+		found, err := scan(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to scan '%s' - %v", rel, err)
+		}
+		if found != "" {
+			flagged = append(flagged, fmt.Sprintf("%s (%s)", rel, found))
+		}
+	}
+	return flagged, nil
+}
+
+// clamdScanner streams files to clamd at a socket path or host:port,
+// returning the signature it finds
+func clamdScanner(addr string) func(file string) (string, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+
+	return func(file string) (string, error) {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		conn, err := net.DialTimeout(network, addr, 10*time.Second)
+		if err != nil {
+			return "", fmt.Errorf("Failed to connect to clamd - %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(scanTimeout))
+
+		_, err = conn.Write([]byte("zINSTREAM\x00"))
+		if err != nil {
+			return "", err
+		}
+		chunk := make([]byte, 4+clamdChunk)
+		for {
+			n, rerr := f.Read(chunk[4:])
+			if n > 0 {
+				binary.BigEndian.PutUint32(chunk, uint32(n))
+				if _, err = conn.Write(chunk[:4+n]); err != nil {
+					return "", err
+				}
+			}
+			if rerr == io.EOF {
+				break
+			}
+			if rerr != nil {
+				return "", rerr
+			}
+		}
+		if _, err = conn.Write([]byte{0, 0, 0, 0}); err != nil {
+			return "", err
+		}
+
+		// eg "stream: OK" or "stream: Eicar-Signature FOUND"
+		reply, err := bufio.NewReader(conn).ReadString(0)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		reply = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(reply, "stream:"), "\x00"))
+		switch {
+		case reply == "OK":
+			return "", nil
+		case strings.HasSuffix(reply, " FOUND"):
+			return strings.TrimSuffix(reply, " FOUND"), nil
+		}
+		return "", fmt.Errorf("clamd replied '%s'", reply)
+	}
+}
+
+// execScanner runs a command (with sh) on each file, passed as its last
+// argument. Like clamscan, it exits 0 for clean files and 1 for flagged ones,
+// whose output says what was found; any other exit fails the scan.
+func execScanner(command string) func(file string) (string, error) {
+	return func(file string) (string, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), scanTimeout)
+		defer cancel()
+
+		out, err := exec.CommandContext(ctx, "sh", "-c", command+` "$1"`, "sh", file).CombinedOutput()
+		var exit *exec.ExitError
+		switch {
+		case err == nil:
+			return "", nil
+		case errors.As(err, &exit) && exit.ExitCode() == 1:
+			// eg clamscan's "<file>: Eicar-Signature FOUND"
+			found, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+			found = strings.TrimSuffix(strings.TrimSpace(strings.TrimPrefix(found, file+":")), " FOUND")
+			if found == "" {
+				found = "flagged"
+			}
+			return found, nil
+		}
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+}
@@ -0,0 +1,125 @@
+package slurp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+)
+
+// Archive formats
+const (
+	FormatTarGz    = "tar.gz"   // gzip compressed tar
+	FormatTarZst   = "tar.zst"  // zstd compressed tar
+	FormatSquashfs = "squashfs" // squashfs image, mountable as is
+)
+
+// validFormat reports whether slurp can write an archive format
+func validFormat(format string) bool {
+	switch format {
+	case FormatTarGz, FormatTarZst, FormatSquashfs:
+		return true
+	}
+	return false
+}
+
+// formatFor returns the archive format for a build, preferring the stage's
+// own, then its template's, over the global default.
+func formatFor(buildId string) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if stage, ok := stages[buildId]; ok {
+		if stage.Format != "" {
+			return stage.Format
+		}
+		if format := config.Get(&config.Templates)[stage.Template].Format; stage.Template != "" && format != "" {
+			return format
+		}
+	}
+	return config.ArchiveFmt
+}
+
+// tarArgs returns the tar flags to create (or extract) an archive format
+func tarArgs(format string, create bool) ([]string, error) {
+	mode := "-x"
+	if create {
+		mode = "-c"
+	}
+	switch format {
+	case FormatTarGz, "":
+		return []string{mode + "zf"}, nil
+	case FormatTarZst:
+		return []string{"--zstd", mode + "f"}, nil
+	}
+	return nil, fmt.Errorf("Unknown archive format '%s'", format)
+}
+
+// commitSquashfs builds a squashfs image of the build dir and uploads it as
+// key. The image is written to a temporary file first, as mksquashfs can't
+// stream.
+// Bash equivalent:
+//  `mksquashfs buildDir/buildId image -noappend && curl localhost:7410/blobs/newId -T image`
+func commitSquashfs(buildId, key string, index *Index, meta map[string]string) error {
+	image, err := ioutil.TempFile(config.BuildDir, ".slurp-squashfs-")
+	if err != nil {
+		return fmt.Errorf("Failed to create image file - %v", err)
+	}
+	image.Close()
+	defer os.Remove(image.Name())
+
+	cmd := exec.Command("mksquashfs", config.BuildDir+"/"+buildId, image.Name(), "-noappend", "-no-progress", "-quiet")
+	config.Log.Trace("%sRunning image command '%v'", reqid.Tag(buildId), cmd.Args)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to build image '%s' - %v", out, err)
+	}
+
+	if isAborted(buildId) {
+		return ErrAborted
+	}
+
+	file, err := os.Open(image.Name())
+	if err != nil {
+		return fmt.Errorf("Failed to open image - %v", err)
+	}
+	defer file.Close()
+
+	sum := newDigest()
+	err = backend.WriteBlobMeta(key, io.TeeReader(file, sum), meta)
+	if err != nil {
+		return fmt.Errorf("Failed to write build - %v", err)
+	}
+
+	index.Entries = append(index.Entries, sum.entry("", key))
+	return nil
+}
+
+// extractSquashfs downloads a squashfs image and unpacks it into dir
+// Bash equivalent:
+//  `curl localhost:7410/blobs/blobId -o image && unsquashfs -f -d dir image`
+func extractSquashfs(blob io.Reader, blobId, dir string) error {
+	image, err := ioutil.TempFile(config.BuildDir, ".slurp-squashfs-")
+	if err != nil {
+		return fmt.Errorf("Failed to create image file - %v", err)
+	}
+	defer os.Remove(image.Name())
+
+	_, err = io.Copy(image, blob)
+	image.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to get old build - %v", err)
+	}
+
+	cmd := exec.Command("unsquashfs", "-f", "-no-progress", "-d", dir, image.Name())
+	config.Log.Trace("%sRunning extract command '%v'", reqid.Tag(blobId), cmd.Args)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to extract build to dir '%s' - %v", out, err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package slurp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mu-box/slurp/config"
+)
+
+// Reclaimed describes an orphaned staging dir removed by garbage collection
+type Reclaimed struct {
+	Id    string `json:"id"`    // name of the removed dir
+	Bytes int64  `json:"bytes"` // size of the files removed
+}
+
+// GCReport is the result of a garbage collection run
+type GCReport struct {
+	Removed     []Reclaimed `json:"removed"`                // orphaned dirs removed
+	Bytes       int64       `json:"bytes"`                  // total bytes reclaimed
+	Staged      int         `json:"staged,omitempty"`       // written back contents no stage lists, removed from storage (stage-store)
+	StagedBytes int64       `json:"staged-bytes,omitempty"` // size of the staged blobs removed
+	Errors      []string    `json:"errors,omitempty"`
+}
+
+// CollectGarbage removes directories in the build dir that don't belong to a
+// known stage (eg. leftovers from a crash), nor to a peer's in a cluster. With
+// stage-store, it also sweeps the written back contents no stage lists.
+func CollectGarbage() (GCReport, error) {
+	report := GCReport{Removed: []Reclaimed{}}
+
+	entries, err := ioutil.ReadDir(config.BuildDir)
+	if err != nil {
+		return report, fmt.Errorf("Failed to read build dir - %v", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() || known(entry.Name()) || peerDir(entry.Name()) {
+			continue
+		}
+
+		path := filepath.Join(config.BuildDir, entry.Name())
+		size := dirSize(path)
+
+		config.Log.Info("Removing orphaned staging dir '%v'", path)
+		err = removeDir(path)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Failed to remove '%s' - %v", entry.Name(), err))
+			continue
+		}
+
+		report.Removed = append(report.Removed, Reclaimed{Id: entry.Name(), Bytes: size})
+		report.Bytes += size
+	}
+
+	if config.StageStore {
+		report.Staged, report.StagedBytes, err = sweepStaged()
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+
+	return report, nil
+}
+
+// dirSize adds up the size of the regular files under path
+func dirSize(path string) int64 {
+	var size int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// known reports whether a dir in the build dir belongs to a stage (or one
+// being staged)
+func known(name string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, ok := stages[name]
+	return ok || pending[name]
+}
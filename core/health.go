@@ -0,0 +1,20 @@
+package slurp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/mu-box/slurp/config"
+)
+
+// CheckStaging ensures files can be written to the build dir
+func CheckStaging() error {
+	file, err := ioutil.TempFile(config.BuildDir, ".slurp-health-")
+	if err != nil {
+		return fmt.Errorf("Build dir not writable - %v", err)
+	}
+	file.Close()
+
+	return os.Remove(file.Name())
+}
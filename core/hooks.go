@@ -0,0 +1,170 @@
+package slurp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+)
+
+// maxHookOutput is the most output of a commit hook kept in its commit's job
+const maxHookOutput = 64 << 10
+
+// HookRun is the record of a commit hook run in a build's staging dir
+type HookRun struct {
+	Command   string        `json:"command"`
+	Exit      int           `json:"exit"`                // exit code (-1 if it was killed or didn't start)
+	Output    string        `json:"output,omitempty"`    // stdout and stderr, interleaved (first 64KiB)
+	Truncated bool          `json:"truncated,omitempty"` // whether output was cut short
+	Started   time.Time     `json:"started"`
+	Duration  time.Duration `json:"duration"`
+	Error     string        `json:"error,omitempty"` // why it failed
+}
+
+// hookOutput collects what a hook writes to stdout and stderr, up to
+// maxHookOutput
+type hookOutput struct {
+	sync.Mutex
+	buf       []byte
+	truncated bool
+}
+
+func (self *hookOutput) Write(p []byte) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+	room := maxHookOutput - len(self.buf)
+	if len(p) > room {
+		self.buf = append(self.buf, p[:room]...)
+		self.truncated = true
+	} else {
+		self.buf = append(self.buf, p...)
+	}
+	return len(p), nil
+}
+
+// commitHooks returns the hooks a build's commit runs: commit-hook, then its
+// template's
+func commitHooks(buildId string) []string {
+	hooks := append([]string{}, config.Get(&config.CommitHook)...)
+	if stage, err := GetStage(buildId); err == nil && stage.Template != "" {
+		hooks = append(hooks, config.Get(&config.Templates)[stage.Template].Hooks...)
+	}
+	return hooks
+}
+
+// runHooks runs a build's commit hooks in its staging dir, in order, stopping
+// at the first to fail. Each is recorded as a check and in the commit's job.
+// Files linked elsewhere are copied first, so hooks editing them in place
+// don't change other stages.
+func runHooks(buildId string, index Index, results *checks) error {
+	hooks := commitHooks(buildId)
+	if len(hooks) == 0 {
+		return nil
+	}
+	err := unshareStage(buildId)
+	if err != nil {
+		return fmt.Errorf("Failed to prepare build for commit hooks - %v", err)
+	}
+
+	for _, command := range hooks {
+		run := runHook(buildId, index, command)
+		logHook(buildId, run)
+
+		err = nil
+		if run.Error != "" {
+			err = fmt.Errorf("Commit hook '%s' failed - %s", command, run.Error)
+			config.Log.Error("%s%v", reqid.Tag(buildId), err)
+		}
+		results.add(command, CheckHook, err, run.Output)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runHook runs a commit hook with sh, killing it (and whatever it started)
+// after commit-hook-timeout or if the build is aborted
+func runHook(buildId string, index Index, command string) HookRun {
+	ctx, cancel := context.WithCancel(context.Background())
+	hookMax := config.Get(&config.HookMax)
+	if hookMax > 0 {
+		ctx, cancel = context.WithTimeout(ctx, hookMax)
+	}
+	defer cancel()
+	onAbort(buildId, cancel)
+
+	output := &hookOutput{}
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Dir = filepath.Join(config.BuildDir, buildId)
+	cmd.Env = append(os.Environ(), "SLURP_BUILD="+buildId, "SLURP_OUTPUT="+index.Output)
+	for k, v := range index.Metadata {
+		cmd.Env = append(cmd.Env, "SLURP_LABEL_"+labelEnv(k)+"="+v)
+	}
+	cmd.Stdout, cmd.Stderr = output, output
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	cmd.WaitDelay = 5 * time.Second
+
+	run := HookRun{Command: command, Started: time.Now().UTC()}
+	config.Log.Debug("%sRunning commit hook '%v' for '%v'", reqid.Tag(buildId), command, buildId)
+	err := cmd.Run()
+	run.Duration = time.Since(run.Started)
+	run.Exit = -1
+	if cmd.ProcessState != nil {
+		run.Exit = cmd.ProcessState.ExitCode()
+	}
+
+	output.Lock()
+	run.Output, run.Truncated = string(output.buf), output.truncated
+	output.Unlock()
+
+	var exit *exec.ExitError
+	switch {
+	case err == nil:
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		run.Error = fmt.Sprintf("killed after %v", hookMax)
+	case isAborted(buildId):
+		run.Error = ErrAborted.Error()
+	case errors.As(err, &exit) && run.Exit > 0:
+		run.Error = fmt.Sprintf("exited %d", run.Exit)
+	default:
+		run.Error = err.Error()
+	}
+	return run
+}
+
+// logHook adds a hook run to the record of the build's commit
+func logHook(buildId string, run HookRun) {
+	job, err := GetJob(buildId)
+	if err != nil {
+		return
+	}
+	job.Hooks = append(job.Hooks, run)
+	putJob(job)
+}
+
+// labelEnv turns a label key into an environment variable name, eg.
+// git.branch into GIT_BRANCH
+func labelEnv(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
@@ -0,0 +1,155 @@
+package slurp
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+)
+
+// minSweep is the shortest interval sweeps are run at under disk pressure
+const minSweep = 5 * time.Second
+
+// SweepTier is a build dir disk usage past which the janitor sweeps more
+// aggressively
+type SweepTier struct {
+	Used   float64 `json:"used"`   // percent of the build dir's filesystem used
+	Factor float64 `json:"factor"` // scale of the sweep interval and stage ttls (0 expires stages at once)
+}
+
+// JanitorStatus is how aggressively expired and abandoned stages are removed
+type JanitorStatus struct {
+	Used     float64    `json:"used"`               // percent of the build dir's filesystem used at the last sweep
+	Tier     *SweepTier `json:"tier,omitempty"`     // tier in effect (omitted while space is plentiful)
+	Interval string     `json:"interval,omitempty"` // time until the next sweep (omitted when sweeps are scheduled)
+	Last     time.Time  `json:"last"`               // when the last sweep ran
+}
+
+// status of the janitor as of its last sweep
+var janitor = struct {
+	sync.Mutex
+	status JanitorStatus
+}{}
+
+// Janitor returns how aggressively the last sweep ran
+func Janitor() JanitorStatus {
+	janitor.Lock()
+	defer janitor.Unlock()
+	status := janitor.status
+	if status.Tier != nil {
+		tier := *status.Tier
+		status.Tier = &tier
+	}
+	return status
+}
+
+// parseTiers parses sweep-tiers ("percent:factor" entries), lowest usage first
+func parseTiers(list []string) ([]SweepTier, error) {
+	tiers := make([]SweepTier, 0, len(list))
+	for _, entry := range list {
+		used, factor, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return nil, fmt.Errorf("'%s' isn't a percent:factor tier, eg 80:0.5", entry)
+		}
+		var tier SweepTier
+		var err error
+		tier.Used, err = strconv.ParseFloat(used, 64)
+		if err != nil || tier.Used < 0 || tier.Used > 100 {
+			return nil, fmt.Errorf("'%s' doesn't start with a percentage", entry)
+		}
+		tier.Factor, err = strconv.ParseFloat(factor, 64)
+		if err != nil || tier.Factor < 0 || tier.Factor > 1 {
+			return nil, fmt.Errorf("'%s' has a factor outside 0-1", entry)
+		}
+		tiers = append(tiers, tier)
+	}
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Used < tiers[j].Used })
+	return tiers, nil
+}
+
+// pressure returns the highest tier the build dir's disk usage is past, or nil
+// while space is plentiful
+func pressure(used float64) *SweepTier {
+	tiers, err := parseTiers(config.Get(&config.SweepTiers))
+	if err != nil {
+		config.Log.Error("Ignoring sweep-tiers - %v", err)
+		return nil
+	}
+
+	var tier *SweepTier
+	for i := range tiers {
+		if used >= tiers[i].Used {
+			tier = &tiers[i]
+		}
+	}
+	return tier
+}
+
+// janitorSweep sweeps as aggressively as the build dir's disk usage calls
+// for, returning the time until the next sweep: interval while space is
+// plentiful, shrinking by the tier's factor (to no less than minSweep) as it
+// fills. Scheduled sweeps pass an interval of 0.
+func janitorSweep(interval time.Duration) time.Duration {
+	now := time.Now()
+
+	var used float64
+	stats, err := DiskUsage()
+	if err != nil {
+		// the build dir may not exist until the first stage creates it
+		config.Log.Debug("Sweeping without disk usage - %v", err)
+	} else {
+		used = stats.Percent
+	}
+
+	tier := pressure(used)
+	sweep(now, tier)
+
+	next := interval
+	if tier != nil && interval > 0 {
+		next = time.Duration(float64(interval) * tier.Factor)
+		if next < minSweep {
+			next = minSweep
+		}
+	}
+
+	janitor.Lock()
+	previous := janitor.status.Tier
+	janitor.status = JanitorStatus{Used: used, Tier: tier, Last: now.UTC()}
+	if next > 0 {
+		janitor.status.Interval = next.String()
+	}
+	janitor.Unlock()
+
+	every := "on schedule"
+	if next > 0 {
+		every = "every " + next.String()
+	}
+	switch {
+	case tier != nil && (previous == nil || previous.Used != tier.Used):
+		config.Log.Info("Build dir %.1f%% used, sweeping %s with stage ttls scaled by %v", used, every, tier.Factor)
+	case tier == nil && previous != nil:
+		config.Log.Info("Build dir %.1f%% used, sweeping %s", used, every)
+	}
+	return next
+}
+
+// expiry returns when a stage expires under a disk pressure tier (nil for
+// none): aborted stages are purged at once, and staged ones live their ttl
+// scaled by the tier's factor
+func expiry(stage *Stage, tier *SweepTier) time.Time {
+	if tier == nil || stage.Expires.IsZero() {
+		return stage.Expires
+	}
+	switch stage.State {
+	case StateAborted:
+		return stage.Created
+	case StateStaged:
+		ttl := stage.Expires.Sub(stage.Created)
+		return stage.Created.Add(time.Duration(float64(ttl) * tier.Factor))
+	}
+	return stage.Expires
+}
@@ -0,0 +1,161 @@
+package slurp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/store"
+)
+
+// Commit job states
+const (
+	JobRunning   = "running"   // commit in progress
+	JobCommitted = "committed" // uploaded
+	JobFailed    = "failed"    // gave up, the stage is staged again
+)
+
+// jobRetention is how long finished commit jobs are kept
+const jobRetention = 24 * time.Hour
+
+// ErrNoJob is returned when a build has no recorded commit
+var ErrNoJob = errors.New("No commit found")
+
+// errInterrupted is the outcome of a commit cut short by a restart that
+// wasn't resumed
+var errInterrupted = errors.New("Interrupted by a restart")
+
+// Job is the record of a build's commit, kept across restarts so an
+// interrupted commit is resumed and its outcome is known
+type Job struct {
+	Build    string    `json:"build"`
+	State    string    `json:"state"`             // running, committed, or failed
+	Attempts int       `json:"attempts"`          // times the commit was started
+	Resumed  bool      `json:"resumed,omitempty"` // restarted after slurp was interrupted
+	Started  time.Time `json:"started"`
+	Ended    time.Time `json:"ended,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Hooks    []HookRun `json:"hooks,omitempty"` // commit hooks run by the last attempt
+}
+
+// GetJob returns the record of a build's last commit
+func GetJob(buildId string) (Job, error) {
+	var job Job
+	found, err := store.Get(jobsBucket, buildId, &job)
+	if err != nil {
+		return job, fmt.Errorf("Failed to load commit - %v", err)
+	}
+	if !found {
+		return job, ErrNoJob
+	}
+	return job, nil
+}
+
+// startJob records a commit starting, counting the attempts of a commit that
+// didn't succeed before
+func startJob(buildId string, resumed bool) {
+	job := Job{Build: buildId, State: JobRunning, Attempts: 1, Resumed: resumed, Started: time.Now().UTC()}
+	if prev, err := GetJob(buildId); err == nil && prev.State != JobCommitted {
+		job.Attempts = prev.Attempts + 1
+	}
+	putJob(job)
+}
+
+// finishJob records the outcome of a commit
+func finishJob(buildId string, err error) {
+	job, gerr := GetJob(buildId)
+	if gerr != nil {
+		return
+	}
+	job.State = JobCommitted
+	job.Ended = time.Now().UTC()
+	if err != nil {
+		job.State = JobFailed
+		job.Error = err.Error()
+	}
+	putJob(job)
+}
+
+// putJob persists a commit record
+func putJob(job Job) {
+	err := store.Put(jobsBucket, job.Build, job)
+	if err != nil {
+		config.Log.Error("Failed to persist commit of '%v' - %v", job.Build, err)
+	}
+}
+
+// ResumeCommits restarts the commits that were running when slurp last
+// stopped (Restore returned their stages to staged), cleaning up the stage
+// once committed like the api does. With resume-commits off they are recorded
+// as failed instead.
+func ResumeCommits() {
+	var running []Job
+	err := store.Each(jobsBucket, func(key string, raw []byte) error {
+		var job Job
+		err := json.Unmarshal(raw, &job)
+		if err != nil {
+			return fmt.Errorf("Bad commit record '%s' - %v", key, err)
+		}
+		if job.State == JobRunning {
+			running = append(running, job)
+		}
+		return nil
+	})
+	if err != nil {
+		config.Log.Error("Failed to load commits - %v", err)
+		return
+	}
+
+	for _, job := range running {
+		stage, err := GetStage(job.Build)
+		switch {
+		case err == nil && stage.State == StateCommitted:
+			// uploaded, only the record was missed
+			finishJob(job.Build, nil)
+		case err == nil && stage.State == StateAborted:
+			finishJob(job.Build, ErrAborted)
+		case err == nil && config.Resume:
+			config.Log.Info("%sResuming interrupted commit of '%v'", reqid.Tag(job.Build), job.Build)
+			go resume(job.Build)
+		default:
+			config.Log.Error("%sCommit of '%v' was interrupted", reqid.Tag(job.Build), job.Build)
+			finishJob(job.Build, errInterrupted)
+		}
+	}
+}
+
+// resume restarts an interrupted commit
+func resume(buildId string) {
+	err := commitStage(buildId, true)
+	if err != nil {
+		config.Log.Error("%sResumed commit of '%v' failed - %v", reqid.Tag(buildId), buildId, err)
+		return
+	}
+
+	err = DeleteStage(buildId)
+	if err != nil {
+		config.Log.Error("%sFailed to clean up '%v' - %v", reqid.Tag(buildId), buildId, err)
+	}
+}
+
+// pruneJobs forgets commits that finished more than jobRetention before now
+func pruneJobs(now time.Time) {
+	var expired []string
+	err := store.Each(jobsBucket, func(key string, raw []byte) error {
+		var job Job
+		if json.Unmarshal(raw, &job) == nil && job.State != JobRunning && now.Sub(job.Ended) > jobRetention {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		config.Log.Error("Failed to load commits - %v", err)
+	}
+
+	for _, id := range expired {
+		store.Delete(jobsBucket, id)
+	}
+}
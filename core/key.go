@@ -0,0 +1,79 @@
+package slurp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/names"
+)
+
+// placeholders in a blob key template, eg "{tenant}/{date}/{buildId}.{format}"
+var placeholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// keyFor returns the blob key template for a build, preferring its
+// template's over the global default.
+func keyFor(buildId string) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if stage, ok := stages[buildId]; ok && stage.Template != "" {
+		if key := config.Get(&config.Templates)[stage.Template].Key; key != "" {
+			return key
+		}
+	}
+	return config.BlobKey
+}
+
+// blobKey renders the key a build's archive (or delta layer) is stored under.
+// Besides {buildId}, {date}, {output}, and {format}, any stage label can be
+// used, eg {tenant}.
+func blobKey(buildId string, index *Index) (string, error) {
+	tmpl := keyFor(buildId)
+	if !strings.Contains(tmpl, "{buildId}") {
+		return "", fmt.Errorf("Blob key template '%s' must contain {buildId}", tmpl)
+	}
+
+	format := index.Format
+	if format == "" {
+		format = FormatTarGz
+	}
+	values := map[string]string{
+		"buildId": buildId,
+		"date":    time.Now().UTC().Format("2006-01-02"),
+		"output":  index.Output,
+		"format":  format,
+	}
+
+	var missing []string
+	key := placeholder.ReplaceAllStringFunc(tmpl, func(match string) string {
+		name := match[1 : len(match)-1]
+		if value, ok := values[name]; ok {
+			return value
+		}
+		if value := index.Metadata[name]; value != "" {
+			return value
+		}
+		missing = append(missing, name)
+		return ""
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("Blob key template '%s' needs stage labels %v", tmpl, missing)
+	}
+
+	key, err := names.Path(key)
+	if err != nil {
+		return "", fmt.Errorf("Bad blob key - %v", err)
+	}
+	return key, nil
+}
+
+// blob returns the id of the single blob an archive or delta build was
+// written to
+func (self *Index) blob() string {
+	if len(self.Entries) == 1 && self.Entries[0].Path == "" {
+		return self.Entries[0].Blob
+	}
+	return self.Build
+}
@@ -0,0 +1,300 @@
+package slurp
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/store"
+)
+
+var (
+	// ErrNoKey is returned when a signing key isn't known
+	ErrNoKey = errors.New("Signing key not found")
+	// ErrRevoked is returned using a revoked signing key
+	ErrRevoked = errors.New("Signing key is revoked")
+	// ErrUnsigned is returned verifying a build that wasn't signed
+	ErrUnsigned = errors.New("Build is not signed")
+	// ErrMismatch is returned verifying a signature that doesn't match its index
+	ErrMismatch = errors.New("Signature doesn't match the build index")
+)
+
+// keyLock serializes changes to the signing keys
+var keyLock = sync.Mutex{}
+
+// SigningKey is an ed25519 key committed builds are signed with. Only the
+// active key signs; the others are kept to verify what they signed until
+// they are revoked.
+type SigningKey struct {
+	Fingerprint string     `json:"fingerprint"` // hex sha256 of the public key
+	Public      string     `json:"public"`      // base64 ed25519 public key
+	Created     time.Time  `json:"created"`
+	Active      bool       `json:"active"`
+	Revoked     *time.Time `json:"revoked,omitempty"`
+}
+
+// storedKey is a signing key as persisted, with its private half (dropped
+// once revoked)
+type storedKey struct {
+	SigningKey
+	Private []byte `json:"private,omitempty"`
+}
+
+// Signature is the signature of a build's index, which holds the checksum of
+// every blob the build wrote
+type Signature struct {
+	Build     string `json:"build"`
+	Key       string `json:"key"`       // fingerprint of the signing key
+	Signature string `json:"signature"` // base64 ed25519 signature of the index blob
+}
+
+// Verification is the result of checking a build's signature
+type Verification struct {
+	Signature
+	Valid bool   `json:"valid"`
+	Error string `json:"error,omitempty"`
+}
+
+// GenerateKey creates a signing key, making it the active one if asked
+func GenerateKey(activate bool) (SigningKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("Failed to generate key - %v", err)
+	}
+
+	sum := sha256.Sum256(public)
+	key := storedKey{
+		SigningKey: SigningKey{
+			Fingerprint: hex.EncodeToString(sum[:]),
+			Public:      base64.StdEncoding.EncodeToString(public),
+			Created:     time.Now().UTC(),
+		},
+		Private: private,
+	}
+
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	err = store.Put(keysBucket, key.Fingerprint, key)
+	if err != nil {
+		return key.SigningKey, fmt.Errorf("Failed to save key - %v", err)
+	}
+	config.Log.Info("Generated signing key '%v'", key.Fingerprint)
+
+	if activate {
+		return activateKey(key.Fingerprint)
+	}
+	return key.SigningKey, nil
+}
+
+// ListKeys returns the signing keys, oldest first
+func ListKeys() ([]SigningKey, error) {
+	keys := []SigningKey{}
+	err := store.Each(keysBucket, func(id string, raw []byte) error {
+		var key storedKey
+		err := json.Unmarshal(raw, &key)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, key.SigningKey)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load keys - %v", err)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	return keys, nil
+}
+
+// ActivateKey makes a key the one new builds are signed with
+func ActivateKey(fingerprint string) (SigningKey, error) {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+	return activateKey(fingerprint)
+}
+
+func activateKey(fingerprint string) (SigningKey, error) {
+	key, err := getKey(fingerprint)
+	if err != nil {
+		return key.SigningKey, err
+	}
+	if key.Revoked != nil {
+		return key.SigningKey, ErrRevoked
+	}
+
+	if active, err := activeKey(); err == nil && active.Fingerprint != fingerprint {
+		active.Active = false
+		err = store.Put(keysBucket, active.Fingerprint, active)
+		if err != nil {
+			return key.SigningKey, fmt.Errorf("Failed to save key - %v", err)
+		}
+	}
+
+	key.Active = true
+	err = store.Put(keysBucket, fingerprint, key)
+	if err != nil {
+		return key.SigningKey, fmt.Errorf("Failed to save key - %v", err)
+	}
+
+	config.Log.Info("Signing key '%v' is now active", fingerprint)
+	return key.SigningKey, nil
+}
+
+// RevokeKey stops a key from signing and builds it signed from verifying.
+// Its private half is deleted, but the record is kept so its signatures are
+// known to be revoked rather than unknown.
+func RevokeKey(fingerprint string) (SigningKey, error) {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	key, err := getKey(fingerprint)
+	if err != nil {
+		return key.SigningKey, err
+	}
+	if key.Revoked == nil {
+		now := time.Now().UTC()
+		key.Revoked = &now
+	}
+	key.Active = false
+	key.Private = nil
+
+	err = store.Put(keysBucket, fingerprint, key)
+	if err != nil {
+		return key.SigningKey, fmt.Errorf("Failed to save key - %v", err)
+	}
+
+	config.Log.Info("Revoked signing key '%v'", fingerprint)
+	return key.SigningKey, nil
+}
+
+// getKey loads a signing key
+func getKey(fingerprint string) (storedKey, error) {
+	var key storedKey
+	found, err := store.Get(keysBucket, fingerprint, &key)
+	if err != nil {
+		return key, fmt.Errorf("Failed to load key - %v", err)
+	}
+	if !found {
+		return key, ErrNoKey
+	}
+	return key, nil
+}
+
+// activeKey returns the key new builds are signed with
+func activeKey() (storedKey, error) {
+	var active *storedKey
+	err := store.Each(keysBucket, func(id string, raw []byte) error {
+		var key storedKey
+		if json.Unmarshal(raw, &key) == nil && key.Active {
+			active = &key
+		}
+		return nil
+	})
+	if err != nil {
+		return storedKey{}, err
+	}
+	if active == nil {
+		return storedKey{}, ErrNoKey
+	}
+	return *active, nil
+}
+
+// signIndex signs a build's index with the active key, if there is one
+func signIndex(buildId string, raw []byte) error {
+	key, err := activeKey()
+	if err == ErrNoKey {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to load signing key - %v", err)
+	}
+
+	signature := Signature{
+		Build:     buildId,
+		Key:       key.Fingerprint,
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.PrivateKey(key.Private), raw)),
+	}
+	b, err := json.Marshal(signature)
+	if err != nil {
+		return err
+	}
+	return backend.WriteBlob(signatureId(buildId), bytes.NewReader(b))
+}
+
+// VerifyBuild checks a committed build's signature against its index and the
+// key that signed it
+func VerifyBuild(buildId string) (Verification, error) {
+	var result Verification
+
+	body, err := backend.ReadBlob(signatureId(buildId))
+	if errors.Is(err, backend.ErrNotFound) {
+		return result, ErrUnsigned
+	}
+	if err != nil {
+		return result, fmt.Errorf("Failed to read build signature - %v", err)
+	}
+	defer body.Close()
+	err = json.NewDecoder(body).Decode(&result.Signature)
+	if err != nil {
+		return result, fmt.Errorf("Failed to parse build signature - %v", err)
+	}
+
+	index, err := backend.ReadBlob(indexId(buildId))
+	if err != nil {
+		return result, fmt.Errorf("Failed to read build index - %w", err)
+	}
+	defer index.Close()
+	raw, err := ioutil.ReadAll(index)
+	if err != nil {
+		return result, fmt.Errorf("Failed to read build index - %v", err)
+	}
+
+	err = verify(result.Signature, raw)
+	result.Valid = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, nil
+}
+
+// verify checks a signature of raw was made by a known, unrevoked key
+func verify(signature Signature, raw []byte) error {
+	key, err := getKey(signature.Key)
+	if err != nil {
+		return err
+	}
+	if key.Revoked != nil {
+		return ErrRevoked
+	}
+
+	public, err := base64.StdEncoding.DecodeString(key.Public)
+	if err != nil {
+		return fmt.Errorf("Bad public key - %v", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature.Signature)
+	if err != nil {
+		return fmt.Errorf("Bad signature - %v", err)
+	}
+	if !ed25519.Verify(ed25519.PublicKey(public), raw, sig) {
+		return ErrMismatch
+	}
+	return nil
+}
+
+// signatureId is the blob id a build's signature is stored under
+func signatureId(buildId string) string {
+	return buildId + ".sig"
+}
@@ -0,0 +1,237 @@
+package slurp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+)
+
+// licenseHead is how much of each file is searched for license identifiers
+const licenseHead = 16 << 10
+
+// LicenseReport lists the licenses found in a committed build, by SPDX id
+type LicenseReport struct {
+	Build    string           `json:"build"`    // id of the committed build
+	Licenses []string         `json:"licenses"` // SPDX ids found, sorted
+	Findings []LicenseFinding `json:"findings"` // where each was found
+}
+
+// LicenseFinding is a license found in a file of a build
+type LicenseFinding struct {
+	Path    string `json:"path"`    // path within the build
+	License string `json:"license"` // SPDX id
+	Source  string `json:"source"`  // "spdx" (an SPDX-License-Identifier tag) or "text" (a license file)
+}
+
+// spdxTag matches SPDX-License-Identifier tags, capturing the expression
+var spdxTag = regexp.MustCompile(`SPDX-License-Identifier:\s*([A-Za-z0-9.+\-() ]+)`)
+
+// licenseTexts identify common license files by phrases of their text, most
+// specific first (whitespace is collapsed before matching)
+var licenseTexts = []struct {
+	id      string
+	phrases []string
+}{
+	{"AGPL-3.0", []string{"GNU AFFERO GENERAL PUBLIC LICENSE", "Version 3"}},
+	{"LGPL-3.0", []string{"GNU LESSER GENERAL PUBLIC LICENSE", "Version 3"}},
+	{"LGPL-2.1", []string{"GNU LESSER GENERAL PUBLIC LICENSE", "Version 2.1"}},
+	{"GPL-3.0", []string{"GNU GENERAL PUBLIC LICENSE", "Version 3"}},
+	{"GPL-2.0", []string{"GNU GENERAL PUBLIC LICENSE", "Version 2"}},
+	{"Apache-2.0", []string{"Apache License", "Version 2.0"}},
+	{"MPL-2.0", []string{"Mozilla Public License Version 2.0"}},
+	{"BSD-3-Clause", []string{"Redistribution and use in source and binary forms", "Neither the name of"}},
+	{"BSD-2-Clause", []string{"Redistribution and use in source and binary forms"}},
+	{"MIT", []string{"Permission is hereby granted, free of charge"}},
+	{"ISC", []string{"Permission to use, copy, modify, and/or distribute this software for any purpose"}},
+	{"Unlicense", []string{"This is free and unencumbered software released into the public domain"}},
+}
+
+// scanLicenses searches the head of every file in a build dir for SPDX
+// identifiers, and license files (LICENSE, COPYING...) for known license
+// texts
+func scanLicenses(buildId string) (*LicenseReport, error) {
+	root := filepath.Join(config.BuildDir, buildId)
+	report := &LicenseReport{Build: buildId, Licenses: []string{}, Findings: []LicenseFinding{}}
+	found := map[string]bool{}
+	head := make([]byte, licenseHead)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if isAborted(buildId) {
+			return ErrAborted
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Failed to open '%s' - %v", rel, err)
+		}
+		n, err := io.ReadFull(file, head)
+		file.Close()
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("Failed to read '%s' - %v", rel, err)
+		}
+
+		add := func(id, source string) {
+			report.Findings = append(report.Findings, LicenseFinding{Path: filepath.ToSlash(rel), License: id, Source: source})
+			found[id] = true
+		}
+		for _, id := range spdxIds(head[:n]) {
+			add(id, "spdx")
+		}
+		if isLicenseFile(info.Name()) {
+			if id := licenseText(head[:n]); id != "" {
+				add(id, "text")
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for id := range found {
+		report.Licenses = append(report.Licenses, id)
+	}
+	sort.Strings(report.Licenses)
+	return report, nil
+}
+
+// spdxIds returns the license ids of the SPDX-License-Identifier tags in b,
+// splitting expressions like "(MIT OR Apache-2.0)"
+func spdxIds(b []byte) []string {
+	var ids []string
+	seen := map[string]bool{}
+	for _, match := range spdxTag.FindAllSubmatch(b, -1) {
+		expr := strings.NewReplacer("(", " ", ")", " ").Replace(string(match[1]))
+		for _, id := range strings.Fields(expr) {
+			switch strings.ToUpper(id) {
+			case "AND", "OR", "WITH":
+				continue
+			}
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// isLicenseFile reports whether a file name is one licenses are kept in
+func isLicenseFile(name string) bool {
+	name = strings.ToUpper(strings.TrimSuffix(name, filepath.Ext(name)))
+	switch name {
+	case "LICENSE", "LICENCE", "COPYING", "UNLICENSE":
+		return true
+	}
+	return strings.HasPrefix(name, "LICENSE-") || strings.HasPrefix(name, "LICENCE-")
+}
+
+// licenseText identifies a license file's text, returning "" if unknown
+func licenseText(b []byte) string {
+	text := strings.Join(strings.Fields(string(b)), " ")
+	for _, license := range licenseTexts {
+		matched := true
+		for _, phrase := range license.phrases {
+			if !strings.Contains(text, phrase) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return license.id
+		}
+	}
+	return ""
+}
+
+// licenseDenied reports whether license-deny forbids a license. Entries match
+// ids case-insensitively, and may end in "*" to match a prefix (eg "GPL-*").
+func licenseDenied(id string) bool {
+	id = strings.ToLower(id)
+	for _, deny := range config.Get(&config.LicDeny) {
+		deny = strings.ToLower(strings.TrimSpace(deny))
+		if strings.HasSuffix(deny, "*") && strings.HasPrefix(id, strings.TrimSuffix(deny, "*")) {
+			return true
+		}
+		if id == deny {
+			return true
+		}
+	}
+	return false
+}
+
+// scanEnabled reports whether commits are scanned for licenses
+func scanEnabled() bool {
+	return config.Get(&config.LicScan) || len(config.Get(&config.LicDeny)) > 0
+}
+
+// forbidden describes the findings license-deny forbids, eg "GPL-3.0 (src/x.c)"
+func (self *LicenseReport) forbidden() []string {
+	var found []string
+	for _, finding := range self.Findings {
+		if licenseDenied(finding.License) {
+			found = append(found, fmt.Sprintf("%s (%s)", finding.License, finding.Path))
+		}
+	}
+	return found
+}
+
+// summary describes a report as a check's output
+func (self *LicenseReport) summary() string {
+	if len(self.Licenses) == 0 {
+		return "no licenses found"
+	}
+	return strings.Join(self.Licenses, ", ")
+}
+
+// GetLicenses fetches the license report of a committed build from the
+// backend (builds committed without scanning have none)
+func GetLicenses(buildId string) (*LicenseReport, error) {
+	body, err := backend.ReadBlob(licensesId(buildId))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read license report - %w", err)
+	}
+	defer body.Close()
+
+	var report LicenseReport
+	err = json.NewDecoder(body).Decode(&report)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse license report - %v", err)
+	}
+
+	return &report, nil
+}
+
+// writeLicenses stores the license report of a committed build alongside its blobs
+func writeLicenses(report *LicenseReport) error {
+	b, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	return backend.WriteBlob(licensesId(report.Build), bytes.NewReader(b))
+}
+
+// licensesId is the blob id a build's license report is stored under
+func licensesId(buildId string) string {
+	return buildId + ".licenses"
+}
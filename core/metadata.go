@@ -0,0 +1,106 @@
+package slurp
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/mu-box/slurp/names"
+)
+
+const (
+	maxMetadataKeys  = 64        // labels allowed per stage
+	maxMetadataValue = 1024      // bytes allowed per label value
+	maxNotes         = 64 * 1024 // bytes allowed of release notes
+)
+
+// UpdateMetadata merges labels into a stage's metadata. Labels with an empty
+// value are removed.
+func UpdateMetadata(buildId string, metadata map[string]string) (Stage, error) {
+	metadata, err := validateMetadata(metadata)
+	if err != nil {
+		return Stage{}, err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	stage, ok := stages[buildId]
+	if !ok {
+		return Stage{}, ErrNoStage
+	}
+
+	merged := stage.copy().Metadata
+	for k, v := range metadata {
+		if v == "" {
+			delete(merged, k)
+			continue
+		}
+		merged[k] = v
+	}
+
+	if len(merged) > maxMetadataKeys {
+		return Stage{}, fmt.Errorf("Too many metadata keys (max %d)", maxMetadataKeys)
+	}
+
+	stage.Metadata = merged
+	record := stage.copy()
+	persist(record)
+	return record, nil
+}
+
+// validateMetadata checks labels are sane before they are stored, returning
+// them with normalized keys
+func validateMetadata(metadata map[string]string) (map[string]string, error) {
+	if len(metadata) > maxMetadataKeys {
+		return nil, fmt.Errorf("Too many metadata keys (max %d)", maxMetadataKeys)
+	}
+
+	normalized := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		key, err := names.Normalize(k)
+		if err != nil {
+			return nil, fmt.Errorf("Bad metadata key %q - %v", k, err)
+		}
+		if _, ok := normalized[key]; ok {
+			return nil, fmt.Errorf("Duplicate metadata key '%s' after normalization", key)
+		}
+		if len(v) > maxMetadataValue {
+			return nil, fmt.Errorf("Metadata value for '%s' too long (max %d)", key, maxMetadataValue)
+		}
+		normalized[key] = v
+	}
+	return normalized, nil
+}
+
+// UpdateNotes replaces a stage's release notes (empty removes them)
+func UpdateNotes(buildId, notes string) (Stage, error) {
+	err := validateNotes(notes)
+	if err != nil {
+		return Stage{}, err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	stage, ok := stages[buildId]
+	if !ok {
+		return Stage{}, ErrNoStage
+	}
+
+	stage.Notes = notes
+	record := stage.copy()
+	persist(record)
+	return record, nil
+}
+
+// validateNotes checks release notes are text, and not too long to keep with
+// the build's index
+func validateNotes(notes string) error {
+	if len(notes) > maxNotes {
+		return fmt.Errorf("Notes too long (max %d bytes)", maxNotes)
+	}
+	if !utf8.ValidString(notes) {
+		return fmt.Errorf("Notes aren't valid UTF-8")
+	}
+	return nil
+}
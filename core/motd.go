@@ -0,0 +1,109 @@
+package slurp
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/ssh"
+)
+
+// motdPrefix starts each line of the message, telling it apart from rsync's
+// own output
+const motdPrefix = "slurp: "
+
+// StartMotd greets each rsync session with the state of the stage it syncs to
+func StartMotd() {
+	ssh.OnMotd(Motd)
+}
+
+// Motd describes a build's stage for whoever syncs to it by hand: its state,
+// when it expires, its quota, the space left to sync into, and how the last
+// commit went. It is empty with ssh-motd off or if the build isn't staged.
+func Motd(buildId string) string {
+	if !config.Get(&config.SshMotd) {
+		return ""
+	}
+	stage, err := GetStage(buildId)
+	if err != nil {
+		return ""
+	}
+
+	var msg strings.Builder
+	line := func(format string, args ...interface{}) {
+		fmt.Fprintf(&msg, motdPrefix+format+"\n", args...)
+	}
+
+	about := fmt.Sprintf("Stage '%s' is %s, added %s ago", stage.Id, stage.State, age(stage.Created))
+	if stage.Template != "" {
+		about += fmt.Sprintf(" with template '%s'", stage.Template)
+	}
+	if stage.Base != "" {
+		about += fmt.Sprintf(" from '%s'", stage.Base)
+	}
+	line("%s", about)
+
+	if stage.Expires.IsZero() {
+		line("It doesn't expire")
+	} else {
+		line("It expires uncommitted in %s (%s)", time.Until(stage.Expires).Round(time.Second), stage.Expires.Format(time.RFC3339))
+	}
+	if quota := quotaFor(stage); quota > 0 {
+		line("It holds %s of its %s quota", bytesize(uint64(dirSize(filepath.Join(config.BuildDir, buildId)))), bytesize(uint64(quota)))
+	}
+
+	if status, err := DiskUsage(); err == nil {
+		free := fmt.Sprintf("%s free in the build dir (%.0f%% used)", bytesize(status.Free), status.Percent)
+		if status.Watermark > 0 {
+			room := int64(float64(status.Total)*status.Watermark/100) - int64(status.Used)
+			if room < 0 {
+				room = 0
+			}
+			if uint64(room) < status.Free {
+				free += fmt.Sprintf(", %s until new stages are refused", bytesize(uint64(room)))
+			}
+		}
+		line("%s", free)
+	}
+
+	// a failed commit of the build matters most, else the last one made
+	if job, err := GetJob(buildId); err == nil && job.State == JobFailed {
+		line("Its last commit failed %s ago (attempt %d) - %s", age(job.Ended), job.Attempts, job.Error)
+	} else if job, ok := lastCommit(); ok {
+		line("Last commit was '%s', %s ago", job.Build, age(job.Ended))
+	}
+	return msg.String()
+}
+
+// lastCommit returns the record of the most recent successful commit
+func lastCommit() (Job, bool) {
+	var last Job
+	for _, job := range recentJobs() {
+		if job.State == JobCommitted && job.Ended.After(last.Ended) {
+			last = job
+		}
+	}
+	return last, !last.Ended.IsZero()
+}
+
+// age returns the time since t, to the second
+func age(t time.Time) time.Duration {
+	return time.Since(t).Round(time.Second)
+}
+
+// bytesize formats a number of bytes in the largest unit under which it is
+// at least 1
+func bytesize(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit && exp < 4; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGTP"[exp])
+}
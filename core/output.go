@@ -0,0 +1,222 @@
+package slurp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/names"
+)
+
+const (
+	OutputArchive = "archive" // commit the stage as a single compressed blob
+	OutputTree    = "tree"    // commit each file of the stage as its own blob
+	OutputDelta   = "delta"   // commit the files changed since the stage's base as a layer
+)
+
+// Index lists the blobs written when a build was committed
+type Index struct {
+	Build   string  `json:"build"`            // id of the committed build
+	Output  string  `json:"output"`           // commit output format used
+	Format  string  `json:"format,omitempty"` // archive format of archive output
+	Entries []Entry `json:"entries"`          // blobs making up the build
+
+	Base  string `json:"base,omitempty"`  // build a delta layer applies to
+	Depth int    `json:"depth,omitempty"` // number of delta layers below this one
+	Files []File `json:"files,omitempty"` // full manifest of a delta build
+
+	Frames  []Frame          `json:"frames,omitempty"` // frames of a seekable tar.zst archive
+	offsets map[string]int64 // where files' contents start in a seekable archive
+
+	Split  string         `json:"split,omitempty"` // rule an archive split into parts was split by [dirs|size]
+	partOf map[string]int // part of a split archive holding each file
+	listed []File         // files already listed while committing
+
+	Metadata map[string]string `json:"metadata,omitempty"` // labels of the committed stage
+	Notes    string            `json:"notes,omitempty"`    // release notes of the committed stage
+	Licenses []string          `json:"licenses,omitempty"` // SPDX ids of the licenses found (when scanned)
+	Verify   string            `json:"verify,omitempty"`   // how its blobs were checked after upload
+}
+
+// Entry describes a single blob written by a commit
+type Entry struct {
+	Path   string `json:"path,omitempty"` // path within the build (empty for archives, the top-level dir of a dirs split part)
+	Part   int    `json:"part,omitempty"` // number of the split archive part the blob is (from 1)
+	Blob   string `json:"blob"`           // blob id in storage
+	Size   int64  `json:"size"`           // bytes written
+	Sha256 string `json:"sha256"`         // hex encoded checksum of the bytes written
+
+	// set for the file of a single file build, served on download
+	ContentType string `json:"content-type,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+}
+
+// Manifest lists every file (and dir, and symlink) of a committed build, so
+// it can be inspected and verified without downloading it
+type Manifest struct {
+	Build string `json:"build"` // id of the committed build
+	Files []File `json:"files"` // paths, modes, sizes, and checksums
+}
+
+// GetIndex fetches the index of a committed build from the backend
+func GetIndex(buildId string) (*Index, error) {
+	body, err := backend.ReadBlob(indexId(buildId))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read build index - %w", err)
+	}
+	defer body.Close()
+
+	var index Index
+	err = json.NewDecoder(body).Decode(&index)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse build index - %v", err)
+	}
+
+	return &index, nil
+}
+
+// GetManifest fetches the file manifest of a committed build from the backend
+func GetManifest(buildId string) (*Manifest, error) {
+	body, err := backend.ReadBlob(manifestId(buildId))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read build manifest - %w", err)
+	}
+	defer body.Close()
+
+	var manifest Manifest
+	err = json.NewDecoder(body).Decode(&manifest)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse build manifest - %v", err)
+	}
+
+	return &manifest, nil
+}
+
+// commitTree uploads each regular file in the build dir as its own blob,
+// prefixed with the build id. The file of a single file build is stored with
+// its content type, size, and filename so it can be served as an asset.
+func commitTree(buildId string, index *Index, single bool) error {
+	root := filepath.Join(config.BuildDir, buildId)
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if isAborted(buildId) {
+			return ErrAborted
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		// blob ids are derived from the path, keep them unambiguous
+		rel, err = names.Path(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Failed to open '%s' - %v", rel, err)
+		}
+		defer file.Close()
+
+		blob := buildId + "/" + rel
+		sum := newDigest()
+		meta := blobMeta(index)
+
+		asset := Entry{}
+		if single {
+			asset.ContentType, err = contentType(file)
+			if err != nil {
+				return fmt.Errorf("Failed to detect type of '%s' - %v", rel, err)
+			}
+			asset.Filename = info.Name()
+			asset.Size = info.Size()
+			meta = assetMeta(meta, asset)
+		}
+
+		config.Log.Trace("Uploading '%v'", blob)
+		err = backend.WriteBlobMeta(blob, io.TeeReader(file, sum), meta)
+		if err != nil {
+			return fmt.Errorf("Failed to write '%s' - %v", rel, err)
+		}
+
+		entry := sum.entry(rel, blob)
+		entry.ContentType, entry.Filename = asset.ContentType, asset.Filename
+		index.Entries = append(index.Entries, entry)
+		return nil
+	})
+}
+
+// writeIndex stores the index of a committed build alongside its blobs,
+// signing it with the active signing key
+func writeIndex(index Index) error {
+	b, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	err = signIndex(index.Build, b)
+	if err != nil {
+		return fmt.Errorf("Failed to sign build - %v", err)
+	}
+	return backend.WriteBlob(indexId(index.Build), bytes.NewReader(b))
+}
+
+// writeManifest stores the file manifest of a committed build alongside its blobs
+func writeManifest(manifest Manifest) error {
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return backend.WriteBlob(manifestId(manifest.Build), bytes.NewReader(b))
+}
+
+// manifestId is the blob id a build's manifest is stored under
+func manifestId(buildId string) string {
+	return buildId + ".manifest"
+}
+
+// indexId is the blob id a build's index is stored under
+func indexId(buildId string) string {
+	return buildId + ".index"
+}
+
+// digest counts and hashes the bytes written to it
+type digest struct {
+	hash hash.Hash
+	size int64
+}
+
+func newDigest() *digest {
+	return &digest{hash: sha256.New()}
+}
+
+func (self *digest) Write(p []byte) (int, error) {
+	self.hash.Write(p)
+	self.size += int64(len(p))
+	return len(p), nil
+}
+
+// entry describes the digested bytes as an index entry
+func (self *digest) entry(path, blob string) Entry {
+	return Entry{
+		Path:   path,
+		Blob:   blob,
+		Size:   self.size,
+		Sha256: hex.EncodeToString(self.hash.Sum(nil)),
+	}
+}
@@ -0,0 +1,104 @@
+package slurp
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/webhook"
+)
+
+var (
+	// ErrNotOwner is returned acting on an owned stage without its owner credential
+	ErrNotOwner = errors.New("Stage is owned by another credential")
+	// ErrNoOwner is returned handing a stage off without a new owner credential
+	ErrNoOwner = errors.New("Missing new owner credential")
+)
+
+// Handoff records a stage changing owners, eg from the job that syncs a build
+// to the one that commits it
+type Handoff struct {
+	From      string    `json:"from,omitempty"` // fingerprint of the previous owner (empty if unowned)
+	To        string    `json:"to"`             // fingerprint of the new owner
+	Time      time.Time `json:"time"`
+	RequestId string    `json:"request-id,omitempty"` // api request that handed it off
+}
+
+// CheckOwner checks a credential may act on a stage. Stages without an owner
+// can be acted on by anyone with api access; missing stages are left for the
+// action to report, but in a cluster a stage this node doesn't hold (which may
+// be a peer's) is refused.
+func CheckOwner(buildId, credential string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	stage, ok := stages[buildId]
+	if !ok && Clustered() {
+		return ErrNoStage
+	}
+	if !ok {
+		return nil
+	}
+	return stage.checkOwner(credential)
+}
+
+// HandoffStage atomically transfers an owned stage from the credential owning
+// it to a new one, recording the handoff. An unowned stage is claimed.
+func HandoffStage(buildId, from, to string) (Stage, error) {
+	if to == "" {
+		return Stage{}, ErrNoOwner
+	}
+
+	mutex.Lock()
+	stage, ok := stages[buildId]
+	if !ok {
+		mutex.Unlock()
+		return Stage{}, ErrNoStage
+	}
+	if stage.State == StateCommitted {
+		mutex.Unlock()
+		return Stage{}, ErrCommitted
+	}
+	err := stage.checkOwner(from)
+	if err != nil {
+		mutex.Unlock()
+		return Stage{}, err
+	}
+
+	handoff := Handoff{From: stage.Owner, To: fingerprint(to), Time: time.Now().UTC(), RequestId: reqid.Get(buildId)}
+	stage.Owner = handoff.To
+	stage.Handoffs = append(stage.Handoffs, handoff)
+	record := stage.copy()
+	mutex.Unlock()
+
+	persist(record)
+
+	config.Log.Info("%sHanded off stage '%v' from '%.12s' to '%.12s'", reqid.Tag(buildId), buildId, handoff.From, handoff.To)
+	webhook.SendLabeled(webhook.StageHandoff, buildId, record.Metadata, handoff)
+
+	return record, nil
+}
+
+// checkOwner checks credential is the stage's owner, if it has one
+func (self *Stage) checkOwner(credential string) error {
+	if self.Owner == "" {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(self.Owner), []byte(fingerprint(credential))) != 1 {
+		return ErrNotOwner
+	}
+	return nil
+}
+
+// fingerprint is what an owner credential is recorded (and compared) as, so
+// the credential itself isn't stored or shown
+func fingerprint(credential string) string {
+	if credential == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(credential))
+	return hex.EncodeToString(sum[:])
+}
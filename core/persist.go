@@ -0,0 +1,158 @@
+package slurp
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/ssh"
+	"github.com/mu-box/slurp/store"
+)
+
+// Stage states
+const (
+	StateStaged     = "staged"     // accepting syncs
+	StateQueued     = "queued"     // waiting for an upload slot to commit
+	StateCommitting = "committing" // being packaged and uploaded
+	StateCommitted  = "committed"  // uploaded, waiting to be cleaned up
+	StateAborted    = "aborted"    // stopped, kept for a post-mortem until it expires
+)
+
+// store buckets
+const (
+	stagesBucket     = "stages"
+	deletedBucket    = "deleted"
+	blobsBucket      = "blobs"
+	jobsBucket       = "jobs"
+	keysBucket       = "keys"
+	stagedBucket     = "staged"
+	statsBucket      = "stats"
+	buildsBucket     = "builds"
+	appsBucket       = "apps"
+	quarantineBucket = "quarantine"
+)
+
+// persist saves a stage record to the store
+func persist(stage Stage) {
+	err := store.Put(stagesBucket, stage.Id, stage)
+	if err != nil {
+		config.Log.Error("Failed to persist stage '%v' - %v", stage.Id, err)
+	}
+	clusterChanged()
+}
+
+// forget removes a stage record from the store
+func forget(buildId string) {
+	err := store.Delete(stagesBucket, buildId)
+	if err != nil {
+		config.Log.Error("Failed to remove stage '%v' from store - %v", buildId, err)
+	}
+	clusterChanged()
+}
+
+// setState updates (and persists) the state of a stage
+func setState(buildId, state string) {
+	mutex.Lock()
+	stage, ok := stages[buildId]
+	if !ok || stage.State == StateAborted {
+		mutex.Unlock()
+		return
+	}
+	stage.State = state
+	record := stage.copy()
+	mutex.Unlock()
+
+	persist(record)
+}
+
+// Restore rebuilds the stages (and their ssh users) and reuse cooldowns from
+// the store after a restart. Stages whose staging dir is gone are dropped and
+// commits interrupted by the restart are returned to staged, for
+// ResumeCommits to restart.
+func Restore() error {
+	var restored []Stage
+	err := store.Each(stagesBucket, func(key string, raw []byte) error {
+		var stage Stage
+		err := json.Unmarshal(raw, &stage)
+		if err != nil {
+			return fmt.Errorf("Bad stage record '%s' - %v", key, err)
+		}
+		restored = append(restored, stage)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to load stages - %v", err)
+	}
+
+	count := 0
+	for i := range restored {
+		stage := restored[i]
+
+		_, err = os.Stat(config.BuildDir + "/" + stage.Id)
+		missing := err != nil
+		if missing && config.StageStore && stage.State != StateCommitted && stage.State != StateAborted {
+			// rebuilt from storage once the backend is up
+			config.Log.Info("Build dir of stage '%v' is gone, hydrating it from storage", stage.Id)
+			hydrating = append(hydrating, stage.Id)
+		} else if missing {
+			config.Log.Error("Dropping stage '%v', build dir is gone - %v", stage.Id, err)
+			forget(stage.Id)
+			continue
+		}
+
+		if stage.State == StateQueued || stage.State == StateCommitting {
+			config.Log.Info("Commit of '%v' was interrupted, returning it to staged", stage.Id)
+			stage.State = StateStaged
+			persist(stage)
+		}
+
+		// committed and aborted stages only need cleaning up, don't let
+		// clients sync to them
+		if stage.State != StateCommitted && stage.State != StateAborted && !missing {
+			err = ssh.AddUser(stage.Id, config.Get(&config.Templates)[stage.Template].Rsync)
+			if err != nil {
+				return fmt.Errorf("Failed to add user - %v", err)
+			}
+		}
+
+		mutex.Lock()
+		stages[stage.Id] = &stage
+		mutex.Unlock()
+		count++
+	}
+
+	err = store.Each(deletedBucket, func(key string, raw []byte) error {
+		var at time.Time
+		err := json.Unmarshal(raw, &at)
+		if err != nil {
+			return fmt.Errorf("Bad deletion record '%s' - %v", key, err)
+		}
+		mutex.Lock()
+		deleted[key] = at
+		mutex.Unlock()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to load deletions - %v", err)
+	}
+
+	err = restoreStats()
+	if err != nil {
+		return fmt.Errorf("Failed to load stats - %v", err)
+	}
+
+	err = restoreRetention()
+	if err != nil {
+		return fmt.Errorf("Failed to load retained builds - %v", err)
+	}
+
+	err = restoreQuarantine()
+	if err != nil {
+		return fmt.Errorf("Failed to load quarantined builds - %v", err)
+	}
+
+	config.Log.Info("Restored %d stage(s)", count)
+	return nil
+}
@@ -0,0 +1,394 @@
+package slurp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/ssh"
+)
+
+// poolKeep is how long a pool entry no stage was seeded from is kept
+const poolKeep = 24 * time.Hour
+
+// ficlone is the linux ioctl cloning a file's blocks into another (a reflink)
+const ficlone = 0x40049409
+
+// errNoClone is returned when the filesystem can't clone files
+var errNoClone = errors.New("Filesystem doesn't support reflinks")
+
+// StartDedup breaks the links of a stage into the pool before each rsync
+// session writes to it, as rsync changes the mode, times, and owner of
+// unchanged files in place
+func StartDedup() {
+	if !config.Dedup {
+		return
+	}
+	ssh.OnSync(func(buildId string) error {
+		err := unshareStage(buildId)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	})
+}
+
+// seedStage extracts a committed build into a new stage. With dedup, files of
+// the build the content-addressed pool already holds (by its manifest) are
+// cloned from the pool rather than extracted, so stages seeded from
+// near-identical builds share disk blocks and take no full copy. Each clone
+// is a file of its own, so rsync changing its attributes or a hook editing it
+// in place leaves the pool and other stages alone. On filesystems without
+// reflinks they are hard linked instead, and unshareStage breaks the links
+// before anything writes to the stage. The files extracted are then added to
+// the pool.
+func seedStage(oldId, newId string) error {
+	dir := filepath.Join(config.BuildDir, newId)
+	if !config.Dedup {
+		return extractBuild(oldId, dir, "")
+	}
+
+	pooled, err := seedPooled(oldId, newId)
+	if err != nil {
+		return err
+	}
+	exclude := ""
+	if len(pooled) > 0 {
+		file, err := ioutil.TempFile("", "slurp-pooled-*")
+		if err != nil {
+			return fmt.Errorf("Failed to create exclude file - %v", err)
+		}
+		defer os.Remove(file.Name())
+
+		// archives name their members with or without a leading "./"
+		for path := range pooled {
+			fmt.Fprintf(file, "%s\n./%s\n", path, path)
+		}
+		err = file.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to write exclude file - %v", err)
+		}
+		exclude = file.Name()
+	}
+
+	err = extractBuild(oldId, dir, exclude)
+	if err != nil {
+		return err
+	}
+
+	err = dedupStage(newId, pooled)
+	if err != nil {
+		// the stage is still usable, just not sharing space
+		config.Log.Error("%s%v", reqid.Tag(newId), err)
+	}
+	return nil
+}
+
+// seedPooled places the files of a build the pool holds in a new stage,
+// returning their paths. Builds without a manifest, and squashfs images
+// (which can't skip files as they unpack), seed nothing.
+func seedPooled(oldId, newId string) (map[string]bool, error) {
+	pooled := map[string]bool{}
+	if index, err := GetIndex(oldId); err != nil || index.Format == FormatSquashfs {
+		return pooled, nil
+	}
+	manifest, err := GetManifest(oldId)
+	if err != nil {
+		config.Log.Debug("%sNot seeding '%v' from the pool - %v", reqid.Tag(newId), newId, err)
+		return pooled, nil
+	}
+
+	root := filepath.Join(config.BuildDir, newId)
+	var size int64
+	for _, file := range manifest.Files {
+		// exclude patterns are lines, and unquote backslashes
+		if !file.Mode.IsRegular() || file.Sha256 == "" || strings.ContainsAny(file.Path, "\n\\") {
+			continue
+		}
+		entry := poolEntry(file.Sha256, file.Mode.Perm())
+		info, err := os.Lstat(entry)
+		if err != nil || info.Mode().Perm() != file.Mode.Perm() {
+			continue
+		}
+
+		path := filepath.Join(root, filepath.FromSlash(file.Path))
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create build dir - %v", err)
+		}
+		err = placeEntry(entry, path, info)
+		if err != nil {
+			// extracted instead
+			config.Log.Trace("%sNot seeding '%s' from the pool - %v", reqid.Tag(newId), file.Path, err)
+			continue
+		}
+		pooled[file.Path] = true
+		size += file.Size
+	}
+
+	config.Log.Debug("%sSeeded %d files (%d bytes) from the pool", reqid.Tag(newId), len(pooled), size)
+	return pooled, nil
+}
+
+// dedupStage adds the files of a freshly seeded stage not seeded from the
+// pool to it, replacing them with clones (or links) of identical entries the
+// pool already has
+func dedupStage(buildId string, pooled map[string]bool) error {
+	root := filepath.Join(config.BuildDir, buildId)
+	var linked, saved int64
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || pooled[filepath.ToSlash(rel)] {
+			return err
+		}
+
+		ok, err := poolLink(path, info)
+		if err != nil {
+			return err
+		}
+		if ok {
+			linked++
+			saved += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to dedup build - %v", err)
+	}
+
+	config.Log.Debug("%sShared %d more files (%d bytes) from the pool", reqid.Tag(buildId), linked, saved)
+	return nil
+}
+
+// poolLink replaces the file at path with a clone (or link) of its pool
+// entry, and returns whether an existing entry was used. New content is added
+// to the pool.
+func poolLink(path string, info os.FileInfo) (bool, error) {
+	key, err := poolKey(path)
+	if err != nil {
+		return false, err
+	}
+	entry := poolEntry(key, info.Mode().Perm())
+
+	existing, err := os.Lstat(entry)
+	if err != nil {
+		err = os.MkdirAll(filepath.Dir(entry), 0755)
+		if err != nil {
+			return false, fmt.Errorf("Failed to create pool dir - %v", err)
+		}
+		err = cloneFile(path, entry, info.Mode().Perm())
+		if err == nil {
+			// clones are seeded with the file's owner and times
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+				os.Lchown(entry, int(stat.Uid), int(stat.Gid))
+			}
+			os.Chtimes(entry, time.Now(), info.ModTime())
+		}
+		if err == errNoClone {
+			err = os.Link(path, entry)
+		}
+		if err != nil && !os.IsExist(err) {
+			return false, fmt.Errorf("Failed to pool '%s' - %v", path, err)
+		}
+		return false, nil
+	}
+
+	err = placeEntry(entry, path, existing)
+	if err != nil {
+		return false, fmt.Errorf("Failed to share '%s' - %v", path, err)
+	}
+	return true, nil
+}
+
+// placeEntry puts a clone of a pool entry, with its owner, mode, and times,
+// at path, or a hard link to it on filesystems that can't clone. The entry's
+// access time records its use, keeping it from pruning.
+func placeEntry(entry, path string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("Pool entry has no owner")
+	}
+
+	tmp := path + ".slurp-link"
+	err := cloneFile(entry, tmp, info.Mode().Perm())
+	switch {
+	case err == errNoClone:
+		err = os.Link(entry, tmp)
+		if err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			os.Remove(tmp)
+		}
+	case err == nil:
+		err = replaceFile(tmp, path, info, stat)
+	}
+	if err != nil {
+		return err
+	}
+
+	os.Chtimes(entry, time.Now(), info.ModTime())
+	return nil
+}
+
+// poolEntry is where the pool keeps contents with a checksum and permissions
+// (a link shares its entry's permissions)
+func poolEntry(sum string, perm os.FileMode) string {
+	return filepath.Join(config.PoolDir, sum[:2], fmt.Sprintf("%s-%o", sum, perm))
+}
+
+// cloneFile creates dst as a reflink of src, sharing its blocks until either
+// is written
+func cloneFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("Failed to open '%s' - %v", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, out.Fd(), ficlone, in.Fd())
+	out.Close()
+	if errno != 0 {
+		os.Remove(dst)
+		switch errno {
+		case syscall.EOPNOTSUPP, syscall.ENOTTY, syscall.EINVAL, syscall.EXDEV:
+			return errNoClone
+		}
+		return fmt.Errorf("Failed to clone '%s' - %v", src, errno)
+	}
+	return nil
+}
+
+// unshareStage gives every file of a stage hard linked elsewhere (into a pool
+// on a filesystem without reflinks) a private copy, so editing it in place
+// changes only this stage
+func unshareStage(buildId string) error {
+	root := filepath.Join(config.BuildDir, buildId)
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !info.Mode().IsRegular() || !ok || stat.Nlink < 2 {
+			return nil
+		}
+
+		tmp := path + ".slurp-link"
+		err = cloneFile(path, tmp, info.Mode().Perm())
+		if err == errNoClone {
+			err = copyFile(path, tmp, info.Mode().Perm())
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to unshare '%s' - %v", path, err)
+		}
+		err = replaceFile(tmp, path, info, stat)
+		if err != nil {
+			return fmt.Errorf("Failed to unshare '%s' - %v", path, err)
+		}
+		return nil
+	})
+}
+
+// replaceFile gives tmp the owner, mode, and times of the file at path and
+// moves it in place of it
+func replaceFile(tmp, path string, info os.FileInfo, stat *syscall.Stat_t) error {
+	os.Lchown(tmp, int(stat.Uid), int(stat.Gid))
+	err := os.Chmod(tmp, info.Mode().Perm())
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// copyFile creates dst as a copy of src's contents
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// poolKey is the content hash of a file
+func poolKey(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open '%s' - %v", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", fmt.Errorf("Failed to hash '%s' - %v", path, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// prunePool removes pool entries no stage was seeded from in poolKeep and no
+// stage links, returning their size. Stages cloned from an entry keep their
+// blocks.
+func prunePool() int64 {
+	if !config.Dedup {
+		return 0
+	}
+
+	var reclaimed int64
+	cutoff := time.Now().Add(-poolKeep)
+	filepath.Walk(config.PoolDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || stat.Nlink > 1 {
+			return nil
+		}
+		if time.Unix(stat.Atim.Sec, stat.Atim.Nsec).Before(cutoff) && os.Remove(path) == nil {
+			reclaimed += info.Size()
+		}
+		return nil
+	})
+	return reclaimed
+}
@@ -0,0 +1,153 @@
+package slurp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+)
+
+// previewFiles is the most files a build's preview holds
+const previewFiles = 20
+
+// Preview holds small well-known files of a committed build (its README,
+// version file, boxfile.yml...), so they can be shown without its blobs
+type Preview struct {
+	Build string        `json:"build"` // id of the committed build
+	Files []PreviewFile `json:"files"` // files matching preview-files, by path
+}
+
+// PreviewFile is a text file of a build's preview
+type PreviewFile struct {
+	Path      string `json:"path"`                // path within the build
+	Size      int64  `json:"size"`                // size of the whole file
+	Content   string `json:"content"`             // its text, up to preview-size KB
+	Truncated bool   `json:"truncated,omitempty"` // whether content was cut at preview-size
+}
+
+// previewEnabled reports whether commits store a preview
+func previewEnabled() bool {
+	return config.Get(&config.PreviewMax) > 0 && len(config.Get(&config.Previews)) > 0
+}
+
+// extractPreview reads the text files of a build dir matching preview-files
+// (case-insensitively, by path within the build). Binary files are left out.
+func extractPreview(buildId string) (*Preview, error) {
+	root := filepath.Join(config.BuildDir, buildId)
+	preview := &Preview{Build: buildId, Files: []PreviewFile{}}
+
+	// don't descend deeper than the patterns reach
+	depth := 0
+	for _, pattern := range config.Get(&config.Previews) {
+		if n := strings.Count(pattern, "/"); n > depth {
+			depth = n
+		}
+	}
+	head := make([]byte, config.Get(&config.PreviewMax)<<10)
+
+	err := filepath.Walk(root, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			if rel != "." && strings.Count(rel, "/") >= depth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !previewMatch(rel) || len(preview.Files) >= previewFiles {
+			return nil
+		}
+
+		file, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("Failed to open '%s' - %v", rel, err)
+		}
+		n, err := io.ReadFull(file, head)
+		file.Close()
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("Failed to read '%s' - %v", rel, err)
+		}
+
+		content, ok := previewText(head[:n], info.Size() > int64(n))
+		if !ok {
+			return nil
+		}
+		preview.Files = append(preview.Files, PreviewFile{Path: rel, Size: info.Size(), Content: content, Truncated: info.Size() > int64(len(content))})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+// previewMatch reports whether a path within a build matches preview-files
+func previewMatch(rel string) bool {
+	rel = strings.ToLower(rel)
+	for _, pattern := range config.Get(&config.Previews) {
+		if ok, _ := path.Match(strings.ToLower(pattern), rel); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// previewText returns the text of a file's head, dropping a rune cut short
+// at the end of a truncated one, or false if it isn't text
+func previewText(b []byte, truncated bool) (string, bool) {
+	if truncated {
+		for i := 0; i < utf8.UTFMax-1 && len(b) > 0 && !utf8.Valid(b); i++ {
+			b = b[:len(b)-1]
+		}
+	}
+	if !utf8.Valid(b) || bytes.IndexByte(b, 0) >= 0 {
+		return "", false
+	}
+	return string(b), true
+}
+
+// GetPreview fetches the preview of a committed build from the backend
+// (builds committed without previews have none)
+func GetPreview(buildId string) (*Preview, error) {
+	body, err := backend.ReadBlob(previewId(buildId))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read preview - %w", err)
+	}
+	defer body.Close()
+
+	var preview Preview
+	err = json.NewDecoder(body).Decode(&preview)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse preview - %v", err)
+	}
+
+	return &preview, nil
+}
+
+// writePreview stores the preview of a committed build alongside its blobs
+func writePreview(preview *Preview) error {
+	b, err := json.Marshal(preview)
+	if err != nil {
+		return err
+	}
+	return backend.WriteBlob(previewId(preview.Build), bytes.NewReader(b))
+}
+
+// previewId is the blob id a build's preview is stored under
+func previewId(buildId string) string {
+	return buildId + ".preview"
+}
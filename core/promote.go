@@ -0,0 +1,156 @@
+package slurp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/webhook"
+)
+
+// ErrSameStore is returned when promoting a build to the store it is in
+var ErrSameStore = errors.New("Can't promote a build to its own store")
+
+// Promotion is the result of copying a build between stores
+type Promotion struct {
+	Build  string   `json:"build"`  // id of the promoted build
+	From   string   `json:"from"`   // store copied from (empty is the primary)
+	To     string   `json:"to"`     // store copied to
+	Builds []string `json:"builds"` // builds copied (delta bases first)
+	Blobs  []Entry  `json:"blobs"`  // blobs copied and verified
+	Bytes  int64    `json:"bytes"`  // bytes copied
+
+	labels map[string]string // labels of the promoted build
+}
+
+// Promote copies a committed build, its manifest, and its index (and the
+// layers a delta build applies to) from one named store to another, streaming
+// the blobs through slurp. Each blob is checked against its recorded checksum
+// as it is read, and again once written. The index is copied last so the
+// build only shows up in the target once it is complete.
+func Promote(buildId, from, to string) (Promotion, error) {
+	promotion := Promotion{Build: buildId, From: from, To: to, Builds: []string{}, Blobs: []Entry{}}
+	if from == to {
+		return promotion, ErrSameStore
+	}
+
+	err := promote(buildId, &promotion)
+	if err != nil {
+		return promotion, err
+	}
+
+	config.Log.Info("%sPromoted '%v' from '%v' to '%v' (%d blobs, %d bytes)", reqid.Tag(buildId), buildId, from, to, len(promotion.Blobs), promotion.Bytes)
+	webhook.SendLabeled(webhook.BuildPromoted, buildId, promotion.labels, promotion)
+	return promotion, nil
+}
+
+// promote copies a build, after the base it applies to if the target doesn't
+// have it yet
+func promote(buildId string, promotion *Promotion) error {
+	raw, err := readAll(promotion.From, indexId(buildId))
+	if err != nil {
+		return fmt.Errorf("Failed to read build index - %w", err)
+	}
+
+	var index Index
+	err = json.Unmarshal(raw, &index)
+	if err != nil {
+		return fmt.Errorf("Failed to parse build index - %v", err)
+	}
+
+	if buildId == promotion.Build {
+		promotion.labels = index.Metadata
+	}
+
+	if index.Base != "" {
+		_, err := readAll(promotion.To, indexId(index.Base))
+		if errors.Is(err, backend.ErrNotFound) {
+			err = promote(index.Base, promotion)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range index.Entries {
+		err = copyBlob(promotion.From, promotion.To, entry)
+		if err != nil {
+			return fmt.Errorf("Failed to promote blob '%s' - %v", entry.Blob, err)
+		}
+		promotion.Blobs = append(promotion.Blobs, entry)
+		promotion.Bytes += entry.Size
+	}
+
+	// builds committed before manifests existed, with no active signing key,
+	// or without license scanning or previews lack them
+	for _, id := range []string{manifestId(buildId), signatureId(buildId), licensesId(buildId), previewId(buildId)} {
+		raw, err := readAll(promotion.From, id)
+		if err == nil {
+			err = backend.WriteBlobAt(promotion.To, id, bytes.NewReader(raw))
+		}
+		if err != nil && !errors.Is(err, backend.ErrNotFound) {
+			return fmt.Errorf("Failed to promote '%s' - %v", id, err)
+		}
+	}
+
+	err = backend.WriteBlobAt(promotion.To, indexId(buildId), bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("Failed to promote build index - %v", err)
+	}
+
+	promotion.Builds = append(promotion.Builds, buildId)
+	return nil
+}
+
+// copyBlob streams a blob between stores, verifying its checksum on the way
+// and in the target
+func copyBlob(from, to string, entry Entry) error {
+	blob, err := backend.ReadBlobAt(from, entry.Blob)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	hash := sha256.New()
+	err = backend.WriteBlobAt(to, entry.Blob, io.TeeReader(blob, hash))
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != entry.Sha256 {
+		return fmt.Errorf("Source checksum %s doesn't match %s", sum, entry.Sha256)
+	}
+
+	copied, err := backend.ReadBlobAt(to, entry.Blob)
+	if err != nil {
+		return fmt.Errorf("Failed to read back - %v", err)
+	}
+	defer copied.Close()
+
+	hash.Reset()
+	_, err = io.Copy(hash, copied)
+	if err != nil {
+		return fmt.Errorf("Failed to read back - %v", err)
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != entry.Sha256 {
+		return fmt.Errorf("Target checksum %s doesn't match %s", sum, entry.Sha256)
+	}
+	return nil
+}
+
+// readAll reads a small blob (index, manifest) from a named store
+func readAll(store, id string) ([]byte, error) {
+	blob, err := backend.ReadBlobAt(store, id)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+	return ioutil.ReadAll(blob)
+}
@@ -0,0 +1,369 @@
+package slurp
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/audit"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/ssh"
+	"github.com/mu-box/slurp/store"
+	"github.com/mu-box/slurp/webhook"
+)
+
+var (
+	// ErrNotQuarantined is returned for a build that isn't quarantined
+	ErrNotQuarantined = errors.New("Build not quarantined")
+	// ErrRetrying is returned purging or retrying a quarantined build whose
+	// retry is running
+	ErrRetrying = errors.New("Build is being retried")
+	// ErrRestaged is returned retrying a quarantined build whose id was
+	// staged again since
+	ErrRestaged = errors.New("Build id was staged again")
+)
+
+// Quarantined is a stage whose commit failed validation or upload, moved out
+// of the build dir (as <quarantine-dir>/<id>/build) with a diagnostic bundle
+// until it is retried or purged
+type Quarantined struct {
+	Build       string    `json:"build"`
+	Stage       Stage     `json:"stage"`             // the stage as its commit failed
+	Error       string    `json:"error"`             // why the commit failed
+	Checks      []Check   `json:"checks"`            // checks run while committing, in order
+	Files       int       `json:"files"`             // files of the build
+	Bytes       int64     `json:"bytes"`             // their size
+	Retries     int       `json:"retries"`           // times it was retried and failed again
+	Retrying    bool      `json:"retrying"`          // whether a retry is running
+	Quarantined time.Time `json:"quarantined"`       // when its commit failed
+	Expires     time.Time `json:"expires,omitempty"` // when it is purged (zero keeps it until purged)
+}
+
+// failedCommit is the error of a commit that failed packaging or uploading a
+// build, with the report sent in its commit-failed event
+type failedCommit struct {
+	err    error
+	report CommitReport
+}
+
+func (self *failedCommit) Error() string {
+	return self.err.Error()
+}
+
+func (self *failedCommit) Unwrap() error {
+	return self.err
+}
+
+// quarantined builds by id, guarded by their lock
+var quarantines = struct {
+	sync.Mutex
+	builds map[string]*Quarantined
+}{builds: map[string]*Quarantined{}}
+
+// ListQuarantined returns the quarantined builds, most recent first
+func ListQuarantined() []Quarantined {
+	quarantines.Lock()
+	list := make([]Quarantined, 0, len(quarantines.builds))
+	for _, record := range quarantines.builds {
+		list = append(list, *record)
+	}
+	quarantines.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Quarantined.After(list[j].Quarantined)
+	})
+	return list
+}
+
+// GetQuarantined returns a quarantined build
+func GetQuarantined(buildId string) (Quarantined, error) {
+	quarantines.Lock()
+	defer quarantines.Unlock()
+	record, ok := quarantines.builds[buildId]
+	if !ok {
+		return Quarantined{}, ErrNotQuarantined
+	}
+	return *record, nil
+}
+
+// Diagnostics opens the diagnostic bundle of a quarantined build: a tar.gz of
+// its quarantine record, file manifest, rsync sessions, commit job, and audit
+// records
+func Diagnostics(buildId string) (*os.File, error) {
+	if _, err := GetQuarantined(buildId); err != nil {
+		return nil, err
+	}
+	return os.Open(diagnosticsPath(buildId))
+}
+
+// quarantine moves a stage whose commit failed out of the build dir, writing
+// its diagnostic bundle. A stage quarantined again after a retry keeps count.
+func quarantine(buildId string, failed *failedCommit) error {
+	stage, err := GetStage(buildId)
+	if err != nil {
+		return err
+	}
+	files, err := manifest(buildId)
+	if err != nil {
+		return fmt.Errorf("Failed to list build - %v", err)
+	}
+
+	now := time.Now().UTC()
+	record := &Quarantined{Build: buildId, Stage: stage, Error: failed.err.Error(), Checks: failed.report.Checks, Quarantined: now}
+	if config.QuarKeep > 0 {
+		record.Expires = now.Add(config.QuarKeep)
+	}
+	for _, file := range files {
+		if file.Mode.IsRegular() {
+			record.Files++
+			record.Bytes += file.Size
+		}
+	}
+	if previous, err := GetQuarantined(buildId); err == nil {
+		record.Retries = previous.Retries + 1
+	}
+
+	// a purge that failed part way may have left an older copy behind
+	if _, err := os.Stat(quarantinePath(buildId)); err == nil {
+		removeDir(quarantinePath(buildId))
+	}
+	err = os.MkdirAll(filepath.Join(config.QuarDir, buildId), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create quarantine dir - %v", err)
+	}
+	err = os.Rename(filepath.Join(config.BuildDir, buildId), quarantinePath(buildId))
+	if err != nil {
+		return fmt.Errorf("Failed to move build into quarantine - %v", err)
+	}
+
+	// capture the sessions before the user (and its sessions) are gone
+	sessions := ssh.Sessions(buildId)
+	ssh.DelUser(buildId)
+	mutex.Lock()
+	delete(stages, buildId)
+	mutex.Unlock()
+	forget(buildId)
+	forgetStaged(buildId)
+
+	err = writeDiagnostics(*record, files, sessions)
+	if err != nil {
+		config.Log.Error("%sFailed to write diagnostics of '%v' - %v", reqid.Tag(buildId), buildId, err)
+	}
+
+	quarantines.Lock()
+	quarantines.builds[buildId] = record
+	quarantines.Unlock()
+	persistQuarantine(*record)
+
+	config.Log.Info("%sQuarantined '%v' - %v", reqid.Tag(buildId), buildId, record.Error)
+	webhook.SendLabeled(webhook.StageQuarantined, buildId, stage.Metadata, *record)
+	return nil
+}
+
+// RetryQuarantined moves a quarantined build back into the build dir as a
+// stage and commits it again, removing the stage once committed. A commit
+// failing again quarantines it again.
+func RetryQuarantined(buildId string) error {
+	quarantines.Lock()
+	record, ok := quarantines.builds[buildId]
+	if !ok {
+		quarantines.Unlock()
+		return ErrNotQuarantined
+	}
+	if record.Retrying {
+		quarantines.Unlock()
+		return ErrRetrying
+	}
+	if _, err := os.Stat(filepath.Join(config.BuildDir, buildId)); err == nil || getUser(buildId) == nil || known(buildId) {
+		quarantines.Unlock()
+		return ErrRestaged
+	}
+	record.Retrying = true
+	stage := record.Stage
+	quarantines.Unlock()
+
+	err := os.Rename(quarantinePath(buildId), filepath.Join(config.BuildDir, buildId))
+	if err != nil {
+		quarantines.Lock()
+		record.Retrying = false
+		quarantines.Unlock()
+		return fmt.Errorf("Failed to move build out of quarantine - %v", err)
+	}
+
+	// give the stage the time it had to live again
+	stage.State, stage.Queue, stage.Node = StateStaged, 0, ""
+	if !stage.Expires.IsZero() {
+		stage.Expires = time.Now().UTC().Add(stage.Expires.Sub(stage.Created))
+	}
+	mutex.Lock()
+	stages[buildId] = &stage
+	mutex.Unlock()
+	persist(stage)
+
+	config.Log.Info("%sRetrying quarantined '%v' (%d earlier retries)", reqid.Tag(buildId), buildId, record.Retries)
+	err = CommitStage(buildId)
+
+	// the record stays only if the commit quarantined the build again
+	quarantines.Lock()
+	if quarantines.builds[buildId] == record {
+		delete(quarantines.builds, buildId)
+		store.Delete(quarantineBucket, buildId)
+		os.RemoveAll(filepath.Join(config.QuarDir, buildId))
+	}
+	quarantines.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return DeleteStage(buildId)
+}
+
+// PurgeQuarantined removes a quarantined build and its diagnostics for good
+func PurgeQuarantined(buildId string) error {
+	quarantines.Lock()
+	record, ok := quarantines.builds[buildId]
+	if !ok {
+		quarantines.Unlock()
+		return ErrNotQuarantined
+	}
+	if record.Retrying {
+		quarantines.Unlock()
+		return ErrRetrying
+	}
+	delete(quarantines.builds, buildId)
+	quarantines.Unlock()
+
+	config.Log.Info("%sPurging quarantined '%v'", reqid.Tag(buildId), buildId)
+	err := removeDir(filepath.Join(config.QuarDir, buildId))
+	if err != nil {
+		return fmt.Errorf("Failed to remove quarantined build - %v", err)
+	}
+	store.Delete(quarantineBucket, buildId)
+	recordDelete(buildId)
+	webhook.SendLabeled(webhook.StageDeleted, buildId, record.Stage.Metadata, nil)
+	return nil
+}
+
+// pruneQuarantine purges the quarantined builds kept past quarantine-ttl
+func pruneQuarantine(now time.Time) {
+	var expired []string
+	quarantines.Lock()
+	for id, record := range quarantines.builds {
+		if !record.Expires.IsZero() && record.Expires.Before(now) && !record.Retrying {
+			expired = append(expired, id)
+		}
+	}
+	quarantines.Unlock()
+
+	for _, id := range expired {
+		err := PurgeQuarantined(id)
+		if err != nil && err != ErrNotQuarantined && err != ErrRetrying {
+			config.Log.Error("Failed to purge expired quarantined '%v' - %v", id, err)
+		}
+	}
+}
+
+// writeDiagnostics bundles what is known of a quarantined build's failure
+func writeDiagnostics(record Quarantined, files []File, sessions []ssh.Session) error {
+	job, _ := GetJob(record.Build)
+	records, err := audit.Query(audit.Filter{Build: record.Build})
+	if err != nil {
+		config.Log.Error("Failed to read audit records of '%v' - %v", record.Build, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(config.QuarDir, record.Build), ".diagnostics-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	gz := gzip.NewWriter(tmp)
+	tw := tar.NewWriter(gz)
+	for _, part := range []struct {
+		name string
+		v    interface{}
+	}{
+		{"quarantine.json", record},
+		{"manifest.json", files},
+		{"sessions.json", sessions},
+		{"job.json", job},
+		{"audit.json", records},
+	} {
+		b, err := json.MarshalIndent(part.v, "", "  ")
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{Name: record.Build + "/" + part.name, Mode: 0644, Size: int64(len(b)), ModTime: record.Quarantined})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), diagnosticsPath(record.Build))
+}
+
+// persistQuarantine saves a quarantine record to the store
+func persistQuarantine(record Quarantined) {
+	err := store.Put(quarantineBucket, record.Build, record)
+	if err != nil {
+		config.Log.Error("Failed to persist quarantine of '%v' - %v", record.Build, err)
+	}
+}
+
+// restoreQuarantine loads the quarantined builds after a restart, dropping
+// those whose files are gone (eg. moved back by a retry the restart cut short)
+func restoreQuarantine() error {
+	var gone []string
+	err := store.Each(quarantineBucket, func(key string, raw []byte) error {
+		var record Quarantined
+		err := json.Unmarshal(raw, &record)
+		if err != nil {
+			return fmt.Errorf("Bad quarantine record '%s' - %v", key, err)
+		}
+		if _, err := os.Stat(quarantinePath(key)); err != nil {
+			gone = append(gone, key)
+			return nil
+		}
+		record.Retrying = false
+		quarantines.Lock()
+		quarantines.builds[key] = &record
+		quarantines.Unlock()
+		return nil
+	})
+	for _, id := range gone {
+		config.Log.Info("Dropping quarantine of '%v', its files are gone", id)
+		store.Delete(quarantineBucket, id)
+	}
+	return err
+}
+
+// quarantinePath is where a quarantined build's files are kept
+func quarantinePath(buildId string) string {
+	return filepath.Join(config.QuarDir, buildId, "build")
+}
+
+// diagnosticsPath is where a quarantined build's diagnostic bundle is kept
+func diagnosticsPath(buildId string) string {
+	return filepath.Join(config.QuarDir, buildId, "diagnostics.tar.gz")
+}
@@ -0,0 +1,105 @@
+package slurp
+
+import (
+	"sync"
+
+	"github.com/mu-box/slurp/config"
+)
+
+// QueueStatus is the state of the commit upload queue
+type QueueStatus struct {
+	Limit   int      `json:"limit"`   // most commits uploading at once (0 unlimited)
+	Running int      `json:"running"` // commits uploading
+	Queued  []string `json:"queued"`  // builds waiting to upload, in order
+}
+
+// waiter is a commit waiting for an upload slot
+type waiter struct {
+	buildId string
+	ready   chan struct{}
+}
+
+// commits uploading and waiting to upload
+var queue = struct {
+	sync.Mutex
+	running int
+	waiting []*waiter
+}{}
+
+// acquireUpload blocks until the build may upload, calling queued first if it
+// has to wait for a slot. It fails if the build is aborted while waiting.
+func acquireUpload(buildId string, queued func()) error {
+	queue.Lock()
+	if config.CommitMax <= 0 || queue.running < config.CommitMax {
+		queue.running++
+		queue.Unlock()
+		return nil
+	}
+
+	w := &waiter{buildId: buildId, ready: make(chan struct{})}
+	queue.waiting = append(queue.waiting, w)
+	queue.Unlock()
+
+	cancel := make(chan struct{})
+	onAbort(buildId, func() { close(cancel) })
+
+	queued()
+	select {
+	case <-w.ready:
+		return nil
+	case <-cancel:
+	}
+
+	queue.Lock()
+	for i := range queue.waiting {
+		if queue.waiting[i] == w {
+			queue.waiting = append(queue.waiting[:i], queue.waiting[i+1:]...)
+			queue.Unlock()
+			return ErrAborted
+		}
+	}
+	queue.Unlock()
+
+	// handed a slot as it was aborted, pass it on
+	releaseUpload()
+	return ErrAborted
+}
+
+// releaseUpload frees an upload slot, handing it to the next waiting commit
+func releaseUpload() {
+	queue.Lock()
+	defer queue.Unlock()
+
+	if len(queue.waiting) > 0 {
+		next := queue.waiting[0]
+		queue.waiting = queue.waiting[1:]
+		close(next.ready)
+		return
+	}
+	queue.running--
+}
+
+// QueuePosition returns a build's place in the upload queue (1 is next), or 0
+// if it isn't waiting
+func QueuePosition(buildId string) int {
+	queue.Lock()
+	defer queue.Unlock()
+	for i, w := range queue.waiting {
+		if w.buildId == buildId {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// Queue returns the state of the commit upload queue
+func Queue() QueueStatus {
+	queue.Lock()
+	defer queue.Unlock()
+
+	status := QueueStatus{Limit: config.CommitMax, Running: queue.running, Queued: []string{}}
+	for _, w := range queue.waiting {
+		status.Queued = append(status.Queued, w.buildId)
+	}
+	return status
+}
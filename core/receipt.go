@@ -0,0 +1,105 @@
+package slurp
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mu-box/slurp/ssh"
+)
+
+// Receipt confirms what an rsync session wrote to a stage. It is signed with
+// the active signing key, so a client can later prove exactly what it
+// uploaded.
+type Receipt struct {
+	Build     string    `json:"build"`
+	Remote    string    `json:"remote"`              // client address
+	Started   time.Time `json:"started"`             // when the session started
+	Ended     time.Time `json:"ended"`               // when the session ended
+	Files     int       `json:"files"`               // files written by the session
+	Bytes     int64     `json:"bytes"`               // bytes of the files written
+	Manifest  string    `json:"manifest"`            // hex sha256 of the stage's manifest after the session
+	Key       string    `json:"key"`                 // fingerprint of the signing key
+	Signature string    `json:"signature,omitempty"` // base64 ed25519 signature of the receipt without its signature
+}
+
+// StartReceipts issues a receipt for every successful rsync session while a
+// signing key is active
+func StartReceipts() {
+	ssh.OnReceipt(issueReceipt)
+}
+
+// issueReceipt signs the receipt of a session, or returns nil without an
+// active signing key
+func issueReceipt(session ssh.Session) ([]byte, error) {
+	key, err := activeKey()
+	if err == ErrNoKey {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load signing key - %v", err)
+	}
+
+	digest, err := manifestDigest(session.Build)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to hash stage manifest - %v", err)
+	}
+
+	receipt := Receipt{
+		Build:    session.Build,
+		Remote:   session.Remote,
+		Started:  session.Started,
+		Ended:    session.Ended,
+		Files:    session.Files,
+		Bytes:    session.Bytes,
+		Manifest: digest,
+		Key:      key.Fingerprint,
+	}
+	raw, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, err
+	}
+	receipt.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.PrivateKey(key.Private), raw))
+	return json.Marshal(receipt)
+}
+
+// VerifyReceipt checks a receipt was signed by a known, unrevoked key and
+// hasn't been altered
+func VerifyReceipt(receipt Receipt) Verification {
+	signature := Signature{Build: receipt.Build, Key: receipt.Key, Signature: receipt.Signature}
+	result := Verification{Signature: signature}
+
+	receipt.Signature = ""
+	raw, err := json.Marshal(receipt)
+	if err == nil {
+		err = verify(signature, raw)
+	}
+	if err == ErrMismatch {
+		err = errors.New("Signature doesn't match the receipt")
+	}
+	result.Valid = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// manifestDigest hashes the manifest of a staged build, as the json a commit
+// would store it as (without archive offsets)
+func manifestDigest(buildId string) (string, error) {
+	files, err := manifest(buildId)
+	if err != nil {
+		return "", err
+	}
+	raw, err := json.Marshal(Manifest{Build: buildId, Files: files})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
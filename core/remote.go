@@ -0,0 +1,542 @@
+package slurp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/ssh"
+	"github.com/mu-box/slurp/store"
+)
+
+// stagedGrace is how long written back contents are kept before a sweep may
+// remove them, so contents uploaded ahead of the file list naming them aren't
+// swept
+const stagedGrace = time.Hour
+
+// placeholderTime is the modification time of evicted files' placeholders,
+// so a placeholder rsync hasn't replaced can be told from an empty file
+var placeholderTime = time.Unix(0, 0)
+
+// remoteLock serializes writing back, evicting and hydrating stages
+var remoteLock = sync.Mutex{}
+
+// stagedFile is a file of a stage backed by storage, its contents stored by
+// checksum
+type stagedFile struct {
+	File
+	Modified time.Time `json:"modified"`
+	Target   string    `json:"target,omitempty"`  // symlink target
+	Touched  time.Time `json:"touched"`           // when it was last written back changed
+	Evicted  bool      `json:"evicted,omitempty"` // only in storage, an empty placeholder is kept locally
+}
+
+// stages restored without a build dir, to be rebuilt from storage
+var hydrating []string
+
+// StartStageStore writes stages back to storage after every sync, and
+// rebuilds the stages restored without a build dir, when stages are backed by
+// storage (the experimental stage-store mode). The restored stages accept
+// syncs once they are rebuilt; those that can't be are dropped.
+func StartStageStore() {
+	if !config.StageStore {
+		return
+	}
+
+	ssh.OnSynced(func(buildId string) {
+		err := writeBack(buildId)
+		if err != nil {
+			config.Log.Error("%s%v", reqid.Tag(buildId), err)
+			return
+		}
+		evictStages()
+	})
+
+	restored := hydrating
+	hydrating = nil
+	if len(restored) == 0 {
+		return
+	}
+
+	go func() {
+		err := backend.WaitHealthy(config.StoreWait)
+		for _, buildId := range restored {
+			if err == nil {
+				err = hydrateStage(buildId)
+			}
+			if err != nil {
+				config.Log.Error("Dropping stage '%v', failed to hydrate it - %v", buildId, err)
+				DeleteStage(buildId)
+				err = nil
+				continue
+			}
+
+			stage, serr := GetStage(buildId)
+			if serr == nil && stage.State == StateStaged {
+				ssh.AddUser(buildId, config.Get(&config.Templates)[stage.Template].Rsync)
+			}
+			config.Log.Info("Hydrated stage '%v' from storage", buildId)
+		}
+	}()
+}
+
+// writeBack uploads what changed in a stage since it was last written back,
+// recording its files so the stage can be rebuilt from storage
+func writeBack(buildId string) error {
+	if !config.StageStore {
+		return nil
+	}
+
+	remoteLock.Lock()
+	defer remoteLock.Unlock()
+
+	old, err := stagedFiles(buildId)
+	if err != nil {
+		return err
+	}
+	stored := map[string]bool{}
+	for _, file := range old {
+		stored[file.Sha256] = true
+	}
+
+	root := filepath.Join(config.BuildDir, buildId)
+	files := map[string]stagedFile{}
+	var uploaded, size int64
+
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		file := stagedFile{File: File{Path: filepath.ToSlash(rel), Mode: info.Mode()}, Modified: info.ModTime(), Touched: time.Now().UTC()}
+		prev, seen := old[file.Path]
+
+		switch {
+		case info.Mode().IsRegular():
+			file.Size = info.Size()
+			switch {
+			case seen && prev.Evicted && info.Size() == 0 && info.ModTime().Equal(placeholderTime):
+				// still only in storage
+				file = prev
+			case seen && !prev.Evicted && prev.Mode == file.Mode && prev.Size == file.Size && prev.Modified.Equal(file.Modified):
+				file = prev
+			default:
+				file.Sha256, err = fileSum(path)
+				if err != nil {
+					return err
+				}
+				if !stored[file.Sha256] {
+					err = uploadStaged(path, file.Sha256)
+					if err != nil {
+						return err
+					}
+					stored[file.Sha256] = true
+					uploaded++
+					size += file.Size
+				}
+			}
+		case info.Mode()&os.ModeSymlink != 0:
+			file.Target, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+
+		files[file.Path] = file
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to write back stage - %v", err)
+	}
+
+	raw, err := json.Marshal(files)
+	if err != nil {
+		return err
+	}
+	err = backend.WriteBlob(stageId(buildId), bytes.NewReader(raw))
+	if err != nil {
+		return fmt.Errorf("Failed to write back stage manifest - %v", err)
+	}
+	err = store.Put(stagedBucket, buildId, files)
+	if err != nil {
+		return fmt.Errorf("Failed to save staged files - %v", err)
+	}
+
+	config.Log.Debug("%sWrote back %d files (%d bytes) of '%v'", reqid.Tag(buildId), uploaded, size, buildId)
+	return nil
+}
+
+// uploadStaged stores a staged file's contents by checksum
+func uploadStaged(path, sum string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return backend.WriteBlob(stagedId(sum), file)
+}
+
+// evictStages replaces the least recently changed files of idle stages with
+// empty placeholders until the stages kept locally fit in stage-cache MB.
+// rsync resends evicted files in full if they are synced again.
+func evictStages() {
+	if !config.StageStore || config.StageCache <= 0 {
+		return
+	}
+
+	remoteLock.Lock()
+	defer remoteLock.Unlock()
+
+	type candidate struct {
+		build string
+		file  stagedFile
+	}
+	var candidates []candidate
+	records := map[string]map[string]stagedFile{}
+	var used int64
+
+	for _, stage := range ListStages() {
+		files, err := localStaged(stage.Id)
+		if err != nil {
+			config.Log.Error("%s%v", reqid.Tag(stage.Id), err)
+			continue
+		}
+		records[stage.Id] = files
+
+		// stages being synced or committed are left alone
+		idle := stage.State == StateStaged && ssh.Idle(stage.Id)
+		for _, file := range files {
+			if !file.Mode.IsRegular() || file.Evicted {
+				continue
+			}
+			used += file.Size
+			if idle && file.Size > 0 {
+				candidates = append(candidates, candidate{stage.Id, file})
+			}
+		}
+	}
+
+	budget := int64(config.StageCache) << 20
+	if used <= budget {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].file.Touched.Before(candidates[j].file.Touched)
+	})
+
+	evicted := map[string]bool{}
+	var count int
+	for _, c := range candidates {
+		if used <= budget {
+			break
+		}
+		err := evictFile(filepath.Join(config.BuildDir, c.build, c.file.Path), c.file)
+		if err != nil {
+			config.Log.Error("%sFailed to evict '%v' - %v", reqid.Tag(c.build), c.file.Path, err)
+			continue
+		}
+		c.file.Evicted = true
+		records[c.build][c.file.Path] = c.file
+		evicted[c.build] = true
+		used -= c.file.Size
+		count++
+	}
+
+	for buildId := range evicted {
+		err := store.Put(stagedBucket, buildId, records[buildId])
+		if err != nil {
+			config.Log.Error("%sFailed to save staged files - %v", reqid.Tag(buildId), err)
+		}
+	}
+	config.Log.Debug("Evicted %d staged files, %d MB of stages kept locally", count, used>>20)
+}
+
+// evictFile replaces a file with an empty placeholder. It is replaced rather
+// than truncated so a file hard linked elsewhere is left alone.
+func evictFile(path string, file stagedFile) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() != file.Size || !info.ModTime().Equal(file.Modified) {
+		return errors.New("File changed since it was written back")
+	}
+
+	err = os.Remove(path)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(path, nil, file.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(path, placeholderTime, placeholderTime)
+}
+
+// hydrateStage downloads the evicted files of a stage, or the whole stage if
+// its build dir is gone (eg. a restart on a diskless node)
+func hydrateStage(buildId string) error {
+	if !config.StageStore {
+		return nil
+	}
+
+	remoteLock.Lock()
+	defer remoteLock.Unlock()
+
+	files, err := stagedFiles(buildId)
+	if err != nil {
+		return err
+	}
+
+	root := filepath.Join(config.BuildDir, buildId)
+	_, err = os.Stat(root)
+	all := os.IsNotExist(err)
+	if all {
+		if files == nil {
+			return fmt.Errorf("Stage '%s' isn't in storage", buildId)
+		}
+		err = os.MkdirAll(root, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create build dir - %v", err)
+		}
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	// parents sort before their contents
+	sort.Strings(paths)
+
+	var count int64
+	for _, path := range paths {
+		file := files[path]
+		local := filepath.Join(root, filepath.FromSlash(path))
+
+		switch {
+		case !all && !file.Evicted:
+			continue
+		case file.Mode.IsDir():
+			err = os.MkdirAll(local, file.Mode.Perm())
+		case file.Mode&os.ModeSymlink != 0:
+			err = os.Symlink(file.Target, local)
+		case file.Mode.IsRegular():
+			if !all {
+				// rsync already replaced the placeholder
+				info, serr := os.Lstat(local)
+				if serr != nil || info.Size() != 0 || !info.ModTime().Equal(placeholderTime) {
+					file.Evicted = false
+					files[path] = file
+					continue
+				}
+			}
+			err = downloadStaged(local, file)
+			count++
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to hydrate '%s' - %v", path, err)
+		}
+		file.Evicted = false
+		files[path] = file
+	}
+
+	// restore directory times once their contents are in place
+	for i := len(paths) - 1; i >= 0; i-- {
+		if file := files[paths[i]]; all && file.Mode.IsDir() {
+			os.Chtimes(filepath.Join(root, filepath.FromSlash(paths[i])), file.Modified, file.Modified)
+		}
+	}
+
+	err = store.Put(stagedBucket, buildId, files)
+	if err != nil {
+		return fmt.Errorf("Failed to save staged files - %v", err)
+	}
+
+	config.Log.Debug("%sHydrated %d files of '%v' from storage", reqid.Tag(buildId), count, buildId)
+	return nil
+}
+
+// downloadStaged writes a staged file's contents from storage to path
+func downloadStaged(path string, file stagedFile) error {
+	body, err := backend.ReadBlob(stagedId(file.Sha256))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".hydrate"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, file.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, body)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, file.Modified, file.Modified)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// stagedFiles returns the files of a stage as last written back, from the
+// store or, if this node doesn't have them, from storage. It is nil for
+// stages never written back.
+func stagedFiles(buildId string) (map[string]stagedFile, error) {
+	files, err := localStaged(buildId)
+	if err != nil || files != nil {
+		return files, err
+	}
+
+	body, err := backend.ReadBlob(stageId(buildId))
+	if errors.Is(err, backend.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read stage manifest - %v", err)
+	}
+	defer body.Close()
+
+	err = json.NewDecoder(body).Decode(&files)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse stage manifest - %v", err)
+	}
+	// nothing of a stage from storage is local yet
+	for path, file := range files {
+		file.Evicted = file.Mode.IsRegular()
+		files[path] = file
+	}
+	return files, nil
+}
+
+// localStaged returns the files of a stage this node last wrote back, nil if
+// it has no record of them
+func localStaged(buildId string) (map[string]stagedFile, error) {
+	var files map[string]stagedFile
+	found, err := store.Get(stagedBucket, buildId, &files)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load staged files - %v", err)
+	}
+	if !found {
+		return nil, nil
+	}
+	if files == nil {
+		files = map[string]stagedFile{}
+	}
+	return files, nil
+}
+
+// forgetStaged drops the record of a stage's written back files, and their
+// list in storage. Their contents are shared by checksum with other stages,
+// they are removed by sweepStaged once no stage lists them.
+func forgetStaged(buildId string) {
+	if !config.StageStore {
+		return
+	}
+	err := store.Delete(stagedBucket, buildId)
+	if err != nil {
+		config.Log.Error("Failed to remove staged files of '%v' from store - %v", buildId, err)
+	}
+	err = backend.DeleteBlob(stageId(buildId))
+	if err != nil && err != backend.ErrNoDelete {
+		config.Log.Error("%sFailed to remove stage manifest of '%v' - %v", reqid.Tag(buildId), buildId, err)
+	}
+}
+
+// sweepStaged removes the written back contents no stage's file list (of any
+// node sharing storage) names anymore, eg. of deleted stages or files since
+// changed, returning how many blobs and bytes it removed
+func sweepStaged() (int, int64, error) {
+	blobs, err := backend.ListBlobs("")
+	if err == backend.ErrNoList {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to list staged blobs - %v", err)
+	}
+
+	// a list that can't be read stops the sweep, its contents may be in use
+	listed := map[string]bool{}
+	var contents []backend.BlobStat
+	for _, blob := range blobs {
+		switch {
+		case strings.HasSuffix(blob.Id, ".staged"):
+			contents = append(contents, blob)
+		case strings.HasSuffix(blob.Id, ".stage"):
+			body, err := backend.ReadBlob(blob.Id)
+			if errors.Is(err, backend.ErrNotFound) {
+				// deleted since it was listed
+				continue
+			}
+			if err != nil {
+				return 0, 0, fmt.Errorf("Failed to read stage manifest '%s' - %v", blob.Id, err)
+			}
+			var files map[string]stagedFile
+			err = json.NewDecoder(body).Decode(&files)
+			body.Close()
+			if err != nil {
+				return 0, 0, fmt.Errorf("Failed to parse stage manifest '%s' - %v", blob.Id, err)
+			}
+			for _, file := range files {
+				listed[file.Sha256] = true
+			}
+		}
+	}
+
+	var count int
+	var size int64
+	for _, blob := range contents {
+		if listed[strings.TrimSuffix(blob.Id, ".staged")] || time.Since(blob.Modified) < stagedGrace {
+			continue
+		}
+		err = backend.DeleteBlob(blob.Id)
+		if err == backend.ErrNoDelete {
+			return count, size, nil
+		}
+		if err != nil {
+			return count, size, fmt.Errorf("Failed to remove staged blob '%s' - %v", blob.Id, err)
+		}
+		count++
+		size += blob.Size
+	}
+	return count, size, nil
+}
+
+// stageId is the blob id the files of a stage backed by storage are listed under
+func stageId(buildId string) string {
+	return buildId + ".stage"
+}
+
+// stagedId is the blob id staged contents are stored under
+func stagedId(sum string) string {
+	return sum + ".staged"
+}
@@ -0,0 +1,161 @@
+package slurp
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+)
+
+// DeletionStatus is the progress of the staging dirs being removed, and of
+// every removal since startup
+type DeletionStatus struct {
+	Workers int        `json:"workers"` // most files removed at once (delete-workers)
+	Rate    int        `json:"rate"`    // most files removed per second (0 unlimited)
+	Active  []Deletion `json:"active"`  // dirs being removed
+	Files   int64      `json:"files"`   // files removed since startup
+	Bytes   int64      `json:"bytes"`   // bytes removed since startup
+}
+
+// Deletion is the progress of a staging dir being removed
+type Deletion struct {
+	Dir     string    `json:"dir"`     // name of the dir in the build dir
+	Started time.Time `json:"started"` // when its removal started
+	Found   int64     `json:"found"`   // files found so far
+	Removed int64     `json:"removed"` // files removed so far
+	Bytes   int64     `json:"bytes"`   // bytes removed so far
+}
+
+// removals in progress, the files being removed at once, and when the next
+// may be under delete-rate
+var deletions = struct {
+	sync.Mutex
+	wake    *sync.Cond
+	active  map[*Deletion]bool
+	running int
+	next    time.Time
+	files   int64
+	bytes   int64
+}{active: map[*Deletion]bool{}}
+
+func init() {
+	deletions.wake = sync.NewCond(&deletions.Mutex)
+}
+
+// Deletions returns the progress of the dirs being removed
+func Deletions() DeletionStatus {
+	deletions.Lock()
+	defer deletions.Unlock()
+	status := DeletionStatus{Workers: deleteWorkers(), Rate: config.Get(&config.DelRate), Active: []Deletion{}, Files: deletions.files, Bytes: deletions.bytes}
+	for deletion := range deletions.active {
+		status.Active = append(status.Active, *deletion)
+	}
+	sort.Slice(status.Active, func(i, j int) bool {
+		return status.Active[i].Started.Before(status.Active[j].Started)
+	})
+	return status
+}
+
+// removeDir removes a dir like os.RemoveAll, but unlinks its files with no
+// more than delete-workers at once and delete-rate a second across every
+// removal, so reclaiming large stages doesn't starve the staging volume
+func removeDir(dir string) error {
+	deletion := &Deletion{Dir: filepath.Base(dir), Started: time.Now().UTC()}
+	deletions.Lock()
+	deletions.active[deletion] = true
+	deletions.Unlock()
+	defer func() {
+		deletions.Lock()
+		delete(deletions.active, deletion)
+		deletions.Unlock()
+	}()
+
+	type file struct {
+		path string
+		info os.FileInfo
+	}
+	files := make(chan file)
+	wg := sync.WaitGroup{}
+	for i := 0; i < deleteWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range files {
+				acquireDelete()
+				err := os.Remove(file.path)
+				releaseDelete()
+				if err != nil {
+					// left for the final RemoveAll to report
+					continue
+				}
+
+				deletions.Lock()
+				deletion.Removed++
+				deletions.files++
+				if file.info.Mode().IsRegular() {
+					deletion.Bytes += file.info.Size()
+					deletions.bytes += file.info.Size()
+				}
+				deletions.Unlock()
+			}
+		}()
+	}
+
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		deletions.Lock()
+		deletion.Found++
+		deletions.Unlock()
+		files <- file{path, info}
+		return nil
+	})
+	close(files)
+	wg.Wait()
+
+	// the dirs (and anything the walk missed) are left
+	return os.RemoveAll(dir)
+}
+
+// acquireDelete waits for a worker slot and, under delete-rate, the file's
+// turn to be removed
+func acquireDelete() {
+	deletions.Lock()
+	for deletions.running >= deleteWorkers() {
+		deletions.wake.Wait()
+	}
+	deletions.running++
+
+	var wait time.Duration
+	if rate := config.Get(&config.DelRate); rate > 0 {
+		now := time.Now()
+		if deletions.next.Before(now) {
+			deletions.next = now
+		}
+		wait = deletions.next.Sub(now)
+		deletions.next = deletions.next.Add(time.Second / time.Duration(rate))
+	}
+	deletions.Unlock()
+
+	time.Sleep(wait)
+}
+
+// deleteWorkers returns how many files may be removed at once
+func deleteWorkers() int {
+	if workers := config.Get(&config.DelWorkers); workers > 1 {
+		return workers
+	}
+	return 1
+}
+
+// releaseDelete frees a worker slot
+func releaseDelete() {
+	deletions.Lock()
+	deletions.running--
+	deletions.Unlock()
+	deletions.wake.Signal()
+}
@@ -0,0 +1,474 @@
+package slurp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/cache"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/names"
+	"github.com/mu-box/slurp/store"
+)
+
+// RetentionReport is the result of judging the committed builds against the
+// retention rules, and of pruning them unless it was a dry run
+type RetentionReport struct {
+	DryRun  bool          `json:"dry-run"` // whether builds were only judged, not pruned
+	Started time.Time     `json:"started"`
+	Ended   time.Time     `json:"ended"`
+	Tracked int           `json:"tracked"` // committed builds retention knows of
+	Kept    int           `json:"kept"`    // builds kept
+	Pruned  []PrunedBuild `json:"pruned"`  // builds pruned (or that would be), oldest first
+	Blobs   int           `json:"blobs"`   // blobs of the pruned builds deleted (or that would be)
+	Bytes   int64         `json:"bytes"`   // bytes of their entries
+	Errors  []string      `json:"errors,omitempty"`
+}
+
+// PrunedBuild is a committed build a retention rule prunes
+type PrunedBuild struct {
+	Build     string            `json:"build"`
+	Rule      string            `json:"rule"`   // name of the rule pruning it
+	Reason    string            `json:"reason"` // why the rule prunes it
+	Committed time.Time         `json:"committed"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Blobs     int               `json:"blobs"` // blobs it is stored as, with its index, manifest...
+	Bytes     int64             `json:"bytes"` // bytes of its entries
+}
+
+// retainedBuild is what retention knows of a committed build: the blobs it
+// was stored as in the primary store
+type retainedBuild struct {
+	Build     string            `json:"build"`
+	Committed time.Time         `json:"committed"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Base      string            `json:"base,omitempty"` // build its delta layer applies to
+	Blobs     []string          `json:"blobs"`          // its entries, then index, manifest...
+	Bytes     int64             `json:"bytes"`          // bytes of its entries
+}
+
+// committed builds retention knows of by id, and the apps with channels (whose
+// builds may be pointed to), guarded by their lock
+var retained = struct {
+	sync.Mutex
+	builds map[string]*retainedBuild
+	apps   map[string]bool
+}{builds: map[string]*retainedBuild{}, apps: map[string]bool{}}
+
+// retaining serializes retention runs
+var retaining = sync.Mutex{}
+
+// StartRetention prunes the committed builds past the retention rules every
+// interval
+func StartRetention(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			report, err := Retain(false)
+			if err != nil {
+				config.Log.Error("Failed to enforce retention - %v", err)
+				continue
+			}
+			for _, msg := range report.Errors {
+				config.Log.Error("Retention - %v", msg)
+			}
+		}
+	}()
+}
+
+// Retain judges the committed builds against the retention rules, deleting
+// the blobs of those they prune unless dryRun. Builds with a stage, delta bases
+// of kept builds, and builds a release channel points to are always kept, as
+// are blobs a kept build shares.
+func Retain(dryRun bool) (RetentionReport, error) {
+	retaining.Lock()
+	defer retaining.Unlock()
+
+	report := RetentionReport{DryRun: dryRun, Started: time.Now().UTC(), Pruned: []PrunedBuild{}}
+	err := adoptBuilds()
+	if err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	pruned, kept, err := judge(report.Started)
+	if err != nil {
+		return report, err
+	}
+	report.Tracked = len(pruned) + len(kept)
+	report.Kept = len(kept)
+
+	// blobs the kept builds still need
+	needed := map[string]bool{}
+	for _, build := range kept {
+		for _, blob := range build.Blobs {
+			needed[blob] = true
+		}
+	}
+
+	for _, build := range pruned {
+		prune := build.PrunedBuild
+		for _, blob := range build.record.Blobs {
+			if !needed[blob] {
+				prune.Blobs++
+			}
+		}
+		report.Pruned = append(report.Pruned, prune)
+		report.Blobs += prune.Blobs
+		report.Bytes += prune.Bytes
+		if dryRun {
+			continue
+		}
+
+		config.Log.Info("Pruning build '%v' - %v (%v)", prune.Build, prune.Reason, prune.Rule)
+		err = pruneBuild(build.record, needed)
+		if errors.Is(err, backend.ErrNoDelete) {
+			return report, err
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("Failed to prune '%s' - %v", prune.Build, err))
+		}
+	}
+
+	report.Ended = time.Now().UTC()
+	return report, nil
+}
+
+// judgedBuild is a build a rule prunes, with its record
+type judgedBuild struct {
+	PrunedBuild
+	record retainedBuild
+}
+
+// judge splits the committed builds into those the retention rules prune
+// (oldest first) and those they keep
+func judge(now time.Time) ([]judgedBuild, []retainedBuild, error) {
+	protected, err := channelBlobs()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	retained.Lock()
+	builds := make([]retainedBuild, 0, len(retained.builds))
+	for _, record := range retained.builds {
+		builds = append(builds, *record)
+	}
+	retained.Unlock()
+
+	// newest first, so each group's rank is its place in it
+	sort.Slice(builds, func(i, j int) bool {
+		return builds[i].Committed.After(builds[j].Committed)
+	})
+
+	rules := config.Get(&config.Retention)
+	ranks := map[string]int{}
+	pruned := map[string]judgedBuild{}
+	for _, build := range builds {
+		i, ok := retentionRule(rules, build.Labels)
+		if !ok {
+			continue
+		}
+		rule := rules[i]
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("retention[%d]", i)
+		}
+		group := fmt.Sprintf("%d/%s", i, build.Labels[rule.GroupBy])
+		rank := ranks[group]
+		ranks[group]++
+
+		var reason string
+		switch {
+		case rule.MaxAge > 0 && now.Sub(build.Committed) > rule.MaxAge:
+			reason = fmt.Sprintf("older than %v", rule.MaxAge)
+		case rule.Keep > 0 && rank >= rule.Keep:
+			reason = fmt.Sprintf("beyond the newest %d", rule.Keep)
+		default:
+			continue
+		}
+		if known(build.Build) || pointedTo(build, protected) {
+			continue
+		}
+		pruned[build.Build] = judgedBuild{PrunedBuild{Build: build.Build, Rule: name, Reason: reason, Committed: build.Committed, Labels: build.Labels, Bytes: build.Bytes}, build}
+	}
+
+	// delta layers need every build below them
+	for _, build := range builds {
+		if _, ok := pruned[build.Build]; ok {
+			continue
+		}
+		for base := build.Base; base != ""; {
+			below, ok := pruned[base]
+			if !ok {
+				break
+			}
+			delete(pruned, base)
+			base = below.record.Base
+		}
+	}
+
+	judged := []judgedBuild{}
+	kept := []retainedBuild{}
+	for _, build := range builds {
+		if judgement, ok := pruned[build.Build]; ok {
+			judged = append(judged, judgement)
+		} else {
+			kept = append(kept, build)
+		}
+	}
+	sort.Slice(judged, func(i, j int) bool {
+		return judged[i].Committed.Before(judged[j].Committed)
+	})
+	return judged, kept, nil
+}
+
+// retentionRule returns the number of the first rule whose labels a build has
+func retentionRule(rules []config.RetentionRule, labels map[string]string) (int, bool) {
+	for i, rule := range rules {
+		matches := true
+		for k, v := range rule.Labels {
+			if labels[k] != v {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// pointedTo reports whether a release channel points to one of a build's blobs
+func pointedTo(build retainedBuild, protected map[string]bool) bool {
+	for _, blob := range build.Blobs {
+		if protected[blob] {
+			return true
+		}
+	}
+	return false
+}
+
+// channelBlobs returns the blobs the release channels point to
+func channelBlobs() (map[string]bool, error) {
+	retained.Lock()
+	apps := make([]string, 0, len(retained.apps))
+	for app := range retained.apps {
+		apps = append(apps, app)
+	}
+	retained.Unlock()
+
+	blobs := map[string]bool{}
+	for _, app := range apps {
+		channels, err := readChannels(app)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read channels of '%s' - %v", app, err)
+		}
+		for _, channel := range channels {
+			blobs[channel.Blob] = true
+		}
+	}
+	return blobs, nil
+}
+
+// pruneBuild deletes the blobs of a build (but those still needed), then
+// forgets it. Its index goes last, so a build failing part way is still listed
+// and pruned again next time.
+func pruneBuild(build retainedBuild, needed map[string]bool) error {
+	for _, blob := range build.Blobs {
+		if needed[blob] {
+			continue
+		}
+		err := backend.DeleteBlob(blob)
+		if err != nil {
+			return fmt.Errorf("Failed to delete blob '%s' - %w", blob, err)
+		}
+		store.Delete(blobsBucket, blob)
+		cache.Forget(blob)
+	}
+
+	retained.Lock()
+	delete(retained.builds, build.Build)
+	retained.Unlock()
+	return store.Delete(buildsBucket, build.Build)
+}
+
+// adoptBuilds starts tracking the builds in the primary store that retention
+// doesn't know of (committed before it tracked builds), found by listing the
+// store's indexes, as committed when their index was written. Builds committed
+// before indexes were written are adopted too: a top-level blob that is none
+// of slurp's own (sidecars, parts, hidden blobs) nor another build's is a
+// build archive, labeled with its blob's metadata, committed when it was
+// written. Nodes of a cluster only prune the builds they commit, so they adopt
+// none.
+func adoptBuilds() error {
+	if Clustered() {
+		return nil
+	}
+	blobs, err := backend.ListBlobs("")
+	if err == backend.ErrNoList {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to list builds - %v", err)
+	}
+
+	known := map[string]bool{}
+	for _, blob := range blobs {
+		buildId := strings.TrimSuffix(blob.Id, ".index")
+		if buildId == blob.Id || buildId == "" || strings.Contains(buildId, "/") {
+			continue
+		}
+		known[buildId] = true
+		retained.Lock()
+		_, tracked := retained.builds[buildId]
+		retained.Unlock()
+		if tracked {
+			continue
+		}
+
+		index, err := GetIndex(buildId)
+		if err != nil {
+			config.Log.Error("Failed to adopt build '%v' - %v", buildId, err)
+			continue
+		}
+		committed := blob.Modified
+		if committed.IsZero() {
+			committed = time.Now().UTC()
+		}
+		config.Log.Debug("Adopting build '%v' for retention", buildId)
+		trackBuild(*index, committed)
+	}
+
+	// once the indexed builds (and so their blobs) are known
+	retained.Lock()
+	for id, build := range retained.builds {
+		known[id] = true
+		for _, blob := range build.Blobs {
+			known[blob] = true
+		}
+	}
+	retained.Unlock()
+	for _, blob := range blobs {
+		if !known[blob.Id] && unindexedBuild(blob.Id) {
+			adoptArchive(blob)
+		}
+	}
+	return nil
+}
+
+// unindexedBuild reports whether a blob retention doesn't know of may be a
+// build committed before indexes were written: a top-level blob that isn't
+// one slurp stores beside builds
+func unindexedBuild(id string) bool {
+	if strings.HasPrefix(id, ".") || strings.Contains(id, "/") {
+		return false
+	}
+	// a sidecar or part of a build, or staged contents
+	_, err := names.BuildId(id)
+	return err == nil
+}
+
+// adoptArchive starts tracking a build committed before indexes were written,
+// stored as the single archive blob
+func adoptArchive(blob backend.BlobStat) {
+	index := Index{Build: blob.Id, Entries: []Entry{{Blob: blob.Id, Size: blob.Size}}}
+	if stat, err := backend.StatBlob(blob.Id); err == nil {
+		index.Metadata = stat.Meta
+	}
+	committed := blob.Modified
+	if committed.IsZero() {
+		committed = time.Now().UTC()
+	}
+	config.Log.Debug("Adopting unindexed build '%v' for retention", blob.Id)
+	trackBuild(index, committed)
+}
+
+// recordBuild remembers the blobs a commit stored a build as, for retention
+func recordBuild(index Index) {
+	trackBuild(index, time.Now().UTC())
+}
+
+// trackBuild remembers the blobs a build is stored as, committed when
+func trackBuild(index Index, committed time.Time) {
+	record := retainedBuild{Build: index.Build, Committed: committed, Labels: index.Metadata, Base: index.Base}
+	for _, entry := range index.Entries {
+		record.Blobs = append(record.Blobs, entry.Blob)
+		record.Bytes += entry.Size
+	}
+	for _, id := range []string{manifestId(index.Build), licensesId(index.Build), previewId(index.Build), signatureId(index.Build), indexId(index.Build)} {
+		record.Blobs = append(record.Blobs, id)
+	}
+
+	retained.Lock()
+	// blobs of an earlier commit of the build are still stored
+	if previous, ok := retained.builds[index.Build]; ok {
+		seen := map[string]bool{}
+		for _, blob := range record.Blobs {
+			seen[blob] = true
+		}
+		var stale []string
+		for _, blob := range previous.Blobs {
+			if !seen[blob] {
+				stale = append(stale, blob)
+			}
+		}
+		record.Blobs = append(stale, record.Blobs...)
+	}
+	retained.builds[index.Build] = &record
+	retained.Unlock()
+
+	err := store.Put(buildsBucket, index.Build, record)
+	if err != nil {
+		config.Log.Error("Failed to record build '%v' - %v", index.Build, err)
+	}
+}
+
+// recordApp remembers an app has channels, so retention keeps the builds they
+// point to
+func recordApp(app string) {
+	retained.Lock()
+	recorded := retained.apps[app]
+	retained.apps[app] = true
+	retained.Unlock()
+	if recorded {
+		return
+	}
+
+	err := store.Put(appsBucket, app, true)
+	if err != nil {
+		config.Log.Error("Failed to record app '%v' - %v", app, err)
+	}
+}
+
+// restoreRetention loads the committed builds and apps with channels after a
+// restart
+func restoreRetention() error {
+	err := store.Each(buildsBucket, func(key string, raw []byte) error {
+		var record retainedBuild
+		err := json.Unmarshal(raw, &record)
+		if err != nil {
+			return fmt.Errorf("Bad build record '%s' - %v", key, err)
+		}
+		retained.Lock()
+		retained.builds[key] = &record
+		retained.Unlock()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return store.Each(appsBucket, func(key string, raw []byte) error {
+		retained.Lock()
+		retained.apps[key] = true
+		retained.Unlock()
+		return nil
+	})
+}
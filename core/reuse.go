@@ -0,0 +1,67 @@
+package slurp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/store"
+)
+
+// ErrRecentlyDeleted is returned when staging a build id that is still within
+// its reuse cooldown
+var ErrRecentlyDeleted = errors.New("Build id was recently deleted")
+
+// when each deleted (never committed) build id was deleted, guarded by mutex
+var deleted = map[string]time.Time{}
+
+// checkReuse fails if the build id was deleted within the reuse cooldown
+func checkReuse(buildId string) error {
+	if config.ReuseWait <= 0 {
+		return nil
+	}
+
+	mutex.Lock()
+	at, ok := deleted[buildId]
+	mutex.Unlock()
+
+	if ok && time.Since(at) < config.ReuseWait {
+		return fmt.Errorf("%w - '%s' can be reused after %v", ErrRecentlyDeleted, buildId, at.Add(config.ReuseWait).Format(time.RFC3339))
+	}
+	return nil
+}
+
+// recordDelete starts the reuse cooldown for a build id
+func recordDelete(buildId string) {
+	if config.ReuseWait <= 0 {
+		return
+	}
+
+	at := time.Now().UTC()
+	mutex.Lock()
+	deleted[buildId] = at
+	mutex.Unlock()
+
+	err := store.Put(deletedBucket, buildId, at)
+	if err != nil {
+		config.Log.Error("Failed to persist deletion of '%v' - %v", buildId, err)
+	}
+}
+
+// pruneDeleted forgets deletions whose cooldown ended before now
+func pruneDeleted(now time.Time) {
+	var expired []string
+	mutex.Lock()
+	for id, at := range deleted {
+		if now.Sub(at) >= config.ReuseWait {
+			delete(deleted, id)
+			expired = append(expired, id)
+		}
+	}
+	mutex.Unlock()
+
+	for _, id := range expired {
+		store.Delete(deletedBucket, id)
+	}
+}
@@ -0,0 +1,315 @@
+package slurp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/audit"
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/cron"
+)
+
+var (
+	// ErrNoTask is returned for a task the scheduler doesn't know
+	ErrNoTask = errors.New("Task not found")
+	// ErrTaskRunning is returned running a task whose last run is still going
+	ErrTaskRunning = errors.New("Task is already running")
+)
+
+// benchSize is the size of the blob the backend benchmark writes and reads
+const benchSize = 8 << 20
+
+// benchId is the blob id the backend benchmark writes
+const benchId = ".slurp-benchmark"
+
+// tasks the scheduler can run, by name. Each returns a summary of what it did.
+var tasks = map[string]func() (string, error){
+	"sweep":        runSweep,
+	"gc":           runGC,
+	"verify":       runVerify,
+	"benchmark":    runBenchmark,
+	"audit-export": runAuditExport,
+	"retention":    runRetention,
+}
+
+// TaskStatus is a scheduled task and the outcome of its last run
+type TaskStatus struct {
+	Task     string     `json:"task"`
+	Schedule string     `json:"schedule,omitempty"` // cron expression it runs on (omitted if only run by hand)
+	Next     *time.Time `json:"next,omitempty"`     // when it next runs (omitted if never)
+	Running  bool       `json:"running"`            // whether a run is in progress
+	Runs     int        `json:"runs"`               // runs since slurp started
+	Started  *time.Time `json:"started,omitempty"`  // when the last run started
+	Ended    *time.Time `json:"ended,omitempty"`    // when the last run ended
+	Duration string     `json:"duration,omitempty"` // how long the last run took
+	Result   string     `json:"result,omitempty"`   // what the last run did
+	Error    string     `json:"error,omitempty"`    // why the last run failed
+}
+
+// scheduled tasks and their schedules
+var schedule = struct {
+	sync.Mutex
+	tasks map[string]*TaskStatus
+	specs map[string]cron.Schedule
+}{tasks: map[string]*TaskStatus{}, specs: map[string]cron.Schedule{}}
+
+// Scheduled reports whether a task runs on a schedule (rather than its
+// interval setting)
+func Scheduled(task string) bool {
+	_, ok := config.Schedule[task]
+	return ok
+}
+
+// StartScheduler runs the tasks in schedule on their cron expressions. A task
+// still running when it is due again is skipped.
+func StartScheduler() error {
+	if errs := checkSchedule(); len(errs) > 0 {
+		return errs[0]
+	}
+	if len(config.Schedule) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	schedule.Lock()
+	for task, expr := range config.Schedule {
+		spec, _ := cron.Parse(expr)
+		schedule.specs[task] = spec
+		schedule.tasks[task] = &TaskStatus{Task: task, Schedule: expr, Next: next(spec, now)}
+		config.Log.Info("Running '%v' on schedule '%v'", task, expr)
+	}
+	schedule.Unlock()
+
+	go func() {
+		for {
+			time.Sleep(time.Until(due(time.Now())))
+		}
+	}()
+	return nil
+}
+
+// due starts the tasks due by now, returning when the next one is (or a
+// minute from now at most)
+func due(now time.Time) time.Time {
+	wake := now.Add(time.Minute)
+
+	schedule.Lock()
+	defer schedule.Unlock()
+	for task, status := range schedule.tasks {
+		if status.Next != nil && !status.Next.After(now) {
+			if status.Running {
+				config.Log.Warn("Skipping scheduled '%v', its last run is still going", task)
+			} else {
+				status.Running = true
+				go runTask(task)
+			}
+			status.Next = next(schedule.specs[task], now)
+		}
+		if status.Next != nil && status.Next.Before(wake) {
+			wake = *status.Next
+		}
+	}
+	return wake
+}
+
+// next returns when a schedule is next due after now, or nil if never
+func next(spec cron.Schedule, now time.Time) *time.Time {
+	at := spec.Next(now)
+	if at.IsZero() {
+		return nil
+	}
+	return utc(at)
+}
+
+// utc returns a pointer to t in UTC
+func utc(t time.Time) *time.Time {
+	t = t.UTC()
+	return &t
+}
+
+// RunTask runs a task now (scheduled or not), waiting for it to finish
+func RunTask(task string) (TaskStatus, error) {
+	schedule.Lock()
+	status, ok := schedule.tasks[task]
+	if ok && status.Running {
+		schedule.Unlock()
+		return *status, ErrTaskRunning
+	}
+	if !ok {
+		if _, known := tasks[task]; !known {
+			schedule.Unlock()
+			return TaskStatus{}, ErrNoTask
+		}
+		// unscheduled tasks can still be run by hand
+		status = &TaskStatus{Task: task}
+		schedule.tasks[task] = status
+	}
+	status.Running = true
+	schedule.Unlock()
+
+	runTask(task)
+
+	schedule.Lock()
+	defer schedule.Unlock()
+	return *schedule.tasks[task], nil
+}
+
+// ListTasks returns the scheduled (and hand run) tasks, by name
+func ListTasks() []TaskStatus {
+	schedule.Lock()
+	defer schedule.Unlock()
+
+	list := make([]TaskStatus, 0, len(schedule.tasks))
+	for _, status := range schedule.tasks {
+		list = append(list, *status)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Task < list[j].Task })
+	return list
+}
+
+// runTask runs a task marked running, recording its outcome
+func runTask(task string) {
+	started := time.Now()
+	result, err := tasks[task]()
+	ended := time.Now()
+
+	schedule.Lock()
+	status := schedule.tasks[task]
+	status.Running = false
+	status.Runs++
+	status.Started, status.Ended = utc(started), utc(ended)
+	status.Duration = ended.Sub(started).String()
+	status.Result, status.Error = result, ""
+	if err != nil {
+		status.Error = err.Error()
+	}
+	schedule.Unlock()
+
+	if err != nil {
+		config.Log.Error("Task '%v' failed - %v", task, err)
+		return
+	}
+	config.Log.Debug("Task '%v' finished in %v - %v", task, ended.Sub(started), result)
+}
+
+// checkSchedule checks every task in schedule is known and has a valid cron
+// expression
+func checkSchedule() []error {
+	var errs []error
+	for task, expr := range config.Schedule {
+		if _, ok := tasks[task]; !ok {
+			names := make([]string, 0, len(tasks))
+			for name := range tasks {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			errs = append(errs, fmt.Errorf("schedule.%s: unknown task [%s]", task, strings.Join(names, "|")))
+			continue
+		}
+		if _, err := cron.Parse(expr); err != nil {
+			errs = append(errs, fmt.Errorf("schedule.%s: %v", task, err))
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errs
+}
+
+// runSweep removes expired stages (as sweep-interval does when unscheduled)
+func runSweep() (string, error) {
+	janitorSweep(0)
+	status := Janitor()
+	if status.Tier != nil {
+		return fmt.Sprintf("build dir %.1f%% used, stage ttls scaled by %v", status.Used, status.Tier.Factor), nil
+	}
+	return fmt.Sprintf("build dir %.1f%% used", status.Used), nil
+}
+
+// runGC removes orphaned staging dirs, and unlisted staged blobs (as POST
+// /admin/gc does)
+func runGC() (string, error) {
+	report, err := CollectGarbage()
+	if err != nil {
+		return "", err
+	}
+	if len(report.Errors) > 0 {
+		return "", errors.New(strings.Join(report.Errors, ", "))
+	}
+	if report.Staged > 0 {
+		return fmt.Sprintf("removed %d orphaned dir(s), %d bytes, and %d staged blob(s), %d bytes", len(report.Removed), report.Bytes, report.Staged, report.StagedBytes), nil
+	}
+	return fmt.Sprintf("removed %d orphaned dir(s), %d bytes", len(report.Removed), report.Bytes), nil
+}
+
+// runVerify verifies a sample of committed blobs across the stores (as
+// verify-interval does when unscheduled)
+func runVerify() (string, error) {
+	report := Verify(config.VerifyN)
+	return fmt.Sprintf("checked %d blob(s) in %d store(s), %d diverged", report.Checked, len(report.Stores), len(report.Diverged)), nil
+}
+
+// runRetention prunes the committed builds past the retention rules (as
+// retention-interval does when unscheduled)
+func runRetention() (string, error) {
+	report, err := Retain(false)
+	if err != nil {
+		return "", err
+	}
+	if len(report.Errors) > 0 {
+		return "", errors.New(strings.Join(report.Errors, ", "))
+	}
+	return fmt.Sprintf("pruned %d build(s), %d blob(s), %d bytes", len(report.Pruned), report.Blobs, report.Bytes), nil
+}
+
+// runAuditExport ships new audit log records to storage (as audit-export
+// does when unscheduled)
+func runAuditExport() (string, error) {
+	segment, err := audit.Export()
+	if err != nil {
+		return "", err
+	}
+	if segment == nil {
+		return "no new records", nil
+	}
+	return fmt.Sprintf("exported %d record(s) as '%s'", segment.Records, segment.Blob), nil
+}
+
+// runBenchmark writes a blob of random bytes to the backend and reads it
+// back, measuring the throughput of each
+func runBenchmark() (string, error) {
+	data := make([]byte, benchSize)
+	rand.Read(data)
+
+	start := time.Now()
+	err := backend.WriteBlob(benchId, bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("Failed to write benchmark blob - %v", err)
+	}
+	wrote := time.Since(start)
+
+	start = time.Now()
+	body, err := backend.ReadBlob(benchId)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read benchmark blob - %v", err)
+	}
+	read, err := ioutil.ReadAll(body)
+	body.Close()
+	if err != nil {
+		return "", fmt.Errorf("Failed to read benchmark blob - %v", err)
+	}
+	took := time.Since(start)
+
+	if !bytes.Equal(read, data) {
+		return "", fmt.Errorf("Benchmark blob read back differs from what was written")
+	}
+
+	mbps := func(d time.Duration) float64 { return float64(benchSize) / (1 << 20) / d.Seconds() }
+	return fmt.Sprintf("write %.1f MB/s (%v), read %.1f MB/s (%v)", mbps(wrote), wrote, mbps(took), took), nil
+}
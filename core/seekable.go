@@ -0,0 +1,351 @@
+package slurp
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+)
+
+// magic numbers of the zstd seekable format's seek table
+const (
+	skippableMagic = 0x184D2A5E // skippable frame, ignored by zstd readers
+	seekableMagic  = 0x8F92EAB1 // seek table footer
+)
+
+var (
+	// ErrNoFile is returned reading a path a build doesn't have
+	ErrNoFile = errors.New("File not found")
+	// ErrUnreadable is returned reading a single file of a build whose format can't be read in part
+	ErrUnreadable = errors.New("Single files can't be read from this build's format")
+)
+
+// Frame is an independently compressed part of a seekable archive
+type Frame struct {
+	Compressed int64 `json:"compressed"` // bytes of the frame in the blob
+	Size       int64 `json:"size"`       // bytes the frame decompresses to
+}
+
+// seekWriter compresses a tar stream into independent zstd frames of
+// zstd-frame-size MB, ending it with the seek table of the zstd seekable
+// format. zstd readers still see one stream, while readers knowing the frames
+// can decompress only the ones holding the bytes they need. It also records
+// where each file's contents start in the tar stream.
+type seekWriter struct {
+	out     *countWriter // compressed blob
+	buf     []byte
+	frames  []Frame
+	tar     *io.PipeWriter   // feeds the tar headers to be indexed
+	offsets map[string]int64 // tar offsets of regular files' contents
+	done    chan struct{}
+}
+
+func newSeekWriter(out io.Writer) *seekWriter {
+	reader, writer := io.Pipe()
+	self := &seekWriter{
+		out:     &countWriter{w: out},
+		buf:     make([]byte, 0, config.ZstdFrame<<20),
+		tar:     writer,
+		offsets: map[string]int64{},
+		done:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(self.done)
+		// tar reads exactly the header and content blocks, so the count after
+		// a header is where its contents start
+		count := &countReader{r: reader}
+		archive := tar.NewReader(count)
+		for {
+			header, err := archive.Next()
+			if err != nil {
+				break
+			}
+			if header.Typeflag == tar.TypeReg {
+				self.offsets[strings.TrimPrefix(path.Clean(header.Name), "/")] = count.n
+			}
+		}
+		io.Copy(io.Discard, reader)
+	}()
+
+	return self
+}
+
+// Write buffers p, compressing a frame whenever one fills up
+func (self *seekWriter) Write(p []byte) (int, error) {
+	self.tar.Write(p)
+
+	written := 0
+	for len(p) > 0 {
+		n := copy(self.buf[len(self.buf):cap(self.buf)], p)
+		self.buf = self.buf[:len(self.buf)+n]
+		written += n
+		p = p[n:]
+
+		if len(self.buf) == cap(self.buf) {
+			err := self.flush()
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush compresses the buffered bytes as a frame
+func (self *seekWriter) flush() error {
+	if len(self.buf) == 0 {
+		return nil
+	}
+
+	start := self.out.n
+	cmd := exec.Command("zstd", "-q", "-c")
+	cmd.Stdin = bytes.NewReader(self.buf)
+	cmd.Stdout = self.out
+	out := &bytes.Buffer{}
+	cmd.Stderr = out
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to compress frame '%s' - %v", strings.TrimSpace(out.String()), err)
+	}
+
+	self.frames = append(self.frames, Frame{Compressed: self.out.n - start, Size: int64(len(self.buf))})
+	self.buf = self.buf[:0]
+	return nil
+}
+
+// Close compresses the last frame and writes the seek table
+func (self *seekWriter) Close() error {
+	err := self.flush()
+	self.tar.Close()
+	<-self.done
+	if err != nil {
+		return err
+	}
+
+	// skippable frame holding each frame's sizes and a footer
+	table := &bytes.Buffer{}
+	binary.Write(table, binary.LittleEndian, uint32(skippableMagic))
+	binary.Write(table, binary.LittleEndian, uint32(len(self.frames)*8+9))
+	for _, frame := range self.frames {
+		binary.Write(table, binary.LittleEndian, uint32(frame.Compressed))
+		binary.Write(table, binary.LittleEndian, uint32(frame.Size))
+	}
+	binary.Write(table, binary.LittleEndian, uint32(len(self.frames)))
+	table.WriteByte(0) // no checksums
+	binary.Write(table, binary.LittleEndian, uint32(seekableMagic))
+
+	_, err = self.out.Write(table.Bytes())
+	return err
+}
+
+// countWriter counts the bytes written through it
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (self *countWriter) Write(p []byte) (int, error) {
+	n, err := self.w.Write(p)
+	self.n += int64(n)
+	return n, err
+}
+
+// countReader counts the bytes read through it
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (self *countReader) Read(p []byte) (int, error) {
+	n, err := self.r.Read(p)
+	self.n += int64(n)
+	return n, err
+}
+
+// BuildFile is a single file of a committed build
+type BuildFile struct {
+	File
+	index *Index
+}
+
+// OpenFile finds a file of a committed build in its manifest, so it can be
+// read without downloading the whole build
+func OpenFile(buildId, name string) (*BuildFile, error) {
+	index, err := GetIndex(buildId)
+	if err != nil {
+		return nil, err
+	}
+	if index.Output == OutputDelta || index.Format == FormatSquashfs {
+		return nil, ErrUnreadable
+	}
+
+	manifest, err := GetManifest(buildId)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range manifest.Files {
+		if file.Path == name && file.Mode.IsRegular() {
+			return &BuildFile{File: file, index: index}, nil
+		}
+	}
+	return nil, ErrNoFile
+}
+
+// ReadRange reads n bytes of the file starting at off. Seekable archives
+// decompress only the frames holding the bytes, other archives are streamed
+// through tar up to the file.
+func (self *BuildFile) ReadRange(off, n int64) (io.ReadCloser, error) {
+	if n == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	if self.index.Output == OutputTree {
+		for _, entry := range self.index.Entries {
+			if entry.Path == self.Path {
+				return backend.ReadBlobRange(entry.Blob, off, n)
+			}
+		}
+		return nil, ErrNoFile
+	}
+
+	if len(self.index.Frames) > 0 && self.Offset > 0 {
+		return readFrames(self.index.blob(), self.index.Frames, self.Offset+off, n)
+	}
+
+	// split archives hold the file in one part, listed without the "./"
+	blob, name := self.index.blob(), "./"+self.Path
+	if self.index.Split != "" {
+		var err error
+		blob, err = self.index.partBlob(self.File)
+		if err != nil {
+			return nil, err
+		}
+		name = self.Path
+	}
+
+	flags, err := tarArgs(self.index.Format, false)
+	if err != nil {
+		return nil, err
+	}
+	body, err := backend.ReadBlob(blob)
+	if err != nil {
+		return nil, err
+	}
+
+	// tar -xzf - -O ./path
+	cmd := exec.Command("tar", append(flags, "-", "-O", "--occurrence=1", name)...)
+	file, err := startReader(cmd, body)
+	if err != nil {
+		return nil, err
+	}
+	return skipRange(file, off, n)
+}
+
+// readFrames reads n bytes at off of a seekable archive, fetching and
+// decompressing only the frames holding them
+// Bash equivalent:
+//  `curl -r start-end localhost:7410/blobs/blobId | zstd -d -c | tail -c +skip | head -c n`
+func readFrames(blobId string, frames []Frame, off, n int64) (io.ReadCloser, error) {
+	var start, compressed, length int64
+	i := 0
+	for ; i < len(frames) && start+frames[i].Size <= off; i++ {
+		start += frames[i].Size
+		compressed += frames[i].Compressed
+	}
+	skip := off - start
+	for end := start; i < len(frames) && end < off+n; i++ {
+		end += frames[i].Size
+		length += frames[i].Compressed
+	}
+
+	config.Log.Trace("Reading %d bytes at %d of '%v' from %d compressed bytes", n, off, blobId, length)
+
+	body, err := backend.ReadBlobRange(blobId, compressed, length)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := startReader(exec.Command("zstd", "-d", "-q", "-c"), body)
+	if err != nil {
+		return nil, err
+	}
+	return skipRange(file, skip, n)
+}
+
+// skipRange discards the first off bytes of a reader, limiting it to n bytes
+func skipRange(body io.ReadCloser, off, n int64) (io.ReadCloser, error) {
+	_, err := io.CopyN(io.Discard, body, off)
+	if err != nil {
+		body.Close()
+		return nil, fmt.Errorf("Failed to skip to offset %d - %v", off, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, n), body}, nil
+}
+
+// cmdReader reads the output of a command fed from a blob, failing the read
+// if the command fails
+type cmdReader struct {
+	io.Reader
+	cmd    *exec.Cmd
+	in     io.Closer
+	stderr *bytes.Buffer
+	waited bool
+	err    error
+}
+
+// startReader runs cmd with in as its input, returning its output
+func startReader(cmd *exec.Cmd, in io.ReadCloser) (*cmdReader, error) {
+	cmd.Stdin = in
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		in.Close()
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		in.Close()
+		return nil, fmt.Errorf("Failed to start '%v' - %v", cmd.Args[0], err)
+	}
+	return &cmdReader{Reader: out, cmd: cmd, in: in, stderr: stderr}, nil
+}
+
+func (self *cmdReader) Read(p []byte) (int, error) {
+	n, err := self.Reader.Read(p)
+	if err == io.EOF && self.wait() != nil {
+		return n, self.err
+	}
+	return n, err
+}
+
+// Close stops the command if it is still running
+func (self *cmdReader) Close() error {
+	if !self.waited {
+		self.cmd.Process.Kill()
+	}
+	self.wait()
+	return self.in.Close()
+}
+
+// wait reaps the command once, keeping its error
+func (self *cmdReader) wait() error {
+	if !self.waited {
+		self.waited = true
+		if err := self.cmd.Wait(); err != nil {
+			self.err = fmt.Errorf("Failed to read file '%s' - %v", strings.TrimSpace(self.stderr.String()), err)
+		}
+	}
+	return self.err
+}
@@ -2,97 +2,264 @@
 package slurp
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/mu-box/slurp/backend"
 	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/names"
+	"github.com/mu-box/slurp/reqid"
 	"github.com/mu-box/slurp/ssh"
+	"github.com/mu-box/slurp/trace"
+	"github.com/mu-box/slurp/webhook"
 )
 
+// Stage is a build that has been staged but not yet committed
+type Stage struct {
+	Id       string    `json:"id"`                 // build id (also the ssh user)
+	Template string    `json:"template,omitempty"` // name of the stage template in use
+	Created  time.Time `json:"created"`            // when the stage was added
+	Expires  time.Time `json:"expires,omitempty"`  // when the stage expires uncommitted (zero never)
+
+	Base   string `json:"base,omitempty"`   // build the stage was seeded from
+	Format string `json:"format,omitempty"` // archive format to commit with (empty uses the template/default)
+	State  string `json:"state"`            // staged, queued, committing, or committed
+	Queue  int    `json:"queue,omitempty"`  // place in the upload queue while queued (1 is next)
+
+	Metadata map[string]string `json:"metadata,omitempty"` // user labels (commit sha, branch, tenant...)
+	Notes    string            `json:"notes,omitempty"`    // release notes from the publisher, stored with the committed build
+
+	Owner    string    `json:"owner,omitempty"`    // fingerprint of the credential owning the stage (empty if unowned)
+	Handoffs []Handoff `json:"handoffs,omitempty"` // owner changes, oldest first
+
+	Node string `json:"node,omitempty"` // cluster node the stage is on (set listing a cluster's stages)
+}
+
+// StageOptions are the optional settings for a new stage
+type StageOptions struct {
+	Template string            // stage template to use
+	Format   string            // archive format to commit with (empty uses the template/default)
+	TTL      time.Duration     // time until the stage expires uncommitted (0 uses the template/default)
+	Metadata map[string]string // labels to attach to the stage
+	Notes    string            // release notes to commit the build with
+	Owner    string            // credential owning the stage (optional)
+	Current  string            // credential of the owner of a stage restaged under its id
+}
+
+// ErrNoStage is returned when a build isn't staged
+var ErrNoStage = errors.New("No Build Found")
+
+// ErrSyncing is returned when committing a build with an rsync session running
+var ErrSyncing = ssh.ErrSyncing
+
 var (
 	// copy of all non-committed builds
-	builds []string
+	stages = map[string]*Stage{}
 
-	// mutex ensures updates to builds are atomic
+	// builds being staged (dir created, not yet registered)
+	pending = map[string]bool{}
+
+	// mutex ensures updates to stages are atomic
 	mutex = sync.Mutex{}
 )
 
-// todo: slurp restart persistance? regenerate builds from config.BuildDir contents
-
 // AddStage fetches the build "oldId" from the backend, uncompresses it to "newId",
-// generates, and returns, a new user secret for rsyncing.
+// generates, and returns, a new user secret for rsyncing. The options select
+// the stage template and how long the stage may live uncommitted.
 // Bash equivalent:
 //  `curl localhost:7410/blobs/oldId | tar -C buildDir/newId -zxf -`
-func AddStage(oldId, newId string) error {
-	// prepare location for extraction
-	err := os.MkdirAll(config.BuildDir+"/"+newId, 0755)
+func AddStage(oldId, newId string, opts StageOptions) error {
+	if opts.Template != "" {
+		if _, ok := config.Get(&config.Templates)[opts.Template]; !ok {
+			return fmt.Errorf("Unknown template '%s'", opts.Template)
+		}
+	}
+
+	if opts.Format != "" && !validFormat(opts.Format) {
+		return fmt.Errorf("Unknown archive format '%s'", opts.Format)
+	}
+
+	newId, err := names.BuildId(newId)
+	if err != nil {
+		return err
+	}
+
+	err = checkReuse(newId)
+	if err != nil {
+		return err
+	}
+
+	err = checkWatermark()
+	if err != nil {
+		return err
+	}
+
+	opts.Metadata, err = validateMetadata(opts.Metadata)
+	if err != nil {
+		return err
+	}
+	err = validateNotes(opts.Notes)
+	if err != nil {
+		return err
+	}
+
+	// restaging an owned stage takes its owner's credential, so it can't be
+	// taken over (or its owner stripped) around a handoff
+	mutex.Lock()
+	if stage, ok := stages[newId]; ok {
+		err = stage.checkOwner(opts.Current)
+		if err != nil {
+			mutex.Unlock()
+			return err
+		}
+	}
+	pending[newId] = true
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		delete(pending, newId)
+		mutex.Unlock()
+	}()
+
+	// prepare location for extraction, noting whether it is new (a restaged
+	// build's dir holds its synced files)
+	_, err = os.Stat(filepath.Join(config.BuildDir, newId))
+	created := os.IsNotExist(err)
+	err = os.MkdirAll(config.BuildDir+"/"+newId, 0755)
 	if err != nil {
 		return fmt.Errorf("Failed to create build dir - %v", err)
 	}
 
 	// backend.ReadBlob(oldId) | tar -C buildDir/newId -zxf -
 	if oldId != "" {
-		// stream last build from backend
-		res, err := backend.ReadBlob(oldId)
+		err := backend.WaitHealthy(config.StoreWait)
 		if err != nil {
-			return fmt.Errorf("Failed to get old build - %v", err)
+			return fmt.Errorf("Backend not ready - %v", err)
 		}
 
-		config.Log.Trace("Fetched build")
-
-		// prepare to extract to new build dir
-		cmd := exec.Command("tar", "--atime-preserve", "-C", newId, "-zxf", "-")
-		// cmd.Dir = "/tmp"
-		cmd.Dir = config.BuildDir
-
-		// pipe build to extract command
-		cmd.Stdin = res
-
-		config.Log.Trace("Running extract command '%v'", cmd.Args)
-		// err := cmd.Run()
-		out, err := cmd.CombinedOutput()
+		// fetch the last build, reassembling delta builds from their layers
+		// (and sharing files from the pool with dedup)
+		err = seedStage(oldId, newId)
 		if err != nil {
-			return fmt.Errorf("Failed to extract build to dir '%s' - %v", out, err)
+			// don't leave a partial seed behind for a retry to build on,
+			// unless the dir was there before
+			if created {
+				os.RemoveAll(filepath.Join(config.BuildDir, newId))
+			}
+			return err
 		}
-
-		config.Log.Trace("Extracted build")
-		res.Close()
 	}
 
-	err = ssh.AddUser(newId)
+	err = ssh.AddUser(newId, config.Get(&config.Templates)[opts.Template].Rsync)
 	if err != nil {
 		return fmt.Errorf("Failed to add user - %v", err)
 	}
 
+	stage := &Stage{Id: newId, Template: opts.Template, Created: time.Now().UTC(), Base: oldId, Format: opts.Format, State: StateStaged, Metadata: map[string]string{}, Notes: opts.Notes, Owner: fingerprint(opts.Owner)}
+	for k, v := range opts.Metadata {
+		stage.Metadata[k] = v
+	}
+	if ttl := ttlFor(opts); ttl > 0 {
+		stage.Expires = stage.Created.Add(ttl)
+	}
+
 	mutex.Lock()
-	builds = append(builds, newId)
+	stages[newId] = stage
+	record := stage.copy()
 	mutex.Unlock()
 
+	persist(record)
+
+	// a stage backed by storage is written back as soon as it is seeded
+	err = writeBack(newId)
+	if err != nil {
+		config.Log.Error("%s%v", reqid.Tag(newId), err)
+	}
+
+	webhook.SendLabeled(webhook.StageAdded, newId, record.Metadata, map[string]interface{}{"old-id": oldId, "stage": stage})
+
 	return nil
 }
 
-// CommitStage compresses the new build, uploads it to the backend and removes
-// the user secret from the ssh server.
-// Bash equivalent:
-//  `tar -C buildDir/buildId -czf - . | curl localhost:7410/blobs/newId -T -`
+// CommitStage packages the new build according to its commit output format,
+// uploads it to the backend and removes the user secret from the ssh server.
 func CommitStage(buildId string) error {
-	// remove user first
-	err := getUser(buildId)
+	return commitStage(buildId, false)
+}
+
+// commitStage commits a build, recording the commit so it is resumed if
+// slurp restarts before it finishes
+func commitStage(buildId string, resumed bool) (err error) {
+	// forget the request of a failed commit, once the failure is logged
+	defer func() {
+		if err != nil {
+			reqid.Clear(buildId)
+		}
+	}()
+	// in a cluster the build dir is shared, a stage this node doesn't hold
+	// may be a peer's
+	if Clustered() && getUser(buildId) != nil {
+		return ErrNoStage
+	}
+	if getUser(buildId) == nil {
+		startJob(buildId, resumed)
+		defer func() {
+			finishJob(buildId, err)
+		}()
+	}
+	defer clearAbort(buildId, false)
+
+	// trace the commit (under the request that made it), its packaging and
+	// upload under it
+	span := trace.Start("commit", trace.KindInternal, trace.Build(buildId))
+	span.Set("slurp.build", buildId)
+	trace.SetBuild(buildId, span.Context())
+	defer func() {
+		trace.ClearBuild(buildId)
+		span.Finish(err)
+	}()
+
+	if stage, err := GetStage(buildId); err == nil && stage.State == StateAborted {
+		return ErrAborted
+	}
+
+	// make sure the backend (and our token) is good before doing any work,
+	// waiting for it if storage is coming back up
+	err = backend.WaitHealthy(config.StoreWait)
+	if err != nil {
+		return fmt.Errorf("Backend not ready - %v", err)
+	}
+
+	// lock the user first so the build can't change while it is packaged,
+	// refusing to commit a build still being synced
+	err = getUser(buildId)
 	if err == nil {
-		err = ssh.DelUser(buildId)
+		err = ssh.LockUser(buildId)
 		if err != nil {
-			return fmt.Errorf("Failed to remove user - %v", err)
+			return ErrSyncing
 		}
+		defer func() {
+			if err != nil {
+				unlockStage(buildId)
+			}
+		}()
 	}
 
-	// don't buffer (free the rams)
-	blobReader, blobWriter := io.Pipe()
+	// fetch what was evicted of a stage backed by storage
+	err = hydrateStage(buildId)
+	if err != nil {
+		return fmt.Errorf("Failed to hydrate stage - %v", err)
+	}
 
-	config.Log.Trace("Preparing to compress '%v'", config.BuildDir+"/"+buildId)
+	config.Log.Trace("%sPreparing to commit '%v'", reqid.Tag(buildId), config.BuildDir+"/"+buildId)
 
 	// check for existing build
 	_, err = os.Stat(config.BuildDir + "/" + buildId)
@@ -100,9 +267,231 @@ func CommitStage(buildId string) error {
 		return fmt.Errorf("Build dir doesn't exist - %v", err)
 	}
 
+	// an identical commit (eg. a CI retry) already uploading is waited on
+	// and reused rather than uploading the same bytes in parallel
+	owned, err := claimUpload(buildId)
+	if err != nil {
+		return err
+	}
+	if owned == nil {
+		config.Log.Info("%sReused identical in-flight commit of '%v'", reqid.Tag(buildId), buildId)
+		return nil
+	}
+
+	// wait for an upload slot so parallel commits don't saturate the storage link
+	queued := trace.Start("queue", trace.KindInternal, span.Context())
+	err = acquireUpload(buildId, func() { setState(buildId, StateQueued) })
+	queued.Finish(err)
+	if err != nil {
+		finishUpload(buildId, owned, err)
+		return err
+	}
+	setState(buildId, StateCommitting)
+	err = commit(buildId)
+	releaseUpload()
+	finishUpload(buildId, owned, err)
+	if err != nil && isAborted(buildId) {
+		return ErrAborted
+	}
+	if err != nil {
+		// with quarantine, a build that failed packaging or uploading is moved
+		// aside rather than returned to staged
+		var failed *failedCommit
+		if config.Quarantine && errors.As(err, &failed) {
+			qerr := quarantine(buildId, failed)
+			if qerr == nil {
+				return err
+			}
+			config.Log.Error("%sFailed to quarantine '%v' - %v", reqid.Tag(buildId), buildId, qerr)
+		}
+		setState(buildId, StateStaged)
+		return err
+	}
+
+	// the stage stays locked, its sessions needn't be kept
+	ssh.DelUser(buildId)
+
+	setState(buildId, StateCommitted)
+	return nil
+}
+
+// commit packages and uploads a build, recording its index. The checks run
+// along the way are sent with the commit event.
+func commit(buildId string) error {
+	var err error
+	var results checks
+	index := Index{Build: buildId, Output: outputFor(buildId), Verify: verifyFor(buildId)}
+	if stage, err := GetStage(buildId); err == nil {
+		index.Metadata, index.Notes = stage.Metadata, stage.Notes
+	}
+
+	// tell receivers why a commit failed, not just that it did
+	fail := func(err error) error {
+		report := CommitReport{Index: index, Checks: results, Error: err.Error()}
+		webhook.SendLabeled(webhook.StageCommitFailed, buildId, index.Metadata, report)
+		return &failedCommit{err, report}
+	}
+
+	results.add("output", CheckPolicy, nil, outputPolicy(buildId, index.Output))
+
+	// hooks may change the build, so they run before it is looked at
+	err = runHooks(buildId, index, &results)
+	if err != nil {
+		return fail(err)
+	}
+
+	// leave out what shouldn't be stored, and refuse what mustn't be
+	err = filterBuild(buildId, &results)
+	if err != nil {
+		return fail(err)
+	}
+	err = checkQuota(buildId, &results)
+	if err != nil {
+		return fail(err)
+	}
+
+	// refuse forbidden licenses before anything is uploaded
+	var licenses *LicenseReport
+	if scanEnabled() {
+		licenses, err = scanLicenses(buildId)
+		if err != nil {
+			results.add("licenses", CheckValidation, err, "")
+			return fail(fmt.Errorf("Failed to scan licenses - %v", err))
+		}
+		results.add("licenses", CheckValidation, nil, licenses.summary())
+		if forbidden := licenses.forbidden(); len(forbidden) > 0 {
+			err = fmt.Errorf("Build contains forbidden licenses: %s", strings.Join(forbidden, ", "))
+			results.add("license-deny", CheckPolicy, err, "")
+			return fail(err)
+		}
+		index.Licenses = licenses.Licenses
+	}
+
+	// keep the README and the like readable without the blobs
+	var preview *Preview
+	if previewEnabled() {
+		preview, err = extractPreview(buildId)
+		if err != nil {
+			return fail(fmt.Errorf("Failed to extract preview - %v", err))
+		}
+	}
+
+	switch index.Output {
+	case OutputArchive:
+		if split, size := splitFor(buildId); split != "" {
+			err = commitSplit(buildId, &index, split, size, &results)
+		} else {
+			err = commitArchive(buildId, &index)
+		}
+	case OutputTree:
+		count, verr := validatePaths(buildId)
+		results.add("paths", CheckValidation, verr, fmt.Sprintf("%d files", count))
+		if verr != nil {
+			return fail(fmt.Errorf("Failed to validate build - %v", verr))
+		}
+		err = commitTree(buildId, &index, count == 1)
+	case OutputDelta:
+		err = commitDelta(buildId, &index, &results)
+	default:
+		err = fmt.Errorf("Unknown commit output '%s'", index.Output)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	// make sure storage has what was written, as far as the level asks
+	err = verifyCommit(&index, &results)
+	if err != nil {
+		return fail(err)
+	}
+
+	// list the files so the build can be inspected without downloading it
+	// (delta and split commits already did)
+	files := index.Files
+	if files == nil {
+		files = index.listed
+	}
+	if files == nil {
+		files, err = manifest(buildId)
+		if err != nil {
+			return fail(fmt.Errorf("Failed to list build - %v", err))
+		}
+	}
+	for i := range files {
+		files[i].Offset = index.offsets[files[i].Path]
+		files[i].Part = index.partOf[files[i].Path]
+	}
+	err = writeManifest(Manifest{Build: buildId, Files: files})
+	if err != nil {
+		return fail(fmt.Errorf("Failed to write build manifest - %v", err))
+	}
+	if licenses != nil {
+		err = writeLicenses(licenses)
+		if err != nil {
+			return fail(fmt.Errorf("Failed to write license report - %v", err))
+		}
+	}
+	if preview != nil {
+		err = writePreview(preview)
+		if err != nil {
+			return fail(fmt.Errorf("Failed to write preview - %v", err))
+		}
+	}
+
+	// record what was written so the build can be listed
+	err = writeIndex(index)
+	if err != nil {
+		return fail(fmt.Errorf("Failed to write build index - %v", err))
+	}
+	recordBlobs(index)
+	countCommit(index)
+	recordBuild(index)
+
+	webhook.SendLabeled(webhook.StageCommitted, buildId, index.Metadata, CommitReport{Index: index, Checks: results})
+
+	return nil
+}
+
+// commitArchive compresses the build dir and streams it to the backend as a
+// single blob.
+// Bash equivalent:
+//  `tar -C buildDir/buildId -czf - . | curl localhost:7410/blobs/newId -T -`
+func commitArchive(buildId string, index *Index) error {
+	index.Format = formatFor(buildId)
+
+	// let readers know how to unpack the blob
+	meta := blobMeta(index)
+	meta["archive-format"] = index.Format
+
+	key, err := blobKey(buildId, index)
+	if err != nil {
+		return err
+	}
+
+	if index.Format == FormatSquashfs {
+		return commitSquashfs(buildId, key, index, meta)
+	}
+
+	flags, err := tarArgs(index.Format, true)
+	if err != nil {
+		return err
+	}
+
+	// tar.zst is compressed in frames that can be read on their own
+	seekable := index.Format == FormatTarZst && config.ZstdFrame > 0
+	if seekable {
+		flags = []string{"-cf"}
+	}
+
+	// buffer within the memory budget, spilling to disk past it (an abort
+	// releases it, failing the compression and upload)
+	buffer := newSpool()
+	defer buffer.Release()
+	onAbort(buildId, buffer.Release)
+
 	// tar -C buildDir/buildId -czf - . | backend.WriteBlob(buildId)
 	// prepare to compress build dir
-	cmd := exec.Command("tar", "-C", config.BuildDir+"/"+buildId, "-czf", "-", ".")
+	cmd := exec.Command("tar", append(append([]string{"-C", config.BuildDir + "/" + buildId}, flags...), "-", ".")...)
 	// cmd.Dir = "/tmp"
 	cmd.Dir = config.BuildDir
 
@@ -111,20 +500,32 @@ func CommitStage(buildId string) error {
 	cmd.Env = append(cmd.Env, "GZIP=-n")
 
 	// pipe compressed build to write command
-	cmd.Stdout = blobWriter
+	cmd.Stdout = buffer
+	var frames *seekWriter
+	if seekable {
+		frames = newSeekWriter(buffer)
+		defer frames.tar.Close()
+		cmd.Stdout = frames
+	}
 
-	config.Log.Trace("Running compress command '%v'", cmd.Args)
+	config.Log.Trace("%sRunning compress command '%v'", reqid.Tag(buildId), cmd.Args)
 
 	// prep writing build to backend
 	echan := make(chan error, 1)
+	sum := newDigest()
 
 	// start stream to backend
 	go func() {
-		echan <- backend.WriteBlob(buildId, blobReader)
+		err := backend.WriteBlobMeta(key, io.TeeReader(buffer, sum), meta)
+		buffer.Release()
+		echan <- err
 	}()
 
 	// compress the build
+	span := trace.Start("tar", trace.KindInternal, trace.Build(buildId))
+	span.Set("slurp.format", index.Format)
 	err = cmd.Run()
+	span.Finish(err)
 	if err != nil {
 		return fmt.Errorf("Failed to compress build - %v", err)
 		// the error `io: read/write on closed pipe` here is likely due to
@@ -132,10 +533,18 @@ func CommitStage(buildId string) error {
 		// for hoarder 'hoarder[s]://'
 	}
 
+	if seekable {
+		err = frames.Close()
+		if err != nil {
+			return fmt.Errorf("Failed to compress build - %v", err)
+		}
+		index.Frames, index.offsets = frames.frames, frames.offsets
+	}
+
 	config.Log.Trace("Compressed build")
 
-	// if the command finished, blobWriter is done
-	blobWriter.Close()
+	// if the command finished, the buffer is complete
+	buffer.Close()
 
 	// wait for WriteBlob to finish
 	err = <-echan
@@ -145,6 +554,7 @@ func CommitStage(buildId string) error {
 
 	config.Log.Trace("Uploaded build")
 
+	index.Entries = append(index.Entries, sum.entry("", key))
 	return nil
 }
 
@@ -152,40 +562,131 @@ func CommitStage(buildId string) error {
 func DeleteStage(buildId string) error {
 	// remove user first
 	err := getUser(buildId)
-	if err != nil {
+	if err != nil && Clustered() {
+		// the shared build dir may be a peer's stage
+		return err
+	}
+	if err == nil {
 		err = ssh.DelUser(buildId)
 		if err != nil {
 			return fmt.Errorf("Failed to remove user - %v", err)
 		}
 	}
 
-	config.Log.Trace("Removing '%v'", config.BuildDir+"/"+buildId)
+	config.Log.Trace("%sRemoving '%v'", reqid.Tag(buildId), config.BuildDir+"/"+buildId)
 
 	// remove build files
-	err = os.RemoveAll(config.BuildDir + "/" + buildId)
+	err = removeDir(filepath.Join(config.BuildDir, buildId))
 	if err != nil {
 		return fmt.Errorf("Failed to remove build dir - %v", err)
 	}
 
 	// remove cached build
 	mutex.Lock()
-	for i := range builds {
-		if builds[i] == buildId {
-			builds = append(builds[:i], builds[i+1:]...)
-			break
-		}
-	}
+	stage, ok := stages[buildId]
+	delete(stages, buildId)
 	mutex.Unlock()
 
+	forget(buildId)
+	forgetStaged(buildId)
+	clearAbort(buildId, true)
+
+	// committed builds are just being cleaned up, not deleted
+	if !ok || stage.State != StateCommitted {
+		recordDelete(buildId)
+	}
+
+	var labels map[string]string
+	if ok {
+		labels = stage.Metadata
+	}
+	webhook.SendLabeled(webhook.StageDeleted, buildId, labels, nil)
+	reqid.Clear(buildId)
+
 	return nil
 }
 
+// ListStages returns all uncommitted stages, sorted by id
+func ListStages() []Stage {
+	mutex.Lock()
+	list := make([]Stage, 0, len(stages))
+	for _, stage := range stages {
+		list = append(list, stage.copy())
+	}
+	mutex.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Id < list[j].Id
+	})
+	return list
+}
+
+// GetStage returns an uncommitted stage
+func GetStage(buildId string) (Stage, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	stage, ok := stages[buildId]
+	if !ok {
+		return Stage{}, ErrNoStage
+	}
+	return stage.copy(), nil
+}
+
+// copy returns a copy of the stage that is safe to use without the lock
+func (self *Stage) copy() Stage {
+	stage := *self
+	if stage.State == StateQueued {
+		stage.Queue = QueuePosition(stage.Id)
+	}
+	stage.Metadata = make(map[string]string, len(self.Metadata))
+	for k, v := range self.Metadata {
+		stage.Metadata[k] = v
+	}
+	stage.Handoffs = append([]Handoff(nil), self.Handoffs...)
+	return stage
+}
+
 // getUser gets the user secret corresponding to an uncommitted build.
 func getUser(buildId string) error {
-	for _, build := range builds {
-		if build == buildId {
-			return nil
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := stages[buildId]; ok {
+		return nil
+	}
+	return ErrNoStage
+}
+
+// unlockStage lets clients sync to a stage again after a failed commit
+func unlockStage(buildId string) {
+	stage, err := GetStage(buildId)
+	if err != nil || stage.State == StateAborted {
+		return
+	}
+	err = ssh.AddUser(buildId, config.Get(&config.Templates)[stage.Template].Rsync)
+	if err != nil {
+		config.Log.Error("%sFailed to unlock '%v' - %v", reqid.Tag(buildId), buildId, err)
+	}
+}
+
+// ReloadTemplates applies reloaded templates' rsync settings to the open
+// stages using them, taking effect from their next rsync session
+func ReloadTemplates() {
+	for _, stage := range ListStages() {
+		if stage.Template != "" {
+			ssh.UpdateUser(stage.Id, config.Get(&config.Templates)[stage.Template].Rsync)
+		}
+	}
+}
+
+// outputFor returns the commit output format for a build, preferring the
+// stage's template over the global default.
+func outputFor(buildId string) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if stage, ok := stages[buildId]; ok && stage.Template != "" {
+		if output := config.Get(&config.Templates)[stage.Template].Output; output != "" {
+			return output
 		}
 	}
-	return fmt.Errorf("No Build Found")
+	return config.CommitOut
 }
@@ -1,9 +1,21 @@
 package slurp_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jcelliott/lumber"
 
@@ -28,13 +40,13 @@ func TestMain(m *testing.M) {
 }
 
 func TestAddStage(t *testing.T) {
-	err := slurp.AddStage("", "core-new")
+	err := slurp.AddStage("", "core-new", slurp.StageOptions{})
 	if err != nil {
 		t.Error(err)
 	}
 
 	// use build from api_test
-	err = slurp.AddStage("newbuild", "core-new")
+	err = slurp.AddStage("newbuild", "core-new", slurp.StageOptions{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -54,6 +66,1133 @@ func TestDeleteStage(t *testing.T) {
 	}
 }
 
+func TestDeleteRate(t *testing.T) {
+	err := slurp.AddStage("", "core-paced", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(config.BuildDir+"core-paced/sub", 0755)
+	for i := 0; i < 10; i++ {
+		err = os.WriteFile(fmt.Sprintf("%score-paced/sub/%d", config.BuildDir, i), []byte("data"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config.DelRate = 50
+	defer func() { config.DelRate = 0 }()
+	before := slurp.Deletions()
+	start := time.Now()
+	err = slurp.DeleteStage("core-paced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took < 150*time.Millisecond {
+		t.Errorf("Expected 10 files at 50/s to take longer than %v", took)
+	}
+	if _, err := os.Stat(config.BuildDir + "core-paced"); !os.IsNotExist(err) {
+		t.Errorf("Expected the build dir removed - %v", err)
+	}
+	after := slurp.Deletions()
+	if after.Files-before.Files != 10 || after.Bytes-before.Bytes != 40 || len(after.Active) != 0 {
+		t.Errorf("Unexpected deletion progress - %+v", after)
+	}
+}
+
+func TestSeedFailKeepsStage(t *testing.T) {
+	err := slurp.AddStage("", "core-reseed", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-reseed")
+	err = os.WriteFile(config.BuildDir+"core-reseed/synced", []byte("data"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed seed only removes a dir it created
+	err = slurp.AddStage("core-no-such-build", "core-reseed", slurp.StageOptions{})
+	if err == nil {
+		t.Fatal("Expected seeding from a missing build to fail")
+	}
+	if _, err := os.Stat(config.BuildDir + "core-reseed/synced"); err != nil {
+		t.Errorf("Expected the stage's files kept - %v", err)
+	}
+	err = slurp.AddStage("core-no-such-build", "core-unseeded", slurp.StageOptions{})
+	if err == nil {
+		t.Fatal("Expected seeding from a missing build to fail")
+	}
+	if _, err := os.Stat(config.BuildDir + "core-unseeded"); !os.IsNotExist(err) {
+		t.Errorf("Expected the partial seed removed - %v", err)
+	}
+}
+
+func TestHandoffStage(t *testing.T) {
+	err := slurp.AddStage("", "core-owned", slurp.StageOptions{Owner: "build-job"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-owned")
+
+	if err = slurp.CheckOwner("core-owned", "release-job"); err != slurp.ErrNotOwner {
+		t.Errorf("Expected not owner error, got %v", err)
+	}
+
+	_, err = slurp.HandoffStage("core-owned", "release-job", "release-job")
+	if err != slurp.ErrNotOwner {
+		t.Errorf("Expected not owner error, got %v", err)
+	}
+
+	stage, err := slurp.HandoffStage("core-owned", "build-job", "release-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stage.Handoffs) != 1 || stage.Handoffs[0].To != stage.Owner {
+		t.Errorf("Handoff not recorded - %+v", stage.Handoffs)
+	}
+
+	if err = slurp.CheckOwner("core-owned", "build-job"); err != slurp.ErrNotOwner {
+		t.Errorf("Expected not owner error, got %v", err)
+	}
+	if err = slurp.CheckOwner("core-owned", "release-job"); err != nil {
+		t.Error(err)
+	}
+
+	// restaging the stage takes its owner's credential
+	err = slurp.AddStage("", "core-owned", slurp.StageOptions{Current: "build-job"})
+	if err != slurp.ErrNotOwner {
+		t.Errorf("Expected not owner error, got %v", err)
+	}
+	if err = slurp.CheckOwner("core-owned", "release-job"); err != nil {
+		t.Errorf("Expected the stage still owned - %v", err)
+	}
+	err = slurp.AddStage("", "core-owned", slurp.StageOptions{Owner: "release-job", Current: "release-job"})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBulkDeleteOwned(t *testing.T) {
+	for _, id := range []string{"core-bulk-owned", "core-bulk-free"} {
+		owner := ""
+		if id == "core-bulk-owned" {
+			owner = "build-job"
+		}
+		err := slurp.AddStage("", id, slurp.StageOptions{Owner: owner})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer slurp.DeleteStage(id)
+	}
+
+	// an owned stage is only deleted with its owner's credential
+	job, err := slurp.BulkDeleteStages(slurp.BulkFilter{Ids: []string{"core-bulk-owned", "core-bulk-free"}, Owner: "release-job"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50 && job.State != slurp.BulkDone; i++ {
+		time.Sleep(10 * time.Millisecond)
+		job, _ = slurp.GetBulk(job.Id)
+	}
+	if job.State != slurp.BulkDone || job.Failed != 1 {
+		t.Fatalf("Expected one failed delete - %+v", job)
+	}
+	if _, err = slurp.GetStage("core-bulk-owned"); err != nil {
+		t.Errorf("Owned stage was deleted - %v", err)
+	}
+	if _, err = slurp.GetStage("core-bulk-free"); err == nil {
+		t.Error("Unowned stage wasn't deleted")
+	}
+}
+
+func TestLicenseDeny(t *testing.T) {
+	err := slurp.AddStage("", "core-licensed", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-licensed")
+
+	err = os.WriteFile(config.BuildDir+"core-licensed/main.c", []byte("// SPDX-License-Identifier: GPL-3.0-only\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.LicDeny = []string{"GPL-*"}
+	err = slurp.CommitStage("core-licensed")
+	config.LicDeny = []string{}
+	if err == nil || !strings.Contains(err.Error(), "GPL-3.0-only (main.c)") {
+		t.Errorf("Expected forbidden license error, got %v", err)
+	}
+
+	config.LicScan = true
+	defer func() { config.LicScan = false }()
+	err = slurp.CommitStage("core-licensed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := slurp.GetLicenses("core-licensed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Licenses) != 1 || report.Licenses[0] != "GPL-3.0-only" {
+		t.Errorf("Unexpected licenses - %v", report.Licenses)
+	}
+}
+
+func TestCommitHooks(t *testing.T) {
+	err := slurp.AddStage("", "core-hooked", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-hooked")
+
+	config.CommitHook = []string{`echo "$SLURP_BUILD" > BUILD`, "exit 3"}
+	err = slurp.CommitStage("core-hooked")
+	if err == nil || !strings.Contains(err.Error(), "exited 3") {
+		t.Errorf("Expected failing hook error, got %v", err)
+	}
+
+	config.CommitHook = config.CommitHook[:1]
+	defer func() { config.CommitHook = []string{} }()
+	err = slurp.CommitStage("core-hooked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := slurp.GetManifest("core-hooked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].Path != "BUILD" || manifest.Files[0].Size != int64(len("core-hooked\n")) {
+		t.Errorf("Expected the hook's file to be committed - %+v", manifest.Files)
+	}
+}
+
+func TestCommitReuse(t *testing.T) {
+	err := slurp.AddStage("", "core-reused", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-reused")
+
+	// the hook edits the dir while a second commit of the build comes in
+	config.CommitHook = []string{"echo hooked >> HOOKS; sleep 0.3; echo done >> HOOKS"}
+	defer func() { config.CommitHook = []string{} }()
+	first := make(chan error)
+	go func() {
+		first <- slurp.CommitStage("core-reused")
+	}()
+	for i := 0; ; i++ {
+		if i > 100 {
+			t.Fatal("Hook didn't run")
+		}
+		if _, err := os.Stat(config.BuildDir + "core-reused/HOOKS"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	err = slurp.CommitStage("core-reused")
+	if err != nil {
+		t.Error(err)
+	}
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	hooks, _ := os.ReadFile(config.BuildDir + "core-reused/HOOKS")
+	if string(hooks) != "hooked\ndone\n" {
+		t.Errorf("Expected the second commit to reuse the first, hooks ran - %q", hooks)
+	}
+}
+
+func TestHookUnshares(t *testing.T) {
+	err := slurp.AddStage("", "core-shared", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-shared")
+	os.WriteFile(config.BuildDir+"core-shared/conf", []byte("base\n"), 0644)
+	err = slurp.CommitStage("core-shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Dedup, config.PoolDir = true, "/tmp/slurpCore/pool/"
+	defer func() { config.Dedup = false }()
+	for _, id := range []string{"core-shared-a", "core-shared-b"} {
+		err = slurp.AddStage("core-shared", id, slurp.StageOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer slurp.DeleteStage(id)
+	}
+	config.CommitHook = []string{"echo hooked >> conf", "chmod 600 conf"}
+	defer func() { config.CommitHook = []string{} }()
+	err = slurp.CommitStage("core-shared-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(config.BuildDir + "core-shared-b/conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(config.BuildDir + "core-shared-b/conf"); string(b) != "base\n" || info.Mode().Perm() != 0644 {
+		t.Errorf("Hook changed another stage's file - %q %v", b, info.Mode())
+	}
+}
+
+func TestSeedPool(t *testing.T) {
+	err := slurp.AddStage("", "core-pooled", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-pooled")
+	os.MkdirAll(config.BuildDir+"core-pooled/bin", 0755)
+	os.WriteFile(config.BuildDir+"core-pooled/bin/app", []byte("app\n"), 0755)
+	os.WriteFile(config.BuildDir+"core-pooled/conf", []byte("conf\n"), 0640)
+	err = slurp.CommitStage("core-pooled")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.Dedup, config.PoolDir = true, "/tmp/slurpCore/pool/"
+	defer func() { config.Dedup = false }()
+	err = slurp.AddStage("core-pooled", "core-pooled-a", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-pooled-a")
+
+	// a tar noting the files it was told to skip
+	real, err := exec.LookPath("tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin := t.TempDir()
+	script := "#!/bin/sh\nprev=\nfor arg; do [ \"$prev\" = -X ] && cat \"$arg\" >> " + bin + "/skipped; prev=$arg; done\nexec " + real + " \"$@\"\n"
+	err = os.WriteFile(bin+"/tar", []byte(script), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	err = slurp.AddStage("core-pooled", "core-pooled-b", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-pooled-b")
+
+	// the second stage takes its files from the pool, not the archive
+	skipped, _ := os.ReadFile(bin + "/skipped")
+	for _, path := range []string{"bin/app", "conf"} {
+		if !strings.Contains(string(skipped), "\n"+path+"\n") && !strings.HasPrefix(string(skipped), path+"\n") {
+			t.Errorf("Expected '%s' seeded from the pool - %q", path, skipped)
+		}
+	}
+	for path, want := range map[string]os.FileMode{"bin/app": 0755, "conf": 0640} {
+		a, err := os.Stat(config.BuildDir + "core-pooled-a/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := os.Stat(config.BuildDir + "core-pooled-b/" + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := os.ReadFile(config.BuildDir + "core-pooled-b/" + path)
+		if string(content) != filepath.Base(path)+"\n" || b.Mode().Perm() != want || !b.ModTime().Equal(a.ModTime()) {
+			t.Errorf("Expected '%s' seeded as committed, got %q %v %v", path, content, b.Mode(), b.ModTime())
+		}
+	}
+
+	// linked files are copied before anything writes to them
+	config.CommitHook = []string{"echo hooked >> conf"}
+	defer func() { config.CommitHook = []string{} }()
+	err = slurp.CommitStage("core-pooled-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(config.BuildDir + "core-pooled-a/conf"); string(b) != "conf\n" {
+		t.Errorf("Hook changed another stage's file - %q", b)
+	}
+}
+
+func TestDeltaTarFails(t *testing.T) {
+	config.Templates = map[string]config.Template{"delta": {Output: "delta"}}
+	defer func() { config.Templates = map[string]config.Template{} }()
+	err := slurp.AddStage("", "core-delta-fail", slurp.StageOptions{Template: "delta"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-delta-fail")
+	os.WriteFile(config.BuildDir+"core-delta-fail/app", []byte("app"), 0644)
+
+	// a tar writing part of an archive before failing
+	bin := t.TempDir()
+	err = os.WriteFile(bin+"/tar", []byte("#!/bin/sh\nprintf partial\nexit 2\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	err = slurp.CommitStage("core-delta-fail")
+	if err == nil || !strings.Contains(err.Error(), "Failed to compress build") {
+		t.Errorf("Expected compression error, got %v", err)
+	}
+	if _, err := backend.StatBlob("core-delta-fail"); err == nil {
+		t.Error("Expected no blob for a failed compression")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	err := slurp.AddStage("", "core-filtered", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-filtered")
+
+	os.MkdirAll(config.BuildDir+"core-filtered/.git/objects", 0755)
+	files := map[string][]byte{".git/HEAD": []byte("ref"), "debug.log": []byte("log"), "app": []byte("ok"), "big.bin": make([]byte, 2<<20)}
+	for name, content := range files {
+		err = os.WriteFile(config.BuildDir+"core-filtered/"+name, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config.Exclude, config.FileMax = []string{".git", "*.log"}, 1
+	defer func() { config.Exclude, config.FileMax, config.Scanner = []string{}, 0, "" }()
+	err = slurp.CommitStage("core-filtered")
+	if err == nil || !strings.Contains(err.Error(), "big.bin (2MB)") {
+		t.Errorf("Expected oversized file error, got %v", err)
+	}
+	for _, name := range []string{".git", "debug.log"} {
+		if _, err = os.Stat(config.BuildDir + "core-filtered/" + name); !os.IsNotExist(err) {
+			t.Errorf("Expected '%s' to be excluded, got %v", name, err)
+		}
+	}
+
+	os.Remove(config.BuildDir + "core-filtered/big.bin")
+	os.WriteFile(config.BuildDir+"core-filtered/bad", []byte("EVIL"), 0644)
+	config.Scanner = `exec:! grep -q EVIL`
+	err = slurp.CommitStage("core-filtered")
+	if err == nil || !strings.Contains(err.Error(), "bad (flagged)") {
+		t.Errorf("Expected flagged file error, got %v", err)
+	}
+
+	os.Remove(config.BuildDir + "core-filtered/bad")
+	err = slurp.CommitStage("core-filtered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := slurp.GetManifest("core-filtered")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(manifest.Files) != 1 || manifest.Files[0].Path != "app" {
+		t.Errorf("Unexpected committed files - %+v", manifest.Files)
+	}
+}
+
+func TestCommitVerify(t *testing.T) {
+	err := slurp.AddStage("", "core-verified", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-verified")
+
+	for i := 0; i < 12; i++ {
+		err = os.WriteFile(fmt.Sprintf("%score-verified/file-%d", config.BuildDir, i), []byte(strings.Repeat("x", i)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config.CommitOut = slurp.OutputTree
+	defer func() { config.CommitOut, config.CommitVer = slurp.OutputArchive, slurp.VerifyNone }()
+	for _, level := range []string{slurp.VerifySize, slurp.VerifySampled, slurp.VerifyFull} {
+		config.CommitVer = level
+		err = slurp.CommitStage("core-verified")
+		if err != nil {
+			t.Fatalf("Failed to commit with %s - %v", level, err)
+		}
+		index, err := slurp.GetIndex("core-verified")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if index.Verify != level || len(index.Entries) != 12 {
+			t.Errorf("Expected a %s verified commit of 12 blobs, got %s (%d)", level, index.Verify, len(index.Entries))
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	config.Quarantine, config.QuarDir = true, "/tmp/slurpQuarantine/"
+	config.LicDeny = []string{"GPL-*"}
+	defer func() {
+		config.Quarantine, config.LicDeny = false, []string{}
+		os.RemoveAll(config.QuarDir)
+	}()
+
+	err := slurp.AddStage("", "core-quarantined", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(config.BuildDir+"core-quarantined/main.c", []byte("// SPDX-License-Identifier: GPL-3.0-only\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = slurp.CommitStage("core-quarantined"); err == nil {
+		t.Fatal("Expected forbidden license error")
+	}
+	if _, err = slurp.GetStage("core-quarantined"); err != slurp.ErrNoStage {
+		t.Errorf("Expected a quarantined build to leave the stages, got %v", err)
+	}
+	record, err := slurp.GetQuarantined("core-quarantined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Files != 1 || len(record.Checks) == 0 || record.Checks[len(record.Checks)-1].Ok {
+		t.Errorf("Unexpected quarantine record - %+v", record)
+	}
+
+	bundle, err := slurp.Diagnostics("core-quarantined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(bundle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	tr := tar.NewReader(gz)
+	for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+		names = append(names, header.Name)
+	}
+	bundle.Close()
+	if len(names) != 5 || names[0] != "core-quarantined/quarantine.json" || names[1] != "core-quarantined/manifest.json" {
+		t.Errorf("Unexpected diagnostic bundle - %v", names)
+	}
+
+	// failing again keeps it quarantined, counting the retry
+	if err = slurp.RetryQuarantined("core-quarantined"); err == nil {
+		t.Fatal("Expected forbidden license error")
+	}
+	if record, err = slurp.GetQuarantined("core-quarantined"); err != nil || record.Retries != 1 {
+		t.Errorf("Expected a retried build to be quarantined again - %+v, %v", record, err)
+	}
+
+	config.LicDeny = []string{}
+	if err = slurp.RetryQuarantined("core-quarantined"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = slurp.GetQuarantined("core-quarantined"); err != slurp.ErrNotQuarantined {
+		t.Errorf("Expected a committed build to leave quarantine, got %v", err)
+	}
+	if _, err = slurp.GetIndex("core-quarantined"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	err := slurp.AddStage("", "core-preview", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-preview")
+
+	files := map[string][]byte{"Readme.md": []byte("# App\n"), "VERSION": []byte("1.2.3"), "README.png": {0x89, 'E', 'L', 'F', 0}, "docs/README": []byte("nested")}
+	os.MkdirAll(config.BuildDir+"core-preview/docs", 0755)
+	for name, content := range files {
+		err = os.WriteFile(config.BuildDir+"core-preview/"+name, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = slurp.CommitStage("core-preview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	preview, err := slurp.GetPreview("core-preview")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(preview.Files) != 2 || preview.Files[0].Path != "Readme.md" || preview.Files[0].Content != "# App\n" || preview.Files[1].Path != "VERSION" {
+		t.Errorf("Unexpected preview - %+v", preview.Files)
+	}
+}
+
+func TestStats(t *testing.T) {
+	err := slurp.AddStage("", "core-stats", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(config.BuildDir+"core-stats/app", []byte("0123456789"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := slurp.GetStats("core-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Staged != 10 || stats.Commits != 0 {
+		t.Errorf("Unexpected stats of a staged build - %+v", stats)
+	}
+
+	err = slurp.CommitStage("core-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slurp.DeleteStage("core-stats")
+
+	stats, err = slurp.GetStats("core-stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Staged != 10 || stats.Commits != 1 || stats.Committed <= 0 {
+		t.Errorf("Unexpected stats of a committed build - %+v", stats)
+	}
+	if totals := slurp.Totals(); totals.Commits < 1 || totals.Committed < stats.Committed {
+		t.Errorf("Unexpected totals - %+v", totals)
+	}
+	if _, err := slurp.GetStats("core-unknown"); err != slurp.ErrNoStage {
+		t.Errorf("Expected no stats of an unknown build, got %v", err)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	config.Templates = map[string]config.Template{"quota": {Quota: 1, Rsync: config.Rsync{BwLimit: 512}}}
+	defer func() { config.Templates = map[string]config.Template{} }()
+	err := slurp.AddStage("", "core-usage", slurp.StageOptions{Template: "quota", TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-usage")
+	err = os.WriteFile(config.BuildDir+"core-usage/app", make([]byte, 1<<19), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	usage, err := slurp.GetUsage("core-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.Files != 1 || usage.Bytes != 1<<19 || usage.Quota != 1<<20 || usage.Remaining != 1<<19 {
+		t.Errorf("Unexpected usage of the staged build - %+v", usage)
+	}
+	if usage.TTL == "" || usage.Sessions != 0 || usage.BwLimit != 512 || !usage.Throttled {
+		t.Errorf("Unexpected limits of the staged build - %+v", usage)
+	}
+
+	err = os.WriteFile(config.BuildDir+"core-usage/big", make([]byte, 1<<20), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage, _ = slurp.GetUsage("core-usage"); usage.Remaining != 0 {
+		t.Errorf("Expected no room left, got %+v", usage)
+	}
+	err = slurp.CommitStage("core-usage")
+	if err == nil || !strings.Contains(err.Error(), "quota") {
+		t.Errorf("Expected over quota error, got %v", err)
+	}
+
+	os.Remove(config.BuildDir + "core-usage/big")
+	err = slurp.CommitStage("core-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := slurp.GetUsage("core-unknown"); err != slurp.ErrNoStage {
+		t.Errorf("Expected no usage of an unknown build, got %v", err)
+	}
+}
+
+func TestState(t *testing.T) {
+	err := slurp.AddStage("", "core-state", slurp.StageOptions{Metadata: map[string]string{"app": "state"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = slurp.CommitStage("core-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slurp.DeleteStage("core-state")
+	err = slurp.AddStage("", "core-state-open", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-state-open")
+
+	state := slurp.ExportState(false)
+	found := map[string]bool{}
+	for _, stage := range state.Stages {
+		found["stage:"+stage.Id] = true
+	}
+	raw, _ := json.Marshal(state)
+	var exported struct {
+		Builds []struct{ Build string }
+	}
+	json.Unmarshal(raw, &exported)
+	for _, build := range exported.Builds {
+		found["build:"+build.Build] = true
+	}
+	if !found["stage:core-state-open"] || !found["build:core-state"] {
+		t.Errorf("Expected the open stage and committed build exported - %s", raw)
+	}
+
+	// importing what is already known changes nothing
+	err = slurp.ImportState(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again := slurp.ExportState(false); len(again.Stages) != len(state.Stages) || len(again.Builds) != len(state.Builds) {
+		t.Errorf("Unexpected state after import - %+v", again)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	builds := []string{"core-retained1", "core-retained2", "core-retained3"}
+	for _, build := range builds {
+		err := slurp.AddStage("", build, slurp.StageOptions{Metadata: map[string]string{"app": "retained"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = slurp.CommitStage(build)
+		if err != nil {
+			t.Fatal(err)
+		}
+		slurp.DeleteStage(build)
+	}
+
+	config.Retention = []config.RetentionRule{{Name: "retained", Labels: map[string]string{"app": "retained"}, GroupBy: "app", Keep: 1}}
+	defer func() { config.Retention = nil }()
+
+	report, err := slurp.Retain(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Pruned) != 2 || report.Pruned[0].Build != "core-retained1" || report.Pruned[1].Build != "core-retained2" || report.Pruned[0].Rule != "retained" {
+		t.Fatalf("Unexpected dry run - %+v", report.Pruned)
+	}
+	if _, err := slurp.GetIndex("core-retained1"); err != nil {
+		t.Errorf("Dry run pruned a build - %v", err)
+	}
+
+	report, err = slurp.Retain(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Pruned) != 2 || len(report.Errors) != 0 {
+		t.Fatalf("Unexpected retention - %+v", report)
+	}
+	if _, err := slurp.GetIndex("core-retained1"); !errors.Is(err, backend.ErrNotFound) {
+		t.Errorf("Expected a pruned build to be gone, got %v", err)
+	}
+	if _, err := slurp.GetIndex("core-retained3"); err != nil {
+		t.Errorf("Expected the newest build to be kept - %v", err)
+	}
+	if report, _ = slurp.Retain(true); len(report.Pruned) != 0 {
+		t.Errorf("Expected nothing left to prune - %+v", report.Pruned)
+	}
+
+	// a build committed before indexes were written is adopted by its blob,
+	// with storage that lists its blobs
+	if _, err := backend.ListBlobs(""); err == backend.ErrNoList {
+		return
+	}
+	err = backend.WriteBlobMeta("core-legacy", strings.NewReader("legacy"), map[string]string{"app": "legacy"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Retention = []config.RetentionRule{{Name: "legacy", Labels: map[string]string{"app": "legacy"}, MaxAge: time.Nanosecond}}
+	// adopted now when its listing has no time, so pruned by the next run
+	slurp.Retain(true)
+	report, err = slurp.Retain(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Pruned) != 1 || report.Pruned[0].Build != "core-legacy" {
+		t.Errorf("Expected the unindexed build pruned - %+v", report.Pruned)
+	}
+	if _, err := backend.StatBlob("core-legacy"); !errors.Is(err, backend.ErrNotFound) {
+		t.Errorf("Expected the unindexed build to be gone, got %v", err)
+	}
+}
+
+func TestNotes(t *testing.T) {
+	err := slurp.AddStage("", "core-noted", slurp.StageOptions{Notes: "Fixes login"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-noted")
+
+	_, err = slurp.UpdateNotes("core-noted", string([]byte{0xff}))
+	if err == nil {
+		t.Errorf("Expected invalid notes to be refused")
+	}
+	stage, err := slurp.UpdateNotes("core-noted", "Fixes login\n\n- adds sso")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stage.Notes != "Fixes login\n\n- adds sso" {
+		t.Errorf("%q doesn't match expected notes", stage.Notes)
+	}
+
+	err = slurp.CommitStage("core-noted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := slurp.GetIndex("core-noted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Notes != stage.Notes {
+		t.Errorf("%q doesn't match expected notes", index.Notes)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	err := slurp.AddStage("", "core-split", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-split")
+	for _, name := range []string{"bin/app", "lib/a.so", "lib/b.so", "README"} {
+		os.MkdirAll(config.BuildDir+"core-split/"+name[:strings.LastIndex(name, "/")+1], 0755)
+		err = os.WriteFile(config.BuildDir+"core-split/"+name, []byte(name), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config.SplitRule = "dirs"
+	err = slurp.CommitStage("core-split")
+	config.SplitRule = ""
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := slurp.GetIndex("core-split")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := []string{}
+	for _, entry := range index.Entries {
+		parts = append(parts, fmt.Sprintf("%d:%s", entry.Part, entry.Path))
+	}
+	if index.Split != "dirs" || fmt.Sprint(parts) != "[1:. 2:bin 3:lib 0:]" {
+		t.Errorf("Unexpected parts %v of %q split", parts, index.Split)
+	}
+
+	// files are read from their part, and the build reassembled from all
+	file, err := slurp.OpenFile("core-split", "lib/b.so")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := file.ReadRange(0, file.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if b, _ := io.ReadAll(body); string(b) != "lib/b.so" {
+		t.Errorf("%q doesn't match expected contents", b)
+	}
+	err = slurp.AddStage("core-split", "core-unsplit", slurp.StageOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-unsplit")
+	if b, _ := os.ReadFile(config.BuildDir + "core-unsplit/bin/app"); string(b) != "bin/app" {
+		t.Errorf("%q doesn't match expected contents", b)
+	}
+}
+
+func TestSeekable(t *testing.T) {
+	config.Templates = map[string]config.Template{"seekable": {Format: "tar.zst"}}
+	config.ZstdFrame = 1
+	defer func() {
+		config.Templates = map[string]config.Template{}
+		config.ZstdFrame = 4
+	}()
+	err := slurp.AddStage("", "core-seekable", slurp.StageOptions{Template: "seekable"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-seekable")
+
+	// a file spanning several 1MB frames
+	big := make([]byte, 5<<19)
+	rand.New(rand.NewSource(1)).Read(big)
+	os.WriteFile(config.BuildDir+"core-seekable/big", big, 0644)
+	os.WriteFile(config.BuildDir+"core-seekable/small", []byte("small"), 0644)
+	err = slurp.CommitStage("core-seekable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := slurp.GetIndex("core-seekable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Frames) != 3 {
+		t.Fatalf("Expected 3 frames, got %+v", index.Frames)
+	}
+	blob := index.Entries[0].Blob
+
+	// zstd reads the frames as one stream, skipping the seek table
+	body, err := backend.ReadBlob(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(body)
+	body.Close()
+	cmd := exec.Command("zstd", "-d", "-q", "-c")
+	cmd.Stdin = bytes.NewReader(raw)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Failed to decompress archive - %v", err)
+	}
+	var size int64
+	for _, frame := range index.Frames {
+		size += frame.Size
+	}
+	archive := tar.NewReader(bytes.NewReader(out))
+	for {
+		header, err := archive.Next()
+		if err != nil {
+			break
+		}
+		if header.Name == "./big" {
+			if b, _ := io.ReadAll(archive); !bytes.Equal(b, big) {
+				t.Error("Decompressed file doesn't match what was committed")
+			}
+		}
+	}
+	if int64(len(out)) != size {
+		t.Errorf("Frames hold %d bytes, the archive %d", size, len(out))
+	}
+
+	// the seek table ends the blob, listing the frames
+	footer := raw[len(raw)-9:]
+	if binary.LittleEndian.Uint32(footer) != uint32(len(index.Frames)) || footer[4] != 0 || binary.LittleEndian.Uint32(footer[5:]) != 0x8F92EAB1 {
+		t.Errorf("Unexpected seek table footer %x", footer)
+	}
+
+	// reads from the start of a file, across a frame boundary, and of a whole
+	// file
+	file, err := slurp.OpenFile("core-seekable", "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	boundary := index.Frames[0].Size - file.Offset
+	for _, read := range []struct{ off, n int64 }{{0, 100}, {boundary - 50, 100}, {0, file.Size}} {
+		body, err := file.ReadRange(read.off, read.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(body)
+		body.Close()
+		if !bytes.Equal(b, big[read.off:read.off+read.n]) {
+			t.Errorf("Read of %d bytes at %d doesn't match the file", read.n, read.off)
+		}
+	}
+	file, err = slurp.OpenFile("core-seekable", "small")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = file.ReadRange(0, file.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer body.Close()
+	if b, _ := io.ReadAll(body); string(b) != "small" {
+		t.Errorf("%q doesn't match expected contents", b)
+	}
+}
+
+func TestDiskWatermark(t *testing.T) {
+	config.DiskHigh = 0.0001
+	defer func() { config.DiskHigh = 90 }()
+
+	err := slurp.AddStage("", "core-full", slurp.StageOptions{})
+	if !errors.Is(err, slurp.ErrDiskFull) {
+		t.Errorf("Expected disk full error, got %v", err)
+	}
+}
+
+func TestMotd(t *testing.T) {
+	err := slurp.AddStage("", "core-motd", slurp.StageOptions{TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slurp.DeleteStage("core-motd")
+
+	motd := slurp.Motd("core-motd")
+	for _, want := range []string{"slurp: Stage 'core-motd' is staged", "slurp: It expires uncommitted in ", "free in the build dir"} {
+		if !strings.Contains(motd, want) {
+			t.Errorf("%q doesn't contain %q", motd, want)
+		}
+	}
+
+	config.SshMotd = false
+	defer func() { config.SshMotd = true }()
+	if motd := slurp.Motd("core-motd"); motd != "" {
+		t.Errorf("Expected no motd with ssh-motd off, got %q", motd)
+	}
+	config.SshMotd = true
+	if motd := slurp.Motd("core-nothing"); motd != "" {
+		t.Errorf("Expected no motd for an unknown build, got %q", motd)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	err := backend.WriteBlob("core-channel.tar.gz", strings.NewReader("release"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config.ChannelRoles = []config.ChannelRole{{Name: "ci", Token: "ci-token", Channels: []string{"*/nightly"}}}
+	defer func() { config.ChannelRoles = []config.ChannelRole{} }()
+	if role, err := slurp.ChannelRole("core-app", "nightly", "ci-token"); err != nil || role != "ci" {
+		t.Errorf("Expected the ci role, got %q, %v", role, err)
+	}
+	for _, token := range []string{"", "bad-token"} {
+		if _, err := slurp.ChannelRole("core-app", "nightly", token); err != slurp.ErrChannelRole {
+			t.Errorf("Expected %q to be refused, got %v", token, err)
+		}
+	}
+	if _, err := slurp.ChannelRole("core-app", "stable", "ci-token"); err != slurp.ErrChannelRole {
+		t.Errorf("Expected the ci role not to move stable, got %v", err)
+	}
+
+	_, err = slurp.SetChannel("core-app", "nightly", "core-missing.tar.gz", "ci", "")
+	if err == nil {
+		t.Error("Expected a channel not to point at a missing blob")
+	}
+	for i := 0; i < 2; i++ {
+		_, err = slurp.SetChannel("core-app", "nightly", "core-channel.tar.gz", "ci", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer slurp.DeleteChannel("core-app", "nightly")
+
+	channel, err := slurp.GetChannel("core-app", "nightly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.Blob != "core-channel.tar.gz" || len(channel.History) != 2 || channel.History[0].Role != "ci" {
+		t.Errorf("%+v doesn't match expected channel", channel)
+	}
+	if _, err := slurp.GetChannel("core-app", "beta"); err != slurp.ErrNoChannel {
+		t.Errorf("Expected no beta channel, got %v", err)
+	}
+}
+
+func TestSweepTiers(t *testing.T) {
+	defer func() { config.SweepTiers = []string{"80:0.5", "95:0"} }()
+
+	for _, tiers := range [][]string{{"80"}, {"101:0.5"}, {"80:2"}, {"x:0.5"}} {
+		config.SweepTiers = tiers
+		found := false
+		for _, err := range slurp.ValidateConfig() {
+			found = found || strings.HasPrefix(err.Error(), "sweep-tiers:")
+		}
+		if !found {
+			t.Errorf("Expected sweep-tiers %v to be refused", tiers)
+		}
+	}
+
+	config.SweepTiers = []string{"95:0", "80:0.5"}
+	for _, err := range slurp.ValidateConfig() {
+		if strings.HasPrefix(err.Error(), "sweep-tiers:") {
+			t.Errorf("Unexpected error - %v", err)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	config.Schedule = map[string]string{"sweep": "*/5 * * * *", "gc": "61 * * * *", "nope": "@daily"}
+	defer func() { config.Schedule = map[string]string{} }()
+
+	var found []string
+	for _, err := range slurp.ValidateConfig() {
+		if strings.HasPrefix(err.Error(), "schedule.") {
+			found = append(found, err.Error())
+		}
+	}
+	if len(found) != 2 || !strings.HasPrefix(found[0], "schedule.gc:") || !strings.HasPrefix(found[1], "schedule.nope:") {
+		t.Errorf("Unexpected schedule errors - %q", found)
+	}
+
+	_, err := slurp.RunTask("nope")
+	if err != slurp.ErrNoTask {
+		t.Errorf("Expected task not found, got %v", err)
+	}
+	os.MkdirAll(config.BuildDir, 0755)
+	status, err := slurp.RunTask("gc")
+	if err != nil || status.Runs != 1 || status.Error != "" {
+		t.Errorf("Unexpected gc run - %+v, %v", status, err)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	config.Node, config.Peers, config.NodeTTL = "a", []string{"live", "gone"}, time.Minute
+	defer func() { config.Node, config.Peers = "", []string{} }()
+
+	// a live peer's stage, and one of a peer that stopped announcing itself
+	announce := func(node slurp.Node) {
+		raw, _ := json.Marshal(node)
+		err := backend.WriteBlob(".cluster/"+node.Name+".json", bytes.NewReader(raw))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	announce(slurp.Node{Name: "live", Api: "http://127.0.0.1:1", Ssh: "127.0.0.1:2", Beat: time.Now(), Stages: []slurp.Stage{{Id: "cluster-live", State: slurp.StateStaged}}})
+	announce(slurp.Node{Name: "gone", Beat: time.Now().Add(-time.Hour), Stages: []slurp.Stage{{Id: "cluster-gone", State: slurp.StateStaged}}})
+	os.MkdirAll(config.BuildDir+"/cluster-gone", 0755)
+
+	err := slurp.StartCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, ok := slurp.Owner("cluster-live")
+	if !ok || node.Name != "live" {
+		t.Errorf("Expected 'cluster-live' on the live peer - %+v", node)
+	}
+	if _, err := slurp.GetStage("cluster-gone"); err != nil {
+		t.Errorf("Expected the stopped peer's stage taken over - %v", err)
+	}
+	if _, ok := slurp.Owner("cluster-gone"); ok {
+		t.Errorf("Expected 'cluster-gone' to be this node's")
+	}
+
+	stages := slurp.ClusterStages()
+	if len(stages) < 2 || stages[0].Id != "cluster-gone" || stages[0].Node != "a" || stages[1].Node != "live" {
+		t.Errorf("Unexpected cluster stages - %+v", stages)
+	}
+	if node, ok := slurp.DataNode(); !ok || node.Name != "live" {
+		t.Errorf("Expected new builds staged on the live peer - %+v", node)
+	}
+
+	// the live peer's stage is refused here, its shared build dir left alone
+	os.MkdirAll(config.BuildDir+"/cluster-live", 0755)
+	defer os.RemoveAll(config.BuildDir + "/cluster-live")
+	if err := slurp.CheckOwner("cluster-live", ""); err != slurp.ErrNoStage {
+		t.Errorf("Expected the peer's stage refused, got %v", err)
+	}
+	if err := slurp.CommitStage("cluster-live"); err != slurp.ErrNoStage {
+		t.Errorf("Expected committing the peer's stage refused, got %v", err)
+	}
+	if err := slurp.DeleteStage("cluster-live"); err != slurp.ErrNoStage {
+		t.Errorf("Expected deleting the peer's stage refused, got %v", err)
+	}
+	if _, err := os.Stat(config.BuildDir + "/cluster-live"); err != nil {
+		t.Errorf("Expected the peer's build dir kept - %v", err)
+	}
+	slurp.DeleteStage("cluster-gone")
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // PRIVS
 ////////////////////////////////////////////////////////////////////////////////
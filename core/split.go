@@ -0,0 +1,236 @@
+package slurp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/trace"
+)
+
+// Split rules
+const (
+	SplitDirs = "dirs" // a part per top-level directory (and one for the top-level files)
+	SplitSize = "size" // parts of up to split-size MB of file contents
+)
+
+// Parts ties the parts of a split archive together. It is stored next to them
+// as "<key>.parts".
+type Parts struct {
+	Build  string  `json:"build"`  // id of the committed build
+	Format string  `json:"format"` // archive format of every part
+	Split  string  `json:"split"`  // rule the build was split by
+	Parts  []Entry `json:"parts"`  // the parts, in order
+}
+
+// validSplit reports whether slurp can split archives by a rule
+func validSplit(split string) bool {
+	switch split {
+	case "", SplitDirs, SplitSize:
+		return true
+	}
+	return false
+}
+
+// splitFor returns the split rule and part size (in bytes) for a build,
+// preferring the stage's template over the global default
+func splitFor(buildId string) (string, int64) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	split, size := config.SplitRule, config.SplitMB
+	if stage, ok := stages[buildId]; ok && stage.Template != "" {
+		template := config.Get(&config.Templates)[stage.Template]
+		if template.Split != "" {
+			split = template.Split
+		}
+		if template.PartMB > 0 {
+			size = template.PartMB
+		}
+	}
+	return split, int64(size) << 20
+}
+
+// commitSplit compresses the build dir as several archive blobs by a split
+// rule, so no one blob outgrows what storage allows, and uploads the parts
+// manifest tying them together.
+// Bash equivalent:
+//  `tar -C buildDir/buildId --no-recursion -czf - part1... | curl localhost:7410/blobs/newId.part-001 -T -`
+func commitSplit(buildId string, index *Index, split string, size int64, results *checks) error {
+	index.Format, index.Split = formatFor(buildId), split
+	if index.Format == FormatSquashfs {
+		return fmt.Errorf("Squashfs archives can't be split")
+	}
+	flags, err := tarArgs(index.Format, true)
+	if err != nil {
+		return err
+	}
+	key, err := blobKey(buildId, index)
+	if err != nil {
+		return err
+	}
+
+	files, err := manifest(buildId)
+	if err != nil {
+		return fmt.Errorf("Failed to list build - %v", err)
+	}
+	index.listed = files
+	parts, names := splitFiles(files, split, size)
+	results.add("split", CheckPolicy, nil, fmt.Sprintf("%d files in %d parts by %s", len(files), len(parts), split))
+
+	index.partOf = map[string]int{}
+	entries := make([]Entry, 0, len(parts))
+	for i, part := range parts {
+		if isAborted(buildId) {
+			return ErrAborted
+		}
+
+		paths := make([]string, len(part))
+		for j, file := range part {
+			paths[j] = file.Path
+			index.partOf[file.Path] = i + 1
+		}
+
+		meta := blobMeta(index)
+		meta["archive-format"] = index.Format
+		meta["archive-part"] = fmt.Sprintf("%d/%d", i+1, len(parts))
+
+		entry, err := writePart(buildId, fmt.Sprintf("%s.part-%03d", key, i+1), flags, paths, meta)
+		if err != nil {
+			return fmt.Errorf("Failed to write part %d of %d - %v", i+1, len(parts), err)
+		}
+		entry.Path, entry.Part = names[i], i+1
+		entries = append(entries, entry)
+	}
+
+	// tie the parts together
+	raw, err := json.Marshal(Parts{Build: buildId, Format: index.Format, Split: split, Parts: entries})
+	if err != nil {
+		return err
+	}
+	sum := newDigest()
+	err = backend.WriteBlobMeta(key+".parts", io.TeeReader(bytes.NewReader(raw), sum), blobMeta(index))
+	if err != nil {
+		return fmt.Errorf("Failed to write parts manifest - %v", err)
+	}
+
+	index.Entries = append(index.Entries, entries...)
+	index.Entries = append(index.Entries, sum.entry("", key+".parts"))
+	return nil
+}
+
+// splitFiles divides a build's files into the parts of a split archive,
+// returning the top-level dir each part holds (dirs split, "." for the
+// top-level files)
+func splitFiles(files []File, split string, size int64) ([][]File, []string) {
+	var parts [][]File
+	var names []string
+
+	if split == SplitDirs {
+		group := map[string]int{}
+		for _, file := range files {
+			dir := "."
+			if i := strings.Index(file.Path, "/"); i >= 0 {
+				dir = file.Path[:i]
+			} else if file.Mode.IsDir() {
+				dir = file.Path
+			}
+			n, ok := group[dir]
+			if !ok {
+				n = len(parts)
+				group[dir] = n
+				parts = append(parts, nil)
+				names = append(names, dir)
+			}
+			parts[n] = append(parts[n], file)
+		}
+	} else {
+		// a file larger than a part gets one of its own
+		var part []File
+		var bytes int64
+		for _, file := range files {
+			if bytes > 0 && bytes+file.Size > size {
+				parts = append(parts, part)
+				part, bytes = nil, 0
+			}
+			part = append(part, file)
+			bytes += file.Size
+		}
+		parts = append(parts, part)
+		names = make([]string, len(parts))
+	}
+
+	if len(parts) == 0 {
+		return [][]File{nil}, []string{""}
+	}
+	return parts, names
+}
+
+// writePart compresses paths of the build dir and uploads them as key
+func writePart(buildId, key string, flags, paths []string, meta map[string]string) (Entry, error) {
+	buffer := newSpool()
+	defer buffer.Release()
+	onAbort(buildId, buffer.Release)
+
+	cmd := exec.Command("tar", append(append([]string{"-C", filepath.Join(config.BuildDir, buildId), "--no-recursion", "--null", "-T", "-"}, flags...), "-")...)
+	cmd.Env = append(os.Environ(), "GZIP=-n")
+	cmd.Stdin = strings.NewReader(strings.Join(paths, "\x00"))
+	cmd.Stdout = buffer
+
+	config.Log.Trace("%sRunning compress command '%v'", reqid.Tag(buildId), cmd.Args)
+
+	echan := make(chan error, 1)
+	sum := newDigest()
+	go func() {
+		err := backend.WriteBlobMeta(key, io.TeeReader(buffer, sum), meta)
+		buffer.Release()
+		echan <- err
+	}()
+
+	span := trace.Start("tar", trace.KindInternal, trace.Build(buildId))
+	span.Set("slurp.format", meta["archive-format"])
+	span.Set("slurp.part", meta["archive-part"])
+	// a failed compression fails the upload rather than ending it, so a
+	// truncated part isn't stored
+	err := cmd.Run()
+	span.Finish(err)
+	if err != nil {
+		buffer.Release()
+		<-echan
+		return Entry{}, fmt.Errorf("Failed to compress build - %v", err)
+	}
+	buffer.Close()
+
+	err = <-echan
+	if err != nil {
+		return Entry{}, fmt.Errorf("Failed to write build - %v", err)
+	}
+	return sum.entry("", key), nil
+}
+
+// parts returns the part blobs of a split archive build, in order
+func (self *Index) parts() []string {
+	var blobs []string
+	for _, entry := range self.Entries {
+		if entry.Part > 0 {
+			blobs = append(blobs, entry.Blob)
+		}
+	}
+	return blobs
+}
+
+// partBlob returns the blob holding a file of a split archive build
+func (self *Index) partBlob(file File) (string, error) {
+	parts := self.parts()
+	if file.Part < 1 || file.Part > len(parts) {
+		return "", fmt.Errorf("No part %d of build '%s'", file.Part, self.Build)
+	}
+	return parts[file.Part-1], nil
+}
@@ -0,0 +1,234 @@
+package slurp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/mu-box/slurp/config"
+)
+
+// spoolChunk is how much of the memory budget a spool takes at a time
+const spoolChunk = 1 << 20
+
+// BufferStatus is the memory used buffering commit uploads
+type BufferStatus struct {
+	Budget   int64 `json:"budget"`   // bytes commits may buffer in memory
+	Used     int64 `json:"used"`     // bytes reserved by running commits
+	Spilling int   `json:"spilling"` // commits buffering to disk
+}
+
+// memory reserved by spools, shared by all commits
+var buffers = struct {
+	sync.Mutex
+	used     int64
+	spilling int
+}{}
+
+// Buffers returns the memory used buffering commit uploads
+func Buffers() BufferStatus {
+	buffers.Lock()
+	defer buffers.Unlock()
+	return BufferStatus{Budget: budget(), Used: buffers.used, Spilling: buffers.spilling}
+}
+
+// budget is the memory commits may buffer in, in bytes
+func budget() int64 {
+	return int64(config.CommitMem) << 20
+}
+
+// reserve takes a chunk of the memory budget, reporting whether it was free
+func reserve() bool {
+	buffers.Lock()
+	defer buffers.Unlock()
+	if buffers.used+spoolChunk > budget() {
+		return false
+	}
+	buffers.used += spoolChunk
+	return true
+}
+
+// unreserve returns a chunk to the memory budget
+func unreserve() {
+	buffers.Lock()
+	buffers.used -= spoolChunk
+	buffers.Unlock()
+}
+
+// segment is a run of spooled bytes, in memory or in the spill file
+type segment struct {
+	mem  []byte // bytes in memory, nil if spilled
+	off  int64  // offset of the bytes in the spill file
+	size int64  // bytes in the segment
+	read int64  // bytes already read
+}
+
+// spool buffers a compressed build between the compressor and the upload so
+// neither waits on the other. It buffers in memory while the shared budget
+// allows, spilling to a file in the build dir once it is used up, so many
+// concurrent commits degrade to disk rather than exhausting memory.
+type spool struct {
+	sync.Mutex
+	cond     *sync.Cond
+	segments []*segment
+	spill    *os.File // created on the first spill
+	end      int64    // bytes written to the spill file
+	closed   bool     // writer is done
+	released bool     // reader is done, further writes fail
+}
+
+func newSpool() *spool {
+	s := &spool{}
+	s.cond = sync.NewCond(s)
+	return s
+}
+
+// Write buffers p, in memory if there is budget for it, else on disk
+func (self *spool) Write(p []byte) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		if self.released {
+			return written, io.ErrClosedPipe
+		}
+
+		tail := self.tail()
+		if tail == nil || tail.mem == nil || len(tail.mem) == cap(tail.mem) {
+			if !reserve() {
+				n, err := self.spillWrite(p)
+				written += n
+				self.cond.Broadcast()
+				return written, err
+			}
+			tail = &segment{mem: make([]byte, 0, spoolChunk)}
+			self.segments = append(self.segments, tail)
+		}
+
+		n := copy(tail.mem[len(tail.mem):cap(tail.mem)], p)
+		tail.mem = tail.mem[:len(tail.mem)+n]
+		tail.size += int64(n)
+		written += n
+		p = p[n:]
+		self.cond.Broadcast()
+	}
+	return written, nil
+}
+
+// spillWrite appends p to the spill file
+func (self *spool) spillWrite(p []byte) (int, error) {
+	if self.spill == nil {
+		file, err := ioutil.TempFile(config.BuildDir, ".slurp-spill-")
+		if err != nil {
+			return 0, err
+		}
+		self.spill = file
+		buffers.Lock()
+		buffers.spilling++
+		buffers.Unlock()
+	}
+
+	n, err := self.spill.WriteAt(p, self.end)
+	if tail := self.tail(); tail != nil && tail.mem == nil && tail.off+tail.size == self.end {
+		tail.size += int64(n)
+	} else {
+		self.segments = append(self.segments, &segment{off: self.end, size: int64(n)})
+	}
+	self.end += int64(n)
+	return n, err
+}
+
+// Read returns buffered bytes in the order they were written, waiting for
+// more until the writer closes
+func (self *spool) Read(p []byte) (int, error) {
+	self.Lock()
+	defer self.Unlock()
+
+	for {
+		if self.released {
+			return 0, io.ErrClosedPipe
+		}
+		if len(self.segments) > 0 {
+			head := self.segments[0]
+			if head.read < head.size {
+				break
+			}
+			// the tail may still be written to
+			if len(self.segments) == 1 && !self.closed {
+				self.cond.Wait()
+				continue
+			}
+			self.drop()
+			continue
+		}
+		if self.closed {
+			return 0, io.EOF
+		}
+		self.cond.Wait()
+	}
+
+	head := self.segments[0]
+	if head.mem != nil {
+		n := copy(p, head.mem[head.read:])
+		head.read += int64(n)
+		return n, nil
+	}
+
+	if rest := head.size - head.read; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n, err := self.spill.ReadAt(p, head.off+head.read)
+	head.read += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Close marks the writer done, readers get EOF once the buffer is drained
+func (self *spool) Close() error {
+	self.Lock()
+	self.closed = true
+	self.cond.Broadcast()
+	self.Unlock()
+	return nil
+}
+
+// Release frees the buffer once the reader is done with it, failing any
+// further writes
+func (self *spool) Release() {
+	self.Lock()
+	defer self.Unlock()
+
+	self.released = true
+	for len(self.segments) > 0 {
+		self.drop()
+	}
+	if self.spill != nil {
+		self.spill.Close()
+		os.Remove(self.spill.Name())
+		self.spill = nil
+		buffers.Lock()
+		buffers.spilling--
+		buffers.Unlock()
+	}
+	self.cond.Broadcast()
+}
+
+// tail returns the segment being written to
+func (self *spool) tail() *segment {
+	if len(self.segments) == 0 {
+		return nil
+	}
+	return self.segments[len(self.segments)-1]
+}
+
+// drop removes the head segment, returning its memory to the budget
+func (self *spool) drop() {
+	if self.segments[0].mem != nil {
+		unreserve()
+	}
+	self.segments = self.segments[1:]
+}
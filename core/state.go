@@ -0,0 +1,253 @@
+package slurp
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/names"
+	"github.com/mu-box/slurp/ssh"
+	"github.com/mu-box/slurp/store"
+)
+
+// stateVersion is bumped whenever the State format changes incompatibly
+const stateVersion = 1
+
+// exportSecret is the file in data-dir holding the secret exporting the
+// signing keys' private halves takes, so only whoever can read slurp's data
+// (`slurp export-state --keys` on its host) can export them, rather than any
+// holder of the api token
+const exportSecret = "export.secret"
+
+// State is a portable snapshot of slurp's local state (not blob contents),
+// used to stand up a replacement instance after host loss: the stages (with
+// their owners and handoffs), build ids in their reuse cooldown, signing keys
+// (private halves only if asked for), the committed builds retention knows
+// of, and commit jobs. Release channels are kept in storage, so they need no
+// snapshot. Quarantined builds, build stats, and staged files are left out.
+type State struct {
+	Version int       `json:"version"` // snapshot format version
+	Created time.Time `json:"created"` // when the snapshot was taken
+	Stages  []Stage   `json:"stages"`  // uncommitted stages
+
+	Deleted map[string]time.Time `json:"deleted,omitempty"` // build ids in their reuse cooldown
+
+	Keys   []storedKey     `json:"keys,omitempty"`   // signing keys
+	Builds []retainedBuild `json:"builds,omitempty"` // committed builds retention knows of
+	Apps   []string        `json:"apps,omitempty"`   // apps with channels, whose builds retention keeps
+	Jobs   []Job           `json:"jobs,omitempty"`   // commit records
+}
+
+// ExportState snapshots the current state, with the private halves of the
+// signing keys if keys is set
+func ExportState(keys bool) State {
+	state := State{Version: stateVersion, Created: time.Now().UTC()}
+
+	mutex.Lock()
+	for _, stage := range stages {
+		state.Stages = append(state.Stages, stage.copy())
+	}
+	if len(deleted) > 0 {
+		state.Deleted = map[string]time.Time{}
+		for id, at := range deleted {
+			state.Deleted[id] = at
+		}
+	}
+	mutex.Unlock()
+
+	sort.Slice(state.Stages, func(i, j int) bool {
+		return state.Stages[i].Id < state.Stages[j].Id
+	})
+
+	retained.Lock()
+	for _, build := range retained.builds {
+		state.Builds = append(state.Builds, *build)
+	}
+	for app := range retained.apps {
+		state.Apps = append(state.Apps, app)
+	}
+	retained.Unlock()
+	sort.Slice(state.Builds, func(i, j int) bool {
+		return state.Builds[i].Build < state.Builds[j].Build
+	})
+	sort.Strings(state.Apps)
+
+	err := store.Each(keysBucket, func(id string, raw []byte) error {
+		var key storedKey
+		if json.Unmarshal(raw, &key) == nil {
+			if !keys {
+				key.Private = nil
+			}
+			state.Keys = append(state.Keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		config.Log.Error("Failed to export signing keys - %v", err)
+	}
+	err = store.Each(jobsBucket, func(id string, raw []byte) error {
+		var job Job
+		if json.Unmarshal(raw, &job) == nil {
+			state.Jobs = append(state.Jobs, job)
+		}
+		return nil
+	})
+	if err != nil {
+		config.Log.Error("Failed to export commit jobs - %v", err)
+	}
+
+	return state
+}
+
+// WriteExportSecret writes a fresh key export secret to data-dir, readable
+// only by slurp's user
+func WriteExportSecret() error {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return fmt.Errorf("Failed to generate export secret - %v", err)
+	}
+
+	path := filepath.Join(config.DataDir, exportSecret)
+	os.Remove(path)
+	err = ioutil.WriteFile(path, []byte(hex.EncodeToString(b)+"\n"), 0600)
+	if err != nil {
+		return fmt.Errorf("Failed to write export secret - %v", err)
+	}
+	return nil
+}
+
+// ReadExportSecret reads the key export secret from data-dir
+func ReadExportSecret() (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join(config.DataDir, exportSecret))
+	if err != nil {
+		return "", fmt.Errorf("Failed to read export secret - %v", err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// CheckExportSecret reports whether secret is the key export secret
+func CheckExportSecret(secret string) bool {
+	current, err := ReadExportSecret()
+	if err != nil || current == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(current)) == 1
+}
+
+// ImportState registers the stages from a snapshot. Staging dirs are created
+// if missing (their contents are not part of the snapshot) and the ssh users
+// re-added so clients can resync. Keys, builds, and jobs already known are
+// kept over the snapshot's, and an imported key is only left active if no
+// key here is (and it has its private half, to sign with).
+func ImportState(state State) error {
+	if state.Version != stateVersion {
+		return fmt.Errorf("Unsupported state version '%d'", state.Version)
+	}
+
+	for i := range state.Stages {
+		stage := state.Stages[i]
+		id, err := names.BuildId(stage.Id)
+		if err != nil {
+			return err
+		}
+		stage.Id = id
+
+		err = os.MkdirAll(config.BuildDir+"/"+stage.Id, 0755)
+		if err != nil {
+			return fmt.Errorf("Failed to create build dir - %v", err)
+		}
+
+		err = ssh.AddUser(stage.Id, config.Get(&config.Templates)[stage.Template].Rsync)
+		if err != nil {
+			return fmt.Errorf("Failed to add user - %v", err)
+		}
+
+		if stage.State == "" {
+			stage.State = StateStaged
+		}
+
+		mutex.Lock()
+		stages[stage.Id] = &stage
+		mutex.Unlock()
+
+		persist(stage)
+	}
+
+	mutex.Lock()
+	for id, at := range state.Deleted {
+		deleted[id] = at
+	}
+	mutex.Unlock()
+
+	for id, at := range state.Deleted {
+		store.Put(deletedBucket, id, at)
+	}
+
+	err := importKeys(state.Keys)
+	if err != nil {
+		return err
+	}
+
+	for i := range state.Builds {
+		build := state.Builds[i]
+		retained.Lock()
+		_, known := retained.builds[build.Build]
+		if !known {
+			retained.builds[build.Build] = &build
+		}
+		retained.Unlock()
+		if !known {
+			store.Put(buildsBucket, build.Build, build)
+		}
+	}
+	for _, app := range state.Apps {
+		recordApp(app)
+	}
+
+	// nothing resumes an imported commit that was running
+	for _, job := range state.Jobs {
+		if _, err := GetJob(job.Build); err != ErrNoJob {
+			continue
+		}
+		if job.State == JobRunning {
+			job.State, job.Error = JobFailed, errInterrupted.Error()
+		}
+		putJob(job)
+	}
+
+	config.Log.Info("Imported %d stage(s), %d signing key(s), %d build(s), and %d job(s)", len(state.Stages), len(state.Keys), len(state.Builds), len(state.Jobs))
+	return nil
+}
+
+// importKeys saves the signing keys of a snapshot that aren't known here
+func importKeys(keys []storedKey) error {
+	keyLock.Lock()
+	defer keyLock.Unlock()
+
+	_, err := activeKey()
+	hasActive := err == nil
+	for _, key := range keys {
+		if _, err := getKey(key.Fingerprint); err != ErrNoKey {
+			continue
+		}
+		if key.Active && (hasActive || len(key.Private) == 0) {
+			key.Active = false
+		}
+		hasActive = hasActive || key.Active
+		err = store.Put(keysBucket, key.Fingerprint, key)
+		if err != nil {
+			return fmt.Errorf("Failed to save key - %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package slurp
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/ssh"
+	"github.com/mu-box/slurp/store"
+)
+
+// statsRetention is how long a build's stats are kept after they last changed
+const statsRetention = 90 * 24 * time.Hour
+
+// BuildStats is what was published to a build: synced to its stage, and
+// written to storage by its commits. Stats outlive the stage, for billing.
+type BuildStats struct {
+	Build     string    `json:"build"`
+	Sessions  int       `json:"sessions"`  // rsync sessions synced to it (resumed ones count once)
+	Files     int       `json:"files"`     // files written by them
+	Synced    int64     `json:"synced"`    // bytes written by them
+	Staged    int64     `json:"staged"`    // size of the staged files, as of its last commit once committed
+	Commits   int       `json:"commits"`   // successful commits
+	Committed int64     `json:"committed"` // bytes of the blobs its commits wrote
+	Updated   time.Time `json:"updated"`   // when they last changed
+}
+
+// StatsTotals adds up the stats of every build kept
+type StatsTotals struct {
+	Builds    int   `json:"builds"`
+	Sessions  int   `json:"sessions"`
+	Files     int   `json:"files"`
+	Synced    int64 `json:"synced"`
+	Commits   int   `json:"commits"`
+	Committed int64 `json:"committed"`
+}
+
+// stats of builds by id, guarded by their lock
+var stats = struct {
+	sync.Mutex
+	builds map[string]*BuildStats
+}{builds: map[string]*BuildStats{}}
+
+// StartStats tallies what every rsync session writes to a build
+func StartStats() {
+	ssh.OnTransfer(countTransfer)
+}
+
+// GetStats returns a build's stats, measuring its staged size if it is still
+// being staged
+func GetStats(buildId string) (BuildStats, error) {
+	stats.Lock()
+	record, ok := stats.builds[buildId]
+	var copied BuildStats
+	if ok {
+		copied = *record
+	}
+	stats.Unlock()
+
+	stage, err := GetStage(buildId)
+	if !ok && err != nil {
+		return BuildStats{}, err
+	}
+	copied.Build = buildId
+	if err == nil && stage.State != StateCommitted {
+		copied.Staged = dirSize(filepath.Join(config.BuildDir, buildId))
+	}
+	return copied, nil
+}
+
+// Totals adds up the stats of every build kept
+func Totals() StatsTotals {
+	stats.Lock()
+	defer stats.Unlock()
+	totals := StatsTotals{Builds: len(stats.builds)}
+	for _, record := range stats.builds {
+		totals.Sessions += record.Sessions
+		totals.Files += record.Files
+		totals.Synced += record.Synced
+		totals.Commits += record.Commits
+		totals.Committed += record.Committed
+	}
+	return totals
+}
+
+// countTransfer adds what an rsync run wrote to its build's stats
+func countTransfer(buildId string, resumed bool, files int, bytes int64) {
+	updateStats(buildId, func(record *BuildStats) {
+		if !resumed {
+			record.Sessions++
+		}
+		record.Files += files
+		record.Synced += bytes
+	})
+}
+
+// countCommit adds the blobs a commit wrote to its build's stats, with the
+// size of the files it committed
+func countCommit(index Index) {
+	staged := dirSize(filepath.Join(config.BuildDir, index.Build))
+	updateStats(index.Build, func(record *BuildStats) {
+		record.Commits++
+		record.Staged = staged
+		for _, entry := range index.Entries {
+			record.Committed += entry.Size
+		}
+	})
+}
+
+// updateStats changes (and persists) a build's stats
+func updateStats(buildId string, fn func(record *BuildStats)) {
+	stats.Lock()
+	record, ok := stats.builds[buildId]
+	if !ok {
+		record = &BuildStats{Build: buildId}
+		stats.builds[buildId] = record
+	}
+	fn(record)
+	record.Updated = time.Now().UTC()
+	copied := *record
+	stats.Unlock()
+
+	err := store.Put(statsBucket, buildId, copied)
+	if err != nil {
+		config.Log.Error("Failed to persist stats of '%v' - %v", buildId, err)
+	}
+}
+
+// restoreStats loads the builds' stats after a restart
+func restoreStats() error {
+	return store.Each(statsBucket, func(key string, raw []byte) error {
+		var record BuildStats
+		err := json.Unmarshal(raw, &record)
+		if err != nil {
+			return fmt.Errorf("Bad stats record '%s' - %v", key, err)
+		}
+		stats.Lock()
+		stats.builds[key] = &record
+		stats.Unlock()
+		return nil
+	})
+}
+
+// pruneStats forgets the stats of builds unchanged for statsRetention
+func pruneStats(now time.Time) {
+	var expired []string
+	stats.Lock()
+	for id, record := range stats.builds {
+		if now.Sub(record.Updated) > statsRetention {
+			expired = append(expired, id)
+			delete(stats.builds, id)
+		}
+	}
+	stats.Unlock()
+
+	for _, id := range expired {
+		store.Delete(statsBucket, id)
+	}
+}
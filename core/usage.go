@@ -0,0 +1,102 @@
+package slurp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/ssh"
+)
+
+// StageUsage is how close a stage is to its limits, so clients can adapt
+// (eg. prune what they upload) before a sync or commit fails on one
+type StageUsage struct {
+	Build     string      `json:"build"`
+	State     string      `json:"state"`
+	Files     int         `json:"files"`              // files in the staging dir
+	Bytes     int64       `json:"bytes"`              // their size
+	Quota     int64       `json:"quota"`              // bytes the stage may hold to be committed (0 unlimited)
+	Remaining int64       `json:"remaining"`          // bytes left under the quota (-1 unlimited)
+	Expires   time.Time   `json:"expires,omitempty"`  // when it expires uncommitted, sooner under disk pressure (zero never)
+	TTL       string      `json:"ttl,omitempty"`      // time left until then
+	Pressure  *SweepTier  `json:"pressure,omitempty"` // disk pressure tier shortening its ttl (omitted while space is plentiful)
+	Sessions  int         `json:"sessions"`           // rsync sessions running
+	BwLimit   int         `json:"bwlimit"`            // KB/s each session is limited to (0 unlimited)
+	Throttled bool        `json:"throttled"`          // whether sessions are bandwidth limited
+	Disk      *DiskStatus `json:"disk,omitempty"`     // usage of the build dir's filesystem
+}
+
+// GetUsage measures a stage's staging dir against its quota and ttl
+func GetUsage(buildId string) (StageUsage, error) {
+	stage, err := GetStage(buildId)
+	if err != nil {
+		return StageUsage{}, err
+	}
+
+	usage := StageUsage{Build: buildId, State: stage.State, Remaining: -1}
+	filepath.Walk(filepath.Join(config.BuildDir, buildId), func(_ string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			usage.Files++
+			usage.Bytes += info.Size()
+		}
+		return nil
+	})
+	if usage.Quota = quotaFor(stage); usage.Quota > 0 {
+		usage.Remaining = usage.Quota - usage.Bytes
+		if usage.Remaining < 0 {
+			usage.Remaining = 0
+		}
+	}
+
+	usage.Pressure = Janitor().Tier
+	usage.Expires = expiry(&stage, usage.Pressure)
+	if !usage.Expires.IsZero() {
+		ttl := time.Until(usage.Expires).Round(time.Second)
+		if ttl < 0 {
+			ttl = 0
+		}
+		usage.TTL = ttl.String()
+	}
+
+	usage.Sessions = ssh.Running()[buildId]
+	usage.BwLimit = config.Get(&config.BwLimit)
+	if limit := config.Get(&config.Templates)[stage.Template].Rsync.BwLimit; stage.Template != "" && limit > 0 {
+		usage.BwLimit = limit
+	}
+	usage.Throttled = usage.BwLimit > 0
+
+	if status, err := DiskUsage(); err == nil {
+		usage.Disk = &status
+	}
+	return usage, nil
+}
+
+// quotaFor returns the bytes a stage may hold: its template's quota, else
+// stage-quota (0 unlimited)
+func quotaFor(stage Stage) int64 {
+	if quota := config.Get(&config.Templates)[stage.Template].Quota; stage.Template != "" && quota > 0 {
+		return int64(quota) << 20
+	}
+	return int64(config.Get(&config.StageQuota)) << 20
+}
+
+// checkQuota refuses to commit a stage holding more than its quota
+func checkQuota(buildId string, results *checks) error {
+	stage, err := GetStage(buildId)
+	if err != nil {
+		return nil
+	}
+	quota := quotaFor(stage)
+	if quota <= 0 {
+		return nil
+	}
+
+	size := dirSize(filepath.Join(config.BuildDir, buildId))
+	if size > quota {
+		err = fmt.Errorf("Stage holds %s, over its %s quota", bytesize(uint64(size)), bytesize(uint64(quota)))
+	}
+	results.add("quota", CheckPolicy, err, fmt.Sprintf("%s of %s", bytesize(uint64(size)), bytesize(uint64(quota))))
+	return err
+}
@@ -0,0 +1,77 @@
+package slurp
+
+import (
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/mu-box/slurp/config"
+)
+
+// ValidateConfig checks the commit settings (formats, outputs, split rules,
+// blob keys, and verification levels of the defaults and every template), the
+// sweep tiers and task schedule, and that the tools they need are installed,
+// returning every problem found
+func ValidateConfig() []error {
+	var errs []error
+	tools := map[string]bool{"tar": true, "rsync": true}
+
+	check := func(name, output, format, key, split, verify string) {
+		switch output {
+		case "", OutputArchive, OutputTree, OutputDelta:
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown commit output '%s'", name, output))
+		}
+		switch verify {
+		case "", VerifyNone, VerifySize, VerifySampled, VerifyFull:
+		default:
+			errs = append(errs, fmt.Errorf("%s: unknown verification level '%s'", name, verify))
+		}
+		switch {
+		case format == FormatTarZst:
+			tools["zstd"] = true
+		case format == FormatSquashfs:
+			tools["mksquashfs"] = true
+			tools["unsquashfs"] = true
+		case format != "" && !validFormat(format):
+			errs = append(errs, fmt.Errorf("%s: unknown archive format '%s'", name, format))
+		}
+		if !validSplit(split) {
+			errs = append(errs, fmt.Errorf("%s: unknown split rule '%s'", name, split))
+		} else if split != "" && format == FormatSquashfs {
+			errs = append(errs, fmt.Errorf("%s: squashfs archives can't be split", name))
+		}
+		if key != "" && !strings.Contains(key, "{buildId}") {
+			errs = append(errs, fmt.Errorf("%s: blob key template '%s' must contain {buildId}", name, key))
+		}
+	}
+
+	check("defaults", config.CommitOut, config.ArchiveFmt, config.BlobKey, config.SplitRule, config.CommitVer)
+	names := make([]string, 0, len(config.Templates))
+	for name := range config.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		template := config.Templates[name]
+		check(fmt.Sprintf("template '%s'", name), template.Output, template.Format, template.Key, template.Split, template.Verify)
+	}
+
+	if _, err := parseTiers(config.SweepTiers); err != nil {
+		errs = append(errs, fmt.Errorf("sweep-tiers: %v", err))
+	}
+	errs = append(errs, checkSchedule()...)
+
+	needed := make([]string, 0, len(tools))
+	for tool := range tools {
+		needed = append(needed, tool)
+	}
+	sort.Strings(needed)
+	for _, tool := range needed {
+		if _, err := exec.LookPath(tool); err != nil {
+			errs = append(errs, fmt.Errorf("'%s' is needed but not installed", tool))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,340 @@
+package slurp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/backend"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/store"
+	"github.com/mu-box/slurp/webhook"
+)
+
+// verifyWorkers is how many blobs are verified at once
+const verifyWorkers = 4
+
+// Levels commits verify their blobs at after uploading them
+const (
+	VerifyNone    = "none"         // trust the upload
+	VerifySize    = "size-only"    // storage has each blob at the size written
+	VerifySampled = "sampled-hash" // a sample of the blobs is read back and hashed, the rest size checked
+	VerifyFull    = "full-hash"    // every blob is read back and hashed
+)
+
+// sampledPercent is the share of a commit's blobs sampled-hash reads back (at
+// least one)
+const sampledPercent = 10
+
+// Divergence is a store whose copy of a blob doesn't match its checksum
+type Divergence struct {
+	Blob     string `json:"blob"`               // blob id
+	Store    string `json:"store"`              // address of the diverged store
+	Error    string `json:"error"`              // why the copy is bad
+	Repaired bool   `json:"repaired,omitempty"` // whether it was re-copied from a healthy store
+}
+
+// VerifyReport is the result of a verification run
+type VerifyReport struct {
+	Started  time.Time    `json:"started"`
+	Ended    time.Time    `json:"ended"`
+	Stores   []string     `json:"stores"`   // primary store followed by its replicas
+	Checked  int          `json:"checked"`  // blobs sampled
+	Diverged []Divergence `json:"diverged"` // bad copies found
+}
+
+// last verification run
+var lastVerify = struct {
+	sync.Mutex
+	report VerifyReport
+}{}
+
+// StartVerifier verifies a sample of committed blobs across the primary store
+// and its replicas every interval
+func StartVerifier(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			Verify(config.VerifyN)
+		}
+	}()
+}
+
+// LastVerify returns the report of the last verification run
+func LastVerify() VerifyReport {
+	lastVerify.Lock()
+	defer lastVerify.Unlock()
+	return lastVerify.report
+}
+
+// Verify compares a random sample of committed blobs in every store against
+// the checksums recorded when they were committed, sending an alert for each
+// diverged copy and re-copying it from a healthy store if repair is enabled.
+func Verify(sample int) VerifyReport {
+	report := VerifyReport{Started: time.Now().UTC(), Stores: backend.Stores(), Diverged: []Divergence{}}
+
+	entries, err := sampleBlobs(sample)
+	if err != nil {
+		config.Log.Error("Failed to sample blobs - %v", err)
+	}
+	report.Checked = len(entries)
+
+	work := make(chan Entry)
+	found := make(chan Divergence)
+	wg := sync.WaitGroup{}
+	for i := 0; i < verifyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range work {
+				for _, divergence := range verifyBlob(entry, report.Stores) {
+					found <- divergence
+				}
+			}
+		}()
+	}
+	go func() {
+		for _, entry := range entries {
+			work <- entry
+		}
+		close(work)
+		wg.Wait()
+		close(found)
+	}()
+
+	for divergence := range found {
+		alertDivergence(divergence)
+		report.Diverged = append(report.Diverged, divergence)
+	}
+
+	report.Ended = time.Now().UTC()
+	config.Log.Info("Verified %d blobs across %d stores, %d diverged", report.Checked, len(report.Stores), len(report.Diverged))
+
+	lastVerify.Lock()
+	lastVerify.report = report
+	lastVerify.Unlock()
+
+	return report
+}
+
+// verifyFor returns the level a build's commit verifies its blobs at
+func verifyFor(buildId string) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+	level := config.CommitVer
+	if stage, ok := stages[buildId]; ok && stage.Template != "" {
+		if verify := config.Get(&config.Templates)[stage.Template].Verify; verify != "" {
+			level = verify
+		}
+	}
+	if level == "" {
+		return VerifyNone
+	}
+	return level
+}
+
+// verifyCommit checks storage has the blobs a commit wrote, as far as its
+// verification level asks, failing if any differ
+func verifyCommit(index *Index, results *checks) error {
+	entries := index.Entries
+	hashed := map[int]bool{}
+	switch index.Verify {
+	case VerifyNone:
+		return nil
+	case VerifySize:
+	case VerifySampled:
+		n := (len(entries)*sampledPercent + 99) / 100
+		for _, i := range rand.Perm(len(entries))[:n] {
+			hashed[i] = true
+		}
+	case VerifyFull:
+		for i := range entries {
+			hashed[i] = true
+		}
+	default:
+		return fmt.Errorf("Unknown verification level '%s'", index.Verify)
+	}
+
+	work := make(chan int)
+	bad := make([]string, len(entries))
+	wg := sync.WaitGroup{}
+	for i := 0; i < verifyWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				var err error
+				if hashed[i] {
+					err = checkCopy(0, entries[i])
+				} else {
+					err = checkSize(entries[i])
+				}
+				if err != nil {
+					bad[i] = fmt.Sprintf("%s (%v)", entries[i].Blob, err)
+				}
+			}
+		}()
+	}
+	for i := range entries {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+
+	var diverged []string
+	for _, msg := range bad {
+		if msg != "" {
+			diverged = append(diverged, msg)
+		}
+	}
+	var err error
+	if len(diverged) > 0 {
+		err = fmt.Errorf("Stored blobs don't match what was written: %s", strings.Join(diverged, ", "))
+	}
+	results.add("verify", CheckValidation, err, fmt.Sprintf("%s: %d blobs hashed, %d size checked", index.Verify, len(hashed), len(entries)-len(hashed)))
+	return err
+}
+
+// checkSize fails if the primary store's copy of a blob isn't the size
+// written, hashing it instead with storage that can't say
+func checkSize(entry Entry) error {
+	stat, err := backend.StatBlob(entry.Blob)
+	if err == backend.ErrNoStat || (err == nil && stat.Size < 0) {
+		return checkCopy(0, entry)
+	}
+	if err != nil {
+		return err
+	}
+	if stat.Size != entry.Size {
+		return fmt.Errorf("Size %d doesn't match %d written", stat.Size, entry.Size)
+	}
+	return nil
+}
+
+// alertDivergence logs a diverged copy and sends it as a webhook event
+func alertDivergence(divergence Divergence) {
+	config.Log.Error("Blob '%v' diverged on '%v' - %v", divergence.Blob, divergence.Store, divergence.Error)
+	webhook.Send(webhook.BlobDiverged, strings.SplitN(divergence.Blob, "/", 2)[0], divergence)
+}
+
+// verifyBlob checks a blob's copy in each store, repairing bad copies from a
+// good one if enabled
+func verifyBlob(entry Entry, stores []string) []Divergence {
+	var diverged []Divergence
+	healthy := -1
+	for i, addr := range stores {
+		err := checkCopy(i, entry)
+		if err != nil {
+			diverged = append(diverged, Divergence{Blob: entry.Blob, Store: addr, Error: err.Error()})
+			continue
+		}
+		if healthy < 0 {
+			healthy = i
+		}
+	}
+
+	if !config.VerifyFix || healthy < 0 {
+		return diverged
+	}
+
+	for i := range diverged {
+		store := storeIndex(stores, diverged[i].Store)
+		err := repairCopy(healthy, store, entry)
+		if err != nil {
+			config.Log.Error("Failed to repair blob '%v' on '%v' - %v", entry.Blob, diverged[i].Store, err)
+			continue
+		}
+		diverged[i].Repaired = true
+	}
+	return diverged
+}
+
+// checkCopy fails if a store's copy of a blob doesn't match its checksum
+func checkCopy(store int, entry Entry) error {
+	blob, err := backend.ReadBlobFrom(store, entry.Blob)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, blob)
+	if err != nil {
+		return fmt.Errorf("Failed to read blob - %v", err)
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != entry.Sha256 {
+		return fmt.Errorf("Checksum %s (%d bytes) doesn't match %s (%d bytes)", sum, size, entry.Sha256, entry.Size)
+	}
+	return nil
+}
+
+// repairCopy copies a blob from a healthy store over a diverged one, checking
+// the result
+func repairCopy(from, to int, entry Entry) error {
+	blob, err := backend.ReadBlobFrom(from, entry.Blob)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	err = backend.WriteBlobTo(to, entry.Blob, blob)
+	if err != nil {
+		return err
+	}
+	return checkCopy(to, entry)
+}
+
+// storeIndex returns the number of a store by its address
+func storeIndex(stores []string, addr string) int {
+	for i := range stores {
+		if stores[i] == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordBlobs remembers the checksums of the blobs written by a commit so
+// they can be verified later
+func recordBlobs(index Index) {
+	for _, entry := range index.Entries {
+		err := store.Put(blobsBucket, entry.Blob, entry)
+		if err != nil {
+			config.Log.Error("Failed to record blob '%v' - %v", entry.Blob, err)
+		}
+	}
+}
+
+// sampleBlobs picks up to n recorded blobs at random
+func sampleBlobs(n int) ([]Entry, error) {
+	var entries []Entry
+	err := store.Each(blobsBucket, func(key string, raw []byte) error {
+		var entry Entry
+		if err := json.Unmarshal(raw, &entry); err != nil {
+			return fmt.Errorf("Bad blob record '%s' - %v", key, err)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rand.Shuffle(len(entries), func(i, j int) {
+		entries[i], entries[j] = entries[j], entries[i]
+	})
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	return entries, nil
+}
@@ -0,0 +1,54 @@
+package slurp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/disk"
+)
+
+// ErrDiskFull is returned when staging while the build dir's filesystem is
+// over the high watermark
+var ErrDiskFull = errors.New("Build dir disk usage over high watermark")
+
+// DiskStatus is the usage of the build dir's filesystem
+type DiskStatus struct {
+	disk.Stats
+	Watermark float64 `json:"watermark"` // percent used at which new stages are refused (0 disables)
+	Accepting bool    `json:"accepting"` // whether new stages are accepted
+}
+
+// DiskUsage returns the usage of the build dir's filesystem
+func DiskUsage() (DiskStatus, error) {
+	stats, err := disk.Usage(config.BuildDir)
+	if err != nil {
+		return DiskStatus{}, err
+	}
+
+	status := DiskStatus{Stats: stats, Watermark: config.DiskHigh, Accepting: true}
+	if config.DiskHigh > 0 && stats.Percent >= config.DiskHigh {
+		status.Accepting = false
+	}
+	return status, nil
+}
+
+// checkWatermark fails if the build dir's filesystem is too full to stage more
+// builds (a full disk corrupts syncs in progress)
+func checkWatermark() error {
+	if config.DiskHigh <= 0 {
+		return nil
+	}
+
+	status, err := DiskUsage()
+	if err != nil {
+		// the build dir may not exist until the first stage creates it
+		config.Log.Debug("Skipping disk watermark check - %v", err)
+		return nil
+	}
+
+	if !status.Accepting {
+		return fmt.Errorf("%w - %.1f%% used, limit %.1f%%", ErrDiskFull, status.Percent, status.Watermark)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// Package "cron" parses cron expressions: the 5 standard fields (minute,
+// hour, day of month, month, day of week) with lists, ranges, and steps, or
+// one of @hourly, @daily, @weekly, @monthly, @yearly, and @every <duration>.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule returns when a task is next due
+type Schedule interface {
+	// Next returns the first run after t (zero if there is none)
+	Next(t time.Time) time.Time
+}
+
+// shorthands for common expressions
+var shorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// field bounds, in expression order
+var bounds = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 0 and 7 are both sunday
+}
+
+// Parse parses a cron expression
+func Parse(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		every, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil || every < time.Second {
+			return nil, fmt.Errorf("'%s' needs a duration of at least 1s", expr)
+		}
+		return interval(every), nil
+	}
+	if full, ok := shorthands[expr]; ok {
+		expr = full
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != len(bounds) {
+		return nil, fmt.Errorf("'%s' doesn't have 5 fields (minute hour day month weekday)", expr)
+	}
+
+	var sets [5]uint64
+	for i, field := range fields {
+		set, err := parseField(field, bounds[i].min, bounds[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' has a bad %s - %v", expr, bounds[i].name, err)
+		}
+		sets[i] = set
+	}
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+
+	return &spec{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		anyDom: fields[2] == "*" || strings.HasPrefix(fields[2], "*/"),
+		anyDow: fields[4] == "*" || strings.HasPrefix(fields[4], "*/"),
+	}, nil
+}
+
+// parseField parses a comma separated list of values, ranges (a-b), and steps
+// (*/n or a-b/n) into a bit set
+func parseField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		span, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step '%s'", part)
+			}
+			span, step = part[:i], n
+		}
+
+		low, high := min, max
+		switch {
+		case span == "*":
+		case strings.Contains(span, "-"):
+			a, b, _ := strings.Cut(span, "-")
+			var err error
+			if low, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("bad range '%s'", part)
+			}
+			if high, err = strconv.Atoi(b); err != nil {
+				return 0, fmt.Errorf("bad range '%s'", part)
+			}
+		default:
+			n, err := strconv.Atoi(span)
+			if err != nil {
+				return 0, fmt.Errorf("bad value '%s'", part)
+			}
+			low, high = n, n
+			if step > 1 {
+				high = max
+			}
+		}
+		if low < min || high > max || low > high {
+			return 0, fmt.Errorf("'%s' is outside %d-%d", part, min, max)
+		}
+
+		for n := low; n <= high; n += step {
+			set |= 1 << uint(n)
+		}
+	}
+	return set, nil
+}
+
+// spec is a parsed 5 field expression
+type spec struct {
+	minute, hour, dom, month, dow uint64
+	anyDom, anyDow                bool
+}
+
+// Next returns the first minute after t the expression matches, in t's
+// location, or zero if none does in the next 5 years
+func (self *spec) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if self.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !self.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if self.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if self.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchDay reports whether t's day matches. As in cron, when both day fields
+// are restricted a day matching either runs.
+func (self *spec) matchDay(t time.Time) bool {
+	dom := self.dom&(1<<uint(t.Day())) != 0
+	dow := self.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case self.anyDom && self.anyDow:
+		return true
+	case self.anyDom:
+		return dow
+	case self.anyDow:
+		return dom
+	}
+	return dom || dow
+}
+
+// interval is an @every schedule
+type interval time.Duration
+
+// Next returns t plus the interval
+func (self interval) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(self))
+}
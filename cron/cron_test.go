@@ -0,0 +1,51 @@
+package cron_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mu-box/slurp/cron"
+)
+
+func TestNext(t *testing.T) {
+	from := time.Date(2016, 7, 26, 12, 7, 30, 0, time.UTC) // a tuesday
+	tests := map[string]time.Time{
+		"* * * * *":       time.Date(2016, 7, 26, 12, 8, 0, 0, time.UTC),
+		"*/15 * * * *":    time.Date(2016, 7, 26, 12, 15, 0, 0, time.UTC),
+		"30 2 * * *":      time.Date(2016, 7, 27, 2, 30, 0, 0, time.UTC),
+		"0 9-17/4 * * *":  time.Date(2016, 7, 26, 13, 0, 0, 0, time.UTC),
+		"0 0 1 * *":       time.Date(2016, 8, 1, 0, 0, 0, 0, time.UTC),
+		"0 0 * * 0":       time.Date(2016, 7, 31, 0, 0, 0, 0, time.UTC),
+		"0 0 * * 7":       time.Date(2016, 7, 31, 0, 0, 0, 0, time.UTC),
+		"0 0 15 * 5":      time.Date(2016, 7, 29, 0, 0, 0, 0, time.UTC), // the 15th or a friday
+		"0 0 29 2 *":      time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC),
+		"5,10 12 26 7 2":  time.Date(2016, 7, 26, 12, 10, 0, 0, time.UTC),
+		"@hourly":         time.Date(2016, 7, 26, 13, 0, 0, 0, time.UTC),
+		"@every 90s":      time.Date(2016, 7, 26, 12, 9, 0, 0, time.UTC),
+		"  @daily ":       time.Date(2016, 7, 27, 0, 0, 0, 0, time.UTC),
+		"0 12 26 7 *":     time.Date(2017, 7, 26, 12, 0, 0, 0, time.UTC),
+		"59 23 31 12 *":   time.Date(2016, 12, 31, 23, 59, 0, 0, time.UTC),
+		"0 0 31 2 *":      {},
+		"0-5 12 * * 1-5":  time.Date(2016, 7, 27, 12, 0, 0, 0, time.UTC),
+		"7 12 26 7 2-3/1": time.Date(2016, 7, 27, 12, 7, 0, 0, time.UTC), // the 26th or a tuesday-wednesday
+	}
+
+	for expr, expected := range tests {
+		schedule, err := cron.Parse(expr)
+		if err != nil {
+			t.Errorf("Failed to parse %q - %v", expr, err)
+			continue
+		}
+		if next := schedule.Next(from); !next.Equal(expected) {
+			t.Errorf("%q: %v doesn't match expected %v", expr, next, expected)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "@every", "@every 10ms", "@sometimes"} {
+		if _, err := cron.Parse(expr); err == nil {
+			t.Errorf("Expected %q to be refused", expr)
+		}
+	}
+}
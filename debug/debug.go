@@ -0,0 +1,81 @@
+// Package "debug" serves go's runtime profiles (net/http/pprof) and exported
+// variables (expvar) on a listener of its own, so a live process can be
+// inspected (eg. for goroutines stuck behind an rsync session) without
+// exposing them on the api.
+package debug
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+
+	"github.com/mu-box/slurp/cache"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/core"
+	"github.com/mu-box/slurp/ssh"
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	expvar.Publish("rsync", expvar.Func(func() interface{} { return ssh.Running() }))
+	expvar.Publish("deletions", expvar.Func(func() interface{} { return slurp.Deletions() }))
+	expvar.Publish("published", expvar.Func(func() interface{} { return slurp.Totals() }))
+	expvar.Publish("cache-peers", expvar.Func(func() interface{} { return cache.Peers() }))
+}
+
+// Start serves the debug endpoints on debug-addr, if set. The address must be
+// a loopback one; profiles aren't for the network.
+func Start() error {
+	if config.DebugAddr == "" {
+		return nil
+	}
+	err := loopback(config.DebugAddr)
+	if err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", config.DebugAddr)
+	if err != nil {
+		return fmt.Errorf("Failed to listen on debug address - %v", err)
+	}
+
+	go func() {
+		err := http.Serve(listener, handler())
+		if err != nil {
+			config.Log.Error("Debug listener stopped - %v", err)
+		}
+	}()
+	config.Log.Info("Debug endpoints listening at http://%v/debug/", listener.Addr())
+	return nil
+}
+
+// loopback checks addr is a host:port on localhost
+func loopback(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("'%s' isn't a host:port address - %v", addr, err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		return fmt.Errorf("'%s' isn't a loopback address", addr)
+	}
+	return nil
+}
+
+// handler routes the pprof and expvar endpoints (on a mux of their own, as
+// importing them only registers them on the default one)
+func handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
@@ -0,0 +1,55 @@
+package debug_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/debug"
+)
+
+func TestStart(t *testing.T) {
+	config.Log = lumber.NewConsoleLogger(lumber.LvlInt("FATAL"))
+
+	for _, bad := range []string{"0.0.0.0:18568", "10.0.0.5:18568", "18568"} {
+		config.DebugAddr = bad
+		if debug.Start() == nil {
+			t.Errorf("Expected debug address %q to be refused", bad)
+		}
+	}
+
+	config.DebugAddr = "127.0.0.1:18568"
+	err := debug.Start()
+	if err != nil {
+		t.Fatalf("Failed to start - %v", err)
+	}
+
+	res, err := http.Get("http://127.0.0.1:18568/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Errorf("Goroutine profile replied %d", res.StatusCode)
+	}
+
+	res, err = http.Get("http://127.0.0.1:18568/debug/vars")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	vars := map[string]interface{}{}
+	err = json.NewDecoder(res.Body).Decode(&vars)
+	if err != nil {
+		t.Fatalf("Failed to decode vars - %v", err)
+	}
+	if _, ok := vars["goroutines"]; !ok {
+		t.Errorf("Expected goroutines in %v", vars)
+	}
+	if _, ok := vars["rsync"]; !ok {
+		t.Errorf("Expected rsync sessions in %v", vars)
+	}
+}
@@ -0,0 +1,160 @@
+// Package "dial" makes slurp's outbound connections to destinations it
+// doesn't control (webhook urls, and any future remote pulls), so they can be
+// limited to an allowlist, resolved with a chosen dns server, and routed
+// through a socks5 proxy rather than reaching into the internal network.
+package dial
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+)
+
+// ErrDenied is returned dialing a destination not in dial-allow
+var ErrDenied = errors.New("Destination not allowed")
+
+// Dialer opens connections. net.Dialer is one.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// base is the dialer connections (or the proxy's) are opened with
+var base = struct {
+	sync.Mutex
+	dialer Dialer
+}{dialer: &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}}
+
+// SetDialer replaces the dialer connections are opened with, eg. one bound to
+// a network namespace or interface. The allowlist and proxy still apply.
+func SetDialer(dialer Dialer) {
+	base.Lock()
+	base.dialer = dialer
+	base.Unlock()
+}
+
+// DialContext connects to addr if it is allowed, through the proxy if one is
+// set. Hosts are resolved before checking the allowlist, and the checked
+// address is the one connected to, so a name can't be re-resolved elsewhere.
+func DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip, err := resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	target := net.JoinHostPort(ip.String(), port)
+
+	base.Lock()
+	dialer := base.dialer
+	base.Unlock()
+
+	if config.DialProxy == "" {
+		return dialer.DialContext(ctx, network, target)
+	}
+	proxy, err := url.Parse(config.DialProxy)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse dial-proxy - %v", err)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxy.Host)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to reach proxy - %v", err)
+	}
+	err = socks5(conn, proxy.User, ip, port)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to connect through proxy - %v", err)
+	}
+	return conn, nil
+}
+
+// Transport returns an http transport dialing through DialContext
+func Transport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = DialContext
+	return transport
+}
+
+// resolve looks up host and returns its first allowed address
+func resolve(ctx context.Context, host string) (net.IP, error) {
+	named := allowed(host, nil)
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := resolver().LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to resolve '%s' - %v", host, err)
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	for _, ip := range ips {
+		if named || allowed("", ip) {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("%w '%s'", ErrDenied, host)
+}
+
+// allowed reports whether a host name or ip is in dial-allow (everything is
+// when it is empty). Names match exactly, or by suffix for "*.example.com".
+func allowed(host string, ip net.IP) bool {
+	if len(config.Get(&config.DialAllow)) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, entry := range config.Get(&config.DialAllow) {
+		entry = strings.ToLower(entry)
+		switch {
+		case ip != nil && strings.Contains(entry, "/"):
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+				return true
+			}
+		case ip != nil && net.ParseIP(entry) != nil:
+			if net.ParseIP(entry).Equal(ip) {
+				return true
+			}
+		case host != "" && strings.HasPrefix(entry, "*."):
+			if strings.HasSuffix(host, entry[1:]) {
+				return true
+			}
+		case host != "" && entry == host:
+			return true
+		}
+	}
+	return false
+}
+
+// resolver returns the resolver for dial-dns, or the system's
+func resolver() *net.Resolver {
+	if config.DialDNS == "" {
+		return net.DefaultResolver
+	}
+	server := config.DialDNS
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			base.Lock()
+			dialer := base.dialer
+			base.Unlock()
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
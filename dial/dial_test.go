@@ -0,0 +1,132 @@
+package dial_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/dial"
+)
+
+func TestAllow(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	defer func() { config.DialAllow = []string{} }()
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	tests := []struct {
+		allow   []string
+		addr    string
+		allowed bool
+	}{
+		{[]string{}, "127.0.0.1", true},
+		{[]string{"10.0.0.0/8"}, "127.0.0.1", false},
+		{[]string{"10.0.0.0/8", "127.0.0.0/8"}, "127.0.0.1", true},
+		{[]string{"127.0.0.1"}, "127.0.0.1", true},
+		{[]string{"localhost"}, "localhost", true},
+		{[]string{"*.example.com"}, "localhost", false},
+		{[]string{"10.0.0.0/8"}, "localhost", false},
+	}
+
+	for _, test := range tests {
+		config.DialAllow = test.allow
+		conn, err := dial.DialContext(context.Background(), "tcp", net.JoinHostPort(test.addr, port))
+		if conn != nil {
+			conn.Close()
+		}
+		if test.allowed && err != nil {
+			t.Errorf("Expected %v allowed by %q - %v", test.addr, test.allow, err)
+		}
+		if !test.allowed && !errors.Is(err, dial.ErrDenied) {
+			t.Errorf("Expected %v denied by %q, got %v", test.addr, test.allow, err)
+		}
+	}
+}
+
+func TestProxy(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hello"))
+		conn.Close()
+	}()
+
+	proxy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Close()
+	requested := make(chan string, 1)
+	go fakeSocks(proxy, requested)
+
+	config.DialProxy = "socks5://user:pass@" + proxy.Addr().String()
+	defer func() { config.DialProxy = "" }()
+
+	conn, err := dial.DialContext(context.Background(), "tcp", target.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial through proxy - %v", err)
+	}
+	defer conn.Close()
+
+	b, _ := io.ReadAll(conn)
+	if string(b) != "hello" {
+		t.Errorf("%q doesn't match expected out", b)
+	}
+	if addr := <-requested; addr != target.Addr().String() {
+		t.Errorf("Proxy was asked for %v rather than %v", addr, target.Addr())
+	}
+}
+
+// fakeSocks accepts one socks5 connection with username/password auth,
+// reporting the address asked for and piping to it
+func fakeSocks(listener net.Listener, requested chan string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 3)
+	io.ReadFull(conn, buf)
+	conn.Write([]byte{0x05, 0x02})
+	// version, "user", "pass"
+	io.ReadFull(conn, make([]byte, 2+4+1+4))
+	conn.Write([]byte{0x01, 0x00})
+
+	req := make([]byte, 10)
+	io.ReadFull(conn, req)
+	addr := net.JoinHostPort(net.IP(req[4:8]).String(), strconv.Itoa(int(req[8])<<8|int(req[9])))
+	requested <- addr
+
+	upstream, err := net.Dial("tcp", addr)
+	if err != nil {
+		conn.Write([]byte{0x05, 0x05, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 127, 0, 0, 1, 0, 0})
+	io.Copy(conn, upstream)
+}
@@ -0,0 +1,97 @@
+package dial
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// socks5 asks a socks5 proxy (RFC 1928) on conn to connect to ip:port,
+// authenticating with user's username and password (RFC 1929) if set
+func socks5(conn net.Conn, user *url.Userinfo, ip net.IP, port string) error {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("Bad port '%s'", port)
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	// offer no auth, or username/password if we have one
+	method := byte(0x00)
+	if user != nil {
+		method = 0x02
+	}
+	_, err = conn.Write([]byte{0x05, 0x01, method})
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err = io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("Proxy refused the auth method")
+	}
+
+	if user != nil {
+		pass, _ := user.Password()
+		if len(user.Username()) > 255 || len(pass) > 255 {
+			return errors.New("Proxy username or password is too long")
+		}
+		req := []byte{0x01, byte(len(user.Username()))}
+		req = append(req, user.Username()...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err = conn.Write(req); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("Proxy refused the username and password")
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 0x01), ip4...)
+	} else {
+		req = append(append(req, 0x04), ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(n))
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	// version, status, reserved, then the bound address to skip
+	head := make([]byte, 4)
+	if _, err = io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0x00 {
+		return fmt.Errorf("Proxy failed to connect (status %d)", head[1])
+	}
+	skip := 0
+	switch head[3] {
+	case 0x01:
+		skip = net.IPv4len
+	case 0x04:
+		skip = net.IPv6len
+	case 0x03:
+		size := make([]byte, 1)
+		if _, err = io.ReadFull(conn, size); err != nil {
+			return err
+		}
+		skip = int(size[0])
+	default:
+		return errors.New("Proxy replied with a bad address type")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
@@ -0,0 +1,35 @@
+// Package "disk" reports filesystem usage for the staging area.
+package disk
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Stats is the usage of the filesystem holding a path
+type Stats struct {
+	Total   uint64  `json:"total"`   // size of the filesystem in bytes
+	Free    uint64  `json:"free"`    // bytes available to slurp
+	Used    uint64  `json:"used"`    // bytes in use
+	Percent float64 `json:"percent"` // percent of the filesystem in use
+}
+
+// Usage returns the usage of the filesystem holding path
+func Usage(path string) (Stats, error) {
+	var fs syscall.Statfs_t
+	err := syscall.Statfs(path, &fs)
+	if err != nil {
+		return Stats{}, fmt.Errorf("Failed to stat filesystem - %v", err)
+	}
+
+	stats := Stats{
+		Total: fs.Blocks * uint64(fs.Bsize),
+		Free:  fs.Bavail * uint64(fs.Bsize),
+	}
+	stats.Used = stats.Total - fs.Bfree*uint64(fs.Bsize)
+	if stats.Total > 0 {
+		stats.Percent = float64(stats.Used) * 100 / float64(stats.Total)
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,23 @@
+package disk_test
+
+import (
+	"testing"
+
+	"github.com/mu-box/slurp/disk"
+)
+
+func TestUsage(t *testing.T) {
+	stats, err := disk.Usage("/")
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if stats.Total == 0 || stats.Percent < 0 || stats.Percent > 100 {
+		t.Errorf("%+v doesn't match expected out", stats)
+	}
+
+	_, err = disk.Usage("/not/a/real/path")
+	if err == nil {
+		t.Error("Expected error for missing path")
+	}
+}
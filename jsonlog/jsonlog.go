@@ -0,0 +1,131 @@
+// Package "jsonlog" is a lumber logger writing one json record per line, for
+// log pipelines that index fields (timestamp, level, component, build,
+// request, and trace ids) rather than parse console lines.
+package jsonlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/trace"
+)
+
+// Record is a log line as json
+type Record struct {
+	Time      time.Time `json:"time"`
+	Level     string    `json:"level"`               // trace, debug, info, warn, error, or fatal
+	Component string    `json:"component,omitempty"` // package that logged it (api, core, ssh, backend...)
+	Build     string    `json:"build,omitempty"`     // build the line is about, if known
+	Request   string    `json:"request_id,omitempty"`
+	Trace     string    `json:"trace_id,omitempty"` // trace of the request, if known
+	Message   string    `json:"message"`
+}
+
+var (
+	// "[id] " prefix of lines tagged with reqid.Tag
+	tagged = regexp.MustCompile(`^\[([0-9A-Za-z._-]+)\] `)
+	// request_id=id field of access log lines
+	field = regexp.MustCompile(`\brequest_id=([0-9A-Za-z._-]+)`)
+)
+
+// Logger writes json records. It embeds a console logger for lumber's level
+// handling (which only writes the record of Close).
+type Logger struct {
+	lumber.Logger
+	out  io.Writer
+	lock sync.Mutex
+}
+
+// New creates a json logger writing records at or above level to out
+func New(out io.Writer, level int) *Logger {
+	return &Logger{Logger: lumber.NewBasicLogger(nopCloser{io.Discard}, level), out: out}
+}
+
+func (self *Logger) Fatal(format string, v ...interface{}) { self.log(lumber.FATAL, format, v...) }
+func (self *Logger) Error(format string, v ...interface{}) { self.log(lumber.ERROR, format, v...) }
+func (self *Logger) Warn(format string, v ...interface{})  { self.log(lumber.WARN, format, v...) }
+func (self *Logger) Info(format string, v ...interface{})  { self.log(lumber.INFO, format, v...) }
+func (self *Logger) Debug(format string, v ...interface{}) { self.log(lumber.DEBUG, format, v...) }
+func (self *Logger) Trace(format string, v ...interface{}) { self.log(lumber.TRACE, format, v...) }
+
+// Print writes a record regardless of the level, as lumber's loggers do
+func (self *Logger) Print(level int, v ...interface{}) {
+	self.write(level, fmt.Sprint(v...))
+}
+
+// Printf writes a record regardless of the level, as lumber's loggers do
+func (self *Logger) Printf(level int, format string, v ...interface{}) {
+	self.write(level, fmt.Sprintf(format, v...))
+}
+
+func (self *Logger) log(level int, format string, v ...interface{}) {
+	if level < self.GetLevel() {
+		return
+	}
+	self.write(level, fmt.Sprintf(format, v...))
+}
+
+// write encodes a record of msg, pulling the request id out of its reqid tag
+// (or access log field) and looking up the build and trace of the request
+func (self *Logger) write(level int, msg string) {
+	record := Record{
+		Time:      time.Now().UTC(),
+		Level:     strings.ToLower(strings.TrimSpace(lumber.LvlStr(level))),
+		Component: component(),
+		Message:   strings.TrimSuffix(msg, "\n"),
+	}
+	if match := tagged.FindStringSubmatch(record.Message); match != nil {
+		record.Request = match[1]
+		record.Message = strings.TrimPrefix(record.Message, match[0])
+	} else if match := field.FindStringSubmatch(record.Message); match != nil {
+		record.Request = match[1]
+	}
+	if record.Request != "" {
+		record.Build = reqid.Build(record.Request)
+		if ctx := trace.Request(record.Request); ctx.Valid() {
+			record.Trace = fmt.Sprintf("%x", ctx.TraceId)
+		}
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	self.lock.Lock()
+	self.out.Write(append(b, '\n'))
+	self.lock.Unlock()
+}
+
+// component names the package of the first caller outside this one, eg
+// "github.com/mu-box/slurp/core.sweep" is "core"
+func component() string {
+	pcs := make([]uintptr, 8)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+	for {
+		frame, more := frames.Next()
+		name := frame.Function[strings.LastIndex(frame.Function, "/")+1:]
+		pkg, _, _ := strings.Cut(name, ".")
+		if pkg != "jsonlog" && pkg != "" {
+			return pkg
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// nopCloser keeps Close from closing the discarded console output
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
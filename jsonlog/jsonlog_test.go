@@ -0,0 +1,54 @@
+package jsonlog_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/mu-box/slurp/jsonlog"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/trace"
+)
+
+func TestRecords(t *testing.T) {
+	out := &bytes.Buffer{}
+	log := jsonlog.New(out, lumber.INFO)
+
+	reqid.Set("build", "abc123")
+	defer reqid.Clear("build")
+	ctx := trace.Start("api GET", trace.KindServer, trace.Context{}).Context()
+	trace.SetRequest("abc123", ctx)
+
+	log.Debug("dropped")
+	log.Info("%sCommitted '%v'", reqid.Tag("build"), "build")
+	log.Error("request_id=abc123 status=%d", 500)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got %q", out.String())
+	}
+
+	var record jsonlog.Record
+	err := json.Unmarshal([]byte(lines[0]), &record)
+	if err != nil {
+		t.Fatalf("Failed to parse record - %v", err)
+	}
+	if record.Level != "info" || record.Message != "Committed 'build'" || record.Request != "abc123" || record.Build != "build" || record.Trace != fmt.Sprintf("%x", ctx.TraceId) {
+		t.Errorf("Unexpected record - %+v", record)
+	}
+	if record.Component != "jsonlog_test" {
+		t.Errorf("%q doesn't match expected component", record.Component)
+	}
+
+	err = json.Unmarshal([]byte(lines[1]), &record)
+	if err != nil {
+		t.Fatalf("Failed to parse record - %v", err)
+	}
+	if record.Level != "error" || record.Request != "abc123" || record.Message != "request_id=abc123 status=500" {
+		t.Errorf("Unexpected record - %+v", record)
+	}
+}
@@ -0,0 +1,143 @@
+// Package "leader" elects the active slurp of an active-passive pair (or
+// more) sharing their state on storage both can reach, eg an NFS mount: the
+// one holding an exclusive lock on a file there runs, while the others stand
+// by to take over once it dies and the lock is released.
+package leader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// poll is the interval standbys retry the lock at, and the leader checks it
+// still holds it
+const poll = time.Second
+
+// Holder is the slurp leading, as recorded in the lock file
+type Holder struct {
+	Host  string    `json:"host"`
+	Pid   int       `json:"pid"`
+	Since time.Time `json:"since"` // when it took the lock
+}
+
+// the lock held, guarded by its mutex
+var held = struct {
+	sync.Mutex
+	file *os.File
+	lost chan struct{} // closed once the lock is lost
+}{lost: make(chan struct{})}
+
+// Acquire blocks until this process holds the lock at path, then records
+// itself in the file as the leader. standby is called with the leader holding
+// it whenever that changes while waiting.
+func Acquire(path string, standby func(Holder)) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create lock dir - %v", err)
+	}
+
+	var last Holder
+	for {
+		file, err := tryLock(path)
+		if err == nil {
+			return lead(file)
+		}
+		if !errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("Failed to lock '%v' - %v", path, err)
+		}
+		if holder, err := Current(path); err == nil && holder != last {
+			last = holder
+			standby(holder)
+		}
+		time.Sleep(poll)
+	}
+}
+
+// tryLock opens the lock file and locks it, failing with EWOULDBLOCK while
+// another process holds it
+func tryLock(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+// lead records this process as the holder of a lock taken, and watches that
+// it keeps it
+func lead(file *os.File) error {
+	host, _ := os.Hostname()
+	raw, err := json.Marshal(Holder{Host: host, Pid: os.Getpid(), Since: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt(append(raw, '\n'), 0)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to record leader - %v", err)
+	}
+
+	held.Lock()
+	held.file = file
+	held.Unlock()
+	go watch(file)
+	return nil
+}
+
+// watch closes the lost channel once the lock file is removed or replaced,
+// when another slurp may take a lock of its own
+func watch(file *os.File) {
+	ours, err := file.Stat()
+	for err == nil {
+		time.Sleep(poll)
+		var info os.FileInfo
+		info, err = os.Stat(file.Name())
+		if err == nil && !os.SameFile(ours, info) {
+			err = fmt.Errorf("Lock file was replaced")
+		}
+	}
+	close(held.lost)
+}
+
+// Leading reports whether this process holds the lock
+func Leading() bool {
+	held.Lock()
+	defer held.Unlock()
+	return held.file != nil
+}
+
+// Lost returns a channel closed if the lock held is lost
+func Lost() <-chan struct{} {
+	return held.lost
+}
+
+// Current returns the leader recorded in the lock file at path
+func Current(path string) (Holder, error) {
+	var holder Holder
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return holder, err
+	}
+	err = json.Unmarshal(raw, &holder)
+	if err != nil {
+		return holder, fmt.Errorf("Failed to read leader - %v", err)
+	}
+	return holder, nil
+}
@@ -0,0 +1,42 @@
+package leader_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mu-box/slurp/leader"
+)
+
+func TestLeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lock", "slurp.lock")
+	if leader.Leading() {
+		t.Fatal("Expected not to lead before acquiring the lock")
+	}
+
+	err := leader.Acquire(path, func(leader.Holder) {
+		t.Error("Expected an unheld lock not to stand by")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !leader.Leading() {
+		t.Error("Expected to lead once the lock is held")
+	}
+	holder, err := leader.Current(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holder.Pid != os.Getpid() || holder.Since.IsZero() {
+		t.Errorf("%+v doesn't match expected holder", holder)
+	}
+
+	// another slurp could lock a new file, so the old lock is lost
+	os.Remove(path)
+	select {
+	case <-leader.Lost():
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the lock to be lost once its file is removed")
+	}
+}
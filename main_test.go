@@ -56,7 +56,7 @@ func TestPing(t *testing.T) {
 func initialize() {
 	http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	config.Log = lumber.NewConsoleLogger(lumber.LvlInt(config.LogLevel))
-	config.ApiToken = ""
+	config.ApiToken = "secret"
 
 	// check for hoarder
 	err := backend.Initialize()
@@ -71,7 +71,7 @@ func rest(method, route, data string) ([]byte, error) {
 	body := bytes.NewBuffer([]byte(data))
 
 	req, _ := http.NewRequest(method, fmt.Sprintf("%s%s", config.ApiAddress, route), body)
-	req.Header.Add("X-AUTH-TOKEN", "")
+	req.Header.Add("X-AUTH-TOKEN", config.ApiToken)
 
 	res, err := http.DefaultClient.Do(req)
 	if err != nil {
@@ -0,0 +1,93 @@
+// Package "names" normalizes and validates user supplied names (build ids,
+// file paths, metadata keys) so visually identical names can't refer to
+// different things and odd bytes can't confuse path handling.
+package names
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxIdLength is the longest build id allowed, in bytes (a file name limit)
+const maxIdLength = 255
+
+// sidecars are the suffixes a build's other blobs are stored under (its
+// index, manifest...), and staged contents are stored under, which a build id
+// can't end with so one build's blob can't be another's sidecar
+var sidecars = []string{".index", ".licenses", ".manifest", ".parts", ".preview", ".sig", ".stage", ".staged"}
+
+var (
+	ErrEmpty   = errors.New("Name can't be empty")
+	ErrInvalid = errors.New("Name is not valid UTF-8")
+)
+
+// Normalize returns the NFC form of name, rejecting invalid (including
+// overlong) UTF-8, control characters, and invisible formatting characters.
+func Normalize(name string) (string, error) {
+	if name == "" {
+		return "", ErrEmpty
+	}
+	if !utf8.ValidString(name) {
+		return "", ErrInvalid
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return "", fmt.Errorf("Name contains disallowed character %U", r)
+		}
+	}
+
+	return norm.NFC.String(name), nil
+}
+
+// BuildId normalizes a build id. Build ids name staging dirs, ssh users, and
+// blobs, so they must also be a single, reasonably sized path segment.
+func BuildId(id string) (string, error) {
+	id, err := Normalize(id)
+	if err != nil {
+		return "", fmt.Errorf("Bad build id - %v", err)
+	}
+
+	if id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("Bad build id - must be a single path segment")
+	}
+	if len(id) > maxIdLength {
+		return "", fmt.Errorf("Bad build id - longer than %d bytes", maxIdLength)
+	}
+	for _, suffix := range sidecars {
+		if strings.HasSuffix(id, suffix) {
+			return "", fmt.Errorf("Bad build id - can't end with '%s'", suffix)
+		}
+	}
+	// split builds are stored as "<id>.part-001"...
+	if i := strings.LastIndex(id, ".part-"); i >= 0 && strings.Trim(id[i+len(".part-"):], "0123456789") == "" {
+		return "", fmt.Errorf("Bad build id - can't end with a part number")
+	}
+
+	return id, nil
+}
+
+// Path normalizes a slash separated relative file path, rejecting absolute
+// paths and ".." segments.
+func Path(path string) (string, error) {
+	path, err := Normalize(path)
+	if err != nil {
+		return "", fmt.Errorf("Bad path - %v", err)
+	}
+
+	if strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("Bad path '%s' - must be relative", path)
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("Bad path '%s' - can't contain '..'", path)
+		}
+	}
+
+	return path, nil
+}
@@ -0,0 +1,54 @@
+package names_test
+
+import (
+	"testing"
+
+	"github.com/mu-box/slurp/names"
+)
+
+func TestBuildId(t *testing.T) {
+	// decomposed "é" is composed
+	id, err := names.BuildId("cafe\u0301")
+	if err != nil {
+		t.Error(err)
+	}
+	if id != "caf\u00e9" {
+		t.Errorf("%q doesn't match expected out", id)
+	}
+
+	bad := []string{
+		"",
+		"..",
+		"a/b",
+		"a\x00b",
+		"a\u200bb",     // zero width space
+		"\xc0\xaf",     // overlong "/"
+		"a\u202eexe.b", // right-to-left override
+		"app.index",    // another build's sidecar
+		"app.sig",
+		"app.parts",
+		"0123abcd.staged",
+		"app.part-001", // another build's part
+	}
+	for _, b := range bad {
+		if _, err := names.BuildId(b); err == nil {
+			t.Errorf("%q should be rejected", b)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	path, err := names.Path("dir/cafe\u0301.txt")
+	if err != nil {
+		t.Error(err)
+	}
+	if path != "dir/caf\u00e9.txt" {
+		t.Errorf("%q doesn't match expected out", path)
+	}
+
+	for _, b := range []string{"/etc/passwd", "a/../../b", "a\nb"} {
+		if _, err := names.Path(b); err == nil {
+			t.Errorf("%q should be rejected", b)
+		}
+	}
+}
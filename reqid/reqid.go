@@ -0,0 +1,148 @@
+// Package "reqid" generates api request ids and remembers which request last
+// touched a build, so api, backend, and ssh log lines for the same build can
+// be correlated.
+package reqid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// Header is the http header request ids are accepted, returned, and
+// forwarded in
+const Header = "X-Request-Id"
+
+// maxLength is the longest request id accepted from a client
+const maxLength = 128
+
+var (
+	// request id keyed by build id
+	builds = map[string]string{}
+
+	// builds touched by watched requests, keyed by request id
+	watched = map[string][]string{}
+
+	// mutex ensures updates to builds are atomic
+	mutex = sync.Mutex{}
+)
+
+// New generates a random request id
+func New() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Accept returns the request id a client sent, if it is one slurp can use (up
+// to 128 letters, digits, '.', '_', or '-', eg a uuid), or else a new one
+func Accept(id string) string {
+	if id == "" || len(id) > maxLength {
+		return New()
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return New()
+		}
+	}
+	return id
+}
+
+// Set associates a request id with a build
+func Set(build, id string) {
+	mutex.Lock()
+	builds[build] = id
+	if touched, ok := watched[id]; ok {
+		watched[id] = append(touched, build)
+	}
+	mutex.Unlock()
+}
+
+// Watch starts collecting the builds a request touches (is Set with), which
+// Clear doesn't forget, until Unwatch
+func Watch(id string) {
+	mutex.Lock()
+	watched[id] = []string{}
+	mutex.Unlock()
+}
+
+// Unwatch stops collecting the builds a request touches, returning them in
+// the order they were first touched
+func Unwatch(id string) []string {
+	mutex.Lock()
+	touched := watched[id]
+	delete(watched, id)
+	mutex.Unlock()
+
+	var unique []string
+	seen := map[string]bool{}
+	for _, build := range touched {
+		if !seen[build] {
+			seen[build] = true
+			unique = append(unique, build)
+		}
+	}
+	return unique
+}
+
+// Clear forgets the request id associated with a build
+func Clear(build string) {
+	mutex.Lock()
+	delete(builds, build)
+	mutex.Unlock()
+}
+
+// Get returns the request id for a build, or for a blob id derived from a
+// build id (eg. "build/path/file" or "build.index", but not "build-2"). An
+// empty string is returned if there is none.
+func Get(key string) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if id, ok := builds[key]; ok {
+		return id
+	}
+
+	// longest build id the key is derived from wins
+	var match, id string
+	for build := range builds {
+		if len(build) > len(match) && derived(key, build) {
+			match, id = build, builds[build]
+		}
+	}
+	return id
+}
+
+// derived reports whether a blob id is a build's: the build id followed by a
+// '/' or '.'
+func derived(key, build string) bool {
+	if len(key) <= len(build) || !strings.HasPrefix(key, build) {
+		return false
+	}
+	return key[len(build)] == '/' || key[len(build)] == '.'
+}
+
+// Build returns a build a request id is associated with (one of them, for
+// requests touching several), or an empty string if there is none.
+func Build(id string) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	for build, bid := range builds {
+		if bid == id {
+			return build
+		}
+	}
+	return ""
+}
+
+// Tag returns a "[id] " log prefix for a build (or blob), or an empty string
+// if no request id is known.
+func Tag(key string) string {
+	id := Get(key)
+	if id == "" {
+		return ""
+	}
+	return "[" + id + "] "
+}
@@ -0,0 +1,58 @@
+package reqid_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mu-box/slurp/reqid"
+)
+
+func TestGet(t *testing.T) {
+	reqid.Set("build", "abc")
+	reqid.Set("build-2", "def")
+
+	if id := reqid.Get("build"); id != "abc" {
+		t.Errorf("%q doesn't match expected out", id)
+	}
+	if id := reqid.Get("build-2/some/file"); id != "def" {
+		t.Errorf("%q doesn't match expected out", id)
+	}
+	if id := reqid.Get("build.index"); id != "abc" {
+		t.Errorf("%q doesn't match expected out", id)
+	}
+	if id := reqid.Get("build-3"); id != "" {
+		t.Errorf("%q doesn't match expected out", id)
+	}
+
+	reqid.Clear("build")
+	if tag := reqid.Tag("build"); tag != "" {
+		t.Errorf("%q doesn't match expected out", tag)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	reqid.Watch("ghi")
+	reqid.Set("watch-a", "ghi")
+	reqid.Set("watch-b", "ghi")
+	reqid.Clear("watch-a")
+	reqid.Set("watch-a", "ghi")
+	reqid.Set("watch-c", "jkl")
+
+	if builds := reqid.Unwatch("ghi"); len(builds) != 2 || builds[0] != "watch-a" || builds[1] != "watch-b" {
+		t.Errorf("%q doesn't match expected out", builds)
+	}
+	if builds := reqid.Unwatch("ghi"); len(builds) != 0 {
+		t.Errorf("%q doesn't match expected out", builds)
+	}
+}
+
+func TestAccept(t *testing.T) {
+	if id := reqid.Accept("7c9e6679-7425-40de-944b-e07fc1f90ae7"); id != "7c9e6679-7425-40de-944b-e07fc1f90ae7" {
+		t.Errorf("%q doesn't match expected out", id)
+	}
+	for _, bad := range []string{"", "has space", "new\nline", strings.Repeat("a", 129)} {
+		if id := reqid.Accept(bad); id == bad || len(id) != 16 {
+			t.Errorf("Expected %q to be replaced, got %q", bad, id)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Package "rotate" is a log file writer that rotates the file once it grows
+// past a size or age, keeping a number of rotated files for a time.
+package rotate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stamp is the time format appended to rotated file names, sorting oldest
+// first
+const stamp = "20060102-150405.000"
+
+// File is a log file rotated to "<path>.<time>" once it is MaxSize bytes or
+// MaxAge old. Age is counted from when the file was created, or opened by
+// this process if it already existed.
+type File struct {
+	Path    string
+	MaxSize int64         // bytes the file may grow to before it is rotated (0 unlimited)
+	MaxAge  time.Duration // time a file is written to before it is rotated (0 unlimited)
+	Keep    int           // rotated files kept, newest first (0 keeps all)
+	KeepFor time.Duration // time rotated files are kept after rotation (0 forever)
+
+	lock   sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+// Open opens (or creates) a log file to append to, rotating it as set
+func Open(path string, maxSize int64, maxAge time.Duration, keep int, keepFor time.Duration) (*File, error) {
+	self := &File{Path: path, MaxSize: maxSize, MaxAge: maxAge, Keep: keep, KeepFor: keepFor}
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create log dir - %v", err)
+	}
+	err = self.open()
+	if err != nil {
+		return nil, err
+	}
+	self.prune()
+	return self, nil
+}
+
+// Write appends p to the file, rotating it first if p would take it past
+// MaxSize or it is older than MaxAge
+func (self *File) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.file == nil {
+		return 0, os.ErrClosed
+	}
+	if self.due(int64(len(p))) {
+		err := self.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := self.file.Write(p)
+	self.size += int64(n)
+	return n, err
+}
+
+// Close closes the file
+func (self *File) Close() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if self.file == nil {
+		return nil
+	}
+	err := self.file.Close()
+	self.file = nil
+	return err
+}
+
+// due reports whether the file should be rotated before writing n bytes
+func (self *File) due(n int64) bool {
+	if self.size == 0 {
+		return false
+	}
+	if self.MaxSize > 0 && self.size+n > self.MaxSize {
+		return true
+	}
+	return self.MaxAge > 0 && time.Since(self.opened) >= self.MaxAge
+}
+
+// open opens the file for appending
+func (self *File) open() error {
+	file, err := os.OpenFile(self.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("Failed to open log file - %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to stat log file - %v", err)
+	}
+
+	self.file, self.size, self.opened = file, info.Size(), time.Now()
+	return nil
+}
+
+// rotate renames the file aside and starts a new one
+func (self *File) rotate() error {
+	err := self.file.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to close log file - %v", err)
+	}
+	self.file = nil
+
+	err = os.Rename(self.Path, self.Path+"."+time.Now().UTC().Format(stamp))
+	if err != nil {
+		return fmt.Errorf("Failed to rotate log file - %v", err)
+	}
+
+	err = self.open()
+	if err != nil {
+		return err
+	}
+	go self.prune()
+	return nil
+}
+
+// Rotated returns the rotated files, oldest first
+func (self *File) Rotated() []string {
+	matches, _ := filepath.Glob(self.Path + ".*")
+	var rotated []string
+	for _, match := range matches {
+		if _, err := time.Parse(stamp, strings.TrimPrefix(match, self.Path+".")); err == nil {
+			rotated = append(rotated, match)
+		}
+	}
+	sort.Strings(rotated)
+	return rotated
+}
+
+// prune removes the rotated files past Keep, or older than KeepFor
+func (self *File) prune() {
+	rotated := self.Rotated()
+	for i, path := range rotated {
+		at, _ := time.Parse(stamp, strings.TrimPrefix(path, self.Path+"."))
+		if (self.Keep > 0 && i < len(rotated)-self.Keep) || (self.KeepFor > 0 && time.Since(at) > self.KeepFor) {
+			os.Remove(path)
+		}
+	}
+}
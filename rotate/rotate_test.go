@@ -0,0 +1,82 @@
+package rotate_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mu-box/slurp/rotate"
+)
+
+func TestRotateSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slurp-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "logs", "slurp.log")
+	file, err := rotate.Open(path, 10, 0, 2, 0)
+	if err != nil {
+		t.Fatalf("Failed to open - %v", err)
+	}
+	defer file.Close()
+
+	for _, line := range []string{"one\n", "two\n", "three\n", "four\n", "five\n", "six\n"} {
+		_, err = file.Write([]byte(line))
+		if err != nil {
+			t.Fatalf("Failed to write - %v", err)
+		}
+		// rotated names are stamped to the millisecond
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != "six\n" {
+		t.Errorf("%q doesn't match expected out", b)
+	}
+
+	// pruning runs in the background after a rotation
+	time.Sleep(50 * time.Millisecond)
+	rotated := file.Rotated()
+	if len(rotated) != 2 {
+		t.Fatalf("Expected 2 rotated files, got %q", rotated)
+	}
+	b, _ = ioutil.ReadFile(rotated[1])
+	if string(b) != "four\nfive\n" {
+		t.Errorf("%q doesn't match expected out", b)
+	}
+	if !strings.HasPrefix(rotated[0], path+".") {
+		t.Errorf("%q isn't named after the log file", rotated[0])
+	}
+}
+
+func TestRotateAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slurp-rotate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "slurp.log")
+	file, err := rotate.Open(path, 0, 20*time.Millisecond, 0, 0)
+	if err != nil {
+		t.Fatalf("Failed to open - %v", err)
+	}
+	defer file.Close()
+
+	file.Write([]byte("old\n"))
+	time.Sleep(30 * time.Millisecond)
+	file.Write([]byte("new\n"))
+
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != "new\n" {
+		t.Errorf("%q doesn't match expected out", b)
+	}
+	if rotated := file.Rotated(); len(rotated) != 1 {
+		t.Errorf("Expected 1 rotated file, got %q", rotated)
+	}
+}
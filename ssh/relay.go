@@ -0,0 +1,152 @@
+package ssh
+
+import (
+	"encoding/base64"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/reqid"
+)
+
+// relayTimeout is how long connecting to the node a sync is relayed to may take
+const relayTimeout = 10 * time.Second
+
+// returns the address of the cluster node syncs to a build are relayed to
+var onRelay func(build string) string
+
+// OnRelay sets the function returning the ssh address of the cluster node
+// owning a build that isn't staged here ("" if none does), so syncs reaching
+// this node are relayed to it
+func OnRelay(fn func(build string) string) {
+	mutex.Lock()
+	onRelay = fn
+	mutex.Unlock()
+}
+
+// relayFor returns the address syncs to a build are relayed to, if any
+func relayFor(build string) string {
+	mutex.Lock()
+	hook := onRelay
+	mutex.Unlock()
+
+	if hook == nil || build == "" {
+		return ""
+	}
+	return hook(build)
+}
+
+// tokenBuild returns the build a resumption token (issued by any node) is
+// for, without checking it; the node that issued it does
+func tokenBuild(token string) string {
+	if !strings.HasPrefix(token, resumePrefix) {
+		return ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(strings.TrimPrefix(token, resumePrefix), ".")[0])
+	if err != nil {
+		return ""
+	}
+	fields := strings.SplitN(string(payload), " ", 3)
+	if len(fields) != 3 {
+		return ""
+	}
+	return fields[2]
+}
+
+// relay passes a client's channels through to the node owning its build,
+// connecting as the client's ssh user, so the owner runs (and tracks) the sync
+func relay(user, build, addr string, chans <-chan ssh.NewChannel, reqs <-chan *ssh.Request) {
+	go ssh.DiscardRequests(reqs)
+
+	server.Lock()
+	signer := server.signer
+	server.Unlock()
+
+	// peers are known by their announcements in storage, not their host keys
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         relayTimeout,
+	})
+	if err != nil {
+		config.Log.Error("%sFailed to relay sync of '%v' to '%v' - %v", reqid.Tag(build), build, addr, err)
+		for newChannel := range chans {
+			newChannel.Reject(ssh.ConnectionFailed, "build's node unreachable")
+		}
+		return
+	}
+	defer client.Close()
+	config.Log.Debug("%sRelaying sync of '%v' to '%v'", reqid.Tag(build), build, addr)
+
+	for newChannel := range chans {
+		go relayChannel(client, newChannel)
+	}
+}
+
+// relayChannel passes a channel's data and requests through to the owner
+func relayChannel(client *ssh.Client, newChannel ssh.NewChannel) {
+	upstream, upReqs, err := client.OpenChannel(newChannel.ChannelType(), newChannel.ExtraData())
+	if err != nil {
+		if open, ok := err.(*ssh.OpenChannelError); ok {
+			newChannel.Reject(open.Reason, open.Message)
+		} else {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		}
+		return
+	}
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	defer channel.Close()
+
+	copied := sync.WaitGroup{}
+	copied.Add(2)
+	go func() {
+		io.Copy(channel, upstream)
+		copied.Done()
+	}()
+	go func() {
+		io.Copy(channel.Stderr(), upstream.Stderr())
+		copied.Done()
+	}()
+	go func() {
+		io.Copy(upstream, channel)
+		upstream.CloseWrite()
+	}()
+
+	// the client's requests (exec...) go to the owner. The owner replies to
+	// exec once the sync is over, after closing the channel, so a request
+	// cut short by the close goes unanswered here too.
+	go func() {
+		for req := range reqs {
+			ok, err := upstream.SendRequest(req.Type, req.WantReply, req.Payload)
+			if req.WantReply && err == nil {
+				req.Reply(ok, nil)
+			}
+		}
+	}()
+
+	// the owner's come back, its exit status once its output is passed on
+	for req := range upReqs {
+		if req.Type == "exit-status" || req.Type == "exit-signal" {
+			if req.WantReply {
+				req.Reply(true, nil)
+			}
+			copied.Wait()
+			channel.SendRequest(req.Type, false, req.Payload)
+			continue
+		}
+		ok, _ := channel.SendRequest(req.Type, req.WantReply, req.Payload)
+		if req.WantReply {
+			req.Reply(ok, nil)
+		}
+	}
+	copied.Wait()
+}
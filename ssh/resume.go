@@ -0,0 +1,95 @@
+package ssh
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+)
+
+// resumePrefix starts resumption tokens, telling them apart from build ids
+const resumePrefix = "slurp-"
+
+// key resumption tokens are signed with, new each start (so a restart, which
+// forgets sessions, also invalidates their tokens)
+var resumeKey = func() []byte {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return key
+}()
+
+// newSessionId generates a random session id
+func newSessionId() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// resumeToken issues a token a client can reconnect with (as its ssh user) to
+// continue a session on build, or an empty string if resume-window is 0
+func resumeToken(build, id string) string {
+	if config.ResumeTTL <= 0 {
+		return ""
+	}
+	payload := id + " " + strconv.FormatInt(time.Now().Unix(), 10) + " " + build
+	return resumePrefix + base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(sign(payload))
+}
+
+// parseResume returns the build and session id a resumption token continues.
+// It fails for anything that isn't a token slurp issued within resume-window.
+func parseResume(token string) (string, string, bool) {
+	if config.ResumeTTL <= 0 || !strings.HasPrefix(token, resumePrefix) {
+		return "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(token, resumePrefix), ".")
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", false
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(mac, sign(string(payload))) {
+		return "", "", false
+	}
+
+	fields := strings.SplitN(string(payload), " ", 3)
+	if len(fields) != 3 {
+		return "", "", false
+	}
+	issued, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || time.Since(time.Unix(issued, 0)) > config.ResumeTTL {
+		return "", "", false
+	}
+	return fields[2], fields[0], true
+}
+
+// sign returns the mac of a token's payload
+func sign(payload string) []byte {
+	mac := hmac.New(sha256.New, resumeKey)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// resumeSession returns the session a reconnected client continues, with its
+// statistics so far, or a new session if it is no longer remembered
+func resumeSession(build, id string) *Session {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, session := range sessions[build] {
+		if session.Id == id {
+			resumed := *session
+			resumed.Parts++
+			resumed.Ended, resumed.Exit, resumed.Stderr, resumed.Error, resumed.Receipt = time.Time{}, 0, "", "", nil
+			return &resumed
+		}
+	}
+	return &Session{Id: newSessionId(), Build: build, Started: time.Now().UTC(), Parts: 1}
+}
@@ -0,0 +1,143 @@
+package ssh
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/mu-box/slurp/bind"
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/webhook"
+)
+
+const (
+	selfCheckTimeout  = 5 * time.Second // time allowed for a self check handshake
+	selfCheckFailures = 3               // failed self checks in a row before restarting the listener
+)
+
+// addresses self checks are connecting from
+var selfChecks = sync.Map{}
+
+// StartSelfCheck handshakes with each ssh listener every interval. If one fails
+// several times in a row it is considered wedged (accepting, but not
+// completing handshakes); an alert is sent and that listener restarted.
+func StartSelfCheck(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		failures := map[string]int{}
+		for range time.Tick(interval) {
+			for _, addr := range bind.Split(config.SshAddr) {
+				selfCheck(addr, failures)
+			}
+		}
+	}()
+}
+
+// selfCheck handshakes with the listener at addr, counting failures in a row
+// and restarting it once it is wedged
+func selfCheck(addr string, failures map[string]int) {
+	err := handshake(addr)
+	if err == nil {
+		failures[addr] = 0
+		return
+	}
+
+	failures[addr]++
+	config.Log.Error("SSH self check at '%s' failed (%d/%d) - %v", addr, failures[addr], selfCheckFailures, err)
+	if failures[addr] < selfCheckFailures {
+		return
+	}
+
+	failures[addr] = 0
+	rerr := restart(addr)
+	if rerr != nil {
+		config.Log.Error("Failed to restart ssh listener at '%s' - %v", addr, rerr)
+	} else {
+		config.Log.Info("Restarted wedged ssh listener at '%s'", addr)
+	}
+
+	data := map[string]interface{}{"addr": addr, "error": err.Error(), "restarted": rerr == nil}
+	webhook.Send(webhook.SshWedged, "", data)
+}
+
+// Handshake completes an ssh handshake with each ssh listener
+func Handshake() error {
+	for _, addr := range bind.Split(config.SshAddr) {
+		err := handshake(addr)
+		if err != nil {
+			return fmt.Errorf("'%s': %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// handshake connects to the ssh listener at addr as a client and completes an
+// ssh handshake. The self check user is unknown, so reaching authentication
+// (and being refused) proves the handshake path works.
+func handshake(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, selfCheckTimeout)
+	if err != nil {
+		return fmt.Errorf("Failed to connect - %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(selfCheckTimeout))
+
+	// keep the expected refusal out of the logs
+	selfChecks.Store(conn.LocalAddr().String(), true)
+	defer selfChecks.Delete(conn.LocalAddr().String())
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("Failed to generate key - %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return fmt.Errorf("Failed to generate key - %v", err)
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:            "slurp-self-check",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         selfCheckTimeout,
+	}
+
+	client, _, _, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err == nil {
+		client.Close()
+		return fmt.Errorf("Self check user was authorized")
+	}
+	if !strings.Contains(err.Error(), "unable to authenticate") {
+		return fmt.Errorf("Failed to handshake - %v", err)
+	}
+
+	return nil
+}
+
+// isSelfCheck reports whether a connection is from a self check
+func isSelfCheck(remote net.Addr) bool {
+	_, ok := selfChecks.Load(remote.String())
+	return ok
+}
+
+// restart replaces the ssh listener at addr, leaving established sessions
+// running
+func restart(addr string) error {
+	server.Lock()
+	sshConfig := server.config
+	server.Unlock()
+
+	if sshConfig == nil {
+		return fmt.Errorf("SSH server not started")
+	}
+	return listen(addr)
+}
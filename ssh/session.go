@@ -0,0 +1,234 @@
+package ssh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+)
+
+const (
+	maxSessions = 10        // sessions remembered per build
+	maxStderr   = 64 * 1024 // bytes of rsync stderr kept per session
+)
+
+// Session is the record of a single rsync session
+type Session struct {
+	Id      string    `json:"id"`              // session id, kept when a client resumes the session
+	Build   string    `json:"build"`           // build synced to
+	Remote  string    `json:"remote"`          // client address (of its latest connection)
+	Started time.Time `json:"started"`         // when rsync started
+	Ended   time.Time `json:"ended,omitempty"` // when rsync exited
+	Args    []string  `json:"args"`            // rsync command line
+	Exit    int       `json:"exit"`            // exit status returned to the client
+	Stderr  string    `json:"stderr,omitempty"`
+	Error   string    `json:"error,omitempty"` // why slurp terminated rsync, eg its deadline passing
+	Parts   int       `json:"parts"`           // rsync runs stitched into the session (more than 1 if the client reconnected)
+
+	Files   int             `json:"files"`             // files written by the session (all its parts)
+	Bytes   int64           `json:"bytes"`             // bytes of the files written
+	Receipt json.RawMessage `json:"receipt,omitempty"` // signed receipt returned to the client
+}
+
+var (
+	// recent sessions keyed by build, guarded by mutex
+	sessions = map[string][]*Session{}
+
+	// issues receipts for successful sessions
+	onReceipt func(session Session) ([]byte, error)
+
+	// describes a build's stage to clients starting a session
+	onMotd func(build string) string
+
+	// tallies what each rsync run wrote to a build
+	onTransfer func(build string, resumed bool, files int, bytes int64)
+)
+
+// OnReceipt sets the function issuing the receipt of a successful rsync
+// session, which is sent to the client (on stderr) and kept with the session.
+// A nil receipt sends none.
+func OnReceipt(fn func(session Session) ([]byte, error)) {
+	mutex.Lock()
+	onReceipt = fn
+	mutex.Unlock()
+}
+
+// receipt issues the receipt of a successful session, if a receipt hook is set
+func receipt(session *Session) ([]byte, error) {
+	mutex.Lock()
+	hook := onReceipt
+	mutex.Unlock()
+
+	if hook == nil {
+		return nil, nil
+	}
+	return hook(*session)
+}
+
+// OnTransfer sets a function called as each rsync run of a session ends,
+// with the files and bytes it wrote and whether it resumed a session
+func OnTransfer(fn func(build string, resumed bool, files int, bytes int64)) {
+	mutex.Lock()
+	onTransfer = fn
+	mutex.Unlock()
+}
+
+// transferred reports what an rsync run wrote, if a transfer hook is set
+func transferred(build string, resumed bool, files int, bytes int64) {
+	mutex.Lock()
+	hook := onTransfer
+	mutex.Unlock()
+
+	if hook != nil {
+		hook(build, resumed, files, bytes)
+	}
+}
+
+// OnMotd sets the function describing a build's stage, which is sent to the
+// client (on stderr) as each rsync session starts, for whoever runs it by hand
+// to see the state of the stage they sync to. An empty message sends none.
+func OnMotd(fn func(build string) string) {
+	mutex.Lock()
+	onMotd = fn
+	mutex.Unlock()
+}
+
+// motd returns the message a session on build starts with, if a motd hook is
+// set
+func motd(build string) string {
+	mutex.Lock()
+	hook := onMotd
+	mutex.Unlock()
+
+	if hook == nil {
+		return ""
+	}
+	return hook(build)
+}
+
+// Sessions returns the most recent rsync sessions for a build
+func Sessions(build string) []Session {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	records := make([]Session, 0, len(sessions[build]))
+	for _, session := range sessions[build] {
+		records = append(records, *session)
+	}
+	return records
+}
+
+// recordSession remembers a session, replacing the record of the session it
+// resumed, or dropping the oldest for the build if needed
+func recordSession(session *Session) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for i, record := range sessions[session.Build] {
+		if record.Id == session.Id {
+			sessions[session.Build][i] = session
+			return
+		}
+	}
+	records := append(sessions[session.Build], session)
+	if len(records) > maxSessions {
+		records = records[len(records)-maxSessions:]
+	}
+	sessions[session.Build] = records
+}
+
+// rsyncArgs generates the rsync server command line for a session, logging
+// the files it receives to logFile. If filter rules are configured they are
+// written to a temporary merge file, which the returned cleanup func removes.
+func rsyncArgs(build string, opts config.Rsync, logFile string) ([]string, func(), error) {
+	args := []string{"rsync", "--server", "-vlogDtprRe.iLsfx", "--delete", "--log-file=" + logFile, "--log-file-format=" + transferFormat}
+	cleanup := func() {}
+
+	if opts.NumericIds {
+		args = append(args, "--numeric-ids")
+	}
+	if opts.Chmod != "" {
+		args = append(args, "--chmod="+opts.Chmod)
+	}
+	timeout, limit := opts.Timeout, opts.BwLimit
+	if timeout <= 0 {
+		timeout = config.Get(&config.RsyncIdle)
+	}
+	if timeout > 0 {
+		args = append(args, fmt.Sprintf("--timeout=%d", timeout))
+	}
+	if limit <= 0 {
+		limit = config.Get(&config.BwLimit)
+	}
+	if limit > 0 {
+		args = append(args, fmt.Sprintf("--bwlimit=%d", limit))
+	}
+
+	if len(opts.Filters) > 0 {
+		file, err := ioutil.TempFile("", "slurp-rsync-*.filter")
+		if err != nil {
+			return nil, cleanup, fmt.Errorf("Failed to create filter file - %v", err)
+		}
+		cleanup = func() { os.Remove(file.Name()) }
+
+		_, err = file.WriteString(strings.Join(opts.Filters, "\n") + "\n")
+		file.Close()
+		if err != nil {
+			cleanup()
+			return nil, func() {}, fmt.Errorf("Failed to write filter file - %v", err)
+		}
+
+		args = append(args, "--filter=merge "+file.Name())
+	}
+
+	return append(args, ".", build+"/"), cleanup, nil
+}
+
+// transferFormat is how rsync logs each file it transfers: the operation, the
+// file's length, and its name
+const transferFormat = "%o %l %n"
+
+// countTransfers counts the files an rsync log file says were received, and
+// their bytes. Lines look like "2006/01/02 15:04:05 [pid] recv 1024 dir/file";
+// directories (ending in "/") aren't counted.
+func countTransfers(log []byte) (int, int64) {
+	files, bytes := 0, int64(0)
+	for _, line := range strings.Split(string(log), "\n") {
+		fields := strings.SplitN(line, " ", 6)
+		if len(fields) < 6 || fields[3] != "recv" || strings.HasSuffix(fields[5], "/") {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			continue
+		}
+		files++
+		bytes += size
+	}
+	return files, bytes
+}
+
+// cappedBuffer keeps the first max bytes written to it
+type cappedBuffer struct {
+	buf []byte
+	max int
+}
+
+func (self *cappedBuffer) Write(p []byte) (int, error) {
+	if room := self.max - len(self.buf); room > 0 {
+		if len(p) > room {
+			self.buf = append(self.buf, p[:room]...)
+		} else {
+			self.buf = append(self.buf, p...)
+		}
+	}
+	return len(p), nil
+}
+
+func (self *cappedBuffer) String() string {
+	return string(self.buf)
+}
@@ -8,19 +8,40 @@ import (
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
 
+	"github.com/mu-box/slurp/bind"
 	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/names"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/trace"
 )
 
+// acceptBackoff is how long to wait after a failed accept
+const acceptBackoff = 100 * time.Millisecond
+
+// the running listeners by address, each replaced if the self check finds it
+// wedged
+var server = struct {
+	sync.Mutex
+	listeners map[string]net.Listener
+	config    *ssh.ServerConfig
+	signer    ssh.Signer // host key, also used to relay syncs to peers
+}{listeners: map[string]net.Listener{}}
+
 // Check for host key, generate and write to a file if none exist
 func initialize() error {
 	// check if key exists
@@ -113,60 +134,167 @@ func Start() error {
 	// add host key
 	sshConfig.AddHostKey(pvtKeySigner)
 
-	// start tcp server
-	serverSocket, err := net.Listen("tcp", config.SshAddr)
-	if err != nil {
-		return fmt.Errorf("Failed to listen for rsync - %v", err)
+	server.Lock()
+	server.config = sshConfig
+	server.signer = pvtKeySigner
+	server.Unlock()
+
+	// start a tcp server per address
+	addrs := bind.Split(config.SshAddr)
+	if len(addrs) == 0 {
+		return fmt.Errorf("No ssh address to listen on")
+	}
+	for _, addr := range addrs {
+		err = listen(addr)
+		if err != nil {
+			return err
+		}
+		config.Log.Info("SSH listening at %v...", addr)
+	}
+
+	return nil
+}
+
+// listen starts accepting connections on an ssh address, replacing its
+// current listener if there is one
+func listen(addr string) error {
+	server.Lock()
+	defer server.Unlock()
+
+	if listener := server.listeners[addr]; listener != nil {
+		listener.Close()
 	}
 
-	config.Log.Info("SSH listening at %v...", config.SshAddr)
+	serverSocket, err := bind.Listen(addr, len(bind.Split(config.SshAddr)) > 1)
+	if err != nil {
+		return fmt.Errorf("Failed to listen for rsync at '%s' - %v", addr, err)
+	}
+	server.listeners[addr] = serverSocket
+	sshConfig := server.config
 
 	// accept connections
 	go func() {
 		for {
 			conn, err := serverSocket.Accept()
 			if err != nil {
-				config.Log.Error("Failed to accept connection - %v", err)
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				// don't spin while out of file descriptors
+				config.Log.Error("Failed to accept connection at '%s' - %v", addr, err)
+				time.Sleep(acceptBackoff)
 				continue
 			}
-			config.Log.Trace("Got connection")
+			config.Log.Trace("Got connection at '%s'", addr)
 			go handleConnection(conn, sshConfig)
 		}
 	}()
 	return nil
 }
 
+// Check connects to each ssh listener and reads the server's version banner,
+// proving the listeners are up and accepting connections
+func Check() error {
+	for _, addr := range bind.Split(config.SshAddr) {
+		err := check(addr)
+		if err != nil {
+			return fmt.Errorf("'%s': %v", addr, err)
+		}
+	}
+	return nil
+}
+
+// check reads the version banner of the ssh listener at addr
+func check(addr string) error {
+	conn, err := net.DialTimeout("tcp", addr, 2*time.Second)
+	if err != nil {
+		return fmt.Errorf("Failed to connect - %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	banner := make([]byte, 8)
+	_, err = io.ReadFull(conn, banner)
+	if err != nil {
+		return fmt.Errorf("Failed to read banner - %v", err)
+	}
+	if string(banner) != "SSH-2.0-" {
+		return fmt.Errorf("Unexpected banner '%s'", banner)
+	}
+
+	return nil
+}
+
 // logAuth logs when a user is attempting to authenticate
 func logAuth(conn ssh.ConnMetadata, method string, err error) {
 	config.Log.Debug("User '%v' connecting from '%v' with '%v' method '%v'", conn.User(), conn.RemoteAddr().String(), string(conn.ClientVersion()), method)
 }
 
-// authenticate connection based on username
+// authenticate connection based on username: a build id, or a resumption
+// token continuing a session on one. Syncs to builds staged on another node
+// of the cluster are relayed to it.
 func userAuth(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 	config.Log.Trace("Attempting to auth user: '%v'", conn.User())
-	// assign a new var here to prevent issues using a user as its deleted
-	for _, permittedUser := range authUsers {
-		if conn.User() == permittedUser {
-			config.Log.Debug("User: '%v' authorized", conn.User())
-			return nil, nil
+	if user, id, ok := parseResume(conn.User()); ok {
+		if _, ok := getUser(user); ok {
+			config.Log.Debug("%sUser: '%v' resuming session '%v'", reqid.Tag(user), user, id)
+			return &ssh.Permissions{Extensions: map[string]string{"build": user, "session": id}}, nil
 		}
 	}
-	config.Log.Error("User: '%v' not found!", conn.User())
+	if user := tokenBuild(conn.User()); user != "" {
+		if addr := relayFor(user); addr != "" {
+			return &ssh.Permissions{Extensions: map[string]string{"build": user, "relay": addr}}, nil
+		}
+		return nil, fmt.Errorf("User not found!")
+	}
+
+	user, err := names.BuildId(conn.User())
+	if err != nil {
+		return nil, fmt.Errorf("Bad user - %v", err)
+	}
+	if _, ok := getUser(user); ok {
+		config.Log.Debug("%sUser: '%v' authorized", reqid.Tag(user), user)
+		return &ssh.Permissions{Extensions: map[string]string{"build": user}}, nil
+	}
+	if addr := relayFor(user); addr != "" {
+		config.Log.Debug("%sUser: '%v' authorized, relaying to '%v'", reqid.Tag(user), user, addr)
+		return &ssh.Permissions{Extensions: map[string]string{"build": user, "relay": addr}}, nil
+	}
+	if !isSelfCheck(conn.RemoteAddr()) {
+		config.Log.Error("User: '%v' not found!", conn.User())
+	}
 	return nil, fmt.Errorf("User not found!")
 }
 
 // handle tcp connection
 func handleConnection(conn net.Conn, sshConfig *ssh.ServerConfig) {
-	config.Log.Trace("Authorized users - %v", authUsers)
+	// don't let slow or half-open clients hold the connection mid-handshake
+	if config.SshTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.SshTimeout))
+	}
+
 	sshConn, chans, reqs, err := ssh.NewServerConn(conn, sshConfig)
 	if err != nil {
-		config.Log.Error("Failed to handshake - %v", err)
+		// self checks are refused on purpose
+		if !isSelfCheck(conn.RemoteAddr()) {
+			config.Log.Error("Failed to handshake - %v", err)
+		}
 		return
 	}
 	config.Log.Debug("Handshake successful")
 
+	// syncs may idle for as long as rsync allows
+	conn.SetDeadline(time.Time{})
+
 	defer sshConn.Close()
 
+	// auth already validated the user (and the session it resumes)
+	build, resume := sshConn.Permissions.Extensions["build"], sshConn.Permissions.Extensions["session"]
+	if addr := sshConn.Permissions.Extensions["relay"]; addr != "" {
+		relay(sshConn.User(), build, addr, chans, reqs)
+		return
+	}
+
 	// service incoming request channel
 	go ssh.DiscardRequests(reqs)
 
@@ -176,12 +304,12 @@ func handleConnection(conn net.Conn, sshConfig *ssh.ServerConfig) {
 			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
 			continue
 		}
-		handleChannel(newChannel, sshConn.Conn.User())
+		handleChannel(newChannel, build, resume, sshConn.RemoteAddr().String())
 	}
 }
 
 // handle ssh connections
-func handleChannel(newChannel ssh.NewChannel, build string) {
+func handleChannel(newChannel ssh.NewChannel, build, resume, remote string) {
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		config.Log.Error("Failed to accept channel request - %v", err)
@@ -201,7 +329,7 @@ func handleChannel(newChannel ssh.NewChannel, build string) {
 					continue // todo: or break?
 				}
 
-				waitedRun(channel, build)
+				waitedRun(channel, build, resume, remote)
 			case "env":
 				ok = true
 			}
@@ -210,21 +338,95 @@ func handleChannel(newChannel ssh.NewChannel, build string) {
 	}(requests)
 }
 
-// run command (rsync server)
-func waitedRun(channel ssh.Channel, build string) {
+// run command (rsync server), continuing the session resume if set
+func waitedRun(channel ssh.Channel, build, resume, remote string) {
 	defer channel.Close()
 
-	config.Log.Trace("Build: '%v'", build)
-	cmd := exec.Command("rsync", "--server", "-vlogDtprRe.iLsfx", "--delete", ".", build+"/")
+	// the build may have been locked for a commit since the client connected
+	opts, ok := startSync(build)
+	if !ok {
+		config.Log.Debug("%sRefusing rsync for build '%v', it is being committed", reqid.Tag(build), build)
+		fmt.Fprintf(channel.Stderr(), "Build '%s' is being committed\n", build)
+		channel.SendRequest("exit-status", true, []byte{0, 0, 0, 1})
+		return
+	}
+	var proc *os.Process
+	defer func() {
+		endSync(build, proc)
+	}()
+
+	err := prepareSync(build)
+	if err != nil {
+		config.Log.Error("%sFailed to prepare rsync - %v", reqid.Tag(build), err)
+		channel.SendRequest("exit-status", true, []byte{0, 0, 0, 2})
+		return
+	}
+
+	// rsync logs the files it receives, for the session's receipt
+	logFile, err := ioutil.TempFile("", "slurp-rsync-*.log")
+	if err != nil {
+		config.Log.Error("%sFailed to prepare rsync - %v", reqid.Tag(build), err)
+		channel.SendRequest("exit-status", true, []byte{0, 0, 0, 2})
+		return
+	}
+	logFile.Close()
+	defer os.Remove(logFile.Name())
+
+	args, cleanup, err := rsyncArgs(build, opts, logFile.Name())
+	defer cleanup()
+	if err != nil {
+		config.Log.Error("%sFailed to prepare rsync - %v", reqid.Tag(build), err)
+		channel.SendRequest("exit-status", true, []byte{0, 0, 0, 2})
+		return
+	}
+
+	session := &Session{Id: newSessionId(), Build: build, Started: time.Now().UTC(), Parts: 1}
+	if resume != "" {
+		session = resumeSession(build, resume)
+	}
+	session.Remote, session.Args = remote, args
+	stderr := &cappedBuffer{max: maxStderr}
+	span := trace.Start("rsync", trace.KindServer, trace.Build(build))
+	defer func() {
+		if session.Ended.IsZero() {
+			session.Ended = time.Now().UTC()
+		}
+		session.Stderr = stderr.String()
+		recordSession(session)
+
+		span.Set("slurp.build", build)
+		span.Set("net.peer.name", remote)
+		span.Set("slurp.files", session.Files)
+		span.Set("slurp.bytes", session.Bytes)
+		span.Set("slurp.exit", session.Exit)
+		var err error
+		if session.Exit != 0 {
+			err = fmt.Errorf("rsync exited %d", session.Exit)
+		}
+		span.Finish(err)
+	}()
+
+	// tell whoever runs the sync the state of the stage, then how a client
+	// that loses its connection can reconnect (with the token as its ssh user)
+	// to continue the session
+	if msg := motd(build); msg != "" {
+		fmt.Fprint(channel.Stderr(), msg)
+	}
+	if token := resumeToken(build, session.Id); token != "" {
+		fmt.Fprintf(channel.Stderr(), "slurp-resume: %s\n", token)
+	}
+
+	config.Log.Debug("%sStarting rsync for build '%v' (session '%v', part %d)", reqid.Tag(build), build, session.Id, session.Parts)
+	cmd := exec.Command(args[0], args[1:]...)
 	cmd.Dir = config.BuildDir
 
-	// connect stdin/out to the ssh pipe
+	// connect stdin/out to the ssh pipe, keeping a copy of stderr for the session
 	cmd.Stdin = channel
 	cmd.Stdout = channel
-	cmd.Stderr = channel.Stderr()
+	cmd.Stderr = io.MultiWriter(channel.Stderr(), stderr)
 
 	// start running the command
-	err := cmd.Start()
+	err = cmd.Start()
 	if err != nil || cmd.Process == nil {
 		config.Log.Fatal("Failed to run command - %v", err)
 		return
@@ -232,6 +434,26 @@ func waitedRun(channel ssh.Channel, build string) {
 
 	config.Log.Trace("PID: %v\n", cmd.Process.Pid)
 
+	// the stage may have been aborted while rsync started
+	proc = cmd.Process
+	if !trackSync(build, proc) {
+		proc.Kill()
+	}
+
+	// a stuck transfer is terminated at its deadline rather than lingering
+	deadline := opts.Deadline
+	if deadline <= 0 {
+		deadline = config.Get(&config.RsyncMax)
+	}
+	var expired int32
+	if deadline > 0 {
+		timer := time.AfterFunc(deadline, func() {
+			atomic.StoreInt32(&expired, 1)
+			proc.Kill()
+		})
+		defer timer.Stop()
+	}
+
 	// using cmd.Wait(), the PID gets killed, but it gets stuck on a c.goroutine (the stdin io.Copy() one)
 	// and doesn't return, hence the implementation.
 	state, err := cmd.Process.Wait()
@@ -251,13 +473,43 @@ func waitedRun(channel ssh.Channel, build string) {
 		if status != "0" {
 			// exit 1
 			exitStatusBuffer = []byte{0, 0, 0, 1}
+			session.Exit = 1
 		}
 	} else {
 		// exit 2
 		exitStatusBuffer = []byte{0, 0, 0, 2}
+		session.Exit = 2
+	}
+	if atomic.LoadInt32(&expired) == 1 {
+		session.Error = fmt.Sprintf("Transfer exceeded its %s deadline", deadline)
+		config.Log.Error("%sTerminated rsync for build '%v' (session '%v') - %v", reqid.Tag(build), build, session.Id, session.Error)
+		fmt.Fprintf(channel.Stderr(), "slurp: %s, terminated\n", session.Error)
+		exitStatusBuffer = []byte{0, 0, 0, 1}
+		session.Exit = 1
+	}
+
+	// confirm what a successful session wrote with a signed receipt
+	var files int
+	var bytes int64
+	if log, err := ioutil.ReadFile(logFile.Name()); err == nil {
+		files, bytes = countTransfers(log)
+		session.Files += files
+		session.Bytes += bytes
+	}
+	transferred(build, resume != "", files, bytes)
+	if session.Exit == 0 {
+		session.Ended = time.Now().UTC()
+		signed, err := receipt(session)
+		if err != nil {
+			config.Log.Error("%sFailed to issue receipt for build '%v' - %v", reqid.Tag(build), build, err)
+		}
+		if signed != nil {
+			session.Receipt = signed
+			fmt.Fprintf(channel.Stderr(), "slurp-receipt: %s\n", signed)
+		}
 	}
 
 	// return exit status to client
 	channel.SendRequest("exit-status", true, exitStatusBuffer)
-	config.Log.Trace("Command's exit-status returned")
+	config.Log.Debug("%sRsync for build '%v' exited - %v", reqid.Tag(build), build, state)
 }
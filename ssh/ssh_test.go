@@ -1,13 +1,17 @@
 package ssh_test
 
 import (
+	"crypto/ed25519"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jcelliott/lumber"
+	gossh "golang.org/x/crypto/ssh"
 
 	"github.com/mu-box/slurp/config"
 	"github.com/mu-box/slurp/ssh"
@@ -37,7 +41,7 @@ func TestMain(m *testing.M) {
 }
 
 func TestAddUser(t *testing.T) {
-	err := ssh.AddUser("sshTest")
+	err := ssh.AddUser("sshTest", config.Rsync{})
 	if err != nil {
 		t.Error(err)
 	}
@@ -73,6 +77,91 @@ func TestCommitStage(t *testing.T) {
 	}
 }
 
+func TestHandshake(t *testing.T) {
+	err := ssh.Handshake()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLockUser(t *testing.T) {
+	err := ssh.AddUser("lockTest", config.Rsync{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// a running session keeps the lock from being taken (an rsync reading
+	// until the client hangs up stands in for a sync)
+	bin := t.TempDir()
+	err = os.WriteFile(bin+"/rsync", []byte("#!/bin/sh\ncat >/dev/null\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+	os.MkdirAll(config.BuildDir+"lockTest", 0755)
+	release, err := hold("lockTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ssh.LockUser("lockTest")
+	release()
+	if err != ssh.ErrSyncing {
+		t.Errorf("Expected %v locking a syncing user, got %v", ssh.ErrSyncing, err)
+	}
+	for i := 0; i < 50 && ssh.Running()["lockTest"] > 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// no sessions running, the lock is taken
+	err = ssh.LockUser("lockTest")
+	if err != nil {
+		t.Errorf("Failed to lock idle user - %v", err)
+	}
+
+	// and new sessions are refused
+	_, err = run("lockTest")
+	if err == nil {
+		t.Error("Expected a session of a locked user to be refused")
+	}
+}
+
+func TestResume(t *testing.T) {
+	err := ssh.AddUser("resumeTest", config.Rsync{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// the session's first run sends a token (whether rsync runs or not)
+	stderr, err := run("resumeTest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := ""
+	for _, line := range strings.Split(stderr, "\n") {
+		if strings.HasPrefix(line, "slurp-resume: ") {
+			token = strings.TrimPrefix(line, "slurp-resume: ")
+		}
+	}
+	if token == "" {
+		t.Fatalf("No resumption token in %q", stderr)
+	}
+
+	// reconnecting with it continues the session
+	_, err = run(token)
+	if err != nil {
+		t.Fatalf("Failed to resume with the token - %v", err)
+	}
+	sessions := ssh.Sessions("resumeTest")
+	if len(sessions) != 1 || sessions[0].Parts != 2 {
+		t.Errorf("Expected one session of 2 parts - %+v", sessions)
+	}
+
+	// a forged one is refused
+	if _, err = run(token[:len(token)-2] + "AA"); err == nil {
+		t.Errorf("Expected a forged token to be refused")
+	}
+}
+
 func TestDelUser(t *testing.T) {
 	err := ssh.DelUser("sshTest")
 	if err != nil {
@@ -84,6 +173,70 @@ func TestDelUser(t *testing.T) {
 // PRIVS
 ////////////////////////////////////////////////////////////////////////////////
 
+// run connects to the ssh server as user and runs rsync, returning its stderr
+func run(user string) (string, error) {
+	signer, err := gossh.NewSignerFromKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	if err != nil {
+		return "", err
+	}
+	client, err := gossh.Dial("tcp", "127.0.0.1:1567", &gossh.ClientConfig{
+		User:            user,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	// the exec request is answered once rsync exits, so read stderr directly
+	stderr, err := session.StderrPipe()
+	if err != nil {
+		return "", err
+	}
+	session.Run("rsync --server")
+	out, err := ioutil.ReadAll(stderr)
+	return string(out), err
+}
+
+// hold starts an rsync session for user that runs until released
+func hold(user string) (func(), error) {
+	signer, err := gossh.NewSignerFromKey(ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize)))
+	if err != nil {
+		return nil, err
+	}
+	client, err := gossh.Dial("tcp", "127.0.0.1:1567", &gossh.ClientConfig{
+		User:            user,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(signer)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := client.NewSession()
+	if err == nil {
+		_, err = session.StdinPipe()
+	}
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	// the exec request is answered once rsync exits, so don't wait on it
+	go session.Run("rsync --server")
+	for i := 0; i < 50 && ssh.Running()[user] == 0; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	return func() { client.Close() }, nil
+}
+
 // manually configure and start internals
 func initialize() {
 	config.BuildDir = "/tmp/slurpSsh/"
@@ -1,40 +1,205 @@
 package ssh
 
 import (
+	"errors"
+	"os"
 	"sync"
 
 	"github.com/mu-box/slurp/config"
 )
 
 var (
-	// copy of all non-committed users
-	authUsers []string
+	// copy of all non-committed users and the rsync settings for their sessions
+	authUsers = map[string]config.Rsync{}
+
+	// number of rsync sessions running for each user
+	syncing = map[string]int{}
+
+	// rsync processes running for each user
+	procs = map[string]map[*os.Process]bool{}
 
 	// mutex ensures updates to authUsers are atomic
 	mutex = sync.Mutex{}
+
+	// called once a user's last running rsync session ends
+	onSynced func(user string)
+
+	// called as each rsync session of a user starts, before it writes
+	onSync func(user string) error
+
+	// held while a user's session runs onSync, so a second session doesn't
+	// start writing before the first is ready
+	preparing = map[string]*sync.Mutex{}
 )
 
-// Add an authorized user
-func AddUser(user string) error {
+// ErrSyncing is returned when locking a user with an rsync session running
+var ErrSyncing = errors.New("Sync in progress")
+
+// Add an authorized user, syncing with the given rsync settings
+func AddUser(user string, opts config.Rsync) error {
 	config.Log.Trace("Adding user %v", user)
 	mutex.Lock()
-	authUsers = append(authUsers, user)
+	authUsers[user] = opts
 	mutex.Unlock()
 
 	return nil
 }
 
+// UpdateUser changes the rsync settings of an authorized user, applied to
+// its next session. Users that aren't authorized (eg locked) are left alone.
+func UpdateUser(user string, opts config.Rsync) {
+	mutex.Lock()
+	if _, ok := authUsers[user]; ok {
+		authUsers[user] = opts
+	}
+	mutex.Unlock()
+}
+
 // Remove an authorized user
 func DelUser(user string) error {
 	config.Log.Trace("Removing user %v", user)
 	mutex.Lock()
-	for i := range authUsers {
-		if authUsers[i] == user {
-			authUsers = append(authUsers[:i], authUsers[i+1:]...)
-			break
+	delete(authUsers, user)
+	delete(sessions, user)
+	mutex.Unlock()
+
+	return nil
+}
+
+// getUser returns the rsync settings for an authorized user
+func getUser(user string) (config.Rsync, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	opts, ok := authUsers[user]
+	return opts, ok
+}
+
+// LockUser removes an authorized user so its build can be committed, failing
+// if an rsync session for it is still running. Sessions can't start once the
+// user is locked, so the build can't change while it is packaged.
+func LockUser(user string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if syncing[user] > 0 {
+		return ErrSyncing
+	}
+	config.Log.Trace("Locking user %v", user)
+	delete(authUsers, user)
+	return nil
+}
+
+// Running returns the number of rsync sessions running for each build
+func Running() map[string]int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	running := make(map[string]int, len(syncing))
+	for user, n := range syncing {
+		running[user] = n
+	}
+	return running
+}
+
+// startSync marks an rsync session running for a user, returning its rsync
+// settings. It fails if the user was locked (or removed) since it connected.
+func startSync(user string) (config.Rsync, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	opts, ok := authUsers[user]
+	if ok {
+		syncing[user]++
+		if preparing[user] == nil {
+			preparing[user] = &sync.Mutex{}
 		}
 	}
+	return opts, ok
+}
+
+// prepareSync runs the sync hook for a starting session, if one is set, one
+// session of a user at a time
+func prepareSync(user string) error {
+	mutex.Lock()
+	hook, lock := onSync, preparing[user]
+	mutex.Unlock()
+
+	if hook == nil || lock == nil {
+		return nil
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	return hook(user)
+}
+
+// trackSync remembers a session's rsync process so it can be terminated. It
+// reports false if the user was aborted while rsync started.
+func trackSync(user string, proc *os.Process) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := authUsers[user]; !ok {
+		return false
+	}
+	if procs[user] == nil {
+		procs[user] = map[*os.Process]bool{}
+	}
+	procs[user][proc] = true
+	return true
+}
+
+// endSync marks an rsync session for a user finished
+func endSync(user string, proc *os.Process) {
+	mutex.Lock()
+	syncing[user]--
+	idle := syncing[user] <= 0
+	if idle {
+		delete(syncing, user)
+		delete(preparing, user)
+	}
+	delete(procs[user], proc)
+	if len(procs[user]) == 0 {
+		delete(procs, user)
+	}
+	hook := onSynced
 	mutex.Unlock()
 
-	return nil
+	if idle && hook != nil {
+		go hook(user)
+	}
+}
+
+// OnSynced sets a function called (in the background) whenever the last
+// running rsync session of a user ends
+func OnSynced(fn func(user string)) {
+	mutex.Lock()
+	onSynced = fn
+	mutex.Unlock()
+}
+
+// OnSync sets a function called as each rsync session of a user starts,
+// before rsync writes to its files. A session it fails is refused.
+func OnSync(fn func(user string) error) {
+	mutex.Lock()
+	onSync = fn
+	mutex.Unlock()
+}
+
+// Idle reports whether a user is authorized (not locked) with no rsync
+// session running
+func Idle(user string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	_, ok := authUsers[user]
+	return ok && syncing[user] == 0
+}
+
+// AbortUser removes an authorized user and terminates its running rsync
+// sessions, keeping their session records. It returns how many were
+// terminated.
+func AbortUser(user string) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config.Log.Trace("Aborting user %v", user)
+	delete(authUsers, user)
+	for proc := range procs[user] {
+		proc.Kill()
+	}
+	return len(procs[user])
 }
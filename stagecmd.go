@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// stageCmd groups the clients of a running slurp's stage api
+	stageCmd = &cobra.Command{
+		Use:   "stage",
+		Short: "Manage the stages of a running slurp (at api-address, with api-token)",
+	}
+
+	// stageAdd stages a new build
+	stageAdd = &cobra.Command{
+		Use:   "add <id>",
+		Short: "Stage a new build, printing the secret to sync it with",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runStageAdd,
+	}
+
+	// stageCommit commits a staged build
+	stageCommit = &cobra.Command{
+		Use:   "commit <id>",
+		Short: "Commit a staged build to storage (waits for the commit)",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runStageCommit,
+	}
+
+	// stageDelete deletes a staged build
+	stageDelete = &cobra.Command{
+		Use:   "delete <id>",
+		Short: "Delete a staged build without committing it",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runStageDelete,
+	}
+
+	// stageList lists the uncommitted stages
+	stageList = &cobra.Command{
+		Use:   "list",
+		Short: "List the uncommitted stages",
+		Args:  cobra.NoArgs,
+		RunE:  runStageList,
+	}
+
+	// stageStatus shows a stage
+	stageStatus = &cobra.Command{
+		Use:   "status <id>",
+		Short: "Show a stage, or the outcome of its commit once committed",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runStageStatus,
+	}
+
+	// credential owning the stage
+	stageOwner string
+
+	// options of a new stage
+	stageFrom     string
+	stageTemplate string
+	stageFormat   string
+	stageTTL      time.Duration
+	stageLabels   map[string]string
+	stageNotes    string
+
+	// print the stage list as json
+	listJson bool
+)
+
+func init() {
+	stageCmd.PersistentFlags().StringVar(&stageOwner, "owner", "", "Credential owning the stage (set when adding it, sent as X-STAGE-OWNER otherwise)")
+	stageAdd.Flags().StringVar(&stageFrom, "from", "", "Committed build to seed the stage with, so only the differences are synced")
+	stageAdd.Flags().StringVar(&stageTemplate, "template", "", "Stage template to use")
+	stageAdd.Flags().StringVar(&stageFormat, "format", "", "Archive format to commit with (defaults to the template's, then archive-format)")
+	stageAdd.Flags().DurationVar(&stageTTL, "ttl", 0, "Time the stage may live uncommitted (0 uses the template's, then stage-ttl)")
+	stageAdd.Flags().StringToStringVar(&stageLabels, "label", nil, "Label for the stage, eg branch=main (repeatable)")
+	stageAdd.Flags().StringVar(&stageNotes, "notes", "", "Release notes to commit the build with")
+	stageCommit.Flags().StringVar(&stageNotes, "notes", "", "Release notes replacing the stage's")
+	stageList.Flags().BoolVar(&listJson, "json", false, "Print the stages as json")
+	stageCmd.AddCommand(stageAdd, stageCommit, stageDelete, stageList, stageStatus)
+	slurp.AddCommand(stageCmd)
+}
+
+func runStageAdd(ccmd *cobra.Command, args []string) error {
+	stage := map[string]interface{}{"new-id": args[0]}
+	for key, value := range map[string]string{"from": stageFrom, "template": stageTemplate, "format": stageFormat, "owner": stageOwner, "notes": stageNotes} {
+		if value != "" {
+			stage[key] = value
+		}
+	}
+	if stageTTL > 0 {
+		stage["ttl"] = stageTTL.String()
+	}
+	if len(stageLabels) > 0 {
+		stage["metadata"] = stageLabels
+	}
+	body, err := json.Marshal(stage)
+	if err != nil {
+		return err
+	}
+
+	res, err := apiRequest("POST", "/stages", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	return printJson(res)
+}
+
+func runStageCommit(ccmd *cobra.Command, args []string) error {
+	var body []byte
+	if ccmd.Flags().Changed("notes") {
+		var err error
+		body, err = json.Marshal(map[string]string{"notes": stageNotes})
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := apiRequestHeader("PUT", stagePath(args[0]), bytes.NewReader(body), ownerHeader())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Committed '%s'\n", args[0])
+	return nil
+}
+
+func runStageDelete(ccmd *cobra.Command, args []string) error {
+	_, err := apiRequestHeader("DELETE", stagePath(args[0]), nil, ownerHeader())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Deleted '%s'\n", args[0])
+	return nil
+}
+
+func runStageList(ccmd *cobra.Command, args []string) error {
+	res, err := apiRequest("GET", "/stages", nil)
+	if err != nil {
+		return err
+	}
+	if listJson {
+		return printJson(res)
+	}
+
+	var stages []struct {
+		Id       string    `json:"id"`
+		Template string    `json:"template"`
+		State    string    `json:"state"`
+		Created  time.Time `json:"created"`
+		Expires  time.Time `json:"expires"`
+		Node     string    `json:"node"`
+	}
+	err = json.Unmarshal(res, &stages)
+	if err != nil {
+		return fmt.Errorf("Failed to parse stages - %v", err)
+	}
+
+	out := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(out, "ID\tSTATE\tTEMPLATE\tCREATED\tEXPIRES\tNODE")
+	for _, stage := range stages {
+		expires := "-"
+		if !stage.Expires.IsZero() {
+			expires = stage.Expires.Local().Format(time.RFC3339)
+		}
+		fmt.Fprintf(out, "%s\t%s\t%s\t%s\t%s\t%s\n", stage.Id, stage.State, orDash(stage.Template), stage.Created.Local().Format(time.RFC3339), expires, orDash(stage.Node))
+	}
+	return out.Flush()
+}
+
+func runStageStatus(ccmd *cobra.Command, args []string) error {
+	res, err := apiRequest("GET", stagePath(args[0]), nil)
+	if err != nil {
+		// committed stages are gone, but their commit is remembered
+		if commit, cerr := apiRequest("GET", stagePath(args[0])+"/commit", nil); cerr == nil {
+			return printJson(commit)
+		}
+		return err
+	}
+	return printJson(res)
+}
+
+// stagePath returns the api path of a stage
+func stagePath(id string) string {
+	return "/stages/" + url.PathEscape(id)
+}
+
+// ownerHeader returns the header carrying the owner credential, if one was
+// given
+func ownerHeader() http.Header {
+	if stageOwner == "" {
+		return nil
+	}
+	return http.Header{"X-Stage-Owner": {stageOwner}}
+}
+
+// printJson prints a json response indented
+func printJson(raw []byte) error {
+	out := &bytes.Buffer{}
+	err := json.Indent(out, bytes.TrimSpace(raw), "", "  ")
+	if err != nil {
+		_, err = os.Stdout.Write(raw)
+		return err
+	}
+	out.WriteByte('\n')
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
+// orDash returns s, or "-" if it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"github.com/mu-box/slurp/bind"
+	"github.com/mu-box/slurp/config"
+	core "github.com/mu-box/slurp/core"
+)
+
+var (
+	// exportState writes a snapshot of a running slurp's state
+	exportState = &cobra.Command{
+		Use:   "export-state [file]",
+		Short: "Export stage registry and metadata (not blob contents) from a running slurp",
+		Args:  cobra.MaximumNArgs(1),
+		RunE:  runExportState,
+	}
+
+	// exportKeys includes the signing keys' private halves in an export
+	exportKeys bool
+
+	// importState loads a snapshot into a running slurp
+	importState = &cobra.Command{
+		Use:   "import-state <file>",
+		Short: "Import a state snapshot into a running slurp",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runImportState,
+	}
+)
+
+func init() {
+	exportState.Flags().BoolVar(&exportKeys, "keys", false, "Include the signing keys' private halves (run on slurp's host, reading the export secret from data-dir)")
+	slurp.AddCommand(exportState, importState)
+}
+
+func runExportState(ccmd *cobra.Command, args []string) error {
+	path, header := "/admin/state", http.Header{}
+	if exportKeys {
+		secret, err := core.ReadExportSecret()
+		if err != nil {
+			return err
+		}
+		path += "?keys=true"
+		header.Set("X-SLURP-EXPORT-SECRET", secret)
+	}
+	state, err := apiRequestHeader("GET", path, nil, header)
+	if err != nil {
+		return err
+	}
+
+	// default to stdout
+	if len(args) == 0 {
+		_, err = os.Stdout.Write(state)
+		return err
+	}
+
+	return ioutil.WriteFile(args[0], state, 0600)
+}
+
+func runImportState(ccmd *cobra.Command, args []string) error {
+	state, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return fmt.Errorf("Failed to read state file - %v", err)
+	}
+
+	_, err = apiRequest("PUT", "/admin/state", bytes.NewReader(state))
+	return err
+}
+
+// apiRequest calls the api of a running slurp and returns the response body
+func apiRequest(method, path string, body io.Reader) ([]byte, error) {
+	return apiRequestHeader(method, path, body, nil)
+}
+
+// apiRequestHeader is apiRequest with extra request headers
+func apiRequestHeader(method, path string, body io.Reader, header http.Header) ([]byte, error) {
+	// any of the api's addresses will do
+	addrs := bind.Split(config.ApiAddress)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("Missing 'api-address'")
+	}
+	req, err := http.NewRequest(method, addrs[0]+path, body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Add("X-AUTH-TOKEN", config.Get(&config.ApiToken))
+
+	// slurp generates a self-signed cert
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: config.Insecure},
+	}}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to reach slurp - %v", err)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read response - %v", err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s failed (%d) - %s", method, path, res.StatusCode, bytes.TrimSpace(b))
+	}
+
+	return b, nil
+}
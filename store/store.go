@@ -0,0 +1,133 @@
+// Package "store" persists slurp's state (stages, cooldowns...) in an embedded
+// bolt database so it survives restarts. Records are stored as json in named
+// buckets. Until Open is called every operation is a no-op.
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	db    *bolt.DB     // the open database, nil if persistence is disabled
+	mutex sync.RWMutex // guards db
+)
+
+// Open opens (creating if needed) the database at path
+func Open(path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return fmt.Errorf("Failed to create data dir - %v", err)
+	}
+
+	d, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("Failed to open database - %v", err)
+	}
+
+	mutex.Lock()
+	db = d
+	mutex.Unlock()
+	return nil
+}
+
+// Close closes the database, disabling persistence
+func Close() error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if db == nil {
+		return nil
+	}
+	err := db.Close()
+	db = nil
+	return err
+}
+
+// Put stores v as json under key in bucket
+func Put(bucket, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if db == nil {
+		return nil
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return bkt.Put([]byte(key), b)
+	})
+}
+
+// Get loads the json stored under key in bucket into v. It reports whether
+// the key was found.
+func Get(bucket, key string, v interface{}) (bool, error) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if db == nil {
+		return false, nil
+	}
+
+	found := false
+	err := db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		b := bkt.Get([]byte(key))
+		if b == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(b, v)
+	})
+	return found, err
+}
+
+// Delete removes key from bucket
+func Delete(bucket, key string) error {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if db == nil {
+		return nil
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.Delete([]byte(key))
+	})
+}
+
+// Each calls fn with every key and its raw json in bucket
+func Each(bucket string, fn func(key string, raw []byte) error) error {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if db == nil {
+		return nil
+	}
+
+	return db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(bucket))
+		if bkt == nil {
+			return nil
+		}
+		return bkt.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
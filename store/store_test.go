@@ -0,0 +1,71 @@
+package store_test
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/mu-box/slurp/store"
+)
+
+type record struct {
+	Name string `json:"name"`
+}
+
+func TestMain(m *testing.M) {
+	// clean test dir
+	os.RemoveAll("/tmp/slurpStore")
+
+	err := store.Open("/tmp/slurpStore/slurp.db")
+	if err != nil {
+		panic(err)
+	}
+
+	rtn := m.Run()
+
+	store.Close()
+	os.RemoveAll("/tmp/slurpStore")
+
+	os.Exit(rtn)
+}
+
+func TestPutGet(t *testing.T) {
+	err := store.Put("things", "a", record{"first"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var r record
+	found, err := store.Get("things", "a", &r)
+	if err != nil || !found {
+		t.Errorf("Failed to get record - %v", err)
+	}
+	if r.Name != "first" {
+		t.Errorf("%q doesn't match expected out", r.Name)
+	}
+
+	found, _ = store.Get("things", "missing", &r)
+	if found {
+		t.Error("Found missing record")
+	}
+}
+
+func TestEachDelete(t *testing.T) {
+	store.Put("each", "a", record{"a"})
+	store.Put("each", "b", record{"b"})
+	store.Delete("each", "a")
+
+	var names []string
+	err := store.Each("each", func(key string, raw []byte) error {
+		var r record
+		err := json.Unmarshal(raw, &r)
+		names = append(names, r.Name)
+		return err
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(names) != 1 || names[0] != "b" {
+		t.Errorf("%v doesn't match expected out", names)
+	}
+}
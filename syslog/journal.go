@@ -0,0 +1,53 @@
+package syslog
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// JournalSocket is systemd-journald's native protocol socket
+const JournalSocket = "/run/systemd/journal/socket"
+
+// NewJournal creates a logger sending entries at or above level to journald
+// on socket, with their PRIORITY set from the level
+func NewJournal(socket string, level int) (*Logger, error) {
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to journald - %v", err)
+	}
+	return newLogger(&journalSink{conn: conn}, level), nil
+}
+
+// journalSink sends entries as journald's native KEY=value fields
+type journalSink struct {
+	conn net.Conn
+}
+
+func (self *journalSink) send(severity int, msg string) error {
+	entry := &bytes.Buffer{}
+	field(entry, "MESSAGE", msg)
+	field(entry, "PRIORITY", strconv.Itoa(severity))
+	field(entry, "SYSLOG_IDENTIFIER", "slurp")
+	_, err := self.conn.Write(entry.Bytes())
+	return err
+}
+
+func (self *journalSink) close() error {
+	return self.conn.Close()
+}
+
+// field writes KEY=value, or for values with newlines KEY, then the value's
+// little endian 64 bit length and the value
+func field(entry *bytes.Buffer, key, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(entry, "%s=%s\n", key, value)
+		return
+	}
+	entry.WriteString(key + "\n")
+	binary.Write(entry, binary.LittleEndian, uint64(len(value)))
+	entry.WriteString(value + "\n")
+}
@@ -0,0 +1,231 @@
+// Package "syslog" is a lumber logger sending lines to the system logger:
+// syslog (RFC 5424, over the local socket or to a remote udp/tcp server) or
+// systemd-journald's native protocol, with lumber levels mapped to their
+// priorities.
+package syslog
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcelliott/lumber"
+)
+
+// local syslog sockets, tried in order
+var sockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// facilities by name
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Severity maps a lumber level to a syslog severity (which journald's
+// PRIORITY shares)
+func Severity(level int) int {
+	switch level {
+	case lumber.FATAL:
+		return 2 // crit
+	case lumber.ERROR:
+		return 3 // err
+	case lumber.WARN:
+		return 4 // warning
+	case lumber.INFO:
+		return 6 // info
+	}
+	return 7 // debug
+}
+
+// Facility returns the code of a facility name, eg daemon or local0
+func Facility(name string) (int, error) {
+	code, ok := facilities[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("Unknown facility '%s'", name)
+	}
+	return code, nil
+}
+
+// sink delivers a line at a severity
+type sink interface {
+	send(severity int, msg string) error
+	close() error
+}
+
+// Logger sends lines to a sink. It embeds a console logger for lumber's level
+// handling (which only writes the record of Close).
+type Logger struct {
+	lumber.Logger
+	sink sink
+	lock sync.Mutex
+}
+
+// New creates a logger sending RFC 5424 messages at or above level to addr
+// (udp://host:514, tcp://host:601, or unix:///dev/log), or the local syslog
+// socket if addr is empty
+func New(addr, facility string, level int) (*Logger, error) {
+	code, err := Facility(facility)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	self := &syslogSink{addr: addr, facility: code, host: host, pid: os.Getpid()}
+	err = self.connect()
+	if err != nil {
+		return nil, err
+	}
+	return newLogger(self, level), nil
+}
+
+func newLogger(sink sink, level int) *Logger {
+	return &Logger{Logger: lumber.NewBasicLogger(nopCloser{}, level), sink: sink}
+}
+
+func (self *Logger) Fatal(format string, v ...interface{}) { self.log(lumber.FATAL, format, v...) }
+func (self *Logger) Error(format string, v ...interface{}) { self.log(lumber.ERROR, format, v...) }
+func (self *Logger) Warn(format string, v ...interface{})  { self.log(lumber.WARN, format, v...) }
+func (self *Logger) Info(format string, v ...interface{})  { self.log(lumber.INFO, format, v...) }
+func (self *Logger) Debug(format string, v ...interface{}) { self.log(lumber.DEBUG, format, v...) }
+func (self *Logger) Trace(format string, v ...interface{}) { self.log(lumber.TRACE, format, v...) }
+
+// Print sends a line regardless of the level, as lumber's loggers do
+func (self *Logger) Print(level int, v ...interface{}) {
+	self.write(level, fmt.Sprint(v...))
+}
+
+// Printf sends a line regardless of the level, as lumber's loggers do
+func (self *Logger) Printf(level int, format string, v ...interface{}) {
+	self.write(level, fmt.Sprintf(format, v...))
+}
+
+// Close closes the connection to the system logger
+func (self *Logger) Close() {
+	self.lock.Lock()
+	self.sink.close()
+	self.lock.Unlock()
+}
+
+func (self *Logger) log(level int, format string, v ...interface{}) {
+	if level < self.GetLevel() {
+		return
+	}
+	self.write(level, fmt.Sprintf(format, v...))
+}
+
+// write sends msg, falling back to stderr if the system logger can't be
+// reached (there is nowhere else to report it)
+func (self *Logger) write(level int, msg string) {
+	msg = strings.TrimSuffix(msg, "\n")
+	self.lock.Lock()
+	err := self.sink.send(Severity(level), msg)
+	self.lock.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %s %s (syslog failed - %v)\n", time.Now().Format("2006-01-02 15:04:05"), strings.TrimSpace(lumber.LvlStr(level)), msg, err)
+	}
+}
+
+// syslogSink sends RFC 5424 messages to a syslog server or socket
+type syslogSink struct {
+	addr     string
+	facility int
+	host     string
+	pid      int
+	conn     net.Conn
+	tcp      bool // tcp messages are framed by octet counting (RFC 6587), others end in a newline
+}
+
+// connect dials addr, or the first local socket that answers
+func (self *syslogSink) connect() error {
+	if self.addr == "" {
+		for _, socket := range sockets {
+			for _, network := range []string{"unixgram", "unix"} {
+				conn, err := net.Dial(network, socket)
+				if err == nil {
+					self.conn = conn
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("Failed to connect to syslog - no socket at %s", strings.Join(sockets, ", "))
+	}
+
+	u, err := url.Parse(self.addr)
+	if err != nil {
+		return fmt.Errorf("Failed to parse syslog address - %v", err)
+	}
+	target := u.Host
+	switch u.Scheme {
+	case "unix":
+		target = u.Path
+	case "udp", "tcp":
+	default:
+		return fmt.Errorf("Syslog address '%s' isn't udp://, tcp://, or unix://", self.addr)
+	}
+	if u.Scheme == "unix" {
+		// as for the local sockets, /dev/log is usually a datagram socket
+		if conn, err := net.Dial("unixgram", target); err == nil {
+			self.conn = conn
+			return nil
+		}
+	}
+	conn, err := net.DialTimeout(u.Scheme, target, 10*time.Second)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to syslog - %v", err)
+	}
+	self.conn, self.tcp = conn, u.Scheme == "tcp"
+	return nil
+}
+
+// send formats and sends a message, reconnecting once if the connection was
+// lost (eg. the syslog server restarted)
+func (self *syslogSink) send(severity int, msg string) error {
+	line := fmt.Sprintf("<%d>1 %s %s slurp %d - - %s", self.facility*8+severity, time.Now().Format("2006-01-02T15:04:05.000000Z07:00"), nilValue(self.host), self.pid, msg)
+	if self.tcp {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	} else {
+		line += "\n"
+	}
+
+	var err error
+	for try := 0; try < 2; try++ {
+		if self.conn == nil {
+			if err = self.connect(); err != nil {
+				continue
+			}
+		}
+		if _, err = self.conn.Write([]byte(line)); err == nil {
+			return nil
+		}
+		self.conn.Close()
+		self.conn = nil
+	}
+	return err
+}
+
+func (self *syslogSink) close() error {
+	if self.conn == nil {
+		return nil
+	}
+	err := self.conn.Close()
+	self.conn = nil
+	return err
+}
+
+// nilValue returns "-" for an empty header field
+func nilValue(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// nopCloser discards the embedded console logger's output
+type nopCloser struct{}
+
+func (nopCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (nopCloser) Close() error                { return nil }
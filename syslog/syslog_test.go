@@ -0,0 +1,112 @@
+package syslog_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jcelliott/lumber"
+
+	"github.com/mu-box/slurp/syslog"
+)
+
+func TestSyslogUdp(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	log, err := syslog.New("udp://"+server.LocalAddr().String(), "local0", lumber.INFO)
+	if err != nil {
+		t.Fatalf("Failed to connect - %v", err)
+	}
+	defer log.Close()
+
+	log.Debug("dropped")
+	log.Warn("Stage '%v' expired", "abc")
+
+	buf := make([]byte, 1024)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// local0 (16) * 8 + warning (4)
+	expected := regexp.MustCompile(`^<132>1 \d{4}-\d\d-\d\dT\d\d:\d\d:\d\d\.\d{6}\S+ \S+ slurp \d+ - - Stage 'abc' expired\n$`)
+	if !expected.Match(buf[:n]) {
+		t.Errorf("%q doesn't match expected out", buf[:n])
+	}
+}
+
+func TestSyslogTcp(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	lines := make(chan string, 1)
+	go func() {
+		conn, err := server.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		b, _ := io.ReadAll(conn)
+		lines <- string(b)
+	}()
+
+	log, err := syslog.New("tcp://"+server.Addr().String(), "daemon", lumber.INFO)
+	if err != nil {
+		t.Fatalf("Failed to connect - %v", err)
+	}
+	log.Error("Commit failed")
+	log.Close()
+
+	// octet counted: "<len> <message>", daemon (3) * 8 + err (3)
+	line := <-lines
+	size, msg, _ := strings.Cut(line, " ")
+	if !strings.HasPrefix(msg, "<27>1 ") || !strings.HasSuffix(msg, " - - Commit failed") {
+		t.Errorf("%q doesn't match expected out", line)
+	}
+	if size != strconv.Itoa(len(msg)) {
+		t.Errorf("%q doesn't frame a %d byte message", size, len(msg))
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "slurp-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "socket")
+	server, err := net.ListenPacket("unixgram", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	log, err := syslog.NewJournal(socket, lumber.INFO)
+	if err != nil {
+		t.Fatalf("Failed to connect - %v", err)
+	}
+	defer log.Close()
+	log.Fatal("line one\nline two")
+
+	buf := make([]byte, 1024)
+	n, _, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "MESSAGE\n\x11\x00\x00\x00\x00\x00\x00\x00line one\nline two\nPRIORITY=2\nSYSLOG_IDENTIFIER=slurp\n"
+	if string(buf[:n]) != expected {
+		t.Errorf("%q doesn't match expected out", buf[:n])
+	}
+}
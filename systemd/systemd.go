@@ -0,0 +1,104 @@
+// Package "systemd" integrates slurp with systemd: adopting the listeners a
+// socket unit bound for it (socket activation), so restarts don't refuse
+// connections, and notifying the service manager once slurp is ready.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor systemd passes listeners as
+const listenFdsStart = 3
+
+// the listening sockets passed by systemd, read once
+var inherited = struct {
+	sync.Once
+	files []*os.File
+}{}
+
+// files returns the listening sockets systemd passed this process, clearing
+// the variables that pass them so child processes (rsync) don't adopt them
+func files() []*os.File {
+	inherited.Do(func() {
+		defer os.Unsetenv("LISTEN_PID")
+		defer os.Unsetenv("LISTEN_FDS")
+		defer os.Unsetenv("LISTEN_FDNAMES")
+
+		pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+		if err != nil || pid != os.Getpid() {
+			return
+		}
+		n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+		if err != nil || n <= 0 {
+			return
+		}
+		for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+			syscall.CloseOnExec(fd)
+			inherited.files = append(inherited.files, os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)))
+		}
+	})
+	return inherited.files
+}
+
+// Listener returns a listener on the socket systemd bound to addr (host:port),
+// or nil if it passed none. The socket itself stays open, so the address can
+// be listened on again (eg. after an ssh listener restart).
+func Listener(addr string) net.Listener {
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil
+	}
+	for _, file := range files() {
+		listener, err := net.FileListener(file)
+		if err != nil {
+			// not a listening stream socket
+			continue
+		}
+		if have, ok := listener.Addr().(*net.TCPAddr); ok && sameAddr(have, want) {
+			return listener
+		}
+		listener.Close()
+	}
+	return nil
+}
+
+// sameAddr reports whether a bound address is the one wanted, taking any
+// unspecified address (0.0.0.0 or ::) to be the same as another
+func sameAddr(have, want *net.TCPAddr) bool {
+	if have.Port != want.Port {
+		return false
+	}
+	if want.IP == nil || want.IP.IsUnspecified() {
+		return have.IP == nil || have.IP.IsUnspecified()
+	}
+	return have.IP.Equal(want.IP)
+}
+
+// Notify sends the service manager a state, eg "READY=1". It does nothing if
+// slurp wasn't started by systemd with a notify socket.
+func Notify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// abstract namespace sockets are passed with a leading '@'
+	if strings.HasPrefix(socket, "@") {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("Failed to connect to notify socket - %v", err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		return fmt.Errorf("Failed to notify systemd - %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package systemd_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mu-box/slurp/systemd"
+)
+
+func TestNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	err := systemd.Notify("READY=1")
+	if err != nil {
+		t.Errorf("Expected notifying without systemd to do nothing - %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", path)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	err = systemd.Notify("READY=1\nSTATUS=Serving")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1\nSTATUS=Serving" {
+		t.Errorf("%q doesn't match expected out - %v", buf[:n], err)
+	}
+}
+
+func TestListener(t *testing.T) {
+	// not started by systemd
+	if listener := systemd.Listener("127.0.0.1:1567"); listener != nil {
+		listener.Close()
+		t.Errorf("Expected no inherited listener")
+	}
+}
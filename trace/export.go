@@ -0,0 +1,196 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+)
+
+const (
+	batchSize  = 512             // spans posted at once
+	queueSize  = 4096            // spans waiting to be posted, past which new ones are dropped
+	flushEvery = 5 * time.Second // interval between posts of waiting spans
+)
+
+// spans waiting to be exported
+var pending = make(chan *Span, queueSize)
+
+// client used to post spans to the collector
+var client = &http.Client{Timeout: 10 * time.Second}
+
+// sample decides whether a new trace is exported
+func sample() bool {
+	if config.OtlpAddr == "" {
+		return false
+	}
+	return config.TraceRatio >= 1 || rand.Float64() < config.TraceRatio
+}
+
+// queue queues a finished span for export, dropping it if the collector is
+// too far behind
+func queue(span *Span) {
+	if config.OtlpAddr == "" {
+		return
+	}
+	select {
+	case pending <- span:
+	default:
+	}
+}
+
+// StartExporter posts finished spans to the otlp-endpoint collector (OTLP
+// over http, json encoded) in batches
+func StartExporter() {
+	if config.OtlpAddr == "" {
+		return
+	}
+	url := strings.TrimSuffix(config.OtlpAddr, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	config.Log.Info("Exporting traces to '%v'", url)
+
+	go func() {
+		tick := time.NewTicker(flushEvery)
+		var batch []*Span
+		for {
+			select {
+			case span := <-pending:
+				batch = append(batch, span)
+				if len(batch) < batchSize {
+					continue
+				}
+			case <-tick.C:
+				if len(batch) == 0 {
+					continue
+				}
+			}
+			err := export(url, batch)
+			if err != nil {
+				config.Log.Error("Failed to export %d span(s) - %v", len(batch), err)
+			}
+			batch = nil
+		}
+	}()
+}
+
+// export posts a batch of spans
+func export(url string, batch []*Span) error {
+	body, err := json.Marshal(encode(batch))
+	if err != nil {
+		return err
+	}
+	res, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status '%d'", res.StatusCode)
+	}
+	return nil
+}
+
+// OTLP json messages (see opentelemetry-proto's trace/v1/trace.proto)
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResource `json:"resourceSpans"`
+	}
+	otlpResource struct {
+		Resource   otlpAttrs   `json:"resource"`
+		ScopeSpans []otlpScope `json:"scopeSpans"`
+	}
+	otlpAttrs struct {
+		Attributes []otlpAttr `json:"attributes"`
+	}
+	otlpScope struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpSpan struct {
+		TraceId      string     `json:"traceId"`
+		SpanId       string     `json:"spanId"`
+		ParentSpanId string     `json:"parentSpanId,omitempty"`
+		Name         string     `json:"name"`
+		Kind         int        `json:"kind"`
+		Start        string     `json:"startTimeUnixNano"`
+		End          string     `json:"endTimeUnixNano"`
+		Attributes   []otlpAttr `json:"attributes,omitempty"`
+		Status       otlpStatus `json:"status"`
+	}
+	otlpAttr struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"` // 1 ok, 2 error
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// encode encodes spans as an OTLP export request from the slurp service
+func encode(batch []*Span) otlpRequest {
+	scope := otlpScope{}
+	scope.Scope.Name = "github.com/mu-box/slurp"
+	for _, span := range batch {
+		span.lock.Lock()
+		s := otlpSpan{
+			TraceId:    hex.EncodeToString(span.ctx.TraceId[:]),
+			SpanId:     hex.EncodeToString(span.ctx.SpanId[:]),
+			Name:       span.Name,
+			Kind:       span.Kind,
+			Start:      strconv.FormatInt(span.Start.UnixNano(), 10),
+			End:        strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes: attrs(span.Attrs),
+			Status:     otlpStatus{Code: 1},
+		}
+		if span.Parent != [8]byte{} {
+			s.ParentSpanId = hex.EncodeToString(span.Parent[:])
+		}
+		if span.Error != "" {
+			s.Status = otlpStatus{Code: 2, Message: span.Error}
+		}
+		span.lock.Unlock()
+		scope.Spans = append(scope.Spans, s)
+	}
+
+	resource := otlpResource{
+		Resource:   otlpAttrs{attrs(map[string]interface{}{"service.name": "slurp"})},
+		ScopeSpans: []otlpScope{scope},
+	}
+	return otlpRequest{ResourceSpans: []otlpResource{resource}}
+}
+
+// attrs encodes attributes as OTLP key values, sorted by key
+func attrs(values map[string]interface{}) []otlpAttr {
+	list := make([]otlpAttr, 0, len(values))
+	for key, value := range values {
+		var v map[string]interface{}
+		switch value := value.(type) {
+		case int:
+			v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+		case int64:
+			v = map[string]interface{}{"intValue": strconv.FormatInt(value, 10)}
+		case float64:
+			v = map[string]interface{}{"doubleValue": value}
+		case bool:
+			v = map[string]interface{}{"boolValue": value}
+		default:
+			v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+		}
+		list = append(list, otlpAttr{Key: key, Value: v})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	return list
+}
@@ -0,0 +1,205 @@
+// Package "trace" records spans of the publish path (api requests, rsync
+// sessions, packaging, and backend uploads) and exports them over OTLP, so a
+// slow publish shows where its time went. Trace context is accepted from and
+// passed on in W3C traceparent headers (to storage, peers, and webhooks).
+//
+// As with request ids (see reqid), spans are tied to builds rather than
+// threaded through calls: a span started for a build is a child of the api
+// request that last touched it, or of the span set for it with SetBuild.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mu-box/slurp/reqid"
+)
+
+// Header is the http header trace context is read from and passed on in
+const Header = "traceparent"
+
+// span kinds, as in OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+// maxRequests is how many api requests' span contexts are remembered
+const maxRequests = 4096
+
+// Context identifies a span across processes
+type Context struct {
+	TraceId [16]byte
+	SpanId  [8]byte
+	Sampled bool
+}
+
+// Valid reports whether the context is set
+func (self Context) Valid() bool {
+	return self.TraceId != [16]byte{} && self.SpanId != [8]byte{}
+}
+
+// String returns the context as a traceparent header value
+func (self Context) String() string {
+	flags := "00"
+	if self.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%x-%x-%s", self.TraceId, self.SpanId, flags)
+}
+
+// Parse parses a traceparent header value, returning an invalid context if
+// it is malformed
+func Parse(header string) Context {
+	var ctx Context
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return Context{}
+	}
+	trace, err1 := hex.DecodeString(parts[1])
+	span, err2 := hex.DecodeString(parts[2])
+	flags, err3 := hex.DecodeString(parts[3])
+	if err1 != nil || err2 != nil || err3 != nil || len(trace) != 16 || len(span) != 8 || len(flags) != 1 {
+		return Context{}
+	}
+	copy(ctx.TraceId[:], trace)
+	copy(ctx.SpanId[:], span)
+	ctx.Sampled = flags[0]&1 == 1
+	if !ctx.Valid() {
+		return Context{}
+	}
+	return ctx
+}
+
+// Span is a timed operation within a trace
+type Span struct {
+	Name   string
+	Kind   int
+	Parent [8]byte
+	Start  time.Time
+	End    time.Time
+	Attrs  map[string]interface{}
+	Error  string
+
+	ctx  Context
+	lock sync.Mutex
+}
+
+var (
+	// span contexts of recent api requests, by request id (oldest first in
+	// order), and spans set for builds
+	requests = map[string]Context{}
+	order    []string
+	builds   = map[string]Context{}
+
+	// mutex ensures updates to requests and builds are atomic
+	mutex = sync.Mutex{}
+)
+
+// Start starts a span as a child of parent, or of a new trace if parent isn't
+// valid
+func Start(name string, kind int, parent Context) *Span {
+	self := &Span{Name: name, Kind: kind, Start: time.Now(), Attrs: map[string]interface{}{}}
+	if parent.Valid() {
+		self.ctx.TraceId, self.Parent, self.ctx.Sampled = parent.TraceId, parent.SpanId, parent.Sampled
+	} else {
+		rand.Read(self.ctx.TraceId[:])
+		self.ctx.Sampled = sample()
+	}
+	rand.Read(self.ctx.SpanId[:])
+	return self
+}
+
+// Context returns the span's context, to start children of it
+func (self *Span) Context() Context {
+	return self.ctx
+}
+
+// Set sets an attribute of the span
+func (self *Span) Set(key string, value interface{}) {
+	self.lock.Lock()
+	self.Attrs[key] = value
+	self.lock.Unlock()
+}
+
+// Finish ends the span, marking it failed if err is set, and queues it for
+// export if its trace is sampled
+func (self *Span) Finish(err error) {
+	self.lock.Lock()
+	self.End = time.Now()
+	if err != nil {
+		self.Error = err.Error()
+	}
+	self.lock.Unlock()
+
+	if self.ctx.Sampled {
+		queue(self)
+	}
+}
+
+// SetRequest remembers the span context of an api request, so spans for the
+// builds it touches (see reqid.Set) are its children
+func SetRequest(id string, ctx Context) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if _, ok := requests[id]; !ok {
+		order = append(order, id)
+	}
+	requests[id] = ctx
+	if len(order) > maxRequests {
+		delete(requests, order[0])
+		order = order[1:]
+	}
+}
+
+// Request returns the span context of a recent api request, which isn't valid
+// if it isn't known
+func Request(id string) Context {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return requests[id]
+}
+
+// SetBuild makes spans started for a build children of ctx (eg. a commit's
+// packaging and upload of the commit span), until ClearBuild
+func SetBuild(build string, ctx Context) {
+	mutex.Lock()
+	builds[build] = ctx
+	mutex.Unlock()
+}
+
+// ClearBuild forgets the span set for a build
+func ClearBuild(build string) {
+	mutex.Lock()
+	delete(builds, build)
+	mutex.Unlock()
+}
+
+// Build returns the span context spans for a build (or blob derived from a
+// build id) are started under: the one set for it, or that of the api request
+// that last touched it. It isn't valid if there is none.
+func Build(key string) Context {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if ctx, ok := builds[key]; ok {
+		return ctx
+	}
+	var match string
+	var ctx Context
+	for build := range builds {
+		if len(build) > len(match) && strings.HasPrefix(key, build) {
+			match, ctx = build, builds[build]
+		}
+	}
+	if match != "" {
+		return ctx
+	}
+	return requests[reqid.Get(key)]
+}
@@ -0,0 +1,56 @@
+package trace_test
+
+import (
+	"testing"
+
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/trace"
+)
+
+func TestParse(t *testing.T) {
+	header := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	ctx := trace.Parse(header)
+	if !ctx.Valid() || !ctx.Sampled {
+		t.Fatalf("Failed to parse %q - %+v", header, ctx)
+	}
+	if ctx.String() != header {
+		t.Errorf("%q doesn't match expected %q", ctx.String(), header)
+	}
+
+	for _, bad := range []string{"", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "00-xyz-00f067aa0ba902b7-01"} {
+		if trace.Parse(bad).Valid() {
+			t.Errorf("Expected %q to be refused", bad)
+		}
+	}
+}
+
+func TestBuild(t *testing.T) {
+	request := trace.Start("api PUT", trace.KindServer, trace.Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"))
+	trace.SetRequest("abc123", request.Context())
+	reqid.Set("build", "abc123")
+	defer reqid.Clear("build")
+
+	if request.Context().TraceId != trace.Parse("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01").TraceId {
+		t.Errorf("Request span didn't continue the client's trace")
+	}
+	if trace.Build("build/file") != request.Context() {
+		t.Errorf("Expected spans for the build under the request that touched it")
+	}
+
+	commit := trace.Start("commit", trace.KindInternal, trace.Build("build"))
+	trace.SetBuild("build", commit.Context())
+	if commit.Parent != request.Context().SpanId {
+		t.Errorf("Commit span isn't a child of the request span")
+	}
+	if trace.Build("build") != commit.Context() {
+		t.Errorf("Expected spans for the build under the span set for it")
+	}
+	trace.ClearBuild("build")
+	if trace.Build("build") != request.Context() {
+		t.Errorf("Expected spans for the build back under the request")
+	}
+
+	if trace.Build("other").Valid() {
+		t.Errorf("Expected no trace for an untouched build")
+	}
+}
@@ -0,0 +1,79 @@
+// Package "signature" signs and verifies slurp webhook payloads. It only
+// depends on the standard library so receivers can import it directly.
+//
+// Each payload is signed with HMAC-SHA256 over "timestamp.nonce.body". Verify
+// rejects stale timestamps; receivers wanting full replay protection should
+// also remember the nonces seen within the tolerance window.
+package signature
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderSignature = "X-Slurp-Signature" // "sha256=<hex hmac>"
+	HeaderTimestamp = "X-Slurp-Timestamp" // unix seconds the payload was signed at
+	HeaderNonce     = "X-Slurp-Nonce"     // random value unique to the payload
+)
+
+var (
+	ErrMissing   = errors.New("Missing signature headers")
+	ErrStale     = errors.New("Signature timestamp outside tolerance")
+	ErrMismatch  = errors.New("Signature mismatch")
+	ErrTimestamp = errors.New("Bad signature timestamp")
+)
+
+// Sign returns the hex encoded signature of a payload
+func Sign(secret []byte, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "." + nonce + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the signature headers for body on header
+func SignRequest(secret []byte, header http.Header, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	n := make([]byte, 16)
+	rand.Read(n)
+	nonce := hex.EncodeToString(n)
+
+	header.Set(HeaderTimestamp, timestamp)
+	header.Set(HeaderNonce, nonce)
+	header.Set(HeaderSignature, "sha256="+Sign(secret, timestamp, nonce, body))
+}
+
+// Verify checks the signature headers of a received payload, rejecting it if
+// the signature doesn't match or it was signed more than tolerance ago.
+func Verify(secret []byte, header http.Header, body []byte, tolerance time.Duration) error {
+	sig := strings.TrimPrefix(header.Get(HeaderSignature), "sha256=")
+	timestamp := header.Get(HeaderTimestamp)
+	nonce := header.Get(HeaderNonce)
+	if sig == "" || timestamp == "" || nonce == "" {
+		return ErrMissing
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrTimestamp
+	}
+	age := time.Since(time.Unix(unix, 0))
+	if age > tolerance || age < -tolerance {
+		return ErrStale
+	}
+
+	expected := Sign(secret, timestamp, nonce, body)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return ErrMismatch
+	}
+
+	return nil
+}
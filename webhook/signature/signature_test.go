@@ -0,0 +1,50 @@
+package signature_test
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/mu-box/slurp/webhook/signature"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	body := []byte(`{"event":"stage.added"}`)
+
+	header := http.Header{}
+	signature.SignRequest(secret, header, body)
+
+	err := signature.Verify(secret, header, body, time.Minute)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// tampered body
+	err = signature.Verify(secret, header, []byte(`{"event":"stage.deleted"}`), time.Minute)
+	if err != signature.ErrMismatch {
+		t.Errorf("%v doesn't match expected out", err)
+	}
+
+	// wrong secret
+	err = signature.Verify([]byte("other"), header, body, time.Minute)
+	if err != signature.ErrMismatch {
+		t.Errorf("%v doesn't match expected out", err)
+	}
+
+	// stale
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	header.Set(signature.HeaderTimestamp, old)
+	header.Set(signature.HeaderSignature, "sha256="+signature.Sign(secret, old, header.Get(signature.HeaderNonce), body))
+	err = signature.Verify(secret, header, body, time.Minute)
+	if err != signature.ErrStale {
+		t.Errorf("%v doesn't match expected out", err)
+	}
+
+	// missing
+	err = signature.Verify(secret, http.Header{}, body, time.Minute)
+	if err != signature.ErrMissing {
+		t.Errorf("%v doesn't match expected out", err)
+	}
+}
@@ -0,0 +1,73 @@
+package webhook
+
+import (
+	"strings"
+	"sync"
+)
+
+// watchBuffer is how many events a watcher may fall behind before it misses
+// some
+const watchBuffer = 64
+
+var (
+	// channels of the watchers of events (see Watch)
+	watchers = map[chan Event]bool{}
+
+	// mutex ensures updates to watchers are atomic
+	watchLock = sync.Mutex{}
+)
+
+// Watch subscribes to every event sent, whether or not a webhook is, until the
+// returned function is called. A watcher that falls more than 64 events behind
+// misses events rather than holding up their delivery.
+func Watch() (<-chan Event, func()) {
+	events := make(chan Event, watchBuffer)
+	watchLock.Lock()
+	watchers[events] = true
+	watchLock.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			watchLock.Lock()
+			delete(watchers, events)
+			watchLock.Unlock()
+		})
+	}
+}
+
+// watched reports whether anything watches events
+func watched() bool {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	return len(watchers) > 0
+}
+
+// broadcast passes an event to its watchers
+func broadcast(event Event) {
+	watchLock.Lock()
+	defer watchLock.Unlock()
+	for events := range watchers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// Matches reports whether an event is one of patterns: its name, a "stage.*"
+// prefix, or "*". Every event matches no patterns.
+func Matches(patterns []string, event string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, want := range patterns {
+		if want == event || want == "*" {
+			return true
+		}
+		if strings.HasSuffix(want, ".*") && strings.HasPrefix(event, strings.TrimSuffix(want, "*")) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+// Package "webhook" delivers stage lifecycle events to the configured webhook
+// urls. Payloads are signed with the webhook secret (see webhook/signature),
+// and delivered through the dial allowlist and proxy (see dial). Events are
+// also passed to watchers in process, eg the api's event stream (see Watch).
+package webhook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mu-box/slurp/config"
+	"github.com/mu-box/slurp/dial"
+	"github.com/mu-box/slurp/reqid"
+	"github.com/mu-box/slurp/trace"
+	"github.com/mu-box/slurp/webhook/signature"
+)
+
+// Lifecycle events
+const (
+	StageAdded        = "stage.added"
+	StageCommitted    = "stage.committed"
+	StageCommitFailed = "stage.commit-failed"
+	StageDeleted      = "stage.deleted"
+	StageAborted      = "stage.aborted"
+	StageExpired      = "stage.expired"
+	StageQuarantined  = "stage.quarantined" // a stage whose commit failed was moved to quarantine
+	StageHandoff      = "stage.handoff"     // a stage changed owners
+
+	BuildPromoted = "build.promoted" // a committed build was copied to another store
+	ChannelMoved  = "channel.moved"  // a release channel was pointed at another blob
+
+	BlobDiverged = "blob.diverged" // a store's copy of a blob failed verification
+	SshWedged    = "ssh.wedged"    // the ssh listener failed its self check
+)
+
+// Event is the payload posted to webhook urls
+type Event struct {
+	Event     string      `json:"event"`                // event name
+	Build     string      `json:"build"`                // build id the event is for
+	RequestId string      `json:"request-id,omitempty"` // api request that triggered the event (or an id generated for it)
+	TraceId   string      `json:"trace-id,omitempty"`   // trace the event is part of, as in its traceparent header
+	Time      time.Time   `json:"time"`                 // when the event happened
+	Data      interface{} `json:"data,omitempty"`       // event specific details
+}
+
+// client used to deliver webhooks
+var client = &http.Client{Timeout: 10 * time.Second, Transport: dial.Transport()}
+
+// Send delivers an event to every subscribed webhook in the background.
+// Events sent without labels only reach webhooks not scoped to labels.
+func Send(event, build string, data interface{}) {
+	SendLabeled(event, build, nil, data)
+}
+
+// SendLabeled delivers an event about a build with the given labels to every
+// subscribed webhook in the background
+func SendLabeled(event, build string, labels map[string]string, data interface{}) {
+	hooks := subscribers(event, labels)
+	if len(hooks) == 0 && !watched() {
+		return
+	}
+
+	// the event is a span of the trace its build was last touched under (or
+	// of a new one), with a child span for each delivery
+	span := trace.Start("event "+event, trace.KindInternal, trace.Build(build))
+	span.Set("slurp.build", build)
+	defer span.Finish(nil)
+	id := reqid.Get(build)
+	if id == "" {
+		id = reqid.New()
+	}
+
+	payload := Event{
+		Event:     event,
+		Build:     build,
+		RequestId: id,
+		TraceId:   fmt.Sprintf("%x", span.Context().TraceId),
+		Time:      time.Now().UTC(),
+		Data:      data,
+	}
+	broadcast(payload)
+	if len(hooks) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		config.Log.Error("Failed to marshal '%v' event - %v", event, err)
+		return
+	}
+
+	for _, hook := range hooks {
+		go func(hook config.Webhook) {
+			err := post(hook, body, id, span.Context())
+			if err != nil {
+				config.Log.Error("%sFailed to deliver '%v' event to '%v' - %v", reqid.Tag(build), event, hook.Url, err)
+			}
+		}(hook)
+	}
+}
+
+// subscribers returns the webhooks an event is delivered to: every
+// webhook-url, and each scoped webhook whose events and labels match
+func subscribers(event string, labels map[string]string) []config.Webhook {
+	var hooks []config.Webhook
+	for _, url := range config.Get(&config.WebhookUrls) {
+		hooks = append(hooks, config.Webhook{Url: url})
+	}
+	for _, hook := range config.Get(&config.Webhooks) {
+		if subscribed(hook, event, labels) {
+			hooks = append(hooks, hook)
+		}
+	}
+	return hooks
+}
+
+// subscribed reports whether a scoped webhook wants an event
+func subscribed(hook config.Webhook, event string, labels map[string]string) bool {
+	if hook.Tenant != "" && labels["tenant"] != hook.Tenant {
+		return false
+	}
+	for k, v := range hook.Labels {
+		if labels[k] != v {
+			return false
+		}
+	}
+
+	return Matches(hook.Events, event)
+}
+
+// post signs and posts a payload to a webhook, passing on the event's request
+// id and trace
+func post(hook config.Webhook, body []byte, id string, parent trace.Context) (err error) {
+	req, err := http.NewRequest("POST", hook.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	span := trace.Start("webhook", trace.KindClient, parent)
+	span.Set("http.url", hook.Url)
+	defer func() {
+		span.Finish(err)
+	}()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(reqid.Header, id)
+	req.Header.Set(trace.Header, span.Context().String())
+
+	secret := hook.Secret
+	if secret == "" {
+		secret = config.Get(&config.WebhookSecret)
+	}
+	if secret != "" {
+		signature.SignRequest([]byte(secret), req.Header, body)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status '%d'", res.StatusCode)
+	}
+	return nil
+}